@@ -0,0 +1,148 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/process"
+)
+
+type ctxKey int
+
+const accessKey ctxKey = iota
+
+// accessEntry collects the attributes of one request for the access log.
+type accessEntry struct {
+	ID string
+
+	mu    sync.Mutex
+	attrs []any
+}
+
+// requestID returns the ID of the request handled with ctx, or "".
+func requestID(ctx context.Context) string {
+	if ae, ok := ctx.Value(accessKey).(*accessEntry); ok {
+		return ae.ID
+	}
+	return ""
+}
+
+// logAttrs adds key-value pairs (such as "file", fn) to the access log entry of the request.
+func logAttrs(ctx context.Context, args ...any) {
+	if ae, ok := ctx.Value(accessKey).(*accessEntry); ok {
+		ae.mu.Lock()
+		ae.attrs = append(ae.attrs, args...)
+		ae.mu.Unlock()
+	}
+}
+
+// newRequestID returns a random request ID, or a sanitized incoming one.
+func newRequestID(incoming string) string {
+	if n := len(incoming); n >= 8 && n <= 64 {
+		ok := true
+		for _, c := range incoming {
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '-' || c == '_' || c == '.') {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return incoming
+		}
+	}
+	var a [8]byte
+	rand.Read(a[:])
+	return hex.EncodeToString(a[:])
+}
+
+// accessWriter records the status and the number of bytes written.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, as the SSE streams need it.
+func (aw *accessWriter) Flush() {
+	if fl, ok := aw.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, as the WebSocket of the agents needs it.
+func (aw *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusSwitchingProtocols
+	}
+	return http.NewResponseController(aw.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController.
+func (aw *accessWriter) Unwrap() http.ResponseWriter { return aw.ResponseWriter }
+
+// withAccessLog assigns an ID to each request (returned in X-Request-ID),
+// and logs the method, path, client, status, bytes and duration
+// (and any attributes added by logAttrs) when the request is finished.
+// The accesses of the files are written to the audit log, too.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		openRequests.Add(1)
+		defer openRequests.Add(-1)
+		ae := &accessEntry{ID: newRequestID(r.Header.Get("X-Request-ID"))}
+		w.Header().Set("X-Request-ID", ae.ID)
+		aw := &accessWriter{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), accessKey, ae)
+		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteIP = r.RemoteAddr
+		}
+		conn := &process.Conn{RemoteIP: remoteIP, RequestID: ae.ID, Query: r.URL.Query()}
+		h.ServeHTTP(aw, r.WithContext(process.WithConn(ctx, conn)))
+		if conn.User != "" {
+			logAttrs(ctx, "user", conn.User)
+		}
+
+		dur := time.Since(start)
+		writeAudit(r, auditEntry{
+			Time: start, ID: ae.ID, User: conn.User, Client: remoteIP,
+			Status: aw.status, Bytes: aw.bytes, DurationMS: dur.Milliseconds(),
+		})
+
+		ae.mu.Lock()
+		args := append([]any{
+			"id", ae.ID, "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery,
+			"client", r.RemoteAddr, "status", aw.status, "bytes", aw.bytes,
+			"dur", dur.String(),
+		}, ae.attrs...)
+		ae.mu.Unlock()
+		slog.Info("access", args...)
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/process"
+)
+
+// requireAdmin allows the request only with an "Authorization: Bearer <token>" header,
+// or for the users with the admin role.
+// With an empty token and no users, the admin endpoints are disabled.
+func requireAdmin(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "admin"
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			u := authenticate(r)
+			if u == nil || u.role < roleAdmin {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="webtail admin"`)
+				http.Error(w, "admin token required", http.StatusUnauthorized)
+				return
+			}
+			name = u.Name
+		}
+		if c := process.ConnFrom(r.Context()); c != nil {
+			c.User = name
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Maintenance is the announced maintenance.
+type Maintenance struct {
+	Message string    `json:"message"`
+	Freeze  bool      `json:"freeze"`
+	Since   time.Time `json:"since"`
+}
+
+// maintenanceState holds the current maintenance announcement, if any.
+type maintenanceState struct {
+	mu      sync.RWMutex
+	current *Maintenance
+}
+
+// maintenance is the server-wide maintenance state.
+var maintenance = &maintenanceState{}
+
+// refuseWhenFrozen refuses new tails with 503 while the maintenance freezes them.
+func refuseWhenFrozen(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := maintenance.Get(); m != nil && m.Freeze {
+			w.Header().Set("Retry-After", "300")
+			http.Error(w, "maintenance: "+m.Message, http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Get returns the current maintenance, or nil.
+func (ms *maintenanceState) Get() *Maintenance {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.current
+}
+
+// Frozen reports whether new tails should be refused.
+func (ms *maintenanceState) Frozen() bool {
+	m := ms.Get()
+	return m != nil && m.Freeze
+}
+
+// Set the maintenance (nil ends it), and announce it to all viewers.
+func (ms *maintenanceState) Set(m *Maintenance) {
+	ms.mu.Lock()
+	ms.current = m
+	ms.mu.Unlock()
+	if m == nil {
+		slog.Warn("maintenance ended")
+		metaEvents.Publish(metaEvent{Kind: "maintenance"}, false)
+		return
+	}
+	slog.Warn("maintenance", "message", m.Message, "freeze", m.Freeze)
+	metaEvents.Publish(metaEvent{Kind: "maintenance", Data: m}, true)
+}
+
+// ServeHTTP returns the current maintenance on GET,
+// starts one on POST (form fields: message, freeze=1), and ends it on DELETE.
+func (ms *maintenanceState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		msg := r.FormValue("message")
+		if msg == "" {
+			http.Error(w, "message is required", http.StatusBadRequest)
+			return
+		}
+		ms.Set(&Maintenance{Message: msg, Freeze: r.FormValue("freeze") == "1", Since: time.Now()})
+	case "DELETE":
+		ms.Set(nil)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ms.Get())
+}
@@ -0,0 +1,277 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/hashicorp/yamux"
+)
+
+// An agent dials out to the aggregator with a (compressed) WebSocket,
+// and serves its usual HTTP handlers over the streams the aggregator opens
+// on the yamux session over that connection.
+// The aggregator proxies /agents/<name>/ to the agent, and checks the roles,
+// as the agent trusts the requests coming from the aggregator.
+
+// agentStreamWindow is the flow control window of each stream of the agent connection:
+// a stream whose reader does not keep up is stalled after this much unread data,
+// without holding up the other streams sharing the connection.
+// It is 16 times the yamux default, so a stream is not limited to 256KiB per round trip
+// on the long distance links of the agents.
+const agentStreamWindow = 4 << 20
+
+// agentMuxConfig is the yamux configuration of the agent connections.
+func agentMuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.MaxStreamWindowSize = agentStreamWindow
+	cfg.LogOutput, cfg.Logger = nil, slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+	return cfg
+}
+
+// agentInstanceHeader holds the JSON encoded instanceInfo of the agent when connecting.
+const agentInstanceHeader = "Webtail-Instance"
+
+// Reconnect delays of the agent after losing the aggregator.
+const (
+	agentMinDelay = time.Second
+	agentMaxDelay = time.Minute
+)
+
+// runAgent connects to the aggregator at connectURL, and serves handler over the connection,
+// reconnecting when it is lost, until ctx is canceled.
+//
+// With compress, the WebSocket messages are compressed (permessage-deflate).
+func runAgent(ctx context.Context, connectURL, token string, compress bool, handler http.Handler) error {
+	delay := agentMinDelay
+	for {
+		start := time.Now()
+		err := serveAgent(ctx, connectURL, token, compress, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(start) > agentMaxDelay {
+			delay = agentMinDelay
+		}
+		slog.Warn("aggregator connection lost, reconnecting", "url", connectURL, "error", err, "after", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, agentMaxDelay)
+	}
+}
+
+// serveAgent serves handler over one connection to the aggregator.
+func serveAgent(ctx context.Context, connectURL, token string, compress bool, handler http.Handler) error {
+	b, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{agentInstanceHeader: {string(b)}}
+	if token != "" {
+		hdr.Set("Authorization", "Bearer "+token)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	opts := websocket.DialOptions{HTTPHeader: hdr}
+	if compress {
+		opts.CompressionMode = websocket.CompressionContextTakeover
+	}
+	c, _, err := websocket.Dial(dialCtx, connectURL, &opts)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("connect to %q: %w", connectURL, err)
+	}
+	conn := websocket.NetConn(ctx, c, websocket.MessageBinary)
+	defer conn.Close()
+	session, err := yamux.Server(conn, agentMuxConfig())
+	if err != nil {
+		return err
+	}
+	slog.Info("connected to the aggregator", "url", connectURL, "name", instance.Name)
+	return serveListener(ctx, session, newHTTPServer(handler), "", "")
+}
+
+// agentConn is an agent connected to this aggregator.
+type agentConn struct {
+	Info  instanceInfo `json:"instance"`
+	Addr  string       `json:"addr"`
+	Since time.Time    `json:"since"`
+
+	session *yamux.Session
+	proxy   *httputil.ReverseProxy
+}
+
+// agentRegistry holds the connected agents by their names.
+type agentRegistry struct {
+	// Token is the secret shared by all the agents, empty disables it.
+	Token string
+
+	mu     sync.Mutex
+	agents map[string]*agentConn
+	// captured is the sequence number of the last captured line copied from each agent.
+	captured map[string]uint64
+}
+
+// agents are the agents connected to this server.
+var agents = &agentRegistry{agents: make(map[string]*agentConn), captured: make(map[string]uint64)}
+
+// connect accepts the WebSocket connection of an agent, and registers it
+// until the connection is closed.
+func (ar *agentRegistry) connect(w http.ResponseWriter, r *http.Request) {
+	var info instanceInfo
+	if err := json.Unmarshal([]byte(r.Header.Get(agentInstanceHeader)), &info); err != nil || info.Name == "" || strings.Contains(info.Name, "/") {
+		http.Error(w, agentInstanceHeader+" must be a JSON object with a name (without a slash)", http.StatusBadRequest)
+		return
+	}
+	// the shared token, or the secret of the paired agent
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "agent token required", http.StatusUnauthorized)
+		return
+	}
+	if ar.Token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(ar.Token)) != 1 {
+		err := errors.New("bad agent token")
+		if pairing != nil {
+			err = pairing.Authorize(r.Context(), info.Name, got)
+		}
+		if errors.Is(err, errNotApproved) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			slog.Warn("agent refused", "name", info.Name, "addr", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	// compress if the agent asks for it
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: websocket.CompressionContextTakeover})
+	if err != nil {
+		slog.Error("accept agent", "name", info.Name, "error", err)
+		return
+	}
+	ctx := r.Context()
+	conn := websocket.NetConn(ctx, c, websocket.MessageBinary)
+	defer conn.Close()
+	session, err := yamux.Client(conn, agentMuxConfig())
+	if err != nil {
+		slog.Error("agent session", "name", info.Name, "error", err)
+		return
+	}
+	defer session.Close()
+	ac := &agentConn{Info: info, Addr: r.RemoteAddr, Since: time.Now(), session: session}
+	ac.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme, pr.Out.URL.Host = "http", info.Name
+			pr.Out.URL.Path = strings.TrimPrefix(pr.Out.URL.Path, "/agents/"+info.Name)
+			pr.Out.URL.RawPath = ""
+			// the credentials of the user are checked here, the agent must not see them
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Del("Cookie")
+			pr.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return session.Open()
+			},
+		},
+		// stream the SSE events as they come
+		FlushInterval: -1,
+	}
+
+	ar.mu.Lock()
+	if old := ar.agents[info.Name]; old != nil {
+		old.session.Close()
+	}
+	ar.agents[info.Name] = ac
+	ar.mu.Unlock()
+	slog.Info("agent connected", "name", info.Name, "addr", r.RemoteAddr)
+	go ar.backfill(ctx, ac)
+
+	select {
+	case <-ctx.Done():
+	case <-session.CloseChan():
+	}
+	ar.mu.Lock()
+	if ar.agents[info.Name] == ac {
+		delete(ar.agents, info.Name)
+	}
+	ar.mu.Unlock()
+	slog.Info("agent disconnected", "name", info.Name, "addr", r.RemoteAddr)
+}
+
+// Disconnect closes the connection of the named agent, if it is connected.
+func (ar *agentRegistry) Disconnect(name string) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if ac := ar.agents[name]; ac != nil {
+		ac.session.Close()
+	}
+}
+
+// List returns the connected agents, ordered by name.
+func (ar *agentRegistry) List() []*agentConn {
+	ar.mu.Lock()
+	list := make([]*agentConn, 0, len(ar.agents))
+	for _, ac := range ar.agents {
+		list = append(list, ac)
+	}
+	ar.mu.Unlock()
+	slices.SortFunc(list, func(a, b *agentConn) int { return strings.Compare(a.Info.Name, b.Info.Name) })
+	return list
+}
+
+// ServeHTTP returns the connected agents as JSON.
+func (ar *agentRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ar.List())
+}
+
+// agentPathRole is the role needed for a path of an agent, mirroring the agent's own routes.
+func agentPathRole(p string) role {
+	switch {
+	case p == "/raw" || p == "/hexdump":
+		return roleDownloader
+	case strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/dev/") || p == "/api/v1/popular" ||
+		strings.HasPrefix(p, "/api/v1/alerts/"):
+		return roleAdmin
+	}
+	return roleViewer
+}
+
+// proxy forwards /agents/{name}/... to the agent, after checking the role needed for the path.
+func (ar *agentRegistry) proxy(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	ar.mu.Lock()
+	ac := ar.agents[name]
+	ar.mu.Unlock()
+	if ac == nil {
+		http.Error(w, fmt.Sprintf("agent %q is not connected", name), http.StatusBadGateway)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/agents/"+name)
+	if rest == "" {
+		http.Redirect(w, r, "/agents/"+name+"/", http.StatusMovedPermanently)
+		return
+	}
+	requireRole(agentPathRole(rest), ac.proxy).ServeHTTP(w, r)
+}
+
+// errAgentFlags is returned when the agent mode is requested without an aggregator.
+var errAgentFlags = errors.New("agent mode needs the -connect URL of the aggregator (such as wss://aggregator/api/v1/agents/connect)")
@@ -0,0 +1,720 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// The alert rules watch the files matching their globs (from their end),
+// and notify a webhook, a Slack channel or email addresses of the lines matching their regexps.
+//
+// The notifications of a rule are rate limited (at most Limit per Per),
+// and the same line (with its numbers masked) is notified only once in Dedup.
+// The suppressed lines are counted, and the count is sent with the next notification.
+//
+// With a -store, the state of the rules (the counters, the rate limit window and the lines
+// seen for Dedup) is saved in it every alertSaveInterval, and loaded when a rule is started,
+// so a restart or another instance taking over the rule does not notify the same lines again.
+//
+// A rule can be silenced for a while (POST /api/v1/alerts/{name}/silence?for=30m), counting
+// the matching lines as suppressed, and its notifications acknowledged (POST /api/v1/alerts/{name}/ack),
+// by the admins only, as these stop the paging; the /admin/alerts page has the same controls.
+// A rule with Escalate notifies its targets too if a notification is not acknowledged in time.
+// The silences and the acknowledgements are kept in the store (as any instance may be asked),
+// and picked up by the instance running the rule every alertSaveInterval.
+
+const (
+	// alertTimeout is the time limit of sending a notification.
+	alertTimeout = 10 * time.Second
+	// alertSaveInterval is how often the changed states of the rules are saved.
+	alertSaveInterval = 5 * time.Second
+	// alertsBucket is the bucket of the states of the rules in the store, by their names.
+	alertsBucket = "alerts"
+	// alertControlsBucket is the bucket of the silences and acknowledgements of the rules in the store.
+	alertControlsBucket = "alert-controls"
+	// maxAlertSeen is the most lines remembered for Dedup.
+	maxAlertSeen = 10_000
+	// maxAlertSilence is the longest silence of a rule.
+	maxAlertSilence = 30 * 24 * time.Hour
+)
+
+// alertTargets are the targets notified by an alert rule.
+type alertTargets struct {
+	// Webhook receives the alertNotification as JSON.
+	Webhook string `json:"webhook,omitempty"`
+	// Slack is the URL of an incoming webhook of Slack.
+	Slack string `json:"slack,omitempty"`
+	// Email are the addresses sent to with the -smtp server.
+	Email []string `json:"email,omitempty"`
+}
+
+func (at alertTargets) empty() bool { return at.Webhook == "" && at.Slack == "" && len(at.Email) == 0 }
+
+// alertEscalation notifies its targets too when the notifications of a rule
+// are not acknowledged After (such as "15m") the first one.
+type alertEscalation struct {
+	After string `json:"after"`
+	alertTargets
+
+	after time.Duration
+}
+
+// alertControl is what the users set on a rule, kept in the store apart from its state.
+type alertControl struct {
+	SilencedUntil time.Time `json:"silencedUntil,omitzero"`
+	// Acked is when the notifications were acknowledged last.
+	Acked time.Time `json:"acked,omitzero"`
+}
+
+// alertRule is an alert rule of the -alerts JSON file.
+type alertRule struct {
+	Name  string `json:"name"`
+	Glob  string `json:"glob"`
+	Match string `json:"match"`
+	alertTargets
+	// Escalate notifies its targets too of the unacknowledged notifications.
+	Escalate *alertEscalation `json:"escalate,omitempty"`
+	// Limit is the most notifications sent in Per (default 10 in 1m).
+	Limit int    `json:"limit,omitempty"`
+	Per   string `json:"per,omitempty"`
+	// Dedup is how long the same line is not notified again (default 5m).
+	Dedup string `json:"dedup,omitempty"`
+
+	re         *regexp.Regexp
+	per, dedup time.Duration
+
+	mu      sync.Mutex
+	state   alertState
+	control alertControl
+	// dirty is set when the state has changed since it was saved
+	dirty bool
+}
+
+// alertState is the state of an alert rule, persisted in the store.
+type alertState struct {
+	WindowStart time.Time `json:"windowStart"`
+	// Sent is the number of notifications in the rate limit window.
+	Sent int `json:"sent"`
+	// Pending is the number of lines suppressed since the last notification.
+	Pending int `json:"pending,omitempty"`
+	// Seen are the masked lines notified, with when, for Dedup.
+	Seen map[string]time.Time `json:"seen,omitempty"`
+
+	Fired      int64      `json:"fired"`
+	Suppressed int64      `json:"suppressed"`
+	LastFired  *time.Time `json:"lastFired,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	// Unacked is the time of the first unacknowledged notification, Escalated is set when it has been escalated.
+	Unacked   *time.Time `json:"unacknowledged,omitempty"`
+	Escalated bool       `json:"escalated,omitempty"`
+}
+
+// AlertStatus is the state of an alert rule, returned by /api/v1/alerts.
+type AlertStatus struct {
+	Name       string     `json:"name"`
+	Glob       string     `json:"glob"`
+	Match      string     `json:"match"`
+	Fired      int64      `json:"fired"`
+	Suppressed int64      `json:"suppressed"`
+	LastFired  *time.Time `json:"lastFired,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+
+	SilencedUntil *time.Time `json:"silencedUntil,omitempty"`
+	Unacked       *time.Time `json:"unacknowledged,omitempty"`
+	Escalated     bool       `json:"escalated,omitempty"`
+}
+
+// alertNotification is the JSON body sent to the webhooks.
+type alertNotification struct {
+	Rule     string    `json:"rule"`
+	Instance string    `json:"instance"`
+	File     string    `json:"file"`
+	Line     string    `json:"line"`
+	Time     time.Time `json:"ts"`
+	// Suppressed is the number of matching lines not notified since the previous notification.
+	Suppressed int `json:"suppressed,omitempty"`
+	// Escalation is set for the escalation of the notifications unacknowledged since Time.
+	Escalation bool `json:"escalation,omitempty"`
+}
+
+// loadAlertRules reads the alert rules from the JSON file, an array of alertRule, such as
+//
+//	[{"name": "errors", "glob": "app/*.log", "match": "(?i)\\berror\\b", "webhook": "https://example.com/hook", "limit": 5, "per": "1m",
+//	  "escalate": {"after": "15m", "email": ["oncall@example.com"]}}]
+func loadAlertRules(fn string) ([]*alertRule, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*alertRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	names := make(map[string]struct{}, len(rules))
+	for _, ar := range rules {
+		if err := ar.init(); err != nil {
+			return nil, fmt.Errorf("%q: %w", fn, err)
+		}
+		if _, ok := names[ar.Name]; ok {
+			return nil, fmt.Errorf("%q: duplicate alert rule %q", fn, ar.Name)
+		}
+		names[ar.Name] = struct{}{}
+	}
+	return rules, nil
+}
+
+// init checks the rule, and fills in the defaults.
+func (ar *alertRule) init() error {
+	if ar.Name == "" || ar.Glob == "" || ar.Match == "" {
+		return fmt.Errorf("alert rule %q: name, glob and match are required", ar.Name)
+	}
+	if ar.alertTargets.empty() {
+		return fmt.Errorf("alert rule %q: a webhook, slack or email target is required", ar.Name)
+	}
+	if esc := ar.Escalate; esc != nil {
+		var err error
+		if esc.after, err = time.ParseDuration(esc.After); err != nil || esc.after <= 0 {
+			return fmt.Errorf("alert rule %q: escalate after %q is not a positive duration", ar.Name, esc.After)
+		}
+		if esc.alertTargets.empty() {
+			return fmt.Errorf("alert rule %q: a webhook, slack or email target of the escalation is required", ar.Name)
+		}
+	}
+	ar.Glob = path.Clean(ar.Glob)
+	if err := checkGlob(ar.Glob); err != nil {
+		return fmt.Errorf("alert rule %q: %w", ar.Name, err)
+	}
+	var err error
+	if ar.re, err = regexp.Compile(ar.Match); err != nil {
+		return fmt.Errorf("alert rule %q: %w", ar.Name, err)
+	}
+	if ar.Limit <= 0 {
+		ar.Limit = 10
+	}
+	ar.per, ar.dedup = time.Minute, 5*time.Minute
+	for _, d := range []struct {
+		s   string
+		dur *time.Duration
+	}{{ar.Per, &ar.per}, {ar.Dedup, &ar.dedup}} {
+		if d.s == "" {
+			continue
+		}
+		if *d.dur, err = time.ParseDuration(d.s); err != nil || *d.dur < 0 {
+			return fmt.Errorf("alert rule %q: %q is not a duration", ar.Name, d.s)
+		}
+	}
+	ar.state.Seen = make(map[string]time.Time)
+	return nil
+}
+
+// status returns the status of the rule.
+func (ar *alertRule) status() AlertStatus {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	as := AlertStatus{
+		Name: ar.Name, Glob: ar.Glob, Match: ar.Match,
+		Fired: ar.state.Fired, Suppressed: ar.state.Suppressed,
+		LastFired: ar.state.LastFired, LastError: ar.state.LastError,
+		Unacked: ar.state.Unacked, Escalated: ar.state.Escalated,
+	}
+	if until := ar.control.SilencedUntil; time.Now().Before(until) {
+		as.SilencedUntil = &until
+	}
+	return as
+}
+
+// loadControl reads the silence and the acknowledgement of the rule from the store.
+func (ar *alertRule) loadControl(ctx context.Context, st store.Store) error {
+	b, err := st.Get(ctx, alertControlsBucket, ar.Name)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var c alertControl
+	if err := json.Unmarshal(b, &c); err != nil {
+		return fmt.Errorf("control of the alert rule %q: %w", ar.Name, err)
+	}
+	ar.mu.Lock()
+	ar.control = c
+	ar.applyControlLocked()
+	ar.mu.Unlock()
+	return nil
+}
+
+// setControl changes the silence or the acknowledgement of the rule with fn, in the store too (if not nil).
+func (ar *alertRule) setControl(ctx context.Context, st store.Store, fn func(*alertControl)) error {
+	ar.mu.Lock()
+	c := ar.control
+	ar.mu.Unlock()
+	if st != nil {
+		if err := store.Update(ctx, st, alertControlsBucket, ar.Name, func(old []byte) ([]byte, error) {
+			c = alertControl{}
+			if old != nil {
+				if err := json.Unmarshal(old, &c); err != nil {
+					return nil, err
+				}
+			}
+			fn(&c)
+			return json.Marshal(c)
+		}); err != nil {
+			return err
+		}
+	} else {
+		fn(&c)
+	}
+	ar.mu.Lock()
+	ar.control = c
+	ar.applyControlLocked()
+	ar.mu.Unlock()
+	return nil
+}
+
+// applyControlLocked clears the unacknowledged notifications if they have been acknowledged, with ar.mu held.
+func (ar *alertRule) applyControlLocked() {
+	if ar.state.Unacked != nil && !ar.control.Acked.Before(*ar.state.Unacked) {
+		ar.state.Unacked, ar.state.Escalated, ar.dirty = nil, false, true
+	}
+}
+
+// escalate reports whether the unacknowledged notifications of the rule are to be escalated now,
+// and returns the time of the first of them.
+func (ar *alertRule) escalate(now time.Time) (time.Time, bool) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	esc, unacked := ar.Escalate, ar.state.Unacked
+	if esc == nil || unacked == nil || ar.state.Escalated || now.Sub(*unacked) < esc.after || now.Before(ar.control.SilencedUntil) {
+		return time.Time{}, false
+	}
+	ar.state.Escalated, ar.dirty = true, true
+	return *unacked, true
+}
+
+// load reads the state of the rule from the store, if it has one.
+func (ar *alertRule) load(ctx context.Context, st store.Store) error {
+	b, err := st.Get(ctx, alertsBucket, ar.Name)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state alertState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("state of the alert rule %q: %w", ar.Name, err)
+	}
+	if state.Seen == nil {
+		state.Seen = make(map[string]time.Time)
+	}
+	ar.mu.Lock()
+	ar.state, ar.dirty = state, false
+	ar.mu.Unlock()
+	return nil
+}
+
+// save writes the state of the rule into the store, if it has changed.
+func (ar *alertRule) save(ctx context.Context, st store.Store) error {
+	ar.mu.Lock()
+	if !ar.dirty {
+		ar.mu.Unlock()
+		return nil
+	}
+	ar.pruneLocked(time.Now())
+	b, err := json.Marshal(ar.state)
+	ar.dirty = false
+	ar.mu.Unlock()
+	if err == nil {
+		err = st.Put(ctx, alertsBucket, ar.Name, b)
+	}
+	if err != nil {
+		ar.mu.Lock()
+		ar.dirty = true
+		ar.mu.Unlock()
+	}
+	return err
+}
+
+// pruneLocked forgets the lines seen before the Dedup window, with ar.mu held.
+func (ar *alertRule) pruneLocked(now time.Time) {
+	for k, t := range ar.state.Seen {
+		if now.Sub(t) >= ar.dedup {
+			delete(ar.state.Seen, k)
+		}
+	}
+}
+
+// digitsRe matches the numbers masked for deduplication, such as timestamps and ids.
+var digitsRe = regexp.MustCompile(`[0-9]+`)
+
+// admit reports whether a notification of the line is to be sent,
+// and the number of lines suppressed before it.
+func (ar *alertRule) admit(text string, now time.Time) (bool, int) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.dirty = true
+	key := digitsRe.ReplaceAllString(text, "#")
+	if last, ok := ar.state.Seen[key]; (ok && now.Sub(last) < ar.dedup) || now.Before(ar.control.SilencedUntil) {
+		ar.state.Pending++
+		ar.state.Suppressed++
+		return false, 0
+	}
+	if now.Sub(ar.state.WindowStart) >= ar.per {
+		ar.state.WindowStart, ar.state.Sent = now, 0
+	}
+	if ar.state.Sent >= ar.Limit {
+		ar.state.Pending++
+		ar.state.Suppressed++
+		return false, 0
+	}
+	ar.state.Sent++
+	if len(ar.state.Seen) >= maxAlertSeen {
+		ar.pruneLocked(now)
+	}
+	ar.state.Seen[key] = now
+	suppressed := ar.state.Pending
+	ar.state.Pending = 0
+	ar.state.Fired++
+	ar.state.LastFired = &now
+	if ar.state.Unacked == nil {
+		ar.state.Unacked = &now
+	}
+	return true, suppressed
+}
+
+// alerter runs the alert rules.
+type alerter struct {
+	Rules []*alertRule
+	// SMTP is the address of the mail server, From is the sender of the emails.
+	SMTP, From string
+	// Store keeps the states of the rules, if not nil.
+	Store store.Store
+
+	client *http.Client
+}
+
+// alerts are the alert rules of this server, nil without any.
+var alerts *alerter
+
+// Run watches the files of the rules until ctx is canceled.
+//
+// With a store granting leases, each rule is run only by the instance holding its lease,
+// so the instances sharing the store do not send the same alerts.
+func (al *alerter) Run(ctx context.Context, root string, FS fs.FS) {
+	if al.client == nil {
+		al.client = &http.Client{Timeout: alertTimeout}
+	}
+	st := al.Store
+	leaser, _ := st.(store.Leaser)
+	if leaser == nil {
+		al.run(ctx, root, FS, st, al.Rules)
+		return
+	}
+	owner := fmt.Sprintf("%s/%d", instance.Name, os.Getpid())
+	var wg sync.WaitGroup
+	for _, ar := range al.Rules {
+		wg.Add(1)
+		go func(ar *alertRule) {
+			defer wg.Done()
+			store.RunLeased(ctx, leaser, "alert:"+ar.Name, owner, time.Minute, func(ctx context.Context) {
+				al.run(ctx, root, FS, st, []*alertRule{ar})
+			})
+		}(ar)
+	}
+	wg.Wait()
+}
+
+// run watches the files of the rules until ctx is canceled,
+// loading their states from st (if not nil) first, and saving them periodically and at the end.
+// The escalations are checked periodically.
+func (al *alerter) run(ctx context.Context, root string, FS fs.FS, st store.Store, rules []*alertRule) {
+	save := func(ctx context.Context) {
+		for _, ar := range rules {
+			if err := ar.save(ctx, st); err != nil {
+				slog.Error("save alert state", "rule", ar.Name, "error", err)
+			}
+		}
+	}
+	if st != nil {
+		for _, ar := range rules {
+			if err := ar.load(ctx, st); err != nil {
+				slog.Error("load alert state", "rule", ar.Name, "error", err)
+			}
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), alertTimeout)
+			save(ctx)
+			cancel()
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(alertSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, ar := range rules {
+					if st != nil {
+						if err := ar.loadControl(ctx, st); err != nil {
+							slog.Error("load alert control", "rule", ar.Name, "error", err)
+						}
+					}
+					if since, ok := ar.escalate(now); ok {
+						go al.notify(ctx, ar, ar.Escalate.alertTargets, alertNotification{
+							Rule: ar.Name, Instance: instance.Name, Time: since, Escalation: true,
+						})
+					}
+				}
+				if st != nil {
+					save(ctx)
+				}
+			}
+		}
+	}()
+	globs := make([]string, len(rules))
+	for i, ar := range rules {
+		globs[i] = ar.Glob
+	}
+	tailGlobs(ctx, root, FS, globs, func(i int, fn string, line Line) {
+		ar := rules[i]
+		if !ar.re.MatchString(line.Text) {
+			return
+		}
+		ok, suppressed := ar.admit(line.Text, time.Now())
+		if !ok {
+			return
+		}
+		n := alertNotification{
+			Rule: ar.Name, Instance: instance.Name, File: fn,
+			Line: redactions.Redact(line.Text), Time: line.Time, Suppressed: suppressed,
+		}
+		go al.notify(ctx, ar, ar.alertTargets, n)
+	})
+}
+
+// notify sends the notification of the rule to the targets.
+func (al *alerter) notify(ctx context.Context, ar *alertRule, targets alertTargets, n alertNotification) {
+	ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+	defer cancel()
+	text := fmt.Sprintf("[%s] %s: %s", n.Rule, n.File, n.Line)
+	if n.Escalation {
+		text = fmt.Sprintf("[%s] not acknowledged since %s", n.Rule, n.Time.Format(time.RFC3339))
+	} else if n.Suppressed != 0 {
+		text += fmt.Sprintf(" (and %d suppressed)", n.Suppressed)
+	}
+	var errs []string
+	if targets.Webhook != "" {
+		if err := al.post(ctx, targets.Webhook, n); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if targets.Slack != "" {
+		if err := al.post(ctx, targets.Slack, struct {
+			Text string `json:"text"`
+		}{Text: text}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(targets.Email) != 0 {
+		if err := al.mail(targets.Email, "webtail alert "+n.Rule, text); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	ar.mu.Lock()
+	ar.state.LastError, ar.dirty = strings.Join(errs, "; "), true
+	ar.mu.Unlock()
+	if len(errs) != 0 {
+		slog.Error("alert", "rule", ar.Name, "errors", errs)
+	} else {
+		slog.Info("alert", "rule", ar.Name, "file", n.File, "escalation", n.Escalation)
+	}
+}
+
+// post the JSON of v to the URL.
+func (al *alerter) post(ctx context.Context, URL string, v any) error {
+	return postJSON(ctx, al.client, URL, v)
+}
+
+// postJSON posts the JSON of v to the URL with the client.
+func postJSON(ctx context.Context, client *http.Client, URL string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("post %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// mail the text to the addresses with the SMTP server.
+func (al *alerter) mail(to []string, subject, text string) error {
+	if al.SMTP == "" {
+		return fmt.Errorf("email alerts need the -smtp server")
+	}
+	msg := "From: " + al.From + "\r\nTo: " + strings.Join(to, ", ") + "\r\nSubject: " + subject +
+		"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + text + "\r\n"
+	return smtp.SendMail(al.SMTP, nil, al.From, to, []byte(msg))
+}
+
+// ServeHTTP returns the status of the alert rules as JSON.
+func (al *alerter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := make([]AlertStatus, len(al.Rules))
+	for i, ar := range al.Rules {
+		list[i] = ar.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// errNoAlertRule is returned for the name of no alert rule.
+var errNoAlertRule = errors.New("no alert rule")
+
+// setControl silences the rule of the name for the duration d (action "silence"),
+// ends its silence ("unsilence"), or acknowledges its notifications, stopping their escalation ("ack").
+func (al *alerter) setControl(ctx context.Context, name, action string, d time.Duration) (AlertStatus, error) {
+	i := slices.IndexFunc(al.Rules, func(ar *alertRule) bool { return ar.Name == name })
+	if i < 0 {
+		return AlertStatus{}, fmt.Errorf("%w %q", errNoAlertRule, name)
+	}
+	ar := al.Rules[i]
+	now := time.Now()
+	var fn func(*alertControl)
+	switch action {
+	case "ack":
+		fn = func(c *alertControl) { c.Acked = now }
+	case "unsilence":
+		fn = func(c *alertControl) { c.SilencedUntil = time.Time{} }
+	case "silence":
+		fn = func(c *alertControl) { c.SilencedUntil = now.Add(d) }
+	default:
+		return AlertStatus{}, fmt.Errorf("unknown action %q", action)
+	}
+	if err := ar.setControl(ctx, al.Store, fn); err != nil {
+		return AlertStatus{}, err
+	}
+	if action == "silence" {
+		slog.Warn("alert silence", "alert", name, "for", d)
+	} else {
+		slog.Warn("alert "+action, "alert", name)
+	}
+	return ar.status(), nil
+}
+
+// parseSilence parses the "for" form value: the duration of a silence, default 1h.
+func parseSilence(s string) (time.Duration, error) {
+	if s == "" {
+		return time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 || d > maxAlertSilence {
+		return 0, fmt.Errorf("for=%q: not a positive duration up to %s", s, maxAlertSilence)
+	}
+	return d, nil
+}
+
+// control silences the rule of {name} for the duration of the "for" form value (default 1h)
+// on POST .../silence, ends its silence on DELETE .../silence, and acknowledges
+// its notifications (stopping their escalation) on POST .../ack.
+func (al *alerter) control(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	action, d := "silence", time.Duration(0)
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/ack"):
+		action = "ack"
+	case r.Method == http.MethodDelete:
+		action = "unsilence"
+	default:
+		var err error
+		if d, err = parseSilence(r.FormValue("for")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	logAttrs(r.Context(), "alert", name)
+	as, err := al.setControl(r.Context(), name, action, d)
+	if errors.Is(err, errNoAlertRule) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(as)
+}
+
+// admin is the admin page of the alert rules on GET, and on POST silences the named rule
+// for the duration of "for" (action=silence), ends its silence (action=unsilence),
+// or acknowledges its notifications (action=ack).
+func (al *alerter) admin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !checkCSRF(r) {
+			http.Error(w, "invalid or missing CSRF token, reload the page", http.StatusForbidden)
+			return
+		}
+		name, action := r.FormValue("name"), r.FormValue("action")
+		var d time.Duration
+		if action == "silence" {
+			var err error
+			if d, err = parseSilence(r.FormValue("for")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		logAttrs(r.Context(), "alert", name)
+		_, err := al.setControl(r.Context(), name, action, d)
+		if errors.Is(err, errNoAlertRule) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	page := alertsPage{CSRF: csrfToken(w, r), Alerts: make([]AlertStatus, len(al.Rules))}
+	for i, ar := range al.Rules {
+		page.Alerts[i] = ar.status()
+	}
+	renderPage(w, "alerts.html", page)
+}
+
+// alertsPage is the data of the alerts.html template.
+type alertsPage struct {
+	CSRF   string
+	Alerts []AlertStatus
+}
@@ -0,0 +1,26 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// assetsFS holds the client-side scripts and styles,
+// so webtail works without reaching any CDN.
+//
+//go:embed assets
+var assetsFS embed.FS
+
+// staticHandler serves the embedded assets under /static/.
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(assetsFS, "assets")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServerFS(sub))
+}
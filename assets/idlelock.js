@@ -0,0 +1,126 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// idlelock.js locks the page after the seconds of its webtail-idle-lock meta tag without interaction:
+// the page is blurred until the user authenticates again (see /api/v1/unlock),
+// with the token, or by logging in again (data-login).
+// The lock survives reloading the page.
+(function () {
+	"use strict";
+
+	// lockedKey is the session storage key of the time of the lock.
+	const lockedKey = "webtail.locked";
+	const activity = ["mousemove", "mousedown", "keydown", "wheel", "touchstart"];
+
+	document.addEventListener("DOMContentLoaded", function () {
+		const meta = document.querySelector('meta[name="webtail-idle-lock"]');
+		const idle = meta ? parseInt(meta.content, 10) * 1000 : 0;
+		if (!(idle > 0)) {
+			return;
+		}
+		let since = null;
+		let timer = null;
+
+		const overlay = document.createElement("form");
+		overlay.className = "idle-lock";
+		overlay.hidden = true;
+		const message = document.createElement("p");
+		message.textContent = "Locked after " + (idle < 120000 ? idle / 1000 + " seconds" : Math.round(idle / 60000) + " minutes") + " idle.";
+		const token = document.createElement("input");
+		token.type = "password";
+		token.placeholder = "Token";
+		token.autocomplete = "current-password";
+		const button = document.createElement("button");
+		button.type = "submit";
+		button.textContent = "Unlock";
+		const error = document.createElement("p");
+		error.className = "error";
+		overlay.append(message, token, button);
+		if (meta.dataset.login) {
+			const login = document.createElement("a");
+			login.textContent = "Log in again";
+			login.href = meta.dataset.login + "?next=" + encodeURIComponent(location.pathname + location.search);
+			overlay.append(" ", login);
+		}
+		overlay.append(error);
+		document.body.appendChild(overlay);
+
+		function lock(at) {
+			since = at || new Date();
+			try {
+				sessionStorage.setItem(lockedKey, since.toISOString());
+			} catch (e) {
+				// the lock is lost on reload
+			}
+			document.body.classList.add("locked");
+			overlay.hidden = false;
+			token.focus();
+		}
+
+		function unlock() {
+			since = null;
+			try {
+				sessionStorage.removeItem(lockedKey);
+			} catch (e) {
+				// nothing to forget
+			}
+			document.body.classList.remove("locked");
+			overlay.hidden = true;
+			token.value = "";
+			error.textContent = "";
+			restart();
+		}
+
+		function restart() {
+			clearTimeout(timer);
+			timer = setTimeout(function () { lock(); }, idle);
+		}
+
+		// tryUnlock asks the server whether the user authenticated again since the lock.
+		function tryUnlock(tok) {
+			return fetch((meta.dataset.root || "./") + "api/v1/unlock", {
+				method: "POST",
+				headers: { "Content-Type": "application/json" },
+				body: JSON.stringify({ since: since.toISOString(), token: tok }),
+			}).then(function (resp) {
+				if (resp.ok) {
+					unlock();
+				} else if (tok) {
+					error.textContent = "Wrong token.";
+				}
+			});
+		}
+
+		overlay.addEventListener("submit", function (ev) {
+			ev.preventDefault();
+			if (token.value) {
+				tryUnlock(token.value);
+			}
+		});
+		activity.forEach(function (kind) {
+			window.addEventListener(kind, function (ev) {
+				if (since === null) {
+					restart();
+				} else if (!overlay.contains(ev.target)) {
+					// the shortcuts of the viewer do not work behind the lock
+					ev.stopImmediatePropagation();
+				}
+			}, { capture: true, passive: kind !== "keydown" });
+		});
+
+		let locked = null;
+		try {
+			locked = sessionStorage.getItem(lockedKey);
+		} catch (e) {
+			// not locked
+		}
+		if (locked) {
+			// such as returning from the login
+			lock(new Date(locked));
+			tryUnlock("");
+		} else {
+			restart();
+		}
+	});
+})();
@@ -0,0 +1,41 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// kiosk.js rotates through the views of a wallboard, showing each for its data-seconds,
+// scrolled to its last line. The streams of all the views are kept open (see webtail.js),
+// so a view is up to date when it is shown.
+(function () {
+	"use strict";
+
+	// toBottom scrolls the pane of the view to its last line.
+	function toBottom(view) {
+		const pre = view.querySelector("pre");
+		pre.scrollTop = pre.scrollHeight;
+	}
+
+	document.addEventListener("DOMContentLoaded", function () {
+		const views = Array.from(document.querySelectorAll(".kiosk-view"));
+		if (!views.length) {
+			return;
+		}
+		let current = 0;
+		views.forEach(function (view) {
+			new MutationObserver(function () {
+				if (!view.hidden) {
+					toBottom(view);
+				}
+			}).observe(view.querySelector("pre"), { childList: true });
+		});
+
+		function show(i) {
+			views[current].hidden = true;
+			current = i;
+			views[current].hidden = false;
+			toBottom(views[current]);
+			setTimeout(function () { show((current + 1) % views.length); },
+				(parseInt(views[current].dataset.seconds, 10) || 30) * 1000);
+		}
+		show(0);
+	});
+})();
@@ -0,0 +1,126 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// quickopen.js adds a Ctrl-P quick-open box to the listing page,
+// fuzzy-matching the paths returned by /api/v1/files.
+(function () {
+	"use strict";
+
+	const maxResults = 20;
+	let files = null;
+
+	// score returns a fuzzy match score of needle in haystack (higher is better),
+	// or -1 if the characters of needle do not appear in order.
+	function score(needle, haystack) {
+		const h = haystack.toLowerCase();
+		const base = h.lastIndexOf("/") + 1;
+		let s = 0, j = 0, prev = -2;
+		for (let i = 0; i < needle.length; i++) {
+			const c = needle[i];
+			j = h.indexOf(c, j);
+			if (j < 0) {
+				return -1;
+			}
+			s += 1;
+			if (j === prev + 1) {
+				s += 5;
+			}
+			if (j >= base) {
+				s += 2;
+			}
+			if (j === 0 || "/._-".includes(h[j - 1])) {
+				s += 3;
+			}
+			prev = j;
+			j++;
+		}
+		return s - haystack.length / 100;
+	}
+
+	function search(q) {
+		q = q.toLowerCase().replace(/\s+/g, "");
+		if (!q || !files) {
+			return [];
+		}
+		const res = [];
+		for (const f of files) {
+			const s = score(q, f);
+			if (s >= 0) {
+				res.push([s, f]);
+			}
+		}
+		res.sort(function (a, b) { return b[0] - a[0]; });
+		return res.slice(0, maxResults).map(function (x) { return x[1]; });
+	}
+
+	function open(p) {
+		location.href = "./file?path=" + encodeURIComponent(p);
+	}
+
+	function show(box, input, list) {
+		box.hidden = false;
+		input.value = "";
+		list.replaceChildren();
+		input.focus();
+		fetch("./api/v1/files")
+			.then(function (resp) { return resp.json(); })
+			.then(function (fs) { files = fs; });
+	}
+
+	document.addEventListener("DOMContentLoaded", function () {
+		const box = document.getElementById("quickopen");
+		if (!box) {
+			return;
+		}
+		const input = box.querySelector("input");
+		const list = box.querySelector("ul");
+		let selected = 0;
+
+		function render() {
+			const res = search(input.value);
+			list.replaceChildren(...res.map(function (p, i) {
+				const li = document.createElement("li");
+				const a = document.createElement("a");
+				a.href = "./file?path=" + encodeURIComponent(p);
+				a.textContent = p;
+				if (i === selected) {
+					li.className = "selected";
+				}
+				li.appendChild(a);
+				return li;
+			}));
+			return res;
+		}
+
+		document.addEventListener("keydown", function (ev) {
+			if ((ev.ctrlKey || ev.metaKey) && ev.key === "p") {
+				ev.preventDefault();
+				show(box, input, list);
+			} else if (ev.key === "Escape" && !box.hidden) {
+				box.hidden = true;
+			}
+		});
+		input.addEventListener("input", function () {
+			selected = 0;
+			render();
+		});
+		input.addEventListener("keydown", function (ev) {
+			const n = list.children.length;
+			if (ev.key === "ArrowDown" && n) {
+				ev.preventDefault();
+				selected = (selected + 1) % n;
+				render();
+			} else if (ev.key === "ArrowUp" && n) {
+				ev.preventDefault();
+				selected = (selected + n - 1) % n;
+				render();
+			} else if (ev.key === "Enter") {
+				const res = search(input.value);
+				if (res.length) {
+					open(res[Math.min(selected, res.length - 1)]);
+				}
+			}
+		});
+	});
+})();
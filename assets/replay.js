@@ -0,0 +1,130 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// replay.js plays back the lines of /api/v1/replay in one pane per source,
+// paced by their timestamps, with a shared play/pause, speed and seek control.
+(function () {
+	"use strict";
+
+	// tick is the interval of advancing the clock of the replay, in milliseconds.
+	const tick = 100;
+
+	function fmtTime(ms) {
+		return new Date(ms).toISOString();
+	}
+
+	function Player(div, data) {
+		this.data = data;
+		this.now = data.from;
+		this.next = 0;
+		this.speed = 1;
+		this.timer = null;
+		this.playButton = div.querySelector("[data-action=play]");
+		this.seekInput = div.querySelector("[data-action=seek]");
+		this.output = div.querySelector("output");
+		const split = div.querySelector(".split");
+		this.panes = data.sources.map(function (src) {
+			const section = document.createElement("section");
+			section.className = "pane";
+			const h2 = document.createElement("h2");
+			h2.textContent = src;
+			const pre = document.createElement("pre");
+			section.appendChild(h2);
+			section.appendChild(pre);
+			split.appendChild(section);
+			return pre;
+		});
+		if (data.truncated) {
+			const p = document.createElement("p");
+			p.className = "banner";
+			p.textContent = "Too many lines: the replay is truncated to the first " + data.lines.length + ".";
+			div.insertBefore(p, split);
+		}
+		const player = this;
+		this.playButton.addEventListener("click", function () { player.toggle(); });
+		div.querySelector("[data-action=speed]").addEventListener("change", function (ev) {
+			player.speed = Number(ev.target.value);
+		});
+		this.seekInput.addEventListener("input", function () {
+			player.seek(data.from + (data.to - data.from) * player.seekInput.value / player.seekInput.max);
+		});
+		document.addEventListener("keydown", function (ev) {
+			if (ev.key === " " && !/^(INPUT|SELECT|TEXTAREA|BUTTON)$/.test(ev.target.tagName)) {
+				ev.preventDefault();
+				player.toggle();
+			}
+		});
+		this.show();
+	}
+
+	// advance appends the lines up to the clock.
+	Player.prototype.advance = function () {
+		const lines = this.data.lines;
+		const touched = new Set();
+		while (this.next < lines.length && lines[this.next].at <= this.now) {
+			const line = lines[this.next++];
+			this.panes[line.s].appendChild(document.createTextNode(line.t + "\n"));
+			touched.add(this.panes[line.s]);
+		}
+		touched.forEach(function (pre) { pre.scrollTop = pre.scrollHeight; });
+	};
+
+	// show updates the time and the position of the seek control.
+	Player.prototype.show = function () {
+		const d = this.data;
+		this.output.textContent = fmtTime(this.now);
+		this.seekInput.value = Math.round(this.seekInput.max * (this.now - d.from) / Math.max(1, d.to - d.from));
+	};
+
+	// seek restarts the panes from the given time.
+	Player.prototype.seek = function (ms) {
+		this.now = ms;
+		this.next = 0;
+		this.panes.forEach(function (pre) { pre.textContent = ""; });
+		this.advance();
+		this.output.textContent = fmtTime(this.now);
+	};
+
+	Player.prototype.toggle = function () {
+		const player = this;
+		if (this.timer) {
+			clearInterval(this.timer);
+			this.timer = null;
+			this.playButton.textContent = "Play";
+			return;
+		}
+		if (this.now >= this.data.to) {
+			this.seek(this.data.from);
+		}
+		this.playButton.textContent = "Pause";
+		this.timer = setInterval(function () {
+			player.now = Math.min(player.data.to, player.now + tick * player.speed);
+			player.advance();
+			player.show();
+			if (player.now >= player.data.to) {
+				player.toggle();
+			}
+		}, tick);
+	};
+
+	document.addEventListener("DOMContentLoaded", function () {
+		const div = document.getElementById("replay");
+		if (!div) {
+			return;
+		}
+		fetch(div.dataset.src).then(function (resp) {
+			if (!resp.ok) {
+				return resp.text().then(function (text) { throw new Error(text); });
+			}
+			return resp.json();
+		}).then(function (data) {
+			new Player(div, data);
+		}).catch(function (err) {
+			const p = document.createElement("p");
+			p.className = "banner";
+			p.textContent = err.message;
+			div.replaceWith(p);
+		});
+	});
+})();
@@ -0,0 +1,34 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// theme.js applies the theme stored in localStorage and wires up the
+// <select id="theme"> in the toolbar. Load it in <head> to avoid a flash.
+(function () {
+	"use strict";
+
+	const key = "webtail.theme";
+	const root = document.documentElement;
+
+	function apply(name) {
+		if (name) {
+			root.dataset.theme = name;
+		} else {
+			delete root.dataset.theme;
+		}
+	}
+
+	apply(localStorage.getItem(key));
+
+	document.addEventListener("DOMContentLoaded", function () {
+		const sel = document.getElementById("theme");
+		if (!sel) {
+			return;
+		}
+		sel.value = localStorage.getItem(key) || "light";
+		sel.addEventListener("change", function () {
+			localStorage.setItem(key, sel.value);
+			apply(sel.value);
+		});
+	});
+})();
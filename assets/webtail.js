@@ -0,0 +1,1258 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// webtail.js connects every <pre data-tail="URL"> element to its
+// Server Sent Events stream and appends the received lines as text,
+// or as the rows of a table if the lines are parsed (see parsers.go).
+(function () {
+	"use strict";
+
+	// banners are the current messages of the banner, by meta event kind.
+	const banners = {};
+
+	function showBanner(kind, message) {
+		banners[kind] = message;
+		const banner = document.getElementById("banner");
+		if (banner) {
+			const text = Object.values(banners).filter(Boolean).join(" / ");
+			banner.textContent = text;
+			banner.hidden = !text;
+		}
+	}
+
+	// meta handles the out-of-band notifications of the server.
+	function meta(ev) {
+		if (ev.kind === "maintenance") {
+			showBanner(ev.kind, ev.data ? ev.data.message : "");
+		} else if (ev.kind === "root") {
+			showBanner(ev.kind, ev.data && ev.data.degraded ? "The root is unavailable: " + ev.data.error : "");
+		} else if (ev.kind === "instance" && ev.data) {
+			document.title = "WebTail - " + ev.data.name + ":" + ev.data.root;
+		}
+	}
+
+	// stateKeys are the URL query parameters holding the view state,
+	// so a link reproduces what the user sees.
+	// The keys of a pane are prefixed with its data-state attribute (such as "p0."),
+	// so the panes of a split view keep their own state.
+	const stateKeys = ["filter", "hl", "lines", "paused", "wrap", "tz", "age", "sort", "hide", "where", "raw", "spark"];
+
+	// wrapKey is the local storage key of the wrapping preference of the viewers,
+	// used when the URL does not say.
+	const wrapKey = "webtail.wrap";
+
+	function preferWrap() {
+		try {
+			return localStorage.getItem(wrapKey) === "1";
+		} catch (e) {
+			return false;
+		}
+	}
+
+	// tzKey is the local storage key of the time zone preference of the viewers,
+	// used when the URL does not say.
+	const tzKey = "webtail.tz";
+
+	function preferTZ() {
+		try {
+			return localStorage.getItem(tzKey) || "";
+		} catch (e) {
+			return "";
+		}
+	}
+
+	// tsRe matches a leading timestamp with a time zone, optionally in brackets:
+	// RFC 3339 (also with a space instead of the T), or the one of the access logs.
+	const tsRe = /^(\[?)(?:(\d{4}-\d{2}-\d{2})([T ])(\d{2}:\d{2}:\d{2})(\.\d+)?(Z|[+-]\d{2}:?\d{2})|(\d{2})\/([A-Z][a-z]{2})\/(\d{4}):(\d{2}:\d{2}:\d{2}) ([+-]\d{4}))/;
+	const months = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"];
+
+	// timeFormats are the formats of the time zones, by name.
+	const timeFormats = {};
+
+	// timeFormat returns the format of the time zone ("local" is the one of the browser),
+	// or null if it is not known.
+	function timeFormat(tz) {
+		if (!timeFormats[tz]) {
+			try {
+				timeFormats[tz] = new Intl.DateTimeFormat("en-US", {
+					timeZone: tz === "local" ? undefined : tz, hourCycle: "h23",
+					year: "numeric", month: "2-digit", day: "2-digit",
+					hour: "2-digit", minute: "2-digit", second: "2-digit", timeZoneName: "longOffset",
+				});
+			} catch (e) {
+				return null;
+			}
+		}
+		return timeFormats[tz];
+	}
+
+	// parseTime returns the leading timestamp of the text (in milliseconds since the epoch)
+	// and its match of tsRe, or null if there is none.
+	function parseTime(text) {
+		const m = tsRe.exec(text);
+		if (!m) {
+			return null;
+		}
+		let t;
+		if (m[2]) {
+			const off = m[6] === "Z" ? "Z" : m[6].slice(0, 3) + ":" + m[6].slice(-2);
+			t = Date.parse(m[2] + "T" + m[4] + (m[5] || "") + off);
+		} else {
+			const month = months.indexOf(m[8]) + 1;
+			t = month ? Date.parse(m[9] + "-" + String(month).padStart(2, "0") + "-" + m[7] + "T" + m[10] + m[11].slice(0, 3) + ":" + m[11].slice(3)) : NaN;
+		}
+		return isNaN(t) ? null : { t: t, m: m };
+	}
+
+	// convertTime returns the leading timestamp of the text converted to the time zone,
+	// with its start and end in the text; or null if there is none.
+	// The fraction of the seconds is kept as it is.
+	function convertTime(text, tz) {
+		const ts = parseTime(text);
+		const f = ts && timeFormat(tz);
+		if (!f) {
+			return null;
+		}
+		const m = ts.m;
+		const t = ts.t;
+		const sep = m[2] ? m[3] : "T";
+		const frac = m[2] ? m[5] || "" : "";
+		const p = {};
+		f.formatToParts(t).forEach(function (part) { p[part.type] = part.value; });
+		const off = p.timeZoneName === "GMT" ? "Z" : p.timeZoneName.replace("GMT", "");
+		return {
+			text: p.year + "-" + p.month + "-" + p.day + sep + p.hour + ":" + p.minute + ":" + p.second + frac + off,
+			start: m[1].length,
+			end: m[0].length,
+		};
+	}
+
+	// formatAge returns the age of ms milliseconds in its largest unit, such as 2s or 5m.
+	function formatAge(ms) {
+		const s = Math.max(0, Math.floor(ms / 1000));
+		if (s < 60) return s + "s";
+		if (s < 3600) return Math.floor(s / 60) + "m";
+		if (s < 86400) return Math.floor(s / 3600) + "h";
+		return Math.floor(s / 86400) + "d";
+	}
+
+	// ageBadge returns the badge of the age of a line written at t.
+	function ageBadge(t) {
+		const badge = document.createElement("span");
+		badge.className = "age";
+		badge.dataset.t = t;
+		badge.title = new Date(t).toLocaleString();
+		updateAge(badge, Date.now());
+		ageObserver.observe(badge);
+		return badge;
+	}
+
+	// updateAge refreshes the text of the age badge, and marks it fresh (under 10s) or stale (over an hour).
+	function updateAge(badge, now) {
+		const age = now - badge.dataset.t;
+		badge.textContent = formatAge(age);
+		badge.classList.toggle("fresh", age < 10000);
+		badge.classList.toggle("stale", age >= 3600000);
+	}
+
+	// visibleAges are the age badges in the viewport: only these are refreshed every second,
+	// the others when they are scrolled into view, so long sessions do not slow down.
+	const visibleAges = new Set();
+	const ageObserver = new IntersectionObserver(function (entries) {
+		const now = Date.now();
+		entries.forEach(function (e) {
+			if (e.isIntersecting) {
+				visibleAges.add(e.target);
+				updateAge(e.target, now);
+				return;
+			}
+			visibleAges.delete(e.target);
+			if (!e.target.isConnected) ageObserver.unobserve(e.target);
+		});
+	});
+	setInterval(function () {
+		const now = Date.now();
+		visibleAges.forEach(function (badge) {
+			if (!badge.isConnected) {
+				// the line was removed or rendered again
+				visibleAges.delete(badge);
+				ageObserver.unobserve(badge);
+				return;
+			}
+			updateAge(badge, now);
+		});
+	}, 1000);
+
+	// compile returns the case-insensitive regexp s, or s as a literal if it is not valid.
+	function compile(s, flags) {
+		try {
+			return new RegExp(s, flags);
+		} catch (e) {
+			return new RegExp(s.replace(/[.*+?^${}()|[\]\\]/g, "\\$&"), flags);
+		}
+	}
+
+	// Pane is a <pre data-tail> element with its stream, view state and controls.
+	function Pane(pre) {
+		this.pre = pre;
+		this.prefix = pre.dataset.state || "";
+		// kiosk is a pane of a wallboard, without controls and shortcuts.
+		this.kiosk = pre.dataset.kiosk !== undefined;
+		this.state = {
+			filter: "", // only the lines matching it are shown
+			hl: [], // highlight rules
+			lines: 0, // keep only the last lines (0: all)
+			paused: false,
+			wrap: false,
+			age: false, // prefix the lines with their age, from their timestamp or their arrival
+			tz: "", // the time zone the leading timestamps are shown in ("local": the one of the browser; "": as logged)
+			sort: "", // the column the rows are sorted by, descending if prefixed by "-"
+			hide: [], // the hidden columns
+			where: {}, // the quick filters of the columns: only the rows with matching fields are shown
+			raw: false, // show the text of the parsed lines, not their fields
+			spark: "", // the pattern whose rate is drawn as a sparkline, see setSpark
+		};
+		this.filterRe = null;
+		this.hlRe = null;
+		this.whereRe = {};
+		this.pending = []; // the lines received while paused
+		this.pauseButton = null;
+		this.statPanel = null;
+		this.rateSpan = null;
+		// streamID identifies the stream on the server, for recording it.
+		this.streamID = "";
+		this.recording = null;
+		// the column view of the parsed lines, see showColumns
+		this.columns = null;
+		this.view = null;
+		this.tbody = null;
+		this.columnsMenu = null;
+		this.whereInputs = {};
+		this.controlsDiv = null;
+		// the file of the stream, and the sparkline of the rate of a pattern in it
+		this.file = "";
+		this.sparkline = null;
+		this.sparkSource = null;
+		this.seq = 0; // the number of the rows received
+	}
+
+	Pane.prototype.readState = function () {
+		if (this.kiosk) {
+			this.readKioskState();
+			return;
+		}
+		const q = new URLSearchParams(location.search);
+		const p = this.prefix;
+		const state = this.state;
+		state.filter = q.get(p + "filter") || "";
+		state.hl = q.getAll(p + "hl").filter(Boolean);
+		state.lines = parseInt(q.get(p + "lines"), 10) || 0;
+		state.paused = q.get(p + "paused") === "1";
+		state.wrap = q.has(p + "wrap") ? q.get(p + "wrap") === "1" : preferWrap();
+		state.tz = q.has(p + "tz") ? q.get(p + "tz") : preferTZ();
+		state.age = q.get(p + "age") === "1";
+		state.sort = q.get(p + "sort") || "";
+		state.hide = q.getAll(p + "hide").filter(Boolean);
+		state.where = {};
+		q.getAll(p + "where").forEach(function (w) {
+			const i = w.indexOf("=");
+			if (i > 0 && i < w.length - 1) {
+				state.where[w.slice(0, i)] = w.slice(i + 1);
+			}
+		});
+		state.raw = q.get(p + "raw") === "1";
+		state.spark = q.get(p + "spark") || "";
+	};
+
+	// readKioskState reads the view state of a wallboard pane from its data attributes,
+	// as the wallboards have no controls.
+	Pane.prototype.readKioskState = function () {
+		const data = this.pre.dataset;
+		const state = this.state;
+		state.filter = data.filter || "";
+		try {
+			state.hl = (JSON.parse(data.hl || "[]") || []).filter(Boolean);
+		} catch (e) {
+			state.hl = [];
+		}
+		state.lines = parseInt(data.lines, 10) || 0;
+		state.wrap = true;
+		state.tz = preferTZ();
+	};
+
+	Pane.prototype.writeState = function () {
+		if (this.kiosk) {
+			return;
+		}
+		const q = new URLSearchParams(location.search);
+		const p = this.prefix;
+		const state = this.state;
+		stateKeys.forEach(function (k) { q.delete(p + k); });
+		if (state.filter) q.set(p + "filter", state.filter);
+		state.hl.forEach(function (h) { q.append(p + "hl", h); });
+		if (state.lines) q.set(p + "lines", state.lines);
+		if (state.paused) q.set(p + "paused", "1");
+		if (state.wrap !== preferWrap()) q.set(p + "wrap", state.wrap ? "1" : "0");
+		if (state.tz !== preferTZ()) q.set(p + "tz", state.tz);
+		if (state.age) q.set(p + "age", "1");
+		if (state.sort) q.set(p + "sort", state.sort);
+		state.hide.forEach(function (c) { q.append(p + "hide", c); });
+		Object.keys(state.where).forEach(function (c) { q.append(p + "where", c + "=" + state.where[c]); });
+		if (state.raw) q.set(p + "raw", "1");
+		if (state.spark) q.set(p + "spark", state.spark);
+		history.replaceState(null, "", "?" + q.toString());
+	};
+
+	Pane.prototype.compileState = function () {
+		const state = this.state;
+		this.filterRe = state.filter ? compile(state.filter, "i") : null;
+		this.hlRe = state.hl.length ? compile(state.hl.map(function (h) { return "(" + compile(h).source + ")"; }).join("|"), "gi") : null;
+		const whereRe = this.whereRe = {};
+		Object.keys(state.where).forEach(function (c) { whereRe[c] = compile(state.where[c], "i"); });
+	};
+
+	// matchWhere reports whether the fields match the quick filters of the columns.
+	// The lines not parsed match only if there are none.
+	Pane.prototype.matchWhere = function (fields) {
+		const whereRe = this.whereRe;
+		return Object.keys(whereRe).every(function (c) {
+			return fields && whereRe[c].test(fields[c] === undefined ? "" : fields[c]);
+		});
+	};
+
+	// highlight appends the text to the element, highlighted,
+	// its leading timestamp converted to the time zone of the view, the original in its tooltip.
+	Pane.prototype.highlight = function (el, text) {
+		const hlRe = this.hlRe;
+		const ts = this.state.tz ? convertTime(text, this.state.tz) : null;
+		if (ts) {
+			el.appendChild(document.createTextNode(text.slice(0, ts.start)));
+			const time = document.createElement("time");
+			time.className = "converted";
+			time.title = text.slice(ts.start, ts.end);
+			time.textContent = ts.text;
+			el.appendChild(time);
+			text = text.slice(ts.end);
+		}
+		if (hlRe === null) {
+			el.appendChild(document.createTextNode(text));
+			return;
+		}
+		let last = 0;
+		hlRe.lastIndex = 0;
+		for (let m; (m = hlRe.exec(text)) !== null && m[0] !== "";) {
+			el.appendChild(document.createTextNode(text.slice(last, m.index)));
+			const mark = document.createElement("mark");
+			mark.className = "hl" + (m.slice(1).findIndex(function (g) { return g !== undefined; }) % 4);
+			mark.textContent = m[0];
+			el.appendChild(mark);
+			last = m.index + m[0].length;
+		}
+		el.appendChild(document.createTextNode(text.slice(last)));
+	};
+
+	// render fills the line element (or the row of the column view) with the text, highlighted.
+	Pane.prototype.render = function (el) {
+		const text = el.dataset.text;
+		el.hidden = this.filterRe !== null && !this.filterRe.test(text);
+		el.textContent = "";
+		const age = this.state.age && el.time;
+		if (el.tagName !== "TR") {
+			if (age) {
+				el.appendChild(ageBadge(el.time));
+			}
+			this.highlight(el, text + "\n");
+			return;
+		}
+		this.renderCells(el);
+		// the age in the first shown cell
+		const td = age && Array.prototype.find.call(el.cells, function (td) { return !td.hidden; });
+		if (td) {
+			td.insertBefore(ageBadge(el.time), td.firstChild);
+		}
+	};
+
+	// renderCells fills the row of the column view with the fields, highlighted.
+	Pane.prototype.renderCells = function (el) {
+		const pane = this;
+		const text = el.dataset.text;
+		const fields = el.fields;
+		if (el.className !== "notice" && !this.matchWhere(fields)) {
+			el.hidden = true;
+		}
+		if (!fields || this.state.raw) {
+			// a notice, a line not parsed, or the raw view
+			const td = el.insertCell();
+			td.colSpan = Math.max(1, this.columns.length);
+			this.highlight(td, text);
+			return;
+		}
+		this.columns.forEach(function (c) {
+			const td = el.insertCell();
+			td.hidden = pane.state.hide.indexOf(c) >= 0;
+			pane.highlight(td, fields[c] === undefined ? "" : fields[c]);
+		});
+	};
+
+	// append appends the line, or a row of the column view with its fields,
+	// with its byte offset in the file if it is known.
+	Pane.prototype.append = function (text, className, fields, offset) {
+		const pane = this;
+		const tbody = this.tbody;
+		const el = document.createElement(tbody ? "tr" : "span");
+		el.className = className || "line";
+		el.dataset.text = text;
+		if (offset >= 0) {
+			el.dataset.offset = offset;
+		}
+		if (!className) {
+			// when it was written, or received
+			const ts = parseTime(text);
+			el.time = ts ? ts.t : Date.now();
+		}
+		if (!tbody) {
+			this.render(el);
+			this.pre.appendChild(el);
+			this.trim(this.pre);
+			return;
+		}
+		el.seq = ++this.seq;
+		if (fields) {
+			el.fields = fields;
+			Object.keys(fields).forEach(function (c) {
+				if (pane.columns.indexOf(c) < 0) {
+					pane.addColumn(c);
+				}
+			});
+		}
+		this.render(el);
+		// the rows after it in the sort order
+		let next = null;
+		if (this.state.sort) {
+			for (let row = tbody.lastElementChild; row && this.compareRows(row, el) > 0; row = row.previousElementSibling) {
+				next = row;
+			}
+		}
+		tbody.insertBefore(el, next);
+		this.trim(tbody);
+	};
+
+	// trim keeps only the last lines of the element, if a limit is set.
+	Pane.prototype.trim = function (parent) {
+		const n = this.state.lines;
+		while (n > 0 && parent.childElementCount > n) {
+			let oldest = parent.firstElementChild;
+			if (parent === this.tbody && this.state.sort) {
+				Array.prototype.forEach.call(parent.rows, function (row) {
+					if (row.seq < oldest.seq) {
+						oldest = row;
+					}
+				});
+			}
+			parent.removeChild(oldest);
+		}
+	};
+
+	// showColumns switches the pane to the column view of the parsed lines:
+	// a table, sorted by a click on the header of a column,
+	// the columns hidden (and shown) in the Columns menu of the controls.
+	Pane.prototype.showColumns = function (columns) {
+		const pane = this;
+		if (this.columns === null) {
+			this.columns = [];
+			this.view = document.createElement("div");
+			this.view.className = "columns-view";
+			const table = document.createElement("table");
+			table.createTHead().insertRow();
+			// the quick filters
+			table.tHead.insertRow().className = "where";
+			this.tbody = table.createTBody();
+			this.tbody.addEventListener("dblclick", function (ev) {
+				// filter for the value of the cell
+				const td = ev.target.closest("td");
+				const row = td && td.parentNode;
+				if (row && row.fields && !pane.state.raw) {
+					const c = pane.columns[td.cellIndex];
+					const value = row.fields[c] === undefined ? "" : row.fields[c];
+					pane.setWhere(c, "^" + value.replace(/[.*+?^${}()|[\]\\]/g, "\\$&") + "$");
+				}
+			});
+			this.view.appendChild(table);
+			this.pre.hidden = true;
+			this.pre.parentNode.insertBefore(this.view, this.pre.nextSibling);
+			if (this.controlsDiv) {
+				this.columnsMenu = document.createElement("details");
+				this.columnsMenu.className = "columns-menu";
+				this.columnsMenu.innerHTML = "<summary>Columns</summary>" +
+					'<label><input type="checkbox" name="raw"> Raw lines</label>';
+				const raw = this.columnsMenu.querySelector("[name=raw]");
+				raw.checked = this.state.raw;
+				raw.addEventListener("change", function () {
+					pane.state.raw = raw.checked;
+					pane.updateHeader();
+					pane.rerender();
+				});
+				this.controlsDiv.appendChild(this.columnsMenu);
+			}
+			this.applyWrap();
+		}
+		columns.forEach(function (c) {
+			if (pane.columns.indexOf(c) < 0) {
+				pane.addColumn(c);
+			}
+		});
+		// the notices received before
+		Array.from(this.pre.children).forEach(function (el) {
+			pane.pre.removeChild(el);
+			pane.append(el.dataset.text, el.className);
+		});
+	};
+
+	// addColumn adds a column to the column view.
+	Pane.prototype.addColumn = function (name) {
+		const pane = this;
+		const state = this.state;
+		this.columns.push(name);
+		const th = document.createElement("th");
+		th.textContent = name;
+		th.title = "Sort by " + name;
+		th.addEventListener("click", function () {
+			state.sort = state.sort === name ? "-" + name : state.sort === "-" + name ? "" : name;
+			pane.sortRows();
+			pane.updateHeader();
+			pane.writeState();
+		});
+		const thead = this.tbody.parentNode.tHead;
+		thead.rows[0].appendChild(th);
+		const input = document.createElement("input");
+		input.type = "search";
+		input.placeholder = "filter";
+		input.title = "Only the rows with " + name + " matching this regexp (double-click a cell to filter for its value)";
+		input.value = state.where[name] || "";
+		input.addEventListener("input", function () { pane.setWhere(name, input.value); });
+		this.whereInputs[name] = input;
+		thead.rows[1].insertCell().appendChild(input);
+		this.updateHeader();
+		if (!this.columnsMenu) {
+			return;
+		}
+		const label = document.createElement("label");
+		const checkbox = document.createElement("input");
+		checkbox.type = "checkbox";
+		checkbox.checked = state.hide.indexOf(name) < 0;
+		checkbox.addEventListener("change", function () {
+			state.hide = state.hide.filter(function (c) { return c !== name; });
+			if (!checkbox.checked) {
+				state.hide.push(name);
+			}
+			pane.updateHeader();
+			pane.rerender();
+		});
+		label.append(checkbox, " " + name);
+		this.columnsMenu.appendChild(label);
+	};
+
+	// setWhere sets the quick filter of the column.
+	Pane.prototype.setWhere = function (name, value) {
+		if (value) {
+			this.state.where[name] = value;
+		} else {
+			delete this.state.where[name];
+		}
+		this.whereInputs[name].value = value;
+		this.rerender();
+	};
+
+	// updateHeader marks the sort column, and hides the hidden ones (all of them in the raw view).
+	Pane.prototype.updateHeader = function () {
+		const state = this.state;
+		const columns = this.columns;
+		const thead = this.tbody.parentNode.tHead;
+		thead.hidden = state.raw;
+		Array.prototype.forEach.call(thead.rows[0].cells, function (th, i) {
+			th.hidden = state.hide.indexOf(columns[i]) >= 0;
+			th.className = state.sort === columns[i] ? "asc" : state.sort === "-" + columns[i] ? "desc" : "";
+			thead.rows[1].cells[i].hidden = th.hidden;
+		});
+	};
+
+	// compareRows compares the rows by the sort column, as numbers if both are;
+	// the rows without the field come last, and the equal ones in the order received.
+	Pane.prototype.compareRows = function (a, b) {
+		const sort = this.state.sort;
+		const desc = sort.charAt(0) === "-";
+		const key = desc ? sort.slice(1) : sort;
+		const x = a.fields ? a.fields[key] : undefined;
+		const y = b.fields ? b.fields[key] : undefined;
+		let c;
+		if (x === undefined || y === undefined) {
+			c = (x === undefined) - (y === undefined);
+		} else {
+			const nx = Number(x);
+			const ny = Number(y);
+			c = x !== "" && y !== "" && !isNaN(nx) && !isNaN(ny) ? nx - ny : x.localeCompare(y);
+			if (desc) {
+				c = -c;
+			}
+		}
+		return c || a.seq - b.seq;
+	};
+
+	// sortRows sorts the rows of the column view by the sort column, or in the order received.
+	Pane.prototype.sortRows = function () {
+		const pane = this;
+		const rows = Array.from(this.tbody.rows);
+		rows.sort(function (a, b) { return pane.state.sort ? pane.compareRows(a, b) : a.seq - b.seq; });
+		rows.forEach(function (row) { pane.tbody.appendChild(row); });
+	};
+
+	Pane.prototype.connect = function () {
+		const pane = this;
+		const es = new EventSource(this.pre.dataset.tail);
+		es.onmessage = function (ev) {
+			let line = { text: ev.data };
+			if (pane.columns !== null) {
+				// the JSON event of a parsed line
+				const data = JSON.parse(ev.data);
+				line = { text: data.text, fields: data.fields };
+			}
+			// the id is "offset:checksum" with annotate=offset
+			line.offset = ev.lastEventId ? parseInt(ev.lastEventId, 10) : -1;
+			if (pane.state.paused) {
+				pane.pending.push(line);
+				pane.updatePaused();
+			} else {
+				pane.append(line.text, "", line.fields, line.offset);
+			}
+		};
+		es.addEventListener("meta", function (ev) {
+			const m = JSON.parse(ev.data);
+			if (m.kind === "dropped" && m.data) {
+				pane.append("-- " + m.data.lines + " lines dropped, too slow" + (m.data.disconnect ? ", disconnected" : "") + " --", "notice");
+			} else if (m.kind === "rate" && m.data) {
+				pane.showRate(m.data);
+			} else if (m.kind === "stat" && m.data) {
+				pane.showStat(m.data);
+			} else if (m.kind === "live" && m.data) {
+				pane.append("-- the last " + m.data.lines + " lines above, live from here --", "notice");
+			} else if (m.kind === "removed" && m.data) {
+				pane.append("-- " + m.data.file + " removed" + (m.data.wait ? ", waiting " + m.data.wait + " for it to reappear" : "") + " --", "notice");
+			} else if (m.kind === "reappeared" && m.data) {
+				pane.append("-- " + m.data.file + " reappeared, following it from its start --", "notice");
+			} else if (m.kind === "restart" && m.data) {
+				pane.append("-- restarted: " + m.data.reason + " --", "notice");
+			} else if (m.kind === "stall" && m.data) {
+				pane.showStall(m.data);
+			} else if (m.kind === "columns" && m.data) {
+				pane.showColumns(m.data.columns || []);
+			} else if (m.kind === "stream" && m.data) {
+				pane.streamID = m.data.id;
+			}
+			meta(m);
+		});
+		let batchID = "";
+		es.addEventListener("zstd", function (ev) {
+			batchID = dispatchBatch(es, ev.data, batchID);
+		});
+		es.onerror = function () {
+			if (es.readyState === EventSource.CLOSED) {
+				pane.append("-- stream closed --", "notice");
+			}
+		};
+	};
+
+	// dispatchBatch dispatches the events of a batch of compress=zstd (see compress.go):
+	// the Server Sent Events compressed into a Zstandard frame, in base64.
+	// It returns the id of the last event, the events without one having the id before them.
+	function dispatchBatch(es, data, id) {
+		const frame = Uint8Array.from(atob(data), function (c) { return c.charCodeAt(0); });
+		const text = new TextDecoder().decode(window.zstdDecompress(frame));
+		text.split("\n\n").forEach(function (block) {
+			let type = "message";
+			const data = [];
+			block.split("\n").forEach(function (line) {
+				const i = line.indexOf(": ");
+				const field = i < 0 ? line : line.slice(0, i);
+				const value = i < 0 ? "" : line.slice(i + 2);
+				if (field === "event") {
+					type = value;
+				} else if (field === "data") {
+					data.push(value);
+				} else if (field === "id") {
+					id = value;
+				}
+			});
+			if (data.length) {
+				es.dispatchEvent(new MessageEvent(type, { data: data.join("\n"), lastEventId: id }));
+			}
+		});
+		return id;
+	}
+
+	// showStall shows in the banner that the stream stalled (see stall= of the streams),
+	// or clears it when the lines resume.
+	Pane.prototype.showStall = function (st) {
+		const source = new URL(this.pre.dataset.tail, location.href).searchParams.get("file");
+		showBanner("stall:" + this.prefix, st.resumed ? "" :
+			"No new lines" + (source ? " in " + source : "") + " for " + st.idle + ", since " + new Date(st.since).toLocaleTimeString());
+		if (st.resumed) {
+			this.append("-- no new lines for " + formatAge(Date.now() - Date.parse(st.since)) + " --", "notice");
+		}
+	};
+
+	// permalinkContext is the number of the lines shown around the line of a permalink.
+	const permalinkContext = 20;
+
+	// permalink returns the URL of the page showing the line of the file at the offset, in its context.
+	function permalink(file, offset) {
+		const q = new URLSearchParams({ path: file, offset: offset, context: permalinkContext });
+		return new URL("./view?" + q + "#o" + offset, location.href).href;
+	}
+
+	// copyText copies the text to the clipboard.
+	function copyText(text) {
+		if (navigator.clipboard && window.isSecureContext) {
+			return navigator.clipboard.writeText(text);
+		}
+		const ta = document.createElement("textarea");
+		ta.value = text;
+		document.body.appendChild(ta);
+		ta.select();
+		const ok = document.execCommand("copy");
+		ta.remove();
+		return ok ? Promise.resolve() : Promise.reject(new Error("copy failed"));
+	}
+
+	// lineTools shows the permalink and the copy buttons of the line under the mouse,
+	// if the offsets of the lines are known.
+	Pane.prototype.lineTools = function () {
+		const file = new URL(this.pre.dataset.tail, location.href).searchParams.get("file");
+		if (!file) {
+			return;
+		}
+		const pre = this.pre;
+		const parent = pre.parentNode;
+		const tools = document.createElement("span");
+		tools.className = "line-tools";
+		tools.hidden = true;
+		tools.innerHTML = '<a title="Permalink: the line in its context">#</a>' +
+			'<button type="button" name="copy" title="Copy the line">Copy</button>' +
+			'<button type="button" name="copy-link" title="Copy the permalink of the line">Copy link</button>';
+		parent.appendChild(tools);
+		const link = tools.querySelector("a");
+		let line = null;
+		parent.addEventListener("mouseover", function (ev) {
+			const el = ev.target.closest && ev.target.closest("[data-offset]");
+			if (!el || el === line || tools.contains(ev.target)) {
+				return;
+			}
+			line = el;
+			link.href = permalink(file, el.dataset.offset);
+			const rect = el.getBoundingClientRect();
+			const box = (el.closest(".columns-view") || pre).getBoundingClientRect();
+			tools.style.top = (window.scrollY + rect.top) + "px";
+			tools.style.left = (window.scrollX + Math.min(box.right, window.innerWidth)) + "px";
+			tools.hidden = false;
+		});
+		parent.addEventListener("mouseleave", function () {
+			tools.hidden = true;
+			line = null;
+		});
+		tools.addEventListener("click", function (ev) {
+			const button = ev.target.closest("button");
+			if (!button || !line) {
+				return;
+			}
+			const label = button.textContent;
+			copyText(button.name === "copy" ? line.dataset.text : link.href).then(function () {
+				button.textContent = "Copied";
+			}, function () {
+				button.textContent = "Failed";
+			}).finally(function () {
+				setTimeout(function () { button.textContent = label; }, 1000);
+			});
+		});
+	};
+
+	// formatBytes returns n bytes in a human readable form.
+	function formatBytes(n) {
+		const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+		let i = 0;
+		for (; n >= 1024 && i < units.length - 1; i++) {
+			n /= 1024;
+		}
+		return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+	}
+
+	// showStat shows the size and growth of the file in the stats panel.
+	Pane.prototype.showStat = function (st) {
+		if (!this.statPanel) {
+			this.statPanel = document.createElement("div");
+			this.statPanel.className = "file-stat";
+			this.pre.parentNode.insertBefore(this.statPanel, this.pre);
+		}
+		const mtime = new Date(st.mtime);
+		this.statPanel.textContent = formatBytes(st.size) +
+			", " + st.linesPerSec.toFixed(1) + " lines/s" +
+			", " + formatBytes(st.bytesPerSec) + "/s" +
+			", last write " + mtime.toLocaleString();
+		this.statPanel.title = "over the last minute";
+		this.statPanel.classList.toggle("idle", st.bytesPerSec === 0);
+	};
+
+	// sparkPoints returns the points of the polyline of the counts, scaled to w×h.
+	function sparkPoints(counts, w, h) {
+		const top = Math.max(1, Math.max.apply(null, counts));
+		const step = counts.length > 1 ? w / (counts.length - 1) : 0;
+		return counts.map(function (n, i) {
+			return (i * step).toFixed(1) + "," + (h - n / top * (h - 1)).toFixed(1);
+		}).join(" ");
+	}
+
+	// setSpark draws the rate of the lines matching the pattern as a sparkline,
+	// following the counts per minute of the last hour (see /stats).
+	Pane.prototype.setSpark = function (pattern) {
+		const pane = this;
+		this.state.spark = pattern;
+		this.writeState();
+		if (this.sparkSource) {
+			this.sparkSource.close();
+			this.sparkSource = null;
+		}
+		const svg = this.sparkline;
+		const line = svg.querySelector("polyline");
+		line.setAttribute("points", "");
+		svg.hidden = !pattern;
+		if (!pattern) {
+			return;
+		}
+		const es = new EventSource("./stats?" + new URLSearchParams({ path: this.file, pattern: pattern, follow: "1" }));
+		es.onmessage = function (ev) {
+			const st = JSON.parse(ev.data);
+			line.setAttribute("points", sparkPoints(st.counts, 120, 20));
+			svg.querySelector("title").textContent = st.total + " lines matching " + st.pattern +
+				" since " + new Date(st.start).toLocaleTimeString() + ", " + st.counts[st.counts.length - 1] + " in the last minute";
+		};
+		es.onerror = function () {
+			if (es.readyState === EventSource.CLOSED) {
+				svg.querySelector("title").textContent = "the rate of " + pattern + " is not available";
+			}
+		};
+		this.sparkSource = es;
+	};
+
+	// showRate shows the rate of the lines of the stream in the controls,
+	// and a warning while the server throttles or drops them.
+	Pane.prototype.showRate = function (sr) {
+		if (!this.controlsDiv) {
+			return;
+		}
+		if (!this.rateSpan) {
+			this.rateSpan = document.createElement("span");
+			this.rateSpan.className = "stream-rate";
+			this.controlsDiv.appendChild(this.rateSpan);
+		}
+		const warnings = [];
+		if (sr.dropped) {
+			warnings.push(sr.dropped + " lines dropped, too slow");
+		}
+		if (sr.throttled) {
+			warnings.push("reads throttled by the server");
+		}
+		if (sr.shedding) {
+			warnings.push("the server is short of memory");
+		}
+		this.rateSpan.textContent = sr.linesPerSec.toFixed(1) + " lines/s, " + formatBytes(sr.bytesPerSec) + "/s" +
+			(warnings.length ? " \u26a0 " + warnings.join(", ") : "");
+		this.rateSpan.title = warnings.length ? "the view is incomplete or late" : "the rate of the lines received";
+		this.rateSpan.classList.toggle("degraded", warnings.length !== 0);
+	};
+
+	Pane.prototype.updatePaused = function () {
+		const n = this.pending.length;
+		this.pauseButton.textContent = this.state.paused ? "Resume" + (n ? " (" + n + " new)" : "") : "Pause";
+	};
+
+	Pane.prototype.setPaused = function (paused) {
+		const pane = this;
+		this.state.paused = paused;
+		if (!paused) {
+			this.pending.splice(0).forEach(function (line) { pane.append(line.text, "", line.fields, line.offset); });
+		}
+		this.updatePaused();
+		this.writeState();
+	};
+
+	Pane.prototype.rerender = function () {
+		const pane = this;
+		this.compileState();
+		Array.from(this.tbody ? this.tbody.rows : this.pre.children).forEach(function (el) { pane.render(el); });
+		this.writeState();
+	};
+
+	Pane.prototype.applyWrap = function () {
+		this.pre.classList.toggle("wrap", this.state.wrap);
+		if (this.view) {
+			this.view.classList.toggle("wrap", this.state.wrap);
+		}
+	};
+
+	// toggleRecording starts recording the stream on the server (as filtered now),
+	// or stops it and downloads the recorded lines.
+	Pane.prototype.toggleRecording = function (button) {
+		const pane = this;
+		button.disabled = true;
+		let req;
+		if (this.recording) {
+			req = fetch("./api/v1/recordings/" + encodeURIComponent(this.recording.id) + "/stop", { method: "POST" });
+		} else {
+			req = fetch("./api/v1/recordings", {
+				method: "POST",
+				body: new URLSearchParams({ stream: this.streamID, filter: this.state.filter }),
+			});
+		}
+		req.then(function (resp) {
+			if (!resp.ok) {
+				return resp.text().then(function (text) { throw new Error(text); });
+			}
+			return resp.json();
+		}).then(function (rec) {
+			if (pane.recording) {
+				pane.recording = null;
+				const a = document.createElement("a");
+				a.href = rec.url;
+				a.download = "";
+				document.body.appendChild(a);
+				a.click();
+				a.remove();
+				pane.append("-- recorded " + rec.lines + " lines" + (rec.truncated ? " (truncated)" : "") + " --", "notice");
+			} else {
+				pane.recording = rec;
+				pane.append("-- recording" + (rec.filter ? " the lines matching " + rec.filter : "") + " --", "notice");
+			}
+		}).catch(function (err) {
+			pane.append("-- recording: " + err.message.trim() + " --", "notice");
+		}).finally(function () {
+			button.disabled = false;
+			button.textContent = pane.recording ? "Stop recording" : "Record";
+			button.classList.toggle("recording", !!pane.recording);
+		});
+	};
+
+	// controls builds the view state controls before the stream.
+	Pane.prototype.controls = function () {
+		const pane = this;
+		const state = this.state;
+		const div = document.createElement("div");
+		div.className = "viewer-controls";
+		div.innerHTML = '<label>Filter <input type="search" name="filter"></label>' +
+			'<label>Highlight <input type="search" name="hl" placeholder="a, b, ..."></label>' +
+			'<label>Keep <input type="number" name="lines" min="0" step="100"> lines</label>' +
+			'<label><input type="checkbox" name="wrap"> Wrap</label>' +
+			'<label><input type="checkbox" name="age"> Age</label>' +
+			'<label>Time zone <input name="tz" list="webtail-tz" placeholder="as logged" title="local, UTC, or a zone such as Europe/Budapest"></label>' +
+			'<button type="button" name="pause"></button>' +
+			'<button type="button" name="record">Record</button>';
+		const filter = div.querySelector("[name=filter]");
+		const hl = div.querySelector("[name=hl]");
+		const lines = div.querySelector("[name=lines]");
+		const wrap = div.querySelector("[name=wrap]");
+		const tz = div.querySelector("[name=tz]");
+		const age = div.querySelector("[name=age]");
+		this.filterInput = filter;
+		this.wrapInput = wrap;
+		this.pauseButton = div.querySelector("[name=pause]");
+		filter.value = state.filter;
+		hl.value = state.hl.join(", ");
+		lines.value = state.lines || "";
+		wrap.checked = state.wrap;
+		tz.value = state.tz;
+		age.checked = state.age;
+		timeZoneList();
+		filter.addEventListener("input", function () {
+			state.filter = filter.value;
+			pane.rerender();
+		});
+		hl.addEventListener("change", function () {
+			state.hl = hl.value.split(",").map(function (h) { return h.trim(); }).filter(Boolean);
+			pane.rerender();
+		});
+		lines.addEventListener("change", function () {
+			state.lines = Math.max(0, parseInt(lines.value, 10) || 0);
+			pane.writeState();
+		});
+		wrap.addEventListener("change", function () {
+			pane.setWrap(wrap.checked);
+		});
+		age.addEventListener("change", function () {
+			state.age = age.checked;
+			pane.rerender();
+		});
+		tz.addEventListener("change", function () {
+			const value = tz.value.trim();
+			tz.setCustomValidity(value && !timeFormat(value) ? "unknown time zone" : "");
+			if (tz.validity.valid) {
+				pane.setTZ(value);
+			}
+		});
+		this.pauseButton.addEventListener("click", function () {
+			pane.setPaused(!state.paused);
+		});
+		const record = div.querySelector("[name=record]");
+		record.addEventListener("click", function () {
+			pane.toggleRecording(record);
+		});
+		this.pre.parentNode.insertBefore(div, this.pre);
+		this.controlsDiv = div;
+		this.updatePaused();
+		this.file = new URL(this.pre.dataset.tail, location.href).searchParams.get("file") || "";
+		if (this.file) {
+			this.sparkControl(div);
+		}
+		favoriteButton(div, this.file);
+		saveViewButton(div, this);
+	};
+
+	// sparkControl adds the input of the pattern of the sparkline to the controls.
+	Pane.prototype.sparkControl = function (div) {
+		const pane = this;
+		const label = document.createElement("label");
+		label.title = "the rate of the lines matching the pattern, per minute";
+		label.innerHTML = 'Rate of <input type="search" name="spark" placeholder="ERROR">' +
+			'<svg class="sparkline" width="120" height="20" viewBox="0 0 120 20" hidden><title></title><polyline points=""></polyline></svg>';
+		div.insertBefore(label, this.pauseButton);
+		const input = label.querySelector("[name=spark]");
+		this.sparkline = label.querySelector("svg");
+		input.value = this.state.spark;
+		input.addEventListener("change", function () {
+			try {
+				new RegExp(input.value);
+				input.setCustomValidity("");
+			} catch (e) {
+				input.setCustomValidity("not a regular expression");
+				return;
+			}
+			pane.setSpark(input.value.trim());
+		});
+		if (this.state.spark) {
+			this.setSpark(this.state.spark);
+		}
+	};
+
+	// scroller returns the element scrolling the lines of the pane:
+	// the pane itself in a split view, the page otherwise.
+	Pane.prototype.scroller = function () {
+		const el = this.view || this.pre;
+		return el.scrollHeight > el.clientHeight ? el : document.scrollingElement;
+	};
+
+	// setWrap wraps the long lines, or scrolls them horizontally,
+	// remembering it as the preference for the other viewers.
+	Pane.prototype.setWrap = function (wrap) {
+		this.state.wrap = wrap;
+		this.wrapInput.checked = wrap;
+		this.applyWrap();
+		try {
+			localStorage.setItem(wrapKey, wrap ? "1" : "0");
+		} catch (e) {
+			// not persisted
+		}
+		this.writeState();
+	};
+
+	// setTZ shows the leading timestamps in the time zone, or as logged if it is empty,
+	// remembering it as the preference for the other viewers.
+	Pane.prototype.setTZ = function (tz) {
+		this.state.tz = tz;
+		try {
+			localStorage.setItem(tzKey, tz);
+		} catch (e) {
+			// not persisted
+		}
+		this.rerender();
+	};
+
+	// timeZoneList adds the datalist of the time zones to the page, once.
+	function timeZoneList() {
+		if (document.getElementById("webtail-tz")) {
+			return;
+		}
+		const list = document.createElement("datalist");
+		list.id = "webtail-tz";
+		const zones = ["local", "UTC"].concat(Intl.supportedValuesOf ? Intl.supportedValuesOf("timeZone") : []);
+		zones.forEach(function (z) {
+			const option = document.createElement("option");
+			option.value = z;
+			list.appendChild(option);
+		});
+		document.body.appendChild(list);
+	}
+
+	// shortcuts are the keyboard shortcuts of the viewer, acting on the active pane.
+	const shortcuts = [
+		{ key: " ", help: "pause / resume", run: function (pane) { pane.setPaused(!pane.state.paused); } },
+		{ key: "/", help: "focus the filter", run: function (pane) { pane.filterInput.focus(); pane.filterInput.select(); } },
+		{ key: "g", help: "jump to the top", run: function (pane) { pane.scroller().scrollTop = 0; } },
+		{ key: "G", help: "jump to the bottom", run: function (pane) { const el = pane.scroller(); el.scrollTop = el.scrollHeight; } },
+		{ key: "j", help: "scroll down", run: function (pane) { pane.scroller().scrollBy(0, 40); } },
+		{ key: "k", help: "scroll up", run: function (pane) { pane.scroller().scrollBy(0, -40); } },
+		{ key: "w", help: "toggle wrapping", run: function (pane) { pane.setWrap(!pane.state.wrap); } },
+		{ key: "1-9", help: "activate the n-th pane of a split view" },
+		{ key: "?", help: "show / hide this help", run: function () { toggleHelp(); } },
+	];
+
+	// toggleHelp shows or hides the list of the keyboard shortcuts.
+	function toggleHelp() {
+		let help = document.getElementById("shortcuts");
+		if (!help) {
+			help = document.createElement("div");
+			help.id = "shortcuts";
+			help.className = "shortcuts";
+			help.hidden = true;
+			const dl = document.createElement("dl");
+			shortcuts.forEach(function (s) {
+				const dt = document.createElement("dt");
+				const kbd = document.createElement("kbd");
+				kbd.textContent = s.key === " " ? "space" : s.key;
+				dt.appendChild(kbd);
+				const dd = document.createElement("dd");
+				dd.textContent = s.help;
+				dl.append(dt, dd);
+			});
+			help.appendChild(dl);
+			document.body.appendChild(help);
+		}
+		help.hidden = !help.hidden;
+	}
+
+	// bindKeys binds the keyboard shortcuts to the panes.
+	// The keys typed into the inputs are not shortcuts, but Escape leaves the input.
+	function bindKeys(panes) {
+		let active = panes[0];
+		panes.forEach(function (pane) {
+			pane.pre.parentNode.addEventListener("focusin", function () { setActive(pane); });
+			pane.pre.parentNode.addEventListener("mousedown", function () { setActive(pane); });
+		});
+		function setActive(pane) {
+			active.pre.classList.remove("active");
+			active = pane;
+			if (panes.length > 1) {
+				pane.pre.classList.add("active");
+			}
+		}
+		document.addEventListener("keydown", function (ev) {
+			const t = ev.target;
+			if (t.matches && t.matches("input, textarea, select, [contenteditable]")) {
+				if (ev.key === "Escape") {
+					t.blur();
+				}
+				return;
+			}
+			if (ev.ctrlKey || ev.metaKey || ev.altKey || !active) {
+				return;
+			}
+			if (ev.key >= "1" && ev.key <= "9" && panes.length > 1) {
+				const pane = panes[ev.key - 1];
+				if (pane) {
+					setActive(pane);
+				}
+				return;
+			}
+			const s = shortcuts.find(function (s) { return s.key === ev.key && s.run; });
+			if (s) {
+				ev.preventDefault();
+				s.run(active);
+			}
+		});
+	}
+
+	// favoriteButton adds a button to the controls, toggling whether the file is a favorite.
+	function favoriteButton(div, file) {
+		if (!file) {
+			return;
+		}
+		const button = document.createElement("button");
+		button.type = "button";
+		button.hidden = true;
+		div.appendChild(button);
+		let favorite = false;
+		function update(favs) {
+			favorite = favs.indexOf(file) >= 0;
+			button.textContent = favorite ? "\u2605 Favorite" : "\u2606 Favorite";
+			button.hidden = false;
+		}
+		const api = "./api/v1/favorites?path=" + encodeURIComponent(file);
+		fetch(api).then(function (resp) { return resp.json(); }).then(update);
+		button.addEventListener("click", function () {
+			fetch(api, { method: favorite ? "DELETE" : "POST" }).then(function (resp) { return resp.json(); }).then(update);
+		});
+	}
+
+	// saveViewButton adds the button saving the files (or the glob) of the viewer or the split view,
+	// with the filter and the highlights of the pane, as a named view of the team, if the server keeps them.
+	function saveViewButton(div, pane) {
+		if (!/\/(file|split)$/.test(location.pathname)) {
+			return;
+		}
+		const button = document.createElement("button");
+		button.type = "button";
+		button.textContent = "Save view";
+		button.hidden = true;
+		div.appendChild(button);
+		fetch("./api/v1/server").then(function (resp) { return resp.json(); }).then(function (info) {
+			const features = info.features || [];
+			button.hidden = features.indexOf("saved-views") < 0 || features.indexOf("read-only") >= 0;
+		});
+		button.addEventListener("click", function () {
+			const name = (prompt("Name of the view (letters, digits, dots, dashes, underscores):") || "").trim();
+			if (!name) {
+				return;
+			}
+			const view = { filter: pane.state.filter, highlight: pane.state.hl };
+			const glob = new URL(pane.pre.dataset.tail, location.href).searchParams.get("glob");
+			if (glob) {
+				view.glob = glob;
+			} else {
+				view.files = Array.from(document.querySelectorAll("pre[data-tail]"), function (pre) {
+					return new URL(pre.dataset.tail, location.href).searchParams.get("file");
+				}).filter(Boolean);
+			}
+			const api = "./api/v1/views/" + encodeURIComponent(name);
+			fetch("./api/v1/views").then(function (resp) { return resp.json(); }).then(function (views) {
+				if (views.some(function (v) { return v.name === name; }) && !confirm("Replace the saved view " + name + "?")) {
+					return;
+				}
+				return fetch(api, { method: "PUT", headers: { "Content-Type": "application/json" }, body: JSON.stringify(view) }).then(function (resp) {
+					if (!resp.ok) {
+						return resp.text().then(function (text) { throw new Error(text.trim()); });
+					}
+					showBanner("saved-view", "Saved the view " + name + ", share it as " + new URL("./views/" + encodeURIComponent(name), location.href).href);
+				});
+			}).catch(function (err) {
+				showBanner("saved-view", "Saving the view " + name + " failed: " + err.message);
+			});
+		});
+	}
+
+	document.addEventListener("DOMContentLoaded", function () {
+		const panes = [];
+		document.querySelectorAll("pre[data-tail]").forEach(function (pre) {
+			const pane = new Pane(pre);
+			pane.readState();
+			pane.compileState();
+			if (!pane.kiosk) {
+				pane.controls();
+				pane.lineTools();
+			}
+			pane.applyWrap();
+			pane.connect();
+			if (!pane.kiosk) {
+				panes.push(pane);
+			}
+		});
+		if (panes.length) {
+			bindKeys(panes);
+		}
+	});
+})();
@@ -0,0 +1,572 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// zstd.js decompresses the Zstandard frames (RFC 8878) of the compress=zstd streams
+// (see compress.go) as window.zstdDecompress(bytes), without dictionaries.
+// The checksums of the frames are not verified.
+(function () {
+	"use strict";
+
+	const frameMagic = 0xFD2FB528;
+	const maxBlockSize = 128 << 10;
+
+	// the baselines and the numbers of the extra bits of the literal length and match length codes
+	const llBase = [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536];
+	const llBits = [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16];
+	const mlBase = [];
+	const mlBits = [];
+	for (let i = 0; i < 32; i++) {
+		mlBase.push(i + 3);
+		mlBits.push(0);
+	}
+	[[35, 1], [37, 1], [39, 1], [41, 1], [43, 2], [47, 2], [51, 3], [59, 3], [67, 4], [83, 4], [99, 5],
+		[131, 7], [259, 8], [515, 9], [1027, 10], [2051, 11], [4099, 12], [8195, 13], [16387, 14], [32771, 15], [65539, 16],
+	].forEach(function (c) {
+		mlBase.push(c[0]);
+		mlBits.push(c[1]);
+	});
+
+	// the predefined distributions of the literal length, match length and offset codes
+	const llDefault = [4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1];
+	const mlDefault = [1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1];
+	const ofDefault = [1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1];
+
+	function fail(msg) {
+		throw new Error("zstd: " + msg);
+	}
+
+	function highBit(n) {
+		return 31 - Math.clz32(n);
+	}
+
+	// ForwardBits reads the bits of src from the offset, the lowest first.
+	function ForwardBits(src, off) {
+		this.src = src;
+		this.start = off;
+		this.pos = off * 8;
+	}
+
+	ForwardBits.prototype.peek = function (n) {
+		let v = 0;
+		for (let i = n - 1; i >= 0; i--) {
+			const p = this.pos + i;
+			v = v * 2 + ((p >> 3) < this.src.length ? (this.src[p >> 3] >> (p & 7)) & 1 : 0);
+		}
+		return v;
+	};
+
+	ForwardBits.prototype.skip = function (n) {
+		this.pos += n;
+	};
+
+	// BackwardBits reads the bits of src[start:end] from its end, after the padding of its last byte.
+	function BackwardBits(src, start, end) {
+		if (end <= start || src[end - 1] === 0) {
+			fail("bad bitstream");
+		}
+		this.src = src;
+		this.start = start;
+		this.pos = (end - 1 - start) * 8 + highBit(src[end - 1]);
+	}
+
+	// read returns the next n bits, the bits before the start of the stream being zero.
+	BackwardBits.prototype.read = function (n) {
+		this.pos -= n;
+		let v = 0;
+		for (let i = n - 1; i >= 0; i--) {
+			const p = this.pos + i;
+			v = v * 2 + (p >= 0 ? (this.src[this.start + (p >> 3)] >> (p & 7)) & 1 : 0);
+		}
+		return v;
+	};
+
+	// peek returns the next n bits without consuming them.
+	BackwardBits.prototype.peek = function (n) {
+		const v = this.read(n);
+		this.pos += n;
+		return v;
+	};
+
+	// overflow reports whether more bits have been read than the stream has.
+	BackwardBits.prototype.overflow = function () {
+		return this.pos < 0;
+	};
+
+	// readFSEDistribution reads the normalized counts of an FSE table description
+	// at src[off], returning them with the accuracy log and the end of the description.
+	function readFSEDistribution(src, off, maxLog, maxSymbol) {
+		const bits = new ForwardBits(src, off);
+		const log = bits.peek(4) + 5;
+		bits.skip(4);
+		if (log > maxLog) {
+			fail("too large accuracy log");
+		}
+		const counts = [];
+		let remaining = (1 << log) + 1;
+		let threshold = 1 << log;
+		let nbBits = log + 1;
+		let previous0 = false;
+		while (remaining > 1 && counts.length <= maxSymbol) {
+			if (previous0) {
+				let repeat;
+				do {
+					repeat = bits.peek(2);
+					bits.skip(2);
+					for (let i = 0; i < repeat; i++) {
+						counts.push(0);
+					}
+				} while (repeat === 3);
+				if (counts.length > maxSymbol) {
+					break;
+				}
+			}
+			const max = 2 * threshold - 1 - remaining;
+			let count;
+			if (bits.peek(nbBits - 1) < max) {
+				count = bits.peek(nbBits - 1);
+				bits.skip(nbBits - 1);
+			} else {
+				count = bits.peek(nbBits);
+				if (count >= threshold) {
+					count -= max;
+				}
+				bits.skip(nbBits);
+			}
+			count--;
+			remaining -= Math.abs(count);
+			counts.push(count);
+			previous0 = count === 0;
+			while (remaining < threshold) {
+				nbBits--;
+				threshold >>= 1;
+			}
+		}
+		if (remaining !== 1) {
+			fail("bad FSE distribution");
+		}
+		return { counts: counts, log: log, end: off + ((bits.pos - bits.start * 8 + 7) >> 3) };
+	}
+
+	// buildFSETable returns the decoding table of the normalized counts.
+	function buildFSETable(counts, log) {
+		const size = 1 << log;
+		const symbols = new Uint8Array(size);
+		const nbBits = new Uint8Array(size);
+		const newState = new Uint16Array(size);
+		const next = [];
+		let high = size - 1;
+		counts.forEach(function (c, s) {
+			if (c === -1) {
+				symbols[high--] = s;
+				next[s] = 1;
+			} else {
+				next[s] = c;
+			}
+		});
+		const step = (size >> 1) + (size >> 3) + 3;
+		let pos = 0;
+		counts.forEach(function (c, s) {
+			for (let i = 0; i < c; i++) {
+				symbols[pos] = s;
+				do {
+					pos = (pos + step) & (size - 1);
+				} while (pos > high);
+			}
+		});
+		if (pos !== 0) {
+			fail("bad FSE table");
+		}
+		for (let u = 0; u < size; u++) {
+			const n = next[symbols[u]]++;
+			nbBits[u] = log - highBit(n);
+			newState[u] = (n << nbBits[u]) - size;
+		}
+		return { log: log, symbols: symbols, nbBits: nbBits, newState: newState };
+	}
+
+	// rleTable returns the decoding table of always the symbol.
+	function rleTable(symbol) {
+		return { log: 0, symbols: [symbol], nbBits: [0], newState: [0] };
+	}
+
+	// FSEState decodes the symbols of a table from a backward bitstream.
+	function FSEState(table, bits) {
+		this.table = table;
+		this.bits = bits;
+		this.state = bits.read(table.log);
+	}
+
+	FSEState.prototype.symbol = function () {
+		return this.table.symbols[this.state];
+	};
+
+	FSEState.prototype.update = function () {
+		const t = this.table;
+		this.state = t.newState[this.state] + this.bits.read(t.nbBits[this.state]);
+	};
+
+	// readHuffmanTable reads the Huffman tree description at src[off],
+	// returning the decoding table and the end of the description.
+	function readHuffmanTable(src, off) {
+		const header = src[off];
+		let weights = [];
+		let end;
+		if (header >= 128) {
+			const n = header - 127;
+			end = off + 1 + ((n + 1) >> 1);
+			for (let i = 0; i < n; i++) {
+				const b = src[off + 1 + (i >> 1)];
+				weights.push(i & 1 ? b & 15 : b >> 4);
+			}
+		} else {
+			end = off + 1 + header;
+			const dist = readFSEDistribution(src, off + 1, 6, 255);
+			const table = buildFSETable(dist.counts, dist.log);
+			const bits = new BackwardBits(src, dist.end, end);
+			const s1 = new FSEState(table, bits);
+			const s2 = new FSEState(table, bits);
+			for (;;) {
+				weights.push(s1.symbol());
+				s1.update();
+				if (bits.overflow()) {
+					weights.push(s2.symbol());
+					break;
+				}
+				weights.push(s2.symbol());
+				s2.update();
+				if (bits.overflow()) {
+					weights.push(s1.symbol());
+					break;
+				}
+				if (weights.length > 255) {
+					fail("too many Huffman weights");
+				}
+			}
+		}
+		// the weight of the last symbol completes the total to a power of two
+		let total = 0;
+		weights.forEach(function (w) {
+			if (w > 0) {
+				total += 1 << (w - 1);
+			}
+		});
+		if (total === 0) {
+			fail("bad Huffman weights");
+		}
+		const maxBits = highBit(total) + 1;
+		const rest = (1 << maxBits) - total;
+		if (rest & (rest - 1)) {
+			fail("bad Huffman weights");
+		}
+		weights.push(highBit(rest) + 1);
+		if (maxBits > 11) {
+			fail("too long Huffman codes");
+		}
+		const size = 1 << maxBits;
+		const symbols = new Uint8Array(size);
+		const nbBits = new Uint8Array(size);
+		let pos = 0;
+		for (let w = 1; w <= maxBits; w++) {
+			weights.forEach(function (ws, s) {
+				if (ws !== w) {
+					return;
+				}
+				const n = 1 << (w - 1);
+				symbols.fill(s, pos, pos + n);
+				nbBits.fill(maxBits + 1 - w, pos, pos + n);
+				pos += n;
+			});
+		}
+		return { table: { maxBits: maxBits, symbols: symbols, nbBits: nbBits }, end: end };
+	}
+
+	// decodeHuffmanStream decodes n literals of the stream src[start:end] into out[at:].
+	function decodeHuffmanStream(table, src, start, end, out, at, n) {
+		const bits = new BackwardBits(src, start, end);
+		for (let i = 0; i < n; i++) {
+			const v = bits.peek(table.maxBits);
+			out[at + i] = table.symbols[v];
+			bits.pos -= table.nbBits[v];
+		}
+		if (bits.pos !== 0) {
+			fail("bad Huffman stream");
+		}
+	}
+
+	// Frame is the state of the decoding of a frame.
+	function Frame() {
+		this.out = new Uint8Array(1024);
+		this.size = 0;
+		this.huffman = null;
+		this.ll = null;
+		this.of = null;
+		this.ml = null;
+		this.reps = [1, 4, 8];
+	}
+
+	Frame.prototype.grow = function (n) {
+		if (this.size + n <= this.out.length) {
+			return;
+		}
+		const out = new Uint8Array(Math.max(this.out.length * 2, this.size + n));
+		out.set(this.out.subarray(0, this.size));
+		this.out = out;
+	};
+
+	Frame.prototype.write = function (bytes) {
+		this.grow(bytes.length);
+		this.out.set(bytes, this.size);
+		this.size += bytes.length;
+	};
+
+	// literals reads the literals section of the block at src[off], returning the literals and its end.
+	Frame.prototype.literals = function (src, off) {
+		const b0 = src[off];
+		const type = b0 & 3;
+		const format = (b0 >> 2) & 3;
+		if (type < 2) {
+			let size, start;
+			if (format === 0 || format === 2) {
+				size = b0 >> 3;
+				start = off + 1;
+			} else if (format === 1) {
+				size = (b0 >> 4) + (src[off + 1] << 4);
+				start = off + 2;
+			} else {
+				size = (b0 >> 4) + (src[off + 1] << 4) + (src[off + 2] << 12);
+				start = off + 3;
+			}
+			if (type === 0) {
+				return { literals: src.subarray(start, start + size), end: start + size };
+			}
+			return { literals: new Uint8Array(size).fill(src[start]), end: start + 1 };
+		}
+		let regenerated, compressed, start;
+		const streams = format === 0 ? 1 : 4;
+		if (format < 2) {
+			const h = b0 | (src[off + 1] << 8) | (src[off + 2] << 16);
+			regenerated = (h >> 4) & 0x3FF;
+			compressed = (h >> 14) & 0x3FF;
+			start = off + 3;
+		} else if (format === 2) {
+			const h = (b0 | (src[off + 1] << 8) | (src[off + 2] << 16) | (src[off + 3] << 24)) >>> 0;
+			regenerated = (h >>> 4) & 0x3FFF;
+			compressed = (h >>> 18) & 0x3FFF;
+			start = off + 4;
+		} else {
+			const h = (b0 | (src[off + 1] << 8) | (src[off + 2] << 16) | (src[off + 3] << 24)) >>> 0;
+			regenerated = (h >>> 4) & 0x3FFFF;
+			compressed = (h >>> 22) + (src[off + 4] << 10);
+			start = off + 5;
+		}
+		const end = start + compressed;
+		if (type === 2) {
+			const ht = readHuffmanTable(src, start);
+			this.huffman = ht.table;
+			start = ht.end;
+		} else if (!this.huffman) {
+			fail("no Huffman table to repeat");
+		}
+		const literals = new Uint8Array(regenerated);
+		if (streams === 1) {
+			decodeHuffmanStream(this.huffman, src, start, end, literals, 0, regenerated);
+		} else {
+			const sizes = [src[start] | (src[start + 1] << 8), src[start + 2] | (src[start + 3] << 8), src[start + 4] | (src[start + 5] << 8)];
+			sizes.push(end - start - 6 - sizes[0] - sizes[1] - sizes[2]);
+			const per = (regenerated + 3) >> 2;
+			let pos = start + 6;
+			for (let i = 0; i < 4; i++) {
+				const n = i < 3 ? per : regenerated - 3 * per;
+				decodeHuffmanStream(this.huffman, src, pos, pos + sizes[i], literals, i * per, n);
+				pos += sizes[i];
+			}
+		}
+		return { literals: literals, end: end };
+	};
+
+	// table returns the decoding table of the mode, reading it from src[off] if needed,
+	// with the end of its description.
+	Frame.prototype.table = function (mode, src, off, previous, defaults, defaultLog, maxLog, maxSymbol) {
+		switch (mode) {
+		case 0:
+			return { table: buildFSETable(defaults, defaultLog), end: off };
+		case 1:
+			return { table: rleTable(src[off]), end: off + 1 };
+		case 2: {
+			const dist = readFSEDistribution(src, off, maxLog, maxSymbol);
+			return { table: buildFSETable(dist.counts, dist.log), end: dist.end };
+		}
+		default:
+			if (!previous) {
+				fail("no table to repeat");
+			}
+			return { table: previous, end: off };
+		}
+	};
+
+	// block decodes the compressed block src[off:end].
+	Frame.prototype.block = function (src, off, end) {
+		const lit = this.literals(src, off);
+		const literals = lit.literals;
+		off = lit.end;
+		let nbSeq = src[off++];
+		if (nbSeq >= 128) {
+			if (nbSeq === 255) {
+				nbSeq = src[off] + (src[off + 1] << 8) + 0x7F00;
+				off += 2;
+			} else {
+				nbSeq = ((nbSeq - 128) << 8) + src[off++];
+			}
+		}
+		let litPos = 0;
+		if (nbSeq > 0) {
+			const modes = src[off++];
+			let t = this.table(modes >> 6, src, off, this.ll, llDefault, 6, 9, 35);
+			this.ll = t.table;
+			t = this.table((modes >> 4) & 3, src, t.end, this.of, ofDefault, 5, 8, 31);
+			this.of = t.table;
+			t = this.table((modes >> 2) & 3, src, t.end, this.ml, mlDefault, 6, 9, 52);
+			this.ml = t.table;
+			const bits = new BackwardBits(src, t.end, end);
+			const ll = new FSEState(this.ll, bits);
+			const of = new FSEState(this.of, bits);
+			const ml = new FSEState(this.ml, bits);
+			const reps = this.reps;
+			for (let i = 0; i < nbSeq; i++) {
+				const ofCode = of.symbol();
+				const mlCode = ml.symbol();
+				const llCode = ll.symbol();
+				if (ofCode > 31 || mlCode > 52 || llCode > 35) {
+					fail("bad sequence code");
+				}
+				const ofValue = 2 ** ofCode + bits.read(ofCode);
+				const matchLength = mlBase[mlCode] + bits.read(mlBits[mlCode]);
+				const litLength = llBase[llCode] + bits.read(llBits[llCode]);
+				let offset;
+				if (ofValue > 3) {
+					offset = ofValue - 3;
+					reps[2] = reps[1];
+					reps[1] = reps[0];
+					reps[0] = offset;
+				} else {
+					const idx = ofValue - 1 + (litLength === 0 ? 1 : 0);
+					if (idx === 0) {
+						offset = reps[0];
+					} else {
+						offset = idx === 3 ? reps[0] - 1 : reps[idx];
+						if (idx !== 1) {
+							reps[2] = reps[1];
+						}
+						reps[1] = reps[0];
+						reps[0] = offset;
+					}
+				}
+				if (i < nbSeq - 1) {
+					ll.update();
+					ml.update();
+					of.update();
+				}
+				if (litPos + litLength > literals.length) {
+					fail("too many literals");
+				}
+				this.write(literals.subarray(litPos, litPos + litLength));
+				litPos += litLength;
+				if (offset < 1 || offset > this.size) {
+					fail("bad offset");
+				}
+				this.grow(matchLength);
+				const out = this.out;
+				for (let j = 0, from = this.size - offset; j < matchLength; j++) {
+					out[this.size++] = out[from + j];
+				}
+			}
+			if (bits.pos !== 0) {
+				fail("bad sequences bitstream");
+			}
+		}
+		this.write(literals.subarray(litPos));
+	};
+
+	// decompress returns the concatenated content of the frames of src.
+	function decompress(src) {
+		const parts = [];
+		let total = 0;
+		let off = 0;
+		while (off < src.length) {
+			const magic = (src[off] | (src[off + 1] << 8) | (src[off + 2] << 16) | (src[off + 3] << 24)) >>> 0;
+			off += 4;
+			if ((magic & 0xFFFFFFF0) >>> 0 === 0x184D2A50) {
+				// skippable frame
+				off += 4 + ((src[off] | (src[off + 1] << 8) | (src[off + 2] << 16) | (src[off + 3] << 24)) >>> 0);
+				continue;
+			}
+			if (magic !== frameMagic) {
+				fail("not a Zstandard frame");
+			}
+			const fhd = src[off++];
+			const single = (fhd >> 5) & 1;
+			const dictSize = [0, 1, 2, 4][fhd & 3];
+			if (dictSize !== 0) {
+				fail("dictionaries are not supported");
+			}
+			off += single ? 0 : 1;
+			const fcsSize = [single, 2, 4, 8][fhd >> 6];
+			const frame = new Frame();
+			if (fcsSize === 1) {
+				frame.grow(src[off]);
+			} else if (fcsSize === 2) {
+				frame.grow(src[off] + (src[off + 1] << 8) + 256);
+			} else if (fcsSize >= 4) {
+				frame.grow(((src[off] | (src[off + 1] << 8) | (src[off + 2] << 16) | (src[off + 3] << 24)) >>> 0) || 1);
+			}
+			off += fcsSize;
+			for (let last = 0; !last;) {
+				if (off + 3 > src.length) {
+					fail("truncated frame");
+				}
+				const h = src[off] | (src[off + 1] << 8) | (src[off + 2] << 16);
+				off += 3;
+				last = h & 1;
+				const type = (h >> 1) & 3;
+				const size = h >> 3;
+				if (size > maxBlockSize) {
+					fail("too large block");
+				}
+				if (type === 0) {
+					frame.write(src.subarray(off, off + size));
+					off += size;
+				} else if (type === 1) {
+					frame.write(new Uint8Array(size).fill(src[off]));
+					off++;
+				} else if (type === 2) {
+					frame.block(src, off, off + size);
+					off += size;
+				} else {
+					fail("reserved block type");
+				}
+			}
+			if ((fhd >> 2) & 1) {
+				off += 4;
+			}
+			parts.push(frame.out.subarray(0, frame.size));
+			total += frame.size;
+		}
+		if (parts.length === 1) {
+			return parts[0];
+		}
+		const out = new Uint8Array(total);
+		let at = 0;
+		parts.forEach(function (p) {
+			out.set(p, at);
+			at += p.length;
+		});
+		return out;
+	}
+
+	window.zstdDecompress = decompress;
+})();
@@ -0,0 +1,298 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// The audit log records who viewed which file, for the environments
+// where the access to the logs must be traceable.
+
+// auditEntry is an access of a file or stream.
+type auditEntry struct {
+	Time   time.Time `json:"ts"`
+	ID     string    `json:"id"`
+	User   string    `json:"user,omitempty"`
+	Client string    `json:"client"`
+	// Path is the URL path of the request, Source is the file (or stream) accessed.
+	Path   string `json:"path"`
+	Source string `json:"source,omitempty"`
+	Status int    `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// DurationMS is how long the access lasted, in milliseconds.
+	DurationMS int64 `json:"dur_ms"`
+}
+
+// auditFilter selects the entries of the /audit page.
+type auditFilter struct {
+	// User is the exact user, Source is a substring of the source.
+	User, Source string
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	return (f.User == "" || e.User == f.User) && strings.Contains(e.Source, f.Source)
+}
+
+// auditSink stores the audit entries.
+type auditSink interface {
+	Write(ctx context.Context, e auditEntry) error
+	// Last returns the last n entries matching the filter, the latest first.
+	Last(ctx context.Context, f auditFilter, n int) ([]auditEntry, error)
+	Close() error
+}
+
+// audit is the audit log of the server, nil if disabled.
+var audit auditSink
+
+// auditedPaths are the URL paths of the accesses of the files (and streams) that are audited.
+var auditedPaths = map[string]bool{
+	"/file": true, "/tail": true, "/raw": true, "/hexdump": true,
+	"/head": true, "/view": true, "/journal/tail": true, "/api/v1/grep": true,
+	"/api/v1/replay": true, "/diff": true, "/stats": true, "/graphql": true,
+}
+
+// audited reports whether the request accesses a file or stream:
+// also the recordings, the streams of the subscriptions, and the reads proxied to the agents.
+func audited(p string) bool {
+	if auditedPaths[p] || strings.HasPrefix(p, "/recordings/") {
+		return true
+	}
+	if rest, ok := strings.CutPrefix(p, "/api/v1/subscriptions/"); ok {
+		return strings.HasSuffix(rest, "/stream")
+	}
+	if rest, ok := strings.CutPrefix(p, "/agents/"); ok {
+		_, rest, _ = strings.Cut(rest, "/")
+		return audited("/" + rest)
+	}
+	return false
+}
+
+// auditSource returns the file (or stream) accessed by the request.
+func auditSource(r *http.Request) string {
+	q := r.URL.Query()
+	p := r.URL.Path
+	if rest, ok := strings.CutPrefix(p, "/agents/"); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		return "agent:" + name + "/" + auditQuerySource(p, q, r)
+	}
+	return auditQuerySource(p, q, r)
+}
+
+// auditQuerySource returns the source of the request of path p by its query.
+func auditQuerySource(p string, q url.Values, r *http.Request) string {
+	switch {
+	case q.Get("path") != "":
+		return q.Get("path")
+	case strings.HasSuffix(p, "/diff"):
+		return q.Get("a") + " " + q.Get("b")
+	case strings.HasSuffix(p, "/api/v1/replay"):
+		return strings.Join(q["file"], " ")
+	case strings.HasSuffix(p, "/graphql"):
+		// the query is in the body
+		return "graphql"
+	case strings.Contains(p, "/api/v1/subscriptions/"):
+		_, id, _ := strings.Cut(strings.TrimSuffix(p, "/stream"), "/api/v1/subscriptions/")
+		return "subscription:" + id
+	}
+	return streamSource(r)
+}
+
+// openAudit opens the audit log: an SQLite database for sqlite:///path/to/audit.db,
+// else a file of JSON lines.
+func openAudit(ctx context.Context, spec string) (auditSink, error) {
+	if strings.HasPrefix(spec, "sqlite:") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		db, err := sql.Open("sqlite3", "file:"+store.Path(u)+"?_busy_timeout=10000&_journal_mode=WAL")
+		if err != nil {
+			return nil, fmt.Errorf("open audit %q: %w", spec, err)
+		}
+		return newAuditDB(ctx, db)
+	}
+	fh, err := os.OpenFile(spec, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{fh: fh}, nil
+}
+
+// auditFile appends the entries to a file, one JSON object per line.
+type auditFile struct {
+	mu sync.Mutex
+	fh *os.File
+}
+
+// auditFileScan is the most bytes of the end of the audit file searched by Last.
+const auditFileScan = 32 << 20
+
+func (af *auditFile) Write(_ context.Context, e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	_, err = af.fh.Write(append(b, '\n'))
+	return err
+}
+
+func (af *auditFile) Last(ctx context.Context, f auditFilter, n int) ([]auditEntry, error) {
+	fh, err := os.Open(af.fh.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	off := max(0, fi.Size()-auditFileScan)
+	scanner := bufio.NewScanner(io.NewSectionReader(fh, off, fi.Size()-off))
+	scanner.Buffer(nil, 1<<20)
+	// keep the last n matching in a ring
+	ring := make([]auditEntry, 0, n)
+	var next int
+	for scanner.Scan() {
+		var e auditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || !f.match(e) {
+			continue
+		}
+		if len(ring) < n {
+			ring = append(ring, e)
+		} else {
+			ring[next] = e
+		}
+		next = (next + 1) % n
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	entries := make([]auditEntry, 0, len(ring))
+	for i := range ring {
+		entries = append(entries, ring[(next-1-i+2*len(ring))%len(ring)])
+	}
+	return entries, scanner.Err()
+}
+
+func (af *auditFile) Close() error { return af.fh.Close() }
+
+// auditDB stores the entries in the webtail_audit table.
+type auditDB struct{ db *sql.DB }
+
+func newAuditDB(ctx context.Context, db *sql.DB) (*auditDB, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS webtail_audit (
+  ts BIGINT NOT NULL,
+  id VARCHAR(64) NOT NULL,
+  username VARCHAR(255) NOT NULL,
+  client VARCHAR(255) NOT NULL,
+  path VARCHAR(255) NOT NULL,
+  source VARCHAR(4096) NOT NULL,
+  status INTEGER NOT NULL,
+  bytes BIGINT NOT NULL,
+  dur_ms BIGINT NOT NULL
+)`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create webtail_audit: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS webtail_audit_ts ON webtail_audit (ts)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &auditDB{db: db}, nil
+}
+
+func (ad *auditDB) Write(ctx context.Context, e auditEntry) error {
+	_, err := ad.db.ExecContext(ctx,
+		"INSERT INTO webtail_audit (ts, id, username, client, path, source, status, bytes, dur_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Time.UnixMilli(), e.ID, e.User, e.Client, e.Path, e.Source, e.Status, e.Bytes, e.DurationMS)
+	return err
+}
+
+func (ad *auditDB) Last(ctx context.Context, f auditFilter, n int) ([]auditEntry, error) {
+	rows, err := ad.db.QueryContext(ctx,
+		"SELECT ts, id, username, client, path, source, status, bytes, dur_ms FROM webtail_audit"+
+			" WHERE (? = '' OR username = ?) AND instr(source, ?) > 0 ORDER BY ts DESC LIMIT ?",
+		f.User, f.User, f.Source, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		var ts int64
+		if err := rows.Scan(&ts, &e.ID, &e.User, &e.Client, &e.Path, &e.Source, &e.Status, &e.Bytes, &e.DurationMS); err != nil {
+			return entries, err
+		}
+		e.Time = time.UnixMilli(ts)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (ad *auditDB) Close() error { return ad.db.Close() }
+
+// writeAudit records the finished access of r, if it is audited.
+func writeAudit(r *http.Request, e auditEntry) {
+	if audit == nil || !audited(r.URL.Path) {
+		return
+	}
+	e.Path, e.Source = r.URL.Path, auditSource(r)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := audit.Write(ctx, e); err != nil {
+		slog.Error("audit", "id", e.ID, "error", err)
+	}
+}
+
+// auditHandler shows the last accesses at /audit, filtered by the user= and source= parameters.
+// n= sets their number (default 200, at most 10000).
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := auditFilter{User: q.Get("user"), Source: q.Get("source")}
+	n := 200
+	if s := q.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 || n > 10000 {
+			http.Error(w, "n="+s+" must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := audit.Last(r.Context(), f, n)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("read audit", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, "audit.html", auditPage{Filter: f, Entries: entries})
+}
+
+// auditPage is the data of the audit.html template.
+type auditPage struct {
+	Filter  auditFilter
+	Entries []auditEntry
+}
+
+// Duration returns how long the access lasted.
+func (e auditEntry) Duration() time.Duration { return time.Duration(e.DurationMS) * time.Millisecond }
@@ -0,0 +1,99 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// When the OIDC issuer is unreachable, or the users file is unreadable, nobody can be authenticated.
+// With -auth-outage=closed (the default) the requests are refused with 503 Service Unavailable;
+// with -auth-outage=open the read-only (GET and HEAD) requests needing at most the viewer role
+// are allowed from the -auth-outage-network networks, everything else is still refused.
+// Both directions of the transition are logged at the error level, and each allowed request is logged.
+
+// authProbeInterval is how often an unavailable authentication backend is tried again.
+const authProbeInterval = 30 * time.Second
+
+// authOutageUser is the user of the requests allowed during an outage.
+const authOutageUser = "(auth outage)"
+
+// authOutage tracks the availability of the authentication backends.
+type authOutage struct {
+	// Open allows the viewers from the Networks during an outage.
+	Open     bool
+	Networks []netip.Prefix
+
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+// authBackend is the state of the authentication backends of the server.
+var authBackend = &authOutage{errs: make(map[string]error)}
+
+// Set records the availability of the source: unavailable with the err, available with nil.
+func (ao *authOutage) Set(source string, err error) {
+	ao.mu.Lock()
+	defer ao.mu.Unlock()
+	old := ao.errs[source]
+	if err == nil {
+		delete(ao.errs, source)
+		if old != nil {
+			slog.Error("authentication backend available again", "source", source)
+		}
+		return
+	}
+	ao.errs[source] = err
+	if old == nil {
+		slog.Error("authentication backend unavailable", "source", source, "error", err, "fail-open", ao.Open)
+	}
+}
+
+// Err returns the errors of the unavailable backends, or nil.
+func (ao *authOutage) Err() error {
+	ao.mu.Lock()
+	defer ao.mu.Unlock()
+	errs := make([]error, 0, len(ao.errs))
+	for k, err := range ao.errs {
+		errs = append(errs, fmt.Errorf("%s: %w", k, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Down reports whether the source is unavailable.
+func (ao *authOutage) Down(source string) bool {
+	ao.mu.Lock()
+	defer ao.mu.Unlock()
+	return ao.errs[source] != nil
+}
+
+// allow reports whether the unauthenticated request needing the min role is allowed during the outage.
+func (ao *authOutage) allow(r *http.Request, min role) bool {
+	if !ao.Open || min > roleViewer || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range ao.Networks {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
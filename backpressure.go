@@ -0,0 +1,135 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Backpressure of the slow clients: the lines of a stream are read into a bounded queue,
+// so a client which can not keep up never stalls the reader of the file.
+// When the queue is full, the oldest line is dropped, and the client is told
+// how many lines it has missed with a "dropped" meta event;
+// or, with the "disconnect" policy, the client is disconnected after that event.
+//
+// The lines read back from the file (from=start, offset:, lines: or a resume) are not dropped:
+// until the reader catches up with the file, it waits for the client instead.
+var (
+	// clientQueueSize is the most lines queued for a client.
+	clientQueueSize = 10_000
+	// slowClientPolicy is "drop" (the oldest lines) or "disconnect".
+	slowClientPolicy = "drop"
+)
+
+// queuedBytes is the size of the lines in all the client queues.
+var queuedBytes atomic.Int64
+
+// droppedLines is the data of the "dropped" meta event.
+type droppedLines struct {
+	Lines      int64 `json:"lines"`
+	Disconnect bool  `json:"disconnect,omitempty"`
+}
+
+// lineQueue is the bounded queue of the lines of a client.
+type lineQueue struct {
+	// ready is signaled when there are lines to take, or the queue is closed.
+	ready chan struct{}
+	// taken is signaled when lines are taken.
+	taken chan struct{}
+	// catchUp is the offset before which the lines are not dropped, but waited for.
+	catchUp int64
+
+	mu      sync.Mutex
+	lines   []Line
+	max     int
+	dropped int64
+	closed  bool
+}
+
+func newLineQueue(size int) *lineQueue {
+	return &lineQueue{ready: make(chan struct{}, 1), taken: make(chan struct{}, 1), max: max(1, size)}
+}
+
+// fill queues the lines read from in, dropping the oldest ones when the queue is full
+// (waiting for the client instead before the catchUp offset),
+// until in is closed or ctx is canceled.
+// Under memory pressure, the queue is shortened (see memoryAccountant.QueueLimit).
+func (q *lineQueue) fill(ctx context.Context, in <-chan Line) {
+	defer func() {
+		q.mu.Lock()
+		q.closed = true
+		q.mu.Unlock()
+		q.signal()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-in:
+			if !ok {
+				return
+			}
+			q.mu.Lock()
+			for line.Offset < q.catchUp && len(q.lines) >= memory.QueueLimit(q.max) && !q.closed {
+				q.mu.Unlock()
+				select {
+				case <-ctx.Done():
+					return
+				case <-q.taken:
+				}
+				q.mu.Lock()
+			}
+			if q.closed {
+				// discarded
+				q.mu.Unlock()
+				return
+			}
+			limit := memory.QueueLimit(q.max)
+			for len(q.lines) >= limit {
+				queuedBytes.Add(-int64(len(q.lines[0].Text)))
+				q.lines = q.lines[1:]
+				q.dropped++
+			}
+			q.lines = append(q.lines, line)
+			queuedBytes.Add(int64(len(line.Text)))
+			q.mu.Unlock()
+			q.signal()
+		}
+	}
+}
+
+func (q *lineQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the queued lines, the number of lines dropped since the last take,
+// and whether the queue is closed (no more lines will come).
+func (q *lineQueue) take() ([]Line, int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lines, dropped := q.lines, q.dropped
+	q.lines, q.dropped = nil, 0
+	for _, line := range lines {
+		queuedBytes.Add(-int64(len(line.Text)))
+	}
+	select {
+	case q.taken <- struct{}{}:
+	default:
+	}
+	return lines, dropped, q.closed
+}
+
+// discard the queued lines and close the queue, when the client is gone.
+func (q *lineQueue) discard() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.take()
+}
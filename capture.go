@@ -0,0 +1,378 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The agents capture the lines matching the capture rules into a bounded, persisted buffer,
+// which the aggregator fetches (/api/v1/capture) while connected,
+// and backfills from after a reconnect, so no matched line is lost during an outage.
+
+// maxCaptureBatch is the most records returned by one /api/v1/capture request.
+const maxCaptureBatch = 1000
+
+// captureSeqHeader holds the sequence number of the last captured record,
+// so the aggregator notices a restarted agent which lost its records.
+const captureSeqHeader = "Webtail-Capture-Seq"
+
+// captureRule captures the lines matching Re of the files matching Glob.
+type captureRule struct {
+	Glob string
+	Re   *regexp.Regexp
+}
+
+// parseCaptureRule parses a "glob=regexp" capture rule.
+func parseCaptureRule(s string) (captureRule, error) {
+	glob, expr, ok := strings.Cut(s, "=")
+	if !ok || glob == "" || expr == "" {
+		return captureRule{}, fmt.Errorf("capture %q: must be glob=regexp", s)
+	}
+	glob = path.Clean(glob)
+	if err := checkGlob(glob); err != nil {
+		return captureRule{}, err
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return captureRule{}, fmt.Errorf("capture %q: %w", s, err)
+	}
+	return captureRule{Glob: glob, Re: re}, nil
+}
+
+// captureRecord is a captured line.
+type captureRecord struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"ts"`
+	File string    `json:"file"`
+	Text string    `json:"text"`
+}
+
+// captureStore is the buffer of the captured lines, kept in memory,
+// and in the JSON lines file at Path (if not empty) to survive restarts.
+// Beyond Size bytes, the oldest records are dropped.
+type captureStore struct {
+	Path string
+	Size int64
+
+	mu    sync.Mutex
+	recs  []captureRecord
+	bytes int64
+	seq   uint64
+	fh    *os.File
+}
+
+// openCaptureStore returns the store, loading the persisted records from path.
+func openCaptureStore(path string, size int64) (*captureStore, error) {
+	cs := captureStore{Path: path, Size: size}
+	if path == "" {
+		return &cs, nil
+	}
+	fh, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if fh != nil {
+		scanner := bufio.NewScanner(fh)
+		scanner.Buffer(nil, maxLineSize+4096)
+		for scanner.Scan() {
+			var rec captureRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				slog.Warn("skip capture record", "file", path, "error", err)
+				continue
+			}
+			cs.recs = append(cs.recs, rec)
+			cs.bytes += int64(len(scanner.Bytes()) + 1)
+			cs.seq = max(cs.seq, rec.Seq)
+		}
+		fh.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read %q: %w", path, err)
+		}
+	}
+	if cs.fh, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640); err != nil {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+// Append the line of file to the store.
+func (cs *captureStore) Append(file string, line Line) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.seq++
+	rec := captureRecord{Seq: cs.seq, Time: line.Time, File: file, Text: line.Text}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("marshal capture", "record", rec, "error", err)
+		return
+	}
+	b = append(b, '\n')
+	cs.recs = append(cs.recs, rec)
+	cs.bytes += int64(len(b))
+	if cs.fh != nil {
+		if _, err := cs.fh.Write(b); err != nil {
+			slog.Error("write capture", "file", cs.Path, "error", err)
+		}
+	}
+	if cs.Size > 0 && cs.bytes > cs.Size {
+		cs.compact()
+	}
+}
+
+// Usage returns the bytes of the captured records.
+func (cs *captureStore) Usage() int64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.bytes
+}
+
+// compact drops the oldest records, down to 3/4 of the size, and rewrites the file.
+func (cs *captureStore) compact() {
+	var drop int
+	for cs.bytes > cs.Size*3/4 && drop < len(cs.recs) {
+		b, _ := json.Marshal(cs.recs[drop])
+		cs.bytes -= int64(len(b) + 1)
+		drop++
+	}
+	slog.Warn("capture buffer full, dropping the oldest records", "dropped", drop)
+	cs.recs = append(cs.recs[:0:0], cs.recs[drop:]...)
+	if cs.fh == nil {
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range cs.recs {
+		enc.Encode(rec)
+	}
+	tmp := cs.Path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o640); err != nil {
+		slog.Error("compact capture", "file", tmp, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, cs.Path); err != nil {
+		slog.Error("compact capture", "file", cs.Path, "error", err)
+		return
+	}
+	fh, err := os.OpenFile(cs.Path, os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		slog.Error("reopen capture", "file", cs.Path, "error", err)
+		return
+	}
+	cs.fh.Close()
+	cs.fh = fh
+}
+
+// After returns the records after the seq, at most n of them,
+// and the sequence number of the last record.
+func (cs *captureStore) After(seq uint64, n int) ([]captureRecord, uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	i := sort.Search(len(cs.recs), func(i int) bool { return cs.recs[i].Seq > seq })
+	recs := cs.recs[i:min(len(cs.recs), i+n)]
+	return append(make([]captureRecord, 0, len(recs)), recs...), cs.seq
+}
+
+// ServeHTTP returns the records after the "after" sequence number as JSON.
+func (cs *captureStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if s := r.URL.Query().Get("after"); s != "" {
+		var err error
+		if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("after=%q: %v", s, err), http.StatusBadRequest)
+			return
+		}
+	}
+	recs, last := cs.After(after, maxCaptureBatch)
+	w.Header().Set(captureSeqHeader, strconv.FormatUint(last, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
+
+// runCapture tails the files of the rules (the existing ones from their end),
+// and appends the matching lines to cs, until ctx is canceled.
+func runCapture(ctx context.Context, cs *captureStore, root string, FS fs.FS, rules []captureRule) {
+	globs := make([]string, len(rules))
+	for i, rule := range rules {
+		globs[i] = rule.Glob
+	}
+	tailGlobs(ctx, root, FS, globs, func(i int, fn string, line Line) {
+		if rules[i].Re.MatchString(line.Text) {
+			cs.Append(fn, line)
+		}
+	})
+}
+
+// tailGlobs tails the files matching the globs (the existing ones from their end),
+// calling handle with the index of the glob, the file and each new line, until ctx is canceled.
+// The globs are rescanned every few seconds for new files.
+//
+// The lines of a file of a glob are handled sequentially.
+func tailGlobs(ctx context.Context, root string, FS fs.FS, globs []string, handle func(i int, fn string, line Line)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	type globFile struct {
+		i  int
+		fn string
+	}
+	// the files tailed; a file is tailed again (from its start) after its tail ended, as it has been rotated
+	var mu sync.Mutex
+	tailed := make(map[globFile]struct{})
+	scan := func(first bool) {
+		for i, glob := range globs {
+			matches, err := fs.Glob(FS, glob)
+			if err != nil {
+				slog.Warn("tail glob", "glob", glob, "error", err)
+			}
+			for _, fn := range matches {
+				key := globFile{i: i, fn: fn}
+				mu.Lock()
+				_, ok := tailed[key]
+				mu.Unlock()
+				if ok {
+					continue
+				}
+				fh, _, err := openTail(root, FS, fn)
+				if err != nil {
+					slog.Warn("tail glob", "file", fn, "error", err)
+					continue
+				}
+				mu.Lock()
+				tailed[key] = struct{}{}
+				mu.Unlock()
+				var off int64
+				if first {
+					if off, err = fh.Seek(0, io.SeekEnd); err != nil {
+						slog.Warn("tail glob", "file", fn, "error", err)
+						off = 0
+					}
+				}
+				ch := make(chan Line)
+				go tailFileFrom(ctx, ch, fh, defaultPoll, off)
+				wg.Add(1)
+				go func(i int, fn string) {
+					defer wg.Done()
+					for line := range ch {
+						handle(i, fn, line)
+					}
+					mu.Lock()
+					delete(tailed, key)
+					mu.Unlock()
+				}(i, fn)
+			}
+		}
+	}
+	scan(true)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scan(false)
+		}
+	}
+}
+
+// captureInterval is the poll interval of the captured lines of the agents.
+const captureInterval = 2 * time.Second
+
+// backfill copies the lines captured by the agent into its "@agent/<name>/capture" virtual file,
+// starting after the last one copied (before a reconnect), while the agent is connected.
+func (ar *agentRegistry) backfill(ctx context.Context, ac *agentConn) {
+	name := ac.Info.Name
+	vf, err := virtualFiles.GetOnHost(virtualName("agent", name, "capture"), name)
+	if err != nil {
+		slog.Error("agent capture", "name", name, "error", err)
+		return
+	}
+	client := &http.Client{Transport: ac.proxy.Transport}
+	for {
+		ar.mu.Lock()
+		after := ar.captured[name]
+		ar.mu.Unlock()
+		recs, last, err := fetchCapture(ctx, client, after)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, errNoCapture) {
+				return
+			}
+			slog.Warn("fetch capture", "agent", name, "error", err)
+		} else if last < after {
+			slog.Warn("the agent has lost its captured lines, starting over", "agent", name, "after", after, "last", last)
+			ar.mu.Lock()
+			ar.captured[name] = 0
+			ar.mu.Unlock()
+			continue
+		}
+		for _, rec := range recs {
+			vf.Append("[" + rec.File + "] " + rec.Text)
+		}
+		if len(recs) != 0 {
+			if after == 0 || recs[0].Seq > after+1 {
+				slog.Info("capture backfill", "agent", name, "after", after, "first", recs[0].Seq, "n", len(recs))
+			}
+			ar.mu.Lock()
+			ar.captured[name] = recs[len(recs)-1].Seq
+			ar.mu.Unlock()
+			if len(recs) == maxCaptureBatch {
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(captureInterval):
+		}
+	}
+}
+
+// errNoCapture is returned by fetchCapture when the agent does not capture.
+var errNoCapture = errors.New("the agent does not capture")
+
+// fetchCapture returns the records captured by the agent after the seq,
+// and the sequence number of its last record.
+func fetchCapture(ctx context.Context, client *http.Client, after uint64) ([]captureRecord, uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://agent/api/v1/capture?after="+strconv.FormatUint(after, 10), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, 0, errNoCapture
+	default:
+		return nil, 0, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	last, err := strconv.ParseUint(resp.Header.Get(captureSeqHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %s: %w", req.URL, captureSeqHeader, err)
+	}
+	var recs []captureRecord
+	err = json.NewDecoder(resp.Body).Decode(&recs)
+	return recs, last, err
+}
@@ -0,0 +1,230 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// wireCodec encodes the events of a stream for the machine consumers,
+// one frame (a WebSocket message, or an NDJSON line) per event.
+//
+// The line events are annotatedEvent, the meta events are metaEvent,
+// so the frames of the meta events are those with a "kind".
+type wireCodec interface {
+	// Binary reports whether the frames are binary (sent as binary WebSocket messages).
+	Binary() bool
+	// Encode returns the frame of an annotatedEvent or a metaEvent.
+	Encode(ev any) ([]byte, error)
+}
+
+var codecs = make(map[string]wireCodec)
+
+// registerCodec registers the codec under name, for the codec=name parameter of the streams.
+// It panics if the name is empty or already registered.
+func registerCodec(name string, c wireCodec) {
+	if name == "" {
+		panic("codec name is empty")
+	}
+	if _, ok := codecs[name]; ok {
+		panic(fmt.Sprintf("codec %q is already registered", name))
+	}
+	codecs[name] = c
+}
+
+// codecNames returns the sorted names of the registered codecs.
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for k := range codecs {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func init() {
+	registerCodec("json", jsonCodec{})
+	registerCodec("cbor", cborCodec{})
+	registerCodec("msgpack", msgpackCodec{})
+	registerCodec("protobuf", protobufCodec{})
+}
+
+// jsonCodec encodes the events as JSON (NDJSON over HTTP).
+type jsonCodec struct{}
+
+func (jsonCodec) Binary() bool                  { return false }
+func (jsonCodec) Encode(ev any) ([]byte, error) { return json.Marshal(ev) }
+
+// cborCodec encodes the events as CBOR (RFC 8949) maps, with the keys of the JSON encoding.
+type cborCodec struct{}
+
+func (cborCodec) Binary() bool                  { return true }
+func (cborCodec) Encode(ev any) ([]byte, error) { return cbor.Marshal(ev) }
+
+// msgpackCodec encodes the events as MessagePack maps, with the keys of the JSON encoding.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Binary() bool { return true }
+func (msgpackCodec) Encode(ev any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+	err := enc.Encode(ev)
+	return buf.Bytes(), err
+}
+
+// protobufCodec encodes the events as this protobuf message:
+//
+//	message Event {
+//	  // line events
+//	  string text = 1;
+//	  optional int64 offset = 2;
+//	  int64 lineno = 3;
+//	  int64 ts_unix_nano = 4;
+//	  string instance = 5;
+//	  map<string, string> fields = 8;
+//	  // meta events
+//	  string kind = 6;
+//	  bytes data_json = 7;
+//	}
+type protobufCodec struct{}
+
+func (protobufCodec) Binary() bool { return true }
+func (protobufCodec) Encode(ev any) ([]byte, error) {
+	var b []byte
+	appendString := func(num protowire.Number, s string) {
+		if s != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	appendInt := func(num protowire.Number, i int64) {
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(i))
+	}
+	switch ev := ev.(type) {
+	case annotatedEvent:
+		appendString(1, ev.Text)
+		if ev.Offset != nil {
+			appendInt(2, *ev.Offset)
+		}
+		if ev.LineNo != 0 {
+			appendInt(3, ev.LineNo)
+		}
+		if ev.Time != nil {
+			appendInt(4, ev.Time.UnixNano())
+		}
+		appendString(5, ev.Instance)
+		for _, k := range slices.Sorted(maps.Keys(ev.Fields)) {
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendString(entry, k)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, ev.Fields[k])
+			b = protowire.AppendTag(b, 8, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+	case metaEvent:
+		appendString(6, ev.Kind)
+		data, err := json.Marshal(ev.Data)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	default:
+		return nil, fmt.Errorf("protobuf: unknown event %T", ev)
+	}
+	return b, nil
+}
+
+// ndjsonSink writes the events as newline delimited frames of a text codec,
+// and an empty line as the heartbeat.
+type ndjsonSink struct {
+	*httpSink
+	codec  wireCodec
+	opts   sseOptions
+	format func(Line) string
+}
+
+func (ns *ndjsonSink) Event(lines []Line) { ns.write(ns.opts.annotate(lines, ns.format)) }
+func (ns *ndjsonSink) Meta(ev metaEvent)  { ns.write(ev) }
+func (ns *ndjsonSink) Ping()              { ns.bw.WriteByte('\n') }
+
+func (ns *ndjsonSink) write(ev any) {
+	b, err := ns.codec.Encode(ev)
+	if err != nil {
+		slog.Error("encode", "event", ev, "error", err)
+		return
+	}
+	ns.bw.Write(b)
+	ns.bw.WriteByte('\n')
+}
+
+// wsSink sends the events as WebSocket messages, one frame each.
+type wsSink struct {
+	ctx    context.Context
+	c      *websocket.Conn
+	codec  wireCodec
+	opts   sseOptions
+	format func(Line) string
+	frames [][]byte
+	ping   bool
+}
+
+func (ws *wsSink) Event(lines []Line) { ws.write(ws.opts.annotate(lines, ws.format)) }
+func (ws *wsSink) Meta(ev metaEvent)  { ws.write(ev) }
+func (ws *wsSink) Ping()              { ws.ping = true }
+func (ws *wsSink) Pending() bool      { return len(ws.frames) != 0 || ws.ping }
+
+func (ws *wsSink) write(ev any) {
+	b, err := ws.codec.Encode(ev)
+	if err != nil {
+		slog.Error("encode", "event", ev, "error", err)
+		return
+	}
+	ws.frames = append(ws.frames, b)
+}
+
+// Flush sends the frames, or a ping if there are none.
+func (ws *wsSink) Flush() error {
+	timeout := 2 * heartbeatInterval
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ws.ctx, timeout)
+	defer cancel()
+	typ := websocket.MessageText
+	if ws.codec.Binary() {
+		typ = websocket.MessageBinary
+	}
+	if ws.ping && len(ws.frames) == 0 {
+		ws.ping = false
+		return ws.c.Ping(ctx)
+	}
+	ws.ping = false
+	for i, b := range ws.frames {
+		if err := ws.c.Write(ctx, typ, b); err != nil {
+			ws.frames = ws.frames[:0]
+			return err
+		}
+		ws.frames[i] = nil
+	}
+	ws.frames = ws.frames[:0]
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// With compress=zstd, the events of an SSE stream are batched (flushed every two seconds,
+// or after every read with nobuffer=1), and each batch is sent as one "zstd" event:
+// the Server Sent Events of the batch compressed into a Zstandard frame, in base64.
+// The viewer decodes them with zstd.js, and dispatches the events within,
+// so a chatty log costs a fraction of the bandwidth for the remote users.
+//
+// The id of the "zstd" event is the id of its last event, for resuming the stream.
+// The heartbeats are not compressed.
+
+// zstdEncoder compresses the batches; EncodeAll is safe for concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+
+// zstdSink collects the events of an sseSink, and sends them compressed when flushed.
+type zstdSink struct {
+	*sseSink
+	// out is the response, the sseSink writes to buf.
+	out *httpSink
+	buf bytes.Buffer
+	// frame is the compressed batch, reused.
+	frame []byte
+}
+
+func newZstdSink(hs *httpSink, opts sseOptions, format func(Line) string) *zstdSink {
+	zs := &zstdSink{out: hs}
+	inner := &httpSink{rc: hs.rc, dw: hs.dw, bw: bufio.NewWriter(&zs.buf)}
+	zs.sseSink = &sseSink{httpSink: inner, opts: opts, format: format}
+	return zs
+}
+
+func (zs *zstdSink) Ping() { zs.out.bw.WriteString(": ping\n\n") }
+
+func (zs *zstdSink) Pending() bool {
+	return zs.bw.Buffered() != 0 || zs.buf.Len() != 0 || zs.out.Pending()
+}
+
+func (zs *zstdSink) Flush() error {
+	if err := zs.bw.Flush(); err != nil {
+		return err
+	}
+	if batch := zs.buf.Bytes(); len(batch) != 0 {
+		zs.frame = zstdEncoder.EncodeAll(batch, zs.frame[:0])
+		bw := zs.out.bw
+		bw.WriteString("event: zstd\n")
+		if id := lastEventID(batch); id != nil {
+			bw.WriteString("id: ")
+			bw.Write(id)
+			bw.WriteByte('\n')
+		}
+		bw.WriteString("data: ")
+		enc := base64.NewEncoder(base64.StdEncoding, bw)
+		enc.Write(zs.frame)
+		enc.Close()
+		bw.WriteString("\n\n")
+		zs.buf.Reset()
+	}
+	return zs.out.Flush()
+}
+
+// lastEventID returns the id of the last event of the Server Sent Events with an id, or nil.
+func lastEventID(events []byte) []byte {
+	start := bytes.LastIndex(events, []byte("\nid: ")) + 1
+	if start == 0 && !bytes.HasPrefix(events, []byte("id: ")) {
+		return nil
+	}
+	id := events[start+len("id: "):]
+	if i := bytes.IndexByte(id, '\n'); i >= 0 {
+		id = id[:i]
+	}
+	return id
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// wsOriginPatterns are the host patterns of the origins allowed to open the WebSocket streams,
+// besides the same origin.
+var wsOriginPatterns []string
+
+// corsPath reports whether the path is served to other origins:
+// the SSE streams and the JSON APIs.
+func corsPath(p string) bool {
+	return p == "/tail" || p == "/journal/tail" || strings.HasPrefix(p, "/api/")
+}
+
+// withCORS allows the origins ("*" for any) to use the SSE stream and the JSON APIs,
+// answering the preflight requests itself.
+func withCORS(origins []string, h http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return h
+	}
+	anyOrigin := slices.Contains(origins, "*")
+	for _, o := range origins {
+		if u, err := url.Parse(o); err == nil && u.Host != "" {
+			o = u.Host
+		}
+		wsOriginPatterns = append(wsOriginPatterns, o)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		hdr := w.Header()
+		hdr.Add("Vary", "Origin")
+		if !anyOrigin && !slices.Contains(origins, origin) {
+			if r.Method == http.MethodOptions {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if anyOrigin {
+			hdr.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			hdr.Set("Access-Control-Allow-Origin", origin)
+			hdr.Set("Access-Control-Allow-Credentials", "true")
+		}
+		hdr.Set("Access-Control-Expose-Headers", "X-Request-ID")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			hdr.Add("Vary", "Access-Control-Request-Method")
+			hdr.Add("Vary", "Access-Control-Request-Headers")
+			hdr.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if reqHdrs := r.Header.Get("Access-Control-Request-Headers"); reqHdrs != "" {
+				hdr.Set("Access-Control-Allow-Headers", reqHdrs)
+			} else {
+				hdr.Set("Access-Control-Allow-Headers", "Last-Event-ID, Content-Type, Authorization")
+			}
+			hdr.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
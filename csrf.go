@@ -0,0 +1,44 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// The admin forms are protected from cross-site requests (which the browser would send
+// with the Basic credentials or the session cookie of the admin) by a double-submit token:
+// a random value in a SameSite cookie, repeated in a hidden field of the forms.
+
+// csrfCookie is the cookie of the CSRF token.
+const csrfCookie = "webtail_csrf"
+
+// csrfToken returns the CSRF token of the client, setting a new one if it has none,
+// to be sent back in the csrf field of the forms.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+	var a [16]byte
+	rand.Read(a[:])
+	token := hex.EncodeToString(a[:])
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookie, Value: token, Path: "/",
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF reports whether the csrf field of the form posted is the token of the cookie.
+func checkCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || len(c.Value) != 32 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(c.Value)) == 1
+}
@@ -0,0 +1,292 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The paginated JSON API returns opaque cursors instead of offsets, so a scripted consumer
+// walking a big tree gets consistent pages while the directories change underneath:
+// the next page starts after the last item of the previous one, not at its index.
+//
+// The cursor of the next page is in the X-Next-Cursor header and the "next" Link,
+// passed back as cursor=; the last page has none.
+
+// pageCursor is the position after the last item of a page.
+type pageCursor struct {
+	// Kind is what the cursor pages: "files" or "grep".
+	Kind string `json:"k"`
+	// After is the last path of a page of files.
+	After string `json:"a,omitempty"`
+	// Offset is where the next page of the grep starts, in the file of Size.
+	Offset int64 `json:"o,omitempty"`
+	Size   int64 `json:"s,omitempty"`
+	// Head is the checksum of the start of the file, Query that of the query of the grep.
+	Head  uint32 `json:"h,omitempty"`
+	Query uint32 `json:"q,omitempty"`
+}
+
+// errCursorExpired is returned for a grep cursor of a file that has been truncated or replaced since,
+// or of another query.
+var errCursorExpired = errors.New("the cursor has expired")
+
+// queryChecksum returns the checksum of the parameters of a query.
+func queryChecksum(params ...string) uint32 {
+	return crc32.ChecksumIEEE([]byte(strings.Join(params, "\x00")))
+}
+
+// Encode returns the cursor as an opaque token.
+func (pc pageCursor) Encode() string {
+	b, _ := json.Marshal(pc)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses the token of the kind of cursor.
+func decodeCursor(token, kind string) (pageCursor, error) {
+	var pc pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(b, &pc)
+	}
+	if err != nil || pc.Kind != kind || pc.Offset < 0 {
+		return pc, fmt.Errorf("cursor %q: not a cursor of %s", token, kind)
+	}
+	return pc, nil
+}
+
+// setNextCursor sets the headers of the next page of r.
+func setNextCursor(w http.ResponseWriter, r *http.Request, pc pageCursor) {
+	token := pc.Encode()
+	q := r.URL.Query()
+	q.Set("cursor", token)
+	w.Header().Set("X-Next-Cursor", token)
+	w.Header().Add("Link", "<"+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+}
+
+// parseLimit parses the limit= page size, def if missing.
+func parseLimit(r *http.Request, def, most int) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > most {
+		return 0, fmt.Errorf("limit=%q must be between 1 and %d", s, most)
+	}
+	return n, nil
+}
+
+// grepWindow limits a grep to the lines with timestamps between Since and Until (unbounded if zero),
+// the lines without a timestamp taking that of the line before them.
+type grepWindow struct {
+	Since, Until time.Time
+	ts           *mergeOptions
+	// at is the timestamp of the last line
+	at time.Time
+}
+
+// parseGrepWindow parses the since, until and ts-layout (default RFC 3339) query parameters,
+// nil without since and until.
+func parseGrepWindow(q url.Values) (*grepWindow, error) {
+	if q.Get("since") == "" && q.Get("until") == "" {
+		return nil, nil
+	}
+	gw := grepWindow{ts: newTimestampLayout(q.Get("ts-layout"))}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if gw.Since, err = parseReplayTime(s); err != nil {
+			return nil, fmt.Errorf("since: %w", err)
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if gw.Until, err = parseReplayTime(s); err != nil {
+			return nil, fmt.Errorf("until: %w", err)
+		}
+	}
+	return &gw, nil
+}
+
+// place returns whether the line is before (-1), within (0) or after (1) the window.
+// The lines before the first timestamp are within.
+func (gw *grepWindow) place(text string) int {
+	if t, ok := gw.ts.timestamp(text); ok {
+		gw.at = t
+	}
+	switch {
+	case gw.at.IsZero():
+		return 0
+	case !gw.Since.IsZero() && gw.at.Before(gw.Since):
+		return -1
+	case !gw.Until.IsZero() && gw.at.After(gw.Until):
+		return 1
+	}
+	return 0
+}
+
+// grepLines returns at most n lines of fh matching re (within the window gw, if not nil),
+// from the offset off, and the offset to continue from, -1 after the end of the window.
+// It scans at most grepMaxScan bytes, so a page may end early, with fewer lines.
+func grepLines(ctx context.Context, fh *os.File, re *regexp.Regexp, gw *grepWindow, off int64, n int) ([]Line, int64, error) {
+	var found []Line
+	start := off
+	for len(found) < n && off-start < grepMaxScan {
+		lines, next, err := readLines(ctx, fh, off, 1000)
+		if err != nil {
+			return found, off, err
+		}
+		if len(lines) == 0 {
+			break
+		}
+		for _, line := range lines {
+			if len(found) == n {
+				next = line.Offset
+				break
+			}
+			if gw != nil {
+				if place := gw.place(line.Text); place < 0 {
+					continue
+				} else if place > 0 {
+					// the lines of a log are written in order
+					return found, -1, nil
+				}
+			}
+			if line.Text = redactions.Redact(line.Text); re.MatchString(line.Text) {
+				found = append(found, line)
+			}
+		}
+		off = next
+	}
+	return found, off, nil
+}
+
+// grepCursor returns the cursor continuing the grep of fh at off, or false at its end.
+// The query is the checksum of the parameters of the grep.
+func grepCursor(fh *os.File, off int64, query uint32) (pageCursor, bool) {
+	if off < 0 {
+		return pageCursor{}, false
+	}
+	fi, err := fh.Stat()
+	if err != nil || off >= fi.Size() {
+		return pageCursor{}, false
+	}
+	// the start of the file identifies it across the rotations
+	head, err := headSum(fh, min(fi.Size(), indexHeadSize))
+	if err != nil {
+		return pageCursor{}, false
+	}
+	return pageCursor{Kind: "grep", Offset: off, Size: fi.Size(), Head: head, Query: query}, true
+}
+
+// grepStart returns the offset of the grep of fh to start from: that of the cursor token, or 0.
+// The cursor has expired (errCursorExpired) if the file has been truncated or replaced since,
+// or it is of another query.
+func grepStart(fh *os.File, token string, query uint32) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	pc, err := decodeCursor(token, "grep")
+	if err != nil {
+		return 0, err
+	}
+	if pc.Query != query {
+		return 0, fmt.Errorf("%w: it is of another query", errCursorExpired)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	} else if fi.Size() < pc.Size {
+		return 0, fmt.Errorf("%w: the file has been truncated", errCursorExpired)
+	}
+	if head, err := headSum(fh, min(pc.Size, indexHeadSize)); err != nil {
+		return 0, err
+	} else if head != pc.Head {
+		return 0, fmt.Errorf("%w: the file has been replaced", errCursorExpired)
+	}
+	return pc.Offset, nil
+}
+
+// grepLine is a line of the /api/v1/grep results.
+type grepLine struct {
+	Text   string `json:"text"`
+	Offset int64  `json:"offset"`
+	No     int64  `json:"lineno,omitempty"`
+}
+
+// grepHandler returns the lines of the path= file matching the pattern= regexp as a JSON array,
+// limit= (default 100, at most 1000) lines per page.
+// With since= and/or until=, only the lines with timestamps (in ts-layout) within them are returned,
+// the first page seeking to since with the -time-index.
+func grepHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		n, err := parseLimit(r, 100, maxGraphQLPage)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		re, err := regexp.Compile(q.Get("pattern"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fn := cleanGraphQLPath(q.Get("path"))
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer fh.Close()
+		query := queryChecksum(q.Get("pattern"), q.Get("since"), q.Get("until"), q.Get("ts-layout"))
+		off, err := grepStart(fh, q.Get("cursor"), query)
+		if err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, errCursorExpired) {
+				code = http.StatusGone
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		gw, err := parseGrepWindow(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if gw != nil && q.Get("cursor") == "" {
+			if off, err = timeIndex.Seek(r.Context(), fn, fh, gw.ts, gw.Since); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		lines, next, err := grepLines(r.Context(), fh, re, gw, off, n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAttrs(r.Context(), "file", fn, "offset", off, "lines", len(lines))
+		if pc, ok := grepCursor(fh, next, query); ok {
+			setNextCursor(w, r, pc)
+		}
+		res := make([]grepLine, len(lines))
+		for i, line := range lines {
+			res[i] = grepLine{Text: line.Text, Offset: line.Offset, No: line.No}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// demoName is the name of the demo source in /tail?file=.
+const demoName = "@demo"
+
+const (
+	// maxDemoBurst is the most lines of a burst.
+	maxDemoBurst = 100_000
+	// maxDemoGiant is the largest giant line: enough to exceed any sane -max-line-size.
+	maxDemoGiant = 16 << 20
+)
+
+// demoSource writes a line per second into a temporary log file,
+// and can be told to misbehave, to exercise the UI and the clients'
+// reconnect logic.
+type demoSource struct {
+	dir string
+
+	mu      sync.Mutex
+	fh      *os.File
+	seq     int
+	silence time.Time
+}
+
+// newDemoSource creates the demo log file in a new temporary directory.
+func newDemoSource() (*demoSource, error) {
+	dir, err := os.MkdirTemp("", "webtail-demo-")
+	if err != nil {
+		return nil, err
+	}
+	ds := demoSource{dir: dir}
+	if ds.fh, err = os.Create(ds.Path()); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &ds, nil
+}
+
+// Path of the current demo log file.
+func (ds *demoSource) Path() string { return filepath.Join(ds.dir, "demo.log") }
+
+// Open the current demo log file for tailing.
+func (ds *demoSource) Open() (*os.File, error) { return os.Open(ds.Path()) }
+
+// Run writes the lines until ctx is canceled, then removes the files.
+func (ds *demoSource) Run(ctx context.Context) error {
+	defer os.RemoveAll(ds.dir)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ds.mu.Lock()
+			ds.fh.Close()
+			ds.mu.Unlock()
+			return nil
+		case now := <-ticker.C:
+			ds.mu.Lock()
+			var err error
+			if now.After(ds.silence) {
+				err = ds.writeLines(1, 0)
+			}
+			ds.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeLines writes n lines, each padded to at least size bytes. Must be called with mu held.
+func (ds *demoSource) writeLines(n, size int) error {
+	bw := bufio.NewWriter(ds.fh)
+	levels := [...]string{"DEBUG", "INFO", "INFO", "INFO", "WARN", "ERROR"}
+	for range n {
+		ds.seq++
+		line := fmt.Sprintf("%s %-5s demo line %d",
+			time.Now().Format(time.RFC3339Nano), levels[rand.IntN(len(levels))], ds.seq)
+		bw.WriteString(line)
+		if pad := size - len(line); pad > 0 {
+			bw.WriteByte(' ')
+			bw.WriteString(strings.Repeat("x", pad-1))
+		}
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP executes the POST /dev/chaos/{action} requests:
+//
+//   - rotate: rename the log to demo.log.1 and start a new one
+//   - truncate: truncate the log to zero length
+//   - burst?n=N: write N (default 1000, at most 100000) lines at once
+//   - silence?for=D: stop writing for D (default 30s)
+//   - giant?size=S: write one line of S (default 1MiB, at most 16MiB) bytes
+func (ds *demoSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	action := r.PathValue("action")
+	slog.Warn("chaos", "action", action, "query", r.URL.RawQuery)
+	var err error
+	switch action {
+	case "rotate":
+		ds.fh.Close()
+		if err = os.Rename(ds.Path(), ds.Path()+".1"); err == nil {
+			ds.fh, err = os.Create(ds.Path())
+		}
+	case "truncate":
+		if err = ds.fh.Truncate(0); err == nil {
+			_, err = ds.fh.Seek(0, 0)
+		}
+	case "burst":
+		n := 1000
+		if s := r.FormValue("n"); s != "" {
+			if n, err = strconv.Atoi(s); err != nil {
+				break
+			}
+			if n < 1 || n > maxDemoBurst {
+				err = fmt.Errorf("n=%d: must be between 1 and %d", n, maxDemoBurst)
+				break
+			}
+		}
+		err = ds.writeLines(n, 0)
+	case "silence":
+		d := 30 * time.Second
+		if s := r.FormValue("for"); s != "" {
+			if d, err = time.ParseDuration(s); err != nil {
+				break
+			}
+		}
+		ds.silence = time.Now().Add(d)
+	case "giant":
+		size := 1 << 20
+		if s := r.FormValue("size"); s != "" {
+			if size, err = strconv.Atoi(s); err != nil {
+				break
+			}
+			if size < 1 || size > maxDemoGiant {
+				err = fmt.Errorf("size=%d: must be between 1 and %d", size, maxDemoGiant)
+				break
+			}
+		}
+		err = ds.writeLines(1, size)
+	default:
+		http.Error(w, "unknown action "+action, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,379 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+const (
+	// maxDiffSize is the most bytes of a side of a diff.
+	maxDiffSize = 4 << 20
+	// maxDiffEdits is the most deleted and inserted lines of a diff.
+	maxDiffEdits = 2000
+	// diffContext is the default number of the unchanged lines around the changes.
+	diffContext = 3
+)
+
+// errTooDifferent is returned for the sides differing in more than maxDiffEdits lines.
+var errTooDifferent = fmt.Errorf("more than %d lines differ", maxDiffEdits)
+
+// diffSide is a side of a diff: a file, or a byte range of it.
+type diffSide struct {
+	Path string
+	// From and To are the byte range, To is -1 for the end of the file.
+	From, To int64
+	// Range is whether the range is given, not the whole file.
+	Range bool
+	Lines []string
+}
+
+// parseDiffSide parses the key (a or b), key-from and key-to query parameters.
+func parseDiffSide(q url.Values, key, def string) (diffSide, error) {
+	side := diffSide{Path: path.Clean(cmp.Or(q.Get(key), def)), To: -1, Range: q.Get(key+"-from") != "" || q.Get(key+"-to") != ""}
+	var err error
+	if side.From, err = parsePageParam(q, key+"-from", 0); err != nil {
+		return side, err
+	}
+	if q.Get(key+"-to") != "" {
+		if side.To, err = parsePageParam(q, key+"-to", 0); err != nil {
+			return side, err
+		}
+		if side.To < side.From {
+			return side, fmt.Errorf("%s-to=%d is before %s-from=%d", key, side.To, key, side.From)
+		}
+	}
+	return side, nil
+}
+
+// read reads the lines of the side, from the first line starting in its range
+// (as /view) to the last one starting before its end.
+// It returns the HTTP status code with the error.
+func (side *diffSide) read(ctx context.Context, root string, FS fs.FS) (int, error) {
+	fh, code, err := openTail(root, FS, side.Path)
+	if err != nil {
+		return code, err
+	}
+	defer fh.Close()
+	if binary, _ := isBinary(fh); binary {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("%q is binary", side.Path)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if side.To < 0 || side.To > fi.Size() {
+		side.To = fi.Size()
+	}
+	if side.From > side.To {
+		return http.StatusBadRequest, fmt.Errorf("%q: the range starts after its end (%d)", side.Path, side.To)
+	}
+	if side.To-side.From > maxDiffSize {
+		return http.StatusUnprocessableEntity, fmt.Errorf("%q: %d bytes, more than the %d bytes of a diff; narrow its range",
+			side.Path, side.To-side.From, maxDiffSize)
+	}
+	off, err := lineStartAfter(ctx, fh, side.From)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for off < side.To {
+		lines, next, err := readLines(ctx, fh, off, 1024)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		for _, line := range lines {
+			if line.Offset >= side.To {
+				break
+			}
+			side.Lines = append(side.Lines, redactions.Redact(line.Text))
+		}
+		if next == off {
+			break
+		}
+		off = next
+	}
+	return http.StatusOK, nil
+}
+
+// title of the side in the headers of the diff.
+func (side diffSide) title() string {
+	if !side.Range {
+		return side.Path
+	}
+	return fmt.Sprintf("%s (bytes %d-%d)", side.Path, side.From, side.To)
+}
+
+// diffOp is a line of the edit script: ' ' kept, '-' deleted from a, or '+' inserted from b,
+// with the indexes of the line in a and b (the next ones for the deleted and inserted lines).
+type diffOp struct {
+	Kind byte
+	A, B int
+}
+
+// diffLines returns the edit script turning the lines a into b (with Myers' algorithm),
+// or errTooDifferent if they differ in more than maxEdits lines.
+func diffLines(a, b []string, maxEdits int) ([]diffOp, error) {
+	// the common prefix and suffix are kept
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(ma), len(mb)
+	// at most n+m edits are needed, more than maxEdits are not searched for
+	limit := min(n+m, maxEdits)
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] is v[-d-1..d+1] before the d-th step, for the backtracking
+	var trace [][]int
+	var done bool
+	for d := 0; d <= limit && !done; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && ma[x] == mb[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+	}
+	if !done {
+		return nil, errTooDifferent
+	}
+
+	// backtrack, building the script of the middle reversed
+	var rev []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		vd := trace[d]
+		get := func(k int) int { return vd[k+d+1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && get(k-1) < get(k+1) {
+			prevK = k + 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			rev = append(rev, diffOp{Kind: ' ', A: pre + x, B: pre + y})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				rev = append(rev, diffOp{Kind: '+', A: pre + x, B: pre + y})
+			} else {
+				x--
+				rev = append(rev, diffOp{Kind: '-', A: pre + x, B: pre + y})
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, pre+len(rev)+suf)
+	for i := range pre {
+		ops = append(ops, diffOp{Kind: ' ', A: i, B: i})
+	}
+	for i := len(rev) - 1; i >= 0; i-- {
+		ops = append(ops, rev[i])
+	}
+	for i := range suf {
+		ops = append(ops, diffOp{Kind: ' ', A: len(a) - suf + i, B: len(b) - suf + i})
+	}
+	return ops, nil
+}
+
+// diffHunk is a group of changes with their context.
+type diffHunk struct {
+	Ops []diffOp
+}
+
+// Header returns the "@@ -a,n +b,m @@" header of the hunk.
+func (h diffHunk) Header() string {
+	var aLen, bLen int
+	for _, op := range h.Ops {
+		if op.Kind != '+' {
+			aLen++
+		}
+		if op.Kind != '-' {
+			bLen++
+		}
+	}
+	// the ranges start at the line before an empty one
+	aStart, bStart := h.Ops[0].A, h.Ops[0].B
+	if aLen != 0 {
+		aStart++
+	}
+	if bLen != 0 {
+		bStart++
+	}
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)
+}
+
+// diffHunks groups the changes of the script into hunks, with the around unchanged lines around them.
+func diffHunks(ops []diffOp, around int) []diffHunk {
+	var hunks []diffHunk
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == ' ' {
+			i++
+			continue
+		}
+		start := max(0, i-around)
+		// the end of the changes closer than 2*around to each other
+		end, kept := i, 0
+		for j := i; j < len(ops) && kept <= 2*around; j++ {
+			if ops[j].Kind == ' ' {
+				kept++
+			} else {
+				end, kept = j+1, 0
+			}
+		}
+		end = min(len(ops), end+around)
+		hunks = append(hunks, diffHunk{Ops: ops[start:end]})
+		i = end
+	}
+	return hunks
+}
+
+// diffHandler compares two files, or two byte ranges of the same file,
+// and shows the unified diff of their lines:
+// a and b are the files (b defaults to a), a-from, a-to, b-from and b-to the byte ranges,
+// context the number of the unchanged lines around the changes (default 3).
+// format=text returns the diff as text.
+func diffHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("a") == "" {
+			writeDiffPage(w, q, nil, nil)
+			return
+		}
+		a, err := parseDiffSide(q, "a", "")
+		var b diffSide
+		if err == nil {
+			b, err = parseDiffSide(q, "b", a.Path)
+		}
+		var around int64
+		if err == nil {
+			around, err = parsePageParam(q, "context", diffContext)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, side := range []*diffSide{&a, &b} {
+			if code, err := side.read(r.Context(), root, FS); err != nil {
+				http.Error(w, err.Error(), fsStatusCode(err, code))
+				return
+			}
+		}
+		ops, err := diffLines(a.Lines, b.Lines, maxDiffEdits)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, errTooDifferent) {
+				code = http.StatusUnprocessableEntity
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		hunks := diffHunks(ops, int(min(around, maxPageLines)))
+		logAttrs(r.Context(), "a", a.title(), "b", b.title(), "hunks", len(hunks))
+
+		if q.Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			bw := bufio.NewWriter(w)
+			if len(hunks) != 0 {
+				bw.WriteString("--- " + a.title() + "\n+++ " + b.title() + "\n")
+			}
+			for _, h := range hunks {
+				bw.WriteString(h.Header() + "\n")
+				for _, op := range h.Ops {
+					bw.WriteByte(op.Kind)
+					bw.WriteString(diffOpText(a, b, op))
+					bw.WriteByte('\n')
+				}
+			}
+			bw.Flush()
+			return
+		}
+		writeDiffPage(w, q, &[2]diffSide{a, b}, hunks)
+	}
+}
+
+// diffOpText returns the text of the line of the op.
+func diffOpText(a, b diffSide, op diffOp) string {
+	if op.Kind == '+' {
+		return b.Lines[op.B]
+	}
+	return a.Lines[op.A]
+}
+
+// writeDiffPage writes the form of the diff, and the diff of the sides, if any.
+func writeDiffPage(w http.ResponseWriter, q url.Values, sides *[2]diffSide, hunks []diffHunk) {
+	page := diffPage{Form: q, Context: cmp.Or(q.Get("context"), strconv.Itoa(diffContext))}
+	if sides != nil {
+		a, b := sides[0], sides[1]
+		text := maps.Clone(q)
+		text.Set("format", "text")
+		page.Compared, page.TextURL, page.A, page.B = true, "./diff?"+text.Encode(), a.title(), b.title()
+		for _, h := range hunks {
+			ph := diffPageHunk{Header: h.Header()}
+			for _, op := range h.Ops {
+				class := "diff-ctx"
+				switch op.Kind {
+				case '-':
+					class = "diff-del"
+				case '+':
+					class = "diff-add"
+				}
+				ph.Lines = append(ph.Lines, diffPageLine{Class: class, Text: string(op.Kind) + diffOpText(a, b, op)})
+			}
+			page.Hunks = append(page.Hunks, ph)
+		}
+	}
+	renderPage(w, "diff.html", page)
+}
+
+// diffPage is the data of the diff.html template: the Form, and the diff of A and B, if Compared.
+type diffPage struct {
+	Form          url.Values
+	Context       string
+	Compared      bool
+	TextURL, A, B string
+	Hunks         []diffPageHunk
+}
+
+// diffPageHunk is a hunk of the diffPage.
+type diffPageHunk struct {
+	Header string
+	Lines  []diffPageLine
+}
+
+// diffPageLine is a line of a diffPageHunk, its Class is diff-ctx, diff-del or diff-add.
+type diffPageLine struct {
+	Class, Text string
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// dockerClient talks to the Docker (or Podman) engine API on a Unix socket.
+type dockerClient struct {
+	client *http.Client
+}
+
+// newDockerClient returns a client for the engine API at the sock Unix socket.
+func newDockerClient(sock string) *dockerClient {
+	var d net.Dialer
+	return &dockerClient{client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}}
+}
+
+// dockerContainer is the subset of the container list entries we use.
+type dockerContainer struct {
+	ID     string   `json:"Id"`
+	Names  []string `json:"Names"`
+	Image  string   `json:"Image"`
+	State  string   `json:"State"`
+	Status string   `json:"Status"`
+}
+
+// Name returns the primary name of the container.
+func (c dockerContainer) Name() string {
+	if len(c.Names) == 0 {
+		return c.ID[:min(12, len(c.ID))]
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+func (dc *dockerClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, b)
+	}
+	return resp, nil
+}
+
+// Containers lists the running containers whose name contains name.
+func (dc *dockerClient) Containers(ctx context.Context, name string) ([]dockerContainer, error) {
+	resp, err := dc.get(ctx, "/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var all []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&all); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return all, nil
+	}
+	containers := all[:0]
+	for _, c := range all {
+		if strings.Contains(c.Name(), name) {
+			containers = append(containers, c)
+		}
+	}
+	return containers, nil
+}
+
+// Logs sends the log lines of the container (both stdout and stderr)
+// to linesCh, starting with the last tail lines, and following new output.
+func (dc *dockerClient) Logs(ctx context.Context, linesCh chan<- Line, id string, tail int) error {
+	defer close(linesCh)
+	id = url.PathEscape(id)
+	resp, err := dc.get(ctx, "/containers/"+id+"/json")
+	if err != nil {
+		return err
+	}
+	var inspect struct {
+		Config struct {
+			Tty bool
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&inspect)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if resp, err = dc.get(ctx, "/containers/"+id+"/logs?follow=1&stdout=1&stderr=1&tail="+strconv.Itoa(tail)); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	if !inspect.Config.Tty {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() { pw.CloseWithError(demuxDockerStream(pw, resp.Body)) }()
+		r = pr
+	}
+	return scanLines(ctx, linesCh, r)
+}
+
+// demuxDockerStream copies the payload of the multiplexed stdout/stderr stream
+// (8 byte frame headers: stream type, 3 zero bytes, uint32 big endian size) to w.
+func demuxDockerStream(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[4:]))
+		if _, err := io.CopyN(w, br, size); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeHTTP lists the containers at /containers (filtered by name=),
+// and shows the viewer of one at /containers?container=ID.
+func (dc *dockerClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if id := q.Get("container"); id != "" {
+		writeViewer(w, "container: "+id, "./tail?"+q.Encode())
+		return
+	}
+	containers, err := dc.Containers(r.Context(), q.Get("name"))
+	if err != nil {
+		slog.Error("list containers", "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	page := listPage{Title: "containers"}
+	for _, c := range containers {
+		page.Items = append(page.Items, listItem{Title: c.Name(), URL: "./containers?container=" + url.QueryEscape(c.ID), Note: c.Image + " - " + c.Status})
+	}
+	renderPage(w, "list.html", page)
+}
+
+// TailHandler streams the logs of the container=ID as SSE.
+//
+// lines=N (default 100) sets the number of past lines to start with.
+func (dc *dockerClient) TailHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts, err := parseSSEOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := q.Get("container")
+	lines := 100
+	if s := q.Get("lines"); s != "" {
+		if lines, err = strconv.Atoi(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	logAttrs(r.Context(), "container", id)
+	linesCh := make(chan Line)
+	go func() {
+		if err := dc.Logs(r.Context(), linesCh, id, lines); err != nil {
+			slog.Error("container logs", "container", id, "error", err)
+		}
+	}()
+	streamEvents(w, r, linesCh, opts)
+}
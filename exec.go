@@ -0,0 +1,65 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// stdinName is the virtual file of the standard input.
+const stdinName = virtualPrefix + "stdin"
+
+// execRestartDelay is the wait before restarting an exited command.
+const execRestartDelay = 5 * time.Second
+
+// runExec runs the shell command, appending its output to the "@exec/<command>" virtual file,
+// and restarts it when it exits, until ctx is canceled.
+func runExec(ctx context.Context, command string) {
+	vf := virtualFiles.Get(virtualName("exec", command))
+	for {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		linesCh := make(chan Line)
+		errCh := make(chan error, 1)
+		go func() { errCh <- tailCommand(ctx, linesCh, cmd) }()
+		for line := range linesCh {
+			vf.Append(line.Text)
+		}
+		err := <-errCh
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("command exited, restarting", "command", command, "error", err, "after", execRestartDelay)
+		vf.Append("-- command exited, restarting --")
+		if err != nil {
+			vf.SetError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(execRestartDelay):
+		}
+	}
+}
+
+// readStdin appends the standard input to the "@stdin" virtual file, until EOF.
+func readStdin(ctx context.Context, r io.Reader) error {
+	vf := virtualFiles.Get(stdinName)
+	linesCh := make(chan Line)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(linesCh)
+		errCh <- scanLines(ctx, linesCh, r)
+	}()
+	for line := range linesCh {
+		vf.Append(line.Text)
+	}
+	return <-errCh
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"time"
+)
+
+const (
+	recentCookie   = "webtail_recent"
+	favoriteCookie = "webtail_favorites"
+	maxRecent      = 10
+	maxFavorites   = 30
+	// pathsCookieTTL is how long the recent and favorite files are remembered.
+	pathsCookieTTL = 365 * 24 * time.Hour
+)
+
+// readPaths returns the list of paths stored in the cookie.
+func readPaths(r *http.Request, name string) []string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return nil
+	}
+	q, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil
+	}
+	return q["p"]
+}
+
+// writePaths stores the list of paths in the cookie.
+func writePaths(w http.ResponseWriter, name string, paths []string) {
+	b := []byte(url.Values{"p": paths}.Encode())
+	http.SetCookie(w, &http.Cookie{
+		Name: name, Value: base64.RawURLEncoding.EncodeToString(b), Path: "/",
+		MaxAge: int(pathsCookieTTL / time.Second), HttpOnly: true, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// addRecent puts fn to the front of the recent files of the browser.
+func addRecent(w http.ResponseWriter, r *http.Request, fn string) {
+	recent := readPaths(r, recentCookie)
+	if len(recent) != 0 && recent[0] == fn {
+		return
+	}
+	recent = slices.DeleteFunc(recent, func(s string) bool { return s == fn })
+	recent = append([]string{fn}, recent[:min(len(recent), maxRecent-1)]...)
+	writePaths(w, recentCookie, recent)
+}
+
+// favoritesHandler lists (GET), adds (POST) or removes (DELETE) the "path" favorite file of the browser.
+func favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	favs := readPaths(r, favoriteCookie)
+	if r.Method != http.MethodGet {
+		fn := path.Clean(r.URL.Query().Get("path"))
+		favs = slices.DeleteFunc(favs, func(s string) bool { return s == fn })
+		if r.Method == http.MethodPost {
+			if len(favs) >= maxFavorites {
+				http.Error(w, "too many favorites", http.StatusConflict)
+				return
+			}
+			favs = append(favs, fn)
+			slices.Sort(favs)
+		}
+		writePaths(w, favoriteCookie, favs)
+	}
+	if favs == nil {
+		favs = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(favs)
+}
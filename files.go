@@ -0,0 +1,239 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileIndex is an in-memory, recursive index of the regular files under Root.
+//
+// It is kept up to date by fsnotify events, with a periodic full rescan
+// as a fallback for missed events (overflows, network filesystems, watch limits).
+type fileIndex struct {
+	Root   string
+	FS     fs.FS
+	Rescan time.Duration
+
+	mu     sync.RWMutex
+	files  map[string]struct{}
+	sorted []string
+	// walked counts the files found by the scans, the progress of the first one
+	walked atomic.Int64
+	// ready is closed after the first scan
+	ready chan struct{}
+}
+
+// newFileIndex returns an empty index of root.
+func newFileIndex(root string, FS fs.FS, rescan time.Duration) *fileIndex {
+	return &fileIndex{Root: root, FS: FS, Rescan: rescan, files: make(map[string]struct{}), ready: make(chan struct{})}
+}
+
+// Files returns the sorted list of indexed files.
+func (fi *fileIndex) Files() []string {
+	fi.mu.RLock()
+	sorted := fi.sorted
+	fi.mu.RUnlock()
+	if sorted != nil {
+		return sorted
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.sorted == nil {
+		fi.sorted = make([]string, 0, len(fi.files))
+		for k := range fi.files {
+			fi.sorted = append(fi.sorted, k)
+		}
+		slices.Sort(fi.sorted)
+	}
+	return fi.sorted
+}
+
+// Run builds the index, then keeps it up to date until ctx is canceled.
+func (fi *fileIndex) Run(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("fsnotify unavailable, falling back to periodic rescan", "error", err)
+		w = nil
+	} else {
+		defer w.Close()
+	}
+	fi.scan(w)
+	close(fi.ready)
+
+	ticker := time.NewTicker(fi.Rescan)
+	defer ticker.Stop()
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if w != nil {
+		events, errs = w.Events, w.Errors
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			fi.scan(w)
+		case err := <-errs:
+			slog.Warn("fsnotify", "error", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				fi.scan(w)
+			}
+		case ev := <-events:
+			fi.handle(w, ev)
+		}
+	}
+}
+
+// scan walks the whole tree, replacing the index, and adds watches for all directories.
+func (fi *fileIndex) scan(w *fsnotify.Watcher) {
+	start := time.Now()
+	files := make(map[string]struct{}, len(fi.files))
+	fi.walk(w, ".", files)
+	fi.mu.Lock()
+	fi.files, fi.sorted = files, nil
+	fi.mu.Unlock()
+	slog.Debug("index scanned", "root", fi.Root, "files", len(files), "dur", time.Since(start))
+}
+
+func (fi *fileIndex) walk(w *fsnotify.Watcher, dir string, files map[string]struct{}) {
+	fs.WalkDir(fi.FS, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Warn("walk", "path", p, "error", err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if w != nil {
+				if err := w.Add(filepath.Join(fi.Root, filepath.FromSlash(p))); err != nil {
+					slog.Debug("watch", "dir", p, "error", err)
+				}
+			}
+		} else if d.Type().IsRegular() {
+			files[p] = struct{}{}
+			fi.walked.Add(1)
+		}
+		return nil
+	})
+}
+
+// handle applies a single fsnotify event to the index.
+func (fi *fileIndex) handle(w *fsnotify.Watcher, ev fsnotify.Event) {
+	rel, err := filepath.Rel(fi.Root, ev.Name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return
+	}
+	p := filepath.ToSlash(rel)
+	switch {
+	case ev.Has(fsnotify.Create):
+		st, err := os.Lstat(ev.Name)
+		if err != nil {
+			return
+		}
+		if st.IsDir() {
+			// files may have been created before the watch was set up
+			files := make(map[string]struct{})
+			fi.walk(w, p, files)
+			fi.mu.Lock()
+			for k := range files {
+				fi.files[k] = struct{}{}
+			}
+			fi.sorted = nil
+			fi.mu.Unlock()
+		} else if st.Mode().IsRegular() {
+			fi.mu.Lock()
+			fi.files[p] = struct{}{}
+			fi.sorted = nil
+			fi.mu.Unlock()
+		}
+
+	case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+		prefix := p + "/"
+		fi.mu.Lock()
+		delete(fi.files, p)
+		for k := range fi.files {
+			if strings.HasPrefix(k, prefix) {
+				delete(fi.files, k)
+			}
+		}
+		fi.sorted = nil
+		fi.mu.Unlock()
+	}
+}
+
+// ServeHTTP returns the indexed files as a JSON array,
+// optionally restricted to the ones under the "path" directory and matching q (as /find).
+//
+// With limit= or cursor=, it returns a page of at most limit (default 1000) files,
+// with the cursor of the next one.
+func (fi *fileIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	files := fi.Files()
+	if dir := path.Clean(q.Get("path")); dir != "." && dir != "/" {
+		prefix := strings.TrimPrefix(dir, "/") + "/"
+		i, _ := slices.BinarySearch(files, prefix)
+		j := i
+		for j < len(files) && strings.HasPrefix(files[j], prefix) {
+			j++
+		}
+		files = files[i:j]
+	}
+	if s := strings.TrimSpace(q.Get("q")); s != "" {
+		var err error
+		if files, err = findFiles(files, ".", s, math.MaxInt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Has("limit") || q.Has("cursor") {
+		n, err := parseLimit(r, 1000, 10000)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if token := q.Get("cursor"); token != "" {
+			pc, err := decodeCursor(token, "files")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			files = filesAfter(files, pc.After)
+		}
+		if len(files) > n {
+			files = files[:n]
+			setNextCursor(w, r, pageCursor{Kind: "files", After: files[n-1]})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+// filesAfter returns the sorted files after the path,
+// which need not exist anymore.
+func filesAfter(files []string, after string) []string {
+	i, ok := slices.BinarySearch(files, after)
+	if ok {
+		i++
+	}
+	return files[i:]
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// statInterval is how often the files shown with a stats panel are sampled.
+	statInterval = 5 * time.Second
+	// statWindow is the period the rates are measured over.
+	statWindow = time.Minute
+	// statMaxRead is the most new bytes read in one sample to count the new lines,
+	// beyond it the count is extrapolated.
+	statMaxRead = 1 << 20
+)
+
+// FileRates is the size and growth of a file, returned by /stat
+// and sent as the "stat" meta event.
+type FileRates struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	BytesPerSec float64   `json:"bytesPerSec"`
+	LinesPerSec float64   `json:"linesPerSec"`
+}
+
+// statSample is the size of the file and the number of lines written since the sampler started.
+type statSample struct {
+	at           time.Time
+	size, lines  int64
+	mtime        time.Time
+	bytesWritten int64
+}
+
+// fileSampler samples the size of a file, and counts its new lines.
+type fileSampler struct {
+	fn     string
+	cancel context.CancelFunc
+	users  int
+	stop   *time.Timer
+	// ready is closed after the first sample
+	ready chan struct{}
+
+	mu      sync.Mutex
+	samples []statSample
+	subs    map[chan metaEvent]struct{}
+}
+
+// statBroker shares the samplers of the files between all the stats panels and /stat requests.
+type statBroker struct {
+	mu       sync.Mutex
+	samplers map[string]*fileSampler
+}
+
+// fileStats are the samplers of the files with stats panels.
+var fileStats = &statBroker{}
+
+// Watch returns the sampler of fn, starting it if needed, and a function to release it.
+// A sampler is stopped a statWindow after its last release.
+func (sb *statBroker) Watch(root string, FS fs.FS, fn string) (*fileSampler, func()) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	smp := sb.samplers[fn]
+	if smp == nil {
+		if sb.samplers == nil {
+			sb.samplers = make(map[string]*fileSampler)
+		}
+		smp = &fileSampler{fn: fn, ready: make(chan struct{}), subs: make(map[chan metaEvent]struct{})}
+		var ctx context.Context
+		ctx, smp.cancel = context.WithCancel(context.Background())
+		go smp.run(ctx, root, FS)
+		sb.samplers[fn] = smp
+	}
+	smp.users++
+	if smp.stop != nil {
+		smp.stop.Stop()
+		smp.stop = nil
+	}
+	return smp, func() {
+		sb.mu.Lock()
+		defer sb.mu.Unlock()
+		if smp.users--; smp.users == 0 {
+			smp.stop = time.AfterFunc(statWindow, func() {
+				sb.mu.Lock()
+				defer sb.mu.Unlock()
+				if smp.users == 0 {
+					delete(sb.samplers, fn)
+					smp.cancel()
+				}
+			})
+		}
+	}
+}
+
+// run samples the file every statInterval, and sends the rates to the subscribers.
+func (smp *fileSampler) run(ctx context.Context, root string, FS fs.FS) {
+	smp.sample(ctx, root, FS)
+	close(smp.ready)
+	ticker := time.NewTicker(statInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !smp.sample(ctx, root, FS) {
+			continue
+		}
+		ev := metaEvent{Kind: "stat", Data: smp.Rates()}
+		smp.mu.Lock()
+		for ch := range smp.subs {
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+		smp.mu.Unlock()
+	}
+}
+
+// sample the size of the file, counting the lines written since the last sample.
+func (smp *fileSampler) sample(ctx context.Context, root string, FS fs.FS) bool {
+	fh, _, err := openTail(root, FS, smp.fn)
+	if err != nil {
+		slog.Debug("sample", "file", smp.fn, "error", err)
+		return false
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		slog.Debug("sample", "file", smp.fn, "error", err)
+		return false
+	}
+	now := time.Now()
+	smp.mu.Lock()
+	first := len(smp.samples) == 0
+	var last statSample
+	if !first {
+		last = smp.samples[len(smp.samples)-1]
+	}
+	smp.mu.Unlock()
+	cur := statSample{at: now, size: fi.Size(), mtime: fi.ModTime(), lines: last.lines, bytesWritten: last.bytesWritten}
+	if cur.size < last.size {
+		// truncated or rotated: what was written since is the whole file
+		last.size = 0
+	}
+	if d := cur.size - last.size; !first && d > 0 {
+		cur.bytesWritten += d
+		b := make([]byte, min(d, statMaxRead))
+		n, err := fh.ReadAt(b, cur.size-int64(len(b)))
+		if err != nil && !errors.Is(err, io.EOF) {
+			slog.Debug("sample", "file", smp.fn, "error", err)
+		}
+		diskLimiter.Wait(ctx, n)
+		lines := int64(bytes.Count(b[:n], []byte{'\n'}))
+		if n != 0 && int64(n) < d {
+			lines = lines * d / int64(n)
+		}
+		cur.lines += lines
+	}
+	smp.mu.Lock()
+	defer smp.mu.Unlock()
+	i := 0
+	for i < len(smp.samples)-1 && now.Sub(smp.samples[i].at) > statWindow {
+		i++
+	}
+	smp.samples = append(smp.samples[i:], cur)
+	return true
+}
+
+// Rates returns the current size of the file, and its growth over the last statWindow,
+// after the first sample.
+func (smp *fileSampler) Rates() FileRates {
+	<-smp.ready
+	smp.mu.Lock()
+	defer smp.mu.Unlock()
+	fr := FileRates{Path: smp.fn}
+	if len(smp.samples) == 0 {
+		return fr
+	}
+	first, last := smp.samples[0], smp.samples[len(smp.samples)-1]
+	fr.Size, fr.ModTime = last.size, last.mtime
+	if dt := last.at.Sub(first.at).Seconds(); dt > 0 {
+		fr.BytesPerSec = float64(last.bytesWritten-first.bytesWritten) / dt
+		fr.LinesPerSec = float64(last.lines-first.lines) / dt
+	}
+	return fr
+}
+
+// Subscribe returns a channel receiving the "stat" meta events of the file,
+// starting with the current rates, and a function to unsubscribe.
+func (smp *fileSampler) Subscribe() (<-chan metaEvent, func()) {
+	ch := make(chan metaEvent, 1)
+	ch <- metaEvent{Kind: "stat", Data: smp.Rates()}
+	smp.mu.Lock()
+	smp.subs[ch] = struct{}{}
+	smp.mu.Unlock()
+	return ch, func() {
+		smp.mu.Lock()
+		delete(smp.subs, ch)
+		smp.mu.Unlock()
+	}
+}
+
+// fileStatHandler returns the FileRates of the "path" file as JSON.
+// The rates are measured from the first request of the file,
+// over the last minute.
+func fileStatHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn := path.Clean(r.URL.Query().Get("path"))
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		fh.Close()
+		smp, release := fileStats.Watch(root, FS, fn)
+		defer release()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(smp.Rates())
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxFindResults limits the number of /find results.
+const maxFindResults = 500
+
+// findFiles returns the files under dir matching q:
+// a glob pattern (matched against both the path and the base name) if it
+// contains any of "*?[", a case-insensitive substring otherwise.
+func findFiles(files []string, dir, q string, limit int) ([]string, error) {
+	prefix := ""
+	if dir != "." && dir != "/" && dir != "" {
+		prefix = strings.TrimPrefix(dir, "/") + "/"
+	}
+	isGlob := strings.ContainsAny(q, "*?[")
+	if isGlob {
+		if _, err := path.Match(q, ""); err != nil {
+			return nil, err
+		}
+	}
+	lq := strings.ToLower(q)
+	var found []string
+	for _, f := range files {
+		if !strings.HasPrefix(f, prefix) {
+			continue
+		}
+		var ok bool
+		if isGlob {
+			ok, _ = path.Match(q, f)
+			if !ok {
+				ok, _ = path.Match(q, path.Base(f))
+			}
+		} else {
+			ok = strings.Contains(strings.ToLower(f), lq)
+		}
+		if ok {
+			if found = append(found, f); len(found) >= limit {
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// find renders the files under path= matching q= as a list of links.
+func (fi *fileIndex) find(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	dir := path.Clean(r.URL.Query().Get("path"))
+	found, err := findFiles(fi.Files(), dir, q, maxFindResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page := listPage{Title: "find", Find: &findForm{Dir: dir, Q: q}, Summary: strconv.Itoa(len(found)) + " files found"}
+	if len(found) >= maxFindResults {
+		page.Summary += " (truncated)"
+	}
+	for _, f := range found {
+		page.Items = append(page.Items, listItem{Title: f, URL: "./file?path=" + url.QueryEscape(f)})
+	}
+	renderPage(w, "list.html", page)
+}
@@ -0,0 +1,244 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func init() {
+	msgpack.RegisterExt(0, (*fluentEventTime)(nil))
+}
+
+// fluentEventTime is the EventTime extension type (0) of the Fluent Forward protocol.
+type fluentEventTime time.Time
+
+// MarshalMsgpack implements msgpack.Marshaler.
+func (t *fluentEventTime) MarshalMsgpack() ([]byte, error) {
+	var b [8]byte
+	tt := time.Time(*t)
+	binary.BigEndian.PutUint32(b[:4], uint32(tt.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(tt.Nanosecond()))
+	return b[:], nil
+}
+
+// UnmarshalMsgpack implements msgpack.Unmarshaler.
+func (t *fluentEventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("EventTime: got %d bytes, wanted 8", len(b))
+	}
+	*t = fluentEventTime(time.Unix(int64(binary.BigEndian.Uint32(b[:4])), int64(binary.BigEndian.Uint32(b[4:]))))
+	return nil
+}
+
+// fluentTime converts the time field of an entry (EventTime or integer seconds).
+func fluentTime(v any) time.Time {
+	switch x := v.(type) {
+	case *fluentEventTime:
+		return time.Time(*x)
+	case int8:
+		return time.Unix(int64(x), 0)
+	case int16:
+		return time.Unix(int64(x), 0)
+	case int32:
+		return time.Unix(int64(x), 0)
+	case int64:
+		return time.Unix(x, 0)
+	case uint8:
+		return time.Unix(int64(x), 0)
+	case uint16:
+		return time.Unix(int64(x), 0)
+	case uint32:
+		return time.Unix(int64(x), 0)
+	case uint64:
+		return time.Unix(int64(x), 0)
+	case float64:
+		return time.Unix(int64(x), int64((x-float64(int64(x)))*1e9))
+	}
+	return time.Now()
+}
+
+// fluentLine formats a record as a log line, using its log/message/msg field,
+// or the JSON form of the whole record.
+func fluentLine(ts time.Time, record any) string {
+	if m, ok := record.(map[string]any); ok {
+		for _, k := range []string{"log", "message", "msg"} {
+			if s, ok := m[k].(string); ok {
+				return ts.Format(time.RFC3339Nano) + " " + s
+			}
+		}
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		b = []byte(fmt.Sprint(record))
+	}
+	return ts.Format(time.RFC3339Nano) + " " + string(b)
+}
+
+// serveFluent receives events by the Fluent Forward protocol on the TCP addr,
+// appending them to the @fluent/<tag> virtual files, until ctx is canceled.
+//
+// The Message, Forward, PackedForward and CompressedPackedForward modes
+// and chunk acknowledgements are supported; the handshake (shared key
+// authentication) is not.
+func serveFluent(ctx context.Context, addr string) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	slog.Info("Listen", "fluent", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := serveFluentConn(ctx, conn); err != nil && !errors.Is(err, io.EOF) {
+				slog.Warn("fluent", "remote", conn.RemoteAddr(), "error", err)
+			}
+		}()
+	}
+}
+
+const (
+	// maxFluentMessage is the most bytes of a message (or of a decompressed PackedForward chunk).
+	maxFluentMessage = 16 << 20
+	// fluentIdleTimeout is how long a connection may be idle (or a message may take).
+	fluentIdleTimeout = 5 * time.Minute
+)
+
+// errFluentTooLarge is returned for messages larger than maxFluentMessage.
+var errFluentTooLarge = fmt.Errorf("message larger than %d bytes", maxFluentMessage)
+
+// messageLimiter limits the bytes read for a message: N is reset before each one.
+type messageLimiter struct {
+	R io.Reader
+	N int64
+}
+
+func (ml *messageLimiter) Read(p []byte) (int, error) {
+	if ml.N <= 0 {
+		return 0, errFluentTooLarge
+	}
+	if int64(len(p)) > ml.N {
+		p = p[:ml.N]
+	}
+	n, err := ml.R.Read(p)
+	ml.N -= int64(n)
+	return n, err
+}
+
+func serveFluentConn(ctx context.Context, conn net.Conn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	limiter := messageLimiter{R: conn}
+	dec := msgpack.NewDecoder(bufio.NewReader(&limiter))
+	enc := msgpack.NewEncoder(conn)
+	for {
+		limiter.N = maxFluentMessage
+		if err := conn.SetReadDeadline(time.Now().Add(fluentIdleTimeout)); err != nil {
+			return err
+		}
+		v, err := dec.DecodeInterface()
+		if err != nil {
+			return err
+		}
+		msg, ok := v.([]any)
+		if !ok || len(msg) < 2 {
+			return fmt.Errorf("unexpected message %T", v)
+		}
+		tag, _ := msg[0].(string)
+		vf, err := virtualFiles.GetOnHost(virtualName("fluent", tag), "")
+		if err != nil {
+			return err
+		}
+		var option map[string]any
+		switch entries := msg[1].(type) {
+		case []any: // Forward
+			for _, e := range entries {
+				if entry, ok := e.([]any); ok && len(entry) >= 2 {
+					vf.Append(fluentLine(fluentTime(entry[0]), entry[1]))
+				}
+			}
+			if len(msg) > 2 {
+				option, _ = msg[2].(map[string]any)
+			}
+		case []byte, string: // PackedForward
+			var b []byte
+			if s, ok := entries.(string); ok {
+				b = []byte(s)
+			} else {
+				b = entries.([]byte)
+			}
+			if len(msg) > 2 {
+				option, _ = msg[2].(map[string]any)
+			}
+			if err := appendPackedFluent(vf, b, option["compressed"] == "gzip"); err != nil {
+				return err
+			}
+		default: // Message
+			if len(msg) < 3 {
+				return fmt.Errorf("short message %v", msg)
+			}
+			vf.Append(fluentLine(fluentTime(msg[1]), msg[2]))
+			if len(msg) > 3 {
+				option, _ = msg[3].(map[string]any)
+			}
+		}
+		if chunk, ok := option["chunk"]; ok {
+			if err := enc.Encode(map[string]any{"ack": chunk}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// appendPackedFluent appends the concatenated msgpack [time, record] entries of b.
+func appendPackedFluent(vf *virtualFile, b []byte, compressed bool) error {
+	var r io.Reader = bytes.NewReader(b)
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	dec := msgpack.NewDecoder(&messageLimiter{R: r, N: maxFluentMessage})
+	for {
+		v, err := dec.DecodeInterface()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if entry, ok := v.([]any); ok && len(entry) >= 2 {
+			vf.Append(fluentLine(fluentTime(entry[0]), entry[1]))
+		}
+	}
+}
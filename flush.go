@@ -0,0 +1,75 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The output of a stream is buffered, and flushed every two seconds (see streamEvents).
+// To diagnose the lines arriving late, a stream can be flushed at once:
+// by its viewer with POST /api/v1/streams/{id}/flush, or by the admin
+// with POST /admin/streams/{id}/flush, the streams listed at GET /admin/streams.
+// The nobuffer=1 option of the stream flushes after every batch of lines.
+
+// Flush asks the stream to flush its buffered output now.
+func (rs *recordableStream) Flush() {
+	select {
+	case rs.flush <- struct{}{}:
+	default:
+	}
+}
+
+// stream returns the stream of the id, or nil.
+func (rr *recordingRegistry) stream(id string) *recordableStream {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.streams[id]
+}
+
+// handleFlush flushes the stream of the user of the request.
+func (rr *recordingRegistry) handleFlush(w http.ResponseWriter, r *http.Request) {
+	rs := rr.stream(r.PathValue("id"))
+	if rs == nil || !sameUser(r, rs.User) {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+	rs.Flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminFlush flushes any stream.
+func (rr *recordingRegistry) handleAdminFlush(w http.ResponseWriter, r *http.Request) {
+	rs := rr.stream(r.PathValue("id"))
+	if rs == nil {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+	slog.Info("flush stream", "id", rs.ID, "user", rs.User, "client", rs.Client)
+	rs.Flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStreams lists the streams as JSON, the oldest first.
+func (rr *recordingRegistry) handleStreams(w http.ResponseWriter, r *http.Request) {
+	rr.mu.Lock()
+	streams := make([]*recordableStream, 0, len(rr.streams))
+	for _, rs := range rr.streams {
+		streams = append(streams, rs)
+	}
+	rr.mu.Unlock()
+	slices.SortFunc(streams, func(a, b *recordableStream) int {
+		if c := a.Started.Compare(b.Started); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(streams)
+}
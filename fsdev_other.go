@@ -0,0 +1,18 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// fileDevice returns false, as the device ID is not available on this OS.
+func fileDevice(fi fs.FileInfo) (uint64, bool) { return 0, false }
+
+// fileRemoved returns false, as the removal of an open file is not detected on this OS.
+func fileRemoved(fh *os.File, err error) bool { return false }
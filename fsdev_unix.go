@@ -0,0 +1,38 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the ID of the device fi is on.
+func fileDevice(fi fs.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// fileRemoved reports whether the open file is removed: it has no links left,
+// or err (of reading it) is ESTALE, as of NFS.
+func fileRemoved(fh *os.File, err error) bool {
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Is(err, syscall.ESTALE)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		return errors.Is(err, syscall.ESTALE)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink == 0
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// errFSTimeout is returned by the filesystem operations of the requests not finishing in fsTimeout.
+var errFSTimeout = errors.New("the filesystem did not respond in time")
+
+// fsTimeout bounds the Stat, ReadDir and Open of the requests (0 disables).
+var fsTimeout = 10 * time.Second
+
+// withFSTimeout returns the result of f, or errFSTimeout if it does not return in fsTimeout.
+//
+// f keeps running in its goroutine: a misbehaving network filesystem may never return,
+// but it does not hang the handler. A late result is closed, if it is a Closer.
+func withFSTimeout[T any](op, name string, f func() (T, error)) (T, error) {
+	if fsTimeout <= 0 {
+		return f()
+	}
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result)
+	abandoned := make(chan struct{})
+	go func() {
+		var res result
+		res.v, res.err = f()
+		select {
+		case done <- res:
+		case <-abandoned:
+			if c, ok := any(res.v).(io.Closer); ok && res.err == nil {
+				c.Close()
+			}
+		}
+	}()
+	timer := time.NewTimer(fsTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.v, res.err
+	case <-timer.C:
+		close(abandoned)
+		var zero T
+		return zero, &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("%w (%s)", errFSTimeout, fsTimeout)}
+	}
+}
+
+// fsStatusCode returns the HTTP status of the filesystem error:
+// 504 Gateway Timeout if the filesystem is unresponsive,
+// 403 Forbidden for a name outside the root, def otherwise.
+func fsStatusCode(err error, def int) int {
+	switch {
+	case errors.Is(err, errFSTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errOutsideRoot):
+		return http.StatusForbidden
+	}
+	return def
+}
+
+// timeoutFS bounds the operations of the wrapped filesystem by fsTimeout.
+type timeoutFS struct{ fsys fs.FS }
+
+var (
+	_ fs.StatFS    = timeoutFS{}
+	_ fs.ReadDirFS = timeoutFS{}
+)
+
+func (tfs timeoutFS) Open(name string) (fs.File, error) {
+	return withFSTimeout("open", name, func() (fs.File, error) { return tfs.fsys.Open(name) })
+}
+
+func (tfs timeoutFS) Stat(name string) (fs.FileInfo, error) {
+	return withFSTimeout("stat", name, func() (fs.FileInfo, error) { return fs.Stat(tfs.fsys, name) })
+}
+
+func (tfs timeoutFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return withFSTimeout("readdir", name, func() ([]fs.DirEntry, error) { return fs.ReadDir(tfs.fsys, name) })
+}
@@ -0,0 +1,162 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// gelfLevels are the syslog severities used by GELF.
+var gelfLevels = [...]string{"EMERG", "ALERT", "CRIT", "ERROR", "WARN", "NOTICE", "INFO", "DEBUG"}
+
+// gelfMessage is a GELF 1.1 message.
+type gelfMessage struct {
+	Host         string         `json:"host"`
+	ShortMessage string         `json:"short_message"`
+	FullMessage  string         `json:"full_message"`
+	Timestamp    float64        `json:"timestamp"`
+	Level        *int           `json:"level"`
+	Facility     string         `json:"facility"`
+	Extra        map[string]any `json:"-"`
+}
+
+// App returns the application name of the message, from the usual additional fields.
+func (m gelfMessage) App() string {
+	for _, k := range []string{"_app", "_application_name", "_service", "_container_name", "_tag"} {
+		if s, ok := m.Extra[k].(string); ok && s != "" {
+			return s
+		}
+	}
+	if m.Facility != "" {
+		return m.Facility
+	}
+	return "default"
+}
+
+// Line formats the message as a log line.
+func (m gelfMessage) Line() string {
+	ts := time.Now()
+	if m.Timestamp != 0 {
+		sec, frac := math.Modf(m.Timestamp)
+		ts = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	level := "-"
+	if m.Level != nil && *m.Level >= 0 && *m.Level < len(gelfLevels) {
+		level = gelfLevels[*m.Level]
+	}
+	msg := m.FullMessage
+	if msg == "" {
+		msg = m.ShortMessage
+	}
+	return ts.Format(time.RFC3339Nano) + " " + level + " " + strings.TrimRight(msg, "\n")
+}
+
+// decodeGELF decodes the (possibly gzip or zlib compressed) JSON payload.
+func decodeGELF(b []byte) (gelfMessage, error) {
+	var m gelfMessage
+	var r io.Reader = bytes.NewReader(b)
+	var err error
+	switch {
+	case len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b:
+		r, err = gzip.NewReader(r)
+	case len(b) > 2 && b[0] == 0x78:
+		r, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		return m, err
+	}
+	if b, err = io.ReadAll(io.LimitReader(r, 1<<20)); err != nil {
+		return m, err
+	}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m.Extra)
+	return m, err
+}
+
+// gelfChunks collects the chunks of a chunked GELF message.
+type gelfChunks struct {
+	parts [][]byte
+	count int
+	first time.Time
+}
+
+// serveGELF receives GELF messages on the UDP addr, appending them to the
+// @gelf/<host>/<app> virtual files, until ctx is canceled.
+func serveGELF(ctx context.Context, addr string) error {
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	slog.Info("Listen", "gelf", addr)
+
+	pending := make(map[string]*gelfChunks)
+	buf := make([]byte, 65536)
+	lastPurge := time.Now()
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		b := buf[:n]
+		// chunked: 0x1e 0x0f, 8 bytes message id, sequence number, sequence count
+		if n > 12 && b[0] == 0x1e && b[1] == 0x0f {
+			id, seq, count := string(b[2:10]), int(b[10]), int(b[11])
+			if count == 0 || count > 128 || seq >= count {
+				continue
+			}
+			c := pending[id]
+			if c == nil {
+				c = &gelfChunks{parts: make([][]byte, count), first: time.Now()}
+				pending[id] = c
+			}
+			if c.parts[seq] == nil {
+				c.parts[seq] = bytes.Clone(b[12:])
+				c.count++
+			}
+			if c.count < len(c.parts) {
+				if time.Since(lastPurge) > time.Second {
+					// incomplete messages are dropped after 5 seconds, as the spec says
+					for k, c := range pending {
+						if time.Since(c.first) > 5*time.Second {
+							delete(pending, k)
+						}
+					}
+					lastPurge = time.Now()
+				}
+				continue
+			}
+			delete(pending, id)
+			b = bytes.Join(c.parts, nil)
+		}
+		m, err := decodeGELF(b)
+		if err != nil {
+			slog.Warn("gelf", "error", err)
+			continue
+		}
+		if vf, err := virtualFiles.GetOnHost(virtualName("gelf", m.Host, m.App()), m.Host); err == nil {
+			vf.Append(m.Line())
+		}
+	}
+}
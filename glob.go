@@ -0,0 +1,184 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// checkGlob checks that pattern is a valid glob whose directory part is literal.
+func checkGlob(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("glob %q: %w", pattern, err)
+	}
+	if !fs.ValidPath(pattern) {
+		return fmt.Errorf("glob %q: %w", pattern, errOutsideRoot)
+	}
+	if strings.ContainsAny(path.Dir(pattern), "*?[") {
+		return fmt.Errorf("glob %q: only the file name may contain wildcards", pattern)
+	}
+	return nil
+}
+
+// tailGlob tails all the files matching pattern (relative to root),
+// including the ones created later, sending their lines to linesCh
+// prefixed with "[<file name>] ".
+//
+// The directory is watched by fsnotify, and re-globbed every few seconds
+// in case events are missed.
+//
+// With merge, the lines are interleaved in the order of their timestamps;
+// the lines without a timestamp follow the previous line of their file.
+//
+// mark, if not nil, replaces the prefixing: it returns the line of the file to send,
+// or false to drop it.
+func tailGlob(ctx context.Context, linesCh chan<- Line, root string, FS fs.FS, pattern string, poll pollOptions, merge *mergeOptions, mark func(fn string, line Line) (Line, bool)) error {
+	var timedCh chan timedLine
+	if merge == nil {
+		defer close(linesCh)
+	} else {
+		timedCh = make(chan timedLine)
+		merged := make(chan struct{})
+		// not canceled with the tails below, to send the held back lines
+		go func(ctx context.Context) {
+			defer close(merged)
+			mergeLines(ctx, linesCh, timedCh, merge.Window)
+		}(ctx)
+		defer func() {
+			close(timedCh)
+			<-merged
+		}()
+	}
+	dir := path.Dir(pattern)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the files tailed; a file is tailed again (from its start) after its tail ended, as it has been rotated
+	var mu sync.Mutex
+	tailed := make(map[string]struct{})
+	start := func(fn string) {
+		mu.Lock()
+		_, ok := tailed[fn]
+		mu.Unlock()
+		if ok {
+			return
+		}
+		fh, _, err := openTail(root, FS, fn)
+		if err != nil {
+			slog.Warn("glob tail", "file", fn, "error", err)
+			return
+		}
+		mu.Lock()
+		tailed[fn] = struct{}{}
+		mu.Unlock()
+		slog.Info("glob tail", "glob", pattern, "file", fn)
+		prefix := "[" + path.Base(fn) + "] "
+		label := func(line Line) (Line, bool) {
+			line.Text = prefix + line.Text
+			return line, true
+		}
+		if mark != nil {
+			label = func(line Line) (Line, bool) { return mark(fn, line) }
+		}
+		ch := make(chan Line)
+		go tailFile(ctx, ch, fh, poll)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				mu.Lock()
+				delete(tailed, fn)
+				mu.Unlock()
+			}()
+			var last time.Time
+			for line := range ch {
+				if merge != nil {
+					if t, ok := merge.timestamp(line.Text); ok {
+						last = t
+					} else if last.IsZero() {
+						last = line.Time
+					}
+				}
+				line, ok := label(line)
+				if !ok {
+					continue
+				}
+				if merge != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case timedCh <- timedLine{Line: line, at: last}:
+					}
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case linesCh <- line:
+				}
+			}
+		}()
+	}
+	glob := func() error {
+		matches, err := fs.Glob(FS, pattern)
+		for _, fn := range matches {
+			start(fn)
+		}
+		return err
+	}
+	if err := glob(); err != nil {
+		return err
+	}
+
+	var events <-chan fsnotify.Event
+	if w, err := fsnotify.NewWatcher(); err != nil {
+		slog.Warn("fsnotify", "error", err)
+	} else {
+		defer w.Close()
+		if err := w.Add(filepath.Join(root, filepath.FromSlash(dir))); err != nil {
+			slog.Warn("watch", "dir", dir, "error", err)
+		} else {
+			events = w.Events
+		}
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := glob(); err != nil {
+				slog.Warn("glob", "pattern", pattern, "error", err)
+			}
+		case ev := <-events:
+			bn := filepath.Base(ev.Name)
+			if ok, _ := path.Match(path.Base(pattern), bn); !ok {
+				continue
+			}
+			switch {
+			case ev.Has(fsnotify.Create):
+				start(path.Join(dir, bn))
+			case ev.Has(fsnotify.Rename), ev.Has(fsnotify.Remove):
+				// the file may be recreated under the same name before its tail ends
+				if err := glob(); err != nil {
+					slog.Warn("glob", "pattern", pattern, "error", err)
+				}
+			}
+		}
+	}
+}
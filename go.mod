@@ -1,5 +1,31 @@
 module github.com/UNO-SOFT/webtail
 
-go 1.22.5
+go 1.24
 
-require github.com/tgulacsi/go v0.27.5
+require (
+	github.com/coder/websocket v1.8.12
+	github.com/coreos/go-oidc/v3 v3.11.0
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/graph-gophers/graphql-go v1.5.0
+	github.com/hashicorp/yamux v0.1.1
+	github.com/klauspost/compress v1.18.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/tgulacsi/go v0.27.5
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.25.0
+	golang.org/x/oauth2 v0.21.0
+	golang.org/x/sys v0.22.0
+	google.golang.org/protobuf v1.34.2
+	sigs.k8s.io/yaml v1.4.0
+)
+
+require (
+	github.com/go-jose/go-jose/v4 v4.0.2 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+)
+
+// v2.0.3+incompatible (required by github.com/tgulacsi/go) is a retracted, accidental tag, older than v1.14
+exclude github.com/mattn/go-sqlite3 v2.0.3+incompatible
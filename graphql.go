@@ -0,0 +1,447 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+// graphQLSchema is the schema of /graphql, for custom dashboards.
+// The lists are paginated with the first (default 100) and after arguments,
+// after being the endCursor of the previous page.
+const graphQLSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	# files lists the indexed files under dir (default the root), matching the glob or substring match.
+	files(dir: String, match: String, first: Int, after: String): FileConnection!
+	# file returns the metadata of the file or virtual file, or null if it does not exist.
+	file(path: String!): File
+	# grep returns the lines of the file matching the regexp pattern.
+	grep(path: String!, pattern: String!, first: Int, after: String): LineConnection!
+	# favorites and recent are the saved files of the browser.
+	favorites: [File!]!
+	recent: [File!]!
+	# sources are the names of the virtual files.
+	sources: [String!]!
+	# views are the saved views of the team, empty without a -store.
+	views: [View!]!
+}
+
+type View {
+	name: String!
+	# url is the viewer of the view, relative to the root of webtail.
+	url: String!
+	files: [String!]!
+	glob: String
+	filter: String
+	highlight: [String!]!
+	author: String
+	# updated is the time of the last change in RFC 3339.
+	updated: String!
+}
+
+type File {
+	path: String!
+	name: String!
+	exists: Boolean!
+	dir: Boolean!
+	virtual: Boolean!
+	size: Float
+	# mtime is the modification time in RFC 3339.
+	mtime: String
+	# head returns the first lines (default 10) of the file.
+	head(lines: Int): [Line!]!
+}
+
+type Line {
+	text: String!
+	offset: Float!
+	lineno: Int
+}
+
+type PageInfo {
+	endCursor: String
+	hasNextPage: Boolean!
+}
+
+type FileConnection {
+	totalCount: Int!
+	nodes: [File!]!
+	pageInfo: PageInfo!
+}
+
+type LineConnection {
+	nodes: [Line!]!
+	pageInfo: PageInfo!
+}
+`
+
+const (
+	// maxGraphQLPage is the most items of a page.
+	maxGraphQLPage = 1000
+	// maxGraphQLReads is the most files read (by grep and head) by a query,
+	// as aliases can repeat any field in one query.
+	maxGraphQLReads = 50
+	// maxGraphQLParallelism is the most fields resolved in parallel by a query.
+	maxGraphQLParallelism = 4
+	// grepMaxScan is the most bytes scanned by one grep query,
+	// beyond it the page ends early, with a cursor to continue.
+	grepMaxScan = 64 << 20
+)
+
+// graphQLHandler returns the handler of /graphql (POST of the query as JSON).
+func graphQLHandler(root string, FS fs.FS, index *fileIndex, saved *savedViews) http.Handler {
+	schema := graphql.MustParseSchema(graphQLSchema, &graphQLResolver{root: root, FS: FS, index: index, saved: saved},
+		graphql.UseFieldResolvers(), graphql.MaxDepth(10), graphql.MaxParallelism(maxGraphQLParallelism))
+	h := &relay.Handler{Schema: schema}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		ctx := context.WithValue(r.Context(), graphQLRequestKey{}, r)
+		ctx = context.WithValue(ctx, graphQLReadsKey{}, new(atomic.Int32))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// graphQLRequestKey is the context key of the request, for the resolvers needing its cookies.
+type graphQLRequestKey struct{}
+
+// graphQLReadsKey is the context key of the number of files read by the query.
+type graphQLReadsKey struct{}
+
+// countRead counts a file read by the query, refusing it above maxGraphQLReads.
+func countRead(ctx context.Context) error {
+	if n, _ := ctx.Value(graphQLReadsKey{}).(*atomic.Int32); n != nil && n.Add(1) > maxGraphQLReads {
+		return fmt.Errorf("a query can read at most %d files", maxGraphQLReads)
+	}
+	return nil
+}
+
+// graphQLResolver is the root resolver of the GraphQL queries.
+type graphQLResolver struct {
+	root  string
+	FS    fs.FS
+	index *fileIndex
+	saved *savedViews
+}
+
+type pageInfo struct {
+	EndCursor   *string
+	HasNextPage bool
+}
+
+type fileConnection struct {
+	TotalCount int32
+	Nodes      []*fileResolver
+	PageInfo   pageInfo
+}
+
+type lineConnection struct {
+	Nodes    []*lineResolver
+	PageInfo pageInfo
+}
+
+// pageSize checks the first argument, def if it is null.
+func pageSize(first *int32, def int) (int, error) {
+	if first == nil {
+		return def, nil
+	}
+	if *first < 0 || *first > maxGraphQLPage {
+		return 0, fmt.Errorf("first must be between 0 and %d", maxGraphQLPage)
+	}
+	return int(*first), nil
+}
+
+// stringArg returns the value of the argument, def if it is null.
+func stringArg(s *string, def string) string {
+	if s == nil {
+		return def
+	}
+	return *s
+}
+
+// Files lists the indexed files.
+func (gr *graphQLResolver) Files(args struct {
+	Dir, Match *string
+	First      *int32
+	After      *string
+}) (*fileConnection, error) {
+	n, err := pageSize(args.First, 100)
+	if err != nil {
+		return nil, err
+	}
+	found, err := findFiles(gr.index.Files(), path.Clean(stringArg(args.Dir, ".")), strings.TrimSpace(stringArg(args.Match, "")), math.MaxInt)
+	if err != nil {
+		return nil, err
+	}
+	conn := fileConnection{TotalCount: int32(len(found))}
+	rest := found
+	if args.After != nil {
+		pc, err := decodeCursor(*args.After, "files")
+		if err != nil {
+			return nil, err
+		}
+		rest = filesAfter(found, pc.After)
+	}
+	for _, fn := range rest[:min(n, len(rest))] {
+		conn.Nodes = append(conn.Nodes, gr.newFile(fn))
+	}
+	if conn.PageInfo.HasNextPage = n < len(rest); len(conn.Nodes) != 0 {
+		cursor := pageCursor{Kind: "files", After: conn.Nodes[len(conn.Nodes)-1].path}.Encode()
+		conn.PageInfo.EndCursor = &cursor
+	}
+	return &conn, nil
+}
+
+// File returns the metadata of the file, or nil if it does not exist.
+func (gr *graphQLResolver) File(args struct{ Path string }) (*fileResolver, error) {
+	fr := gr.newFile(args.Path)
+	if err := fr.stat(); err != nil {
+		return nil, err
+	}
+	if !fr.st.Exists {
+		return nil, nil
+	}
+	return fr, nil
+}
+
+// Grep returns the lines of the file matching the pattern, from the offset of the after cursor.
+func (gr *graphQLResolver) Grep(ctx context.Context, args struct {
+	Path, Pattern string
+	First         *int32
+	After         *string
+}) (*lineConnection, error) {
+	n, err := pageSize(args.First, 100)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(args.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := countRead(ctx); err != nil {
+		return nil, err
+	}
+	fh, _, err := openTail(gr.root, gr.FS, cleanGraphQLPath(args.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	query := queryChecksum(args.Pattern)
+	off, err := grepStart(fh, stringArg(args.After, ""), query)
+	if err != nil {
+		return nil, err
+	}
+	lines, next, err := grepLines(ctx, fh, re, nil, off, n)
+	if err != nil {
+		return nil, err
+	}
+	var conn lineConnection
+	for _, line := range lines {
+		conn.Nodes = append(conn.Nodes, &lineResolver{line: line})
+	}
+	if pc, ok := grepCursor(fh, next, query); ok {
+		cursor := pc.Encode()
+		conn.PageInfo.EndCursor, conn.PageInfo.HasNextPage = &cursor, true
+	}
+	return &conn, nil
+}
+
+// Favorites returns the favorite files of the browser.
+func (gr *graphQLResolver) Favorites(ctx context.Context) []*fileResolver {
+	return gr.cookieFiles(ctx, favoriteCookie)
+}
+
+// Recent returns the recently viewed files of the browser.
+func (gr *graphQLResolver) Recent(ctx context.Context) []*fileResolver {
+	return gr.cookieFiles(ctx, recentCookie)
+}
+
+func (gr *graphQLResolver) cookieFiles(ctx context.Context, name string) []*fileResolver {
+	r, _ := ctx.Value(graphQLRequestKey{}).(*http.Request)
+	if r == nil {
+		return nil
+	}
+	paths := readPaths(r, name)
+	files := make([]*fileResolver, len(paths))
+	for i, p := range paths {
+		files[i] = gr.newFile(p)
+	}
+	return files
+}
+
+// Sources returns the names of the virtual files.
+func (gr *graphQLResolver) Sources() []string { return virtualFiles.Names() }
+
+// Views returns the saved views.
+func (gr *graphQLResolver) Views(ctx context.Context) ([]*viewResolver, error) {
+	views, err := gr.saved.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*viewResolver, len(views))
+	for i, sv := range views {
+		list[i] = &viewResolver{sv: sv}
+	}
+	return list, nil
+}
+
+// viewResolver resolves the fields of a View.
+type viewResolver struct{ sv savedView }
+
+func (vr *viewResolver) Name() string        { return vr.sv.Name }
+func (vr *viewResolver) URL() string         { return vr.sv.URL() }
+func (vr *viewResolver) Files() []string     { return nonNil(vr.sv.Files) }
+func (vr *viewResolver) Glob() *string       { return optString(vr.sv.Glob) }
+func (vr *viewResolver) Filter() *string     { return optString(vr.sv.Filter) }
+func (vr *viewResolver) Highlight() []string { return nonNil(vr.sv.Highlight) }
+func (vr *viewResolver) Author() *string     { return optString(vr.sv.Author) }
+func (vr *viewResolver) Updated() string     { return vr.sv.Updated.Format(time.RFC3339) }
+
+// optString returns nil for the empty string.
+func optString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// nonNil returns the empty slice for nil.
+func nonNil(ss []string) []string {
+	if ss == nil {
+		return []string{}
+	}
+	return ss
+}
+
+// cleanGraphQLPath returns the path relative to the root.
+func cleanGraphQLPath(p string) string { return path.Clean(strings.TrimPrefix(p, "/")) }
+
+// fileResolver resolves the fields of a File, stating it only when needed.
+type fileResolver struct {
+	gr   *graphQLResolver
+	path string
+
+	once sync.Once
+	st   FileStat
+	err  error
+}
+
+func (gr *graphQLResolver) newFile(p string) *fileResolver {
+	return &fileResolver{gr: gr, path: cleanGraphQLPath(p)}
+}
+
+func (fr *fileResolver) stat() error {
+	fr.once.Do(func() {
+		fr.st.Path = fr.path
+		if virtualFiles.Lookup(fr.path) != nil {
+			fr.st.Exists, fr.st.Virtual = true, true
+			return
+		}
+		if err := rootStatus.Err(); err != nil {
+			fr.err = fmt.Errorf("root unavailable: %w", err)
+			return
+		}
+		fi, err := fr.gr.FS.(fs.StatFS).Stat(fr.path)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				fr.err = err
+			}
+			return
+		}
+		mtime := fi.ModTime()
+		fr.st.Exists, fr.st.Dir, fr.st.Size, fr.st.ModTime = true, fi.IsDir(), fi.Size(), &mtime
+	})
+	return fr.err
+}
+
+func (fr *fileResolver) Path() string { return fr.path }
+func (fr *fileResolver) Name() string { return path.Base(fr.path) }
+
+func (fr *fileResolver) Exists() (bool, error) {
+	err := fr.stat()
+	return fr.st.Exists, err
+}
+
+func (fr *fileResolver) Dir() (bool, error) {
+	err := fr.stat()
+	return fr.st.Dir, err
+}
+
+func (fr *fileResolver) Virtual() (bool, error) {
+	err := fr.stat()
+	return fr.st.Virtual, err
+}
+
+func (fr *fileResolver) Size() (*float64, error) {
+	if err := fr.stat(); err != nil || !fr.st.Exists || fr.st.Virtual {
+		return nil, err
+	}
+	size := float64(fr.st.Size)
+	return &size, nil
+}
+
+func (fr *fileResolver) Mtime() (*string, error) {
+	if err := fr.stat(); err != nil || fr.st.ModTime == nil {
+		return nil, err
+	}
+	s := fr.st.ModTime.Format(time.RFC3339)
+	return &s, nil
+}
+
+// Head returns the first lines of the file.
+func (fr *fileResolver) Head(ctx context.Context, args struct{ Lines *int32 }) ([]*lineResolver, error) {
+	n, err := pageSize(args.Lines, headLines)
+	if err != nil {
+		return nil, err
+	}
+	if err := countRead(ctx); err != nil {
+		return nil, err
+	}
+	fh, _, err := openTail(fr.gr.root, fr.gr.FS, fr.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	lines, _, err := readLines(ctx, fh, 0, n)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*lineResolver, len(lines))
+	for i, line := range lines {
+		line.Text = redactions.Redact(line.Text)
+		nodes[i] = &lineResolver{line: line}
+	}
+	return nodes, nil
+}
+
+// lineResolver resolves the fields of a Line.
+type lineResolver struct{ line Line }
+
+func (lr *lineResolver) Text() string    { return lr.line.Text }
+func (lr *lineResolver) Offset() float64 { return float64(lr.line.Offset) }
+func (lr *lineResolver) Lineno() *int32 {
+	if lr.line.No == 0 {
+		return nil
+	}
+	no := int32(lr.line.No)
+	return &no
+}
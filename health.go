@@ -0,0 +1,115 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// openRequests is the number of the requests being served, including the streams.
+var openRequests atomic.Int64
+
+// healthCheck is the result of a check of /readyz.
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+	return healthCheck{OK: true}
+}
+
+// healthStatus is the JSON status of /healthz and /readyz.
+type healthStatus struct {
+	// Status is "ok", or "unavailable" if not ready.
+	Status      string    `json:"status"`
+	Instance    string    `json:"instance"`
+	Started     time.Time `json:"started"`
+	Connections int64     `json:"connections"`
+	// ReadOnly is whether the server runs with -read-only.
+	ReadOnly bool `json:"readOnly"`
+	// Root is whether the root is accessible, Disk whether its listing is readable.
+	Root   *healthCheck    `json:"root,omitempty"`
+	Disk   *healthCheck    `json:"disk,omitempty"`
+	Warmup *WarmupProgress `json:"warmup,omitempty"`
+}
+
+// healthHandler serves the probes of the load balancers and Kubernetes:
+// /healthz (liveness) is 200 OK while the server runs,
+// /readyz (readiness) is 503 Service Unavailable until the warm-up is finished,
+// or while the root is not accessible or not readable.
+type healthHandler struct {
+	FS       fs.FS
+	ReadOnly bool
+}
+
+func (hh healthHandler) status() healthStatus {
+	return healthStatus{
+		Status: "ok", Instance: instance.Name, Started: warmup.Progress().Started,
+		Connections: openRequests.Load(), ReadOnly: hh.ReadOnly,
+	}
+}
+
+func (hh healthHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	st := hh.status()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (hh healthHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	st := hh.status()
+	p := warmup.Progress()
+	st.Warmup = &p
+	// the periodic check of -root-check, or a fresh one bounded by -fs-timeout
+	err := rootStatus.Err()
+	if err == nil {
+		_, err = fs.Stat(hh.FS, ".")
+	}
+	root := newHealthCheck(err)
+	st.Root = &root
+	ready := p.Ready && root.OK
+	if root.OK {
+		disk := newHealthCheck(hh.readRoot())
+		st.Disk = &disk
+		ready = ready && disk.OK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		st.Status = "unavailable"
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// readRoot reads the first entry of the root, bounded by -fs-timeout.
+func (hh healthHandler) readRoot() error {
+	_, err := withFSTimeout("readdir", ".", func() ([]fs.DirEntry, error) {
+		fh, err := hh.FS.Open(".")
+		if err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+		dir, ok := fh.(fs.ReadDirFile)
+		if !ok {
+			return nil, &fs.PathError{Op: "readdir", Path: ".", Err: errors.New("not a directory")}
+		}
+		entries, err := dir.ReadDir(1)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return entries, err
+	})
+	return err
+}
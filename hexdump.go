@@ -0,0 +1,140 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// binaryProbeSize is the size of the first block checked by isBinary.
+	binaryProbeSize = 8192
+	// hexdumpPageSize is the number of bytes shown on a hexdump page.
+	hexdumpPageSize = 4096
+)
+
+// isBinary reports whether the first block of data of fh contains NUL bytes.
+//
+// Trailing NUL bytes are ignored, as those may be preallocated space not written yet.
+func isBinary(fh *os.File) (bool, error) {
+	d, err := seekData(fh, 0)
+	if err != nil || d < 0 {
+		return false, err
+	}
+	var a [binaryProbeSize]byte
+	n, err := fh.ReadAt(a[:], d)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return bytes.IndexByte(bytes.TrimRight(a[:n], "\x00"), 0) >= 0, nil
+}
+
+// writeHexdump writes b in xxd format, starting at the off address.
+func writeHexdump(w io.Writer, b []byte, off int64) {
+	const digits = "0123456789abcdef"
+	buf := make([]byte, 0, 80)
+	for len(b) != 0 {
+		n := min(16, len(b))
+		buf = fmt.Appendf(buf[:0], "%08x: ", off)
+		for i := 0; i < 16; i++ {
+			if i < n {
+				buf = append(buf, digits[b[i]>>4], digits[b[i]&0xf])
+			} else {
+				buf = append(buf, ' ', ' ')
+			}
+			if i%2 == 1 {
+				buf = append(buf, ' ')
+			}
+		}
+		buf = append(buf, ' ')
+		for _, c := range b[:n] {
+			if c < ' ' || c > '~' {
+				c = '.'
+			}
+			buf = append(buf, c)
+		}
+		buf = append(buf, '\n')
+		w.Write(buf)
+		b, off = b[n:], off+int64(n)
+	}
+}
+
+// hexdumpHandler shows a page of the "path" file, from the "off" offset, in xxd format.
+func hexdumpHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if redactions != nil {
+			http.Error(w, "hexdump cannot be redacted, so it is disabled with redaction rules", http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query()
+		fn := path.Clean(q.Get("path"))
+		var off int64
+		if s := q.Get("off"); s != "" {
+			var err error
+			if off, err = strconv.ParseInt(s, 10, 64); err != nil || off < 0 {
+				http.Error(w, fmt.Sprintf("off=%q: not a valid offset", s), http.StatusBadRequest)
+				return
+			}
+			off -= off % 16
+		}
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer fh.Close()
+		fi, err := fh.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var a [hexdumpPageSize]byte
+		n, err := fh.ReadAt(a[:], off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := diskLimiter.Wait(r.Context(), n); err != nil {
+			return
+		}
+		logAttrs(r.Context(), "file", fn, "off", off)
+
+		link := func(text string, off int64) pageLink {
+			return pageLink{Title: text, URL: "./hexdump?" + url.Values{"path": {fn}, "off": {strconv.FormatInt(off, 10)}}.Encode()}
+		}
+		page := hexdumpPage{Path: fn, Size: fi.Size(), TextURL: "./file?" + url.Values{"path": {fn}, "text": {"1"}}.Encode()}
+		page.Nav = []pageLink{link("first", 0)}
+		if off > 0 {
+			page.Nav = append(page.Nav, link("previous", max(0, off-hexdumpPageSize)))
+		}
+		if off+int64(n) < fi.Size() {
+			page.Nav = append(page.Nav, link("next", off+hexdumpPageSize))
+		}
+		last := max(0, fi.Size()-1)
+		page.Nav = append(page.Nav, link("last", last-last%hexdumpPageSize))
+		var dump strings.Builder
+		writeHexdump(&dump, a[:n], off)
+		page.Dump = dump.String()
+		renderPage(w, "hexdump.html", page)
+	}
+}
+
+// hexdumpPage is the data of the hexdump.html template.
+type hexdumpPage struct {
+	Path, TextURL string
+	Size          int64
+	Nav           []pageLink
+	Dump          string
+}
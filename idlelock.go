@@ -0,0 +1,57 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// idleLock is how long the pages may be idle before they are locked (-idle-lock), 0 disables it.
+//
+// A locked page is blurred (see idlelock.js), until its user authenticates again:
+// with its token, or by logging in with OIDC since the lock.
+var idleLock time.Duration
+
+// unlockRequest is the body of POST /api/v1/unlock.
+type unlockRequest struct {
+	// Since is when the page was locked.
+	Since time.Time `json:"since"`
+	// Token of the user, empty to check the OIDC login.
+	Token string `json:"token,omitempty"`
+}
+
+// unlockHandler answers 204 No Content if the user of the request authenticated again
+// since the page was locked, 403 Forbidden otherwise.
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	u := authenticate(r)
+	if u == nil {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	var req unlockRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	if req.Token != "" {
+		ok = u.checkToken(req.Token)
+	} else if issued, found := oidcLogin.sessionIssued(r); found {
+		// the session cookie has a precision of seconds
+		ok = !issued.Before(req.Since.Truncate(time.Second))
+	}
+	logAttrs(r.Context(), "unlock", ok)
+	if !ok {
+		slog.Warn("unlock refused", "user", u.Name)
+		// slow down guessing the token
+		time.Sleep(time.Second)
+		http.Error(w, "authenticate again to unlock", http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
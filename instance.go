@@ -0,0 +1,17 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+// instanceInfo identifies this webtail server to the consumers of its streams,
+// so lines from several instances feeding one dashboard can be told apart.
+type instanceInfo struct {
+	Name string `json:"name"`
+	Host string `json:"host,omitempty"`
+	Root string `json:"root,omitempty"`
+}
+
+// instance is this server's identity, sent as an "instance" meta event
+// at the start of every stream.
+var instance instanceInfo
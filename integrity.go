@@ -0,0 +1,110 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// lineHasher keeps a hash chain over the streamed lines:
+// h(k) = SHA-256(h(k-1) || line || "\n"), starting from all zeros.
+//
+// Every N lines the current state is published as a "hash" meta event,
+// so a downloaded slice between two checkpoints can be verified.
+type lineHasher struct {
+	N     int64
+	lines int64
+	sum   [sha256.Size]byte
+}
+
+// hashCheckpoint is the data of a "hash" meta event.
+type hashCheckpoint struct {
+	// Lines is the number of lines hashed since the start of the stream.
+	Lines int64 `json:"lines"`
+	// LineNo and Offset are the source line number of the last hashed line,
+	// and the source offset after it.
+	LineNo int64  `json:"lineno,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Hash   string `json:"hash"`
+}
+
+func newLineHasher(n int64) *lineHasher {
+	if n <= 0 {
+		return nil
+	}
+	return &lineHasher{N: n}
+}
+
+// chainHash returns the next link of the hash chain.
+func chainHash(prev [sha256.Size]byte, text string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write([]byte(text))
+	h.Write([]byte{'\n'})
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Add the line to the chain, returning a checkpoint event after every N lines.
+func (lh *lineHasher) Add(line Line) (metaEvent, bool) {
+	lh.sum = chainHash(lh.sum, line.Text)
+	lh.lines++
+	if lh.lines%lh.N != 0 {
+		return metaEvent{}, false
+	}
+	cp := hashCheckpoint{Lines: lh.lines, LineNo: line.No, Hash: hex.EncodeToString(lh.sum[:])}
+	if line.Offset >= 0 {
+		cp.Offset = line.Offset + int64(len(line.Text)) + 1
+	}
+	return metaEvent{Kind: "hash", Data: cp}, true
+}
+
+// verifyResult is the answer of verifyHandler.
+type verifyResult struct {
+	Lines int64  `json:"lines"`
+	Hash  string `json:"hash"`
+	OK    *bool  `json:"ok,omitempty"`
+}
+
+// verifyHandler computes the hash chain of the lines in the request body,
+// starting from the "prev" checkpoint hash (all zeros if empty),
+// and compares the result to "hash", if given.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var sum [sha256.Size]byte
+	if s := q.Get("prev"); s != "" {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != len(sum) {
+			http.Error(w, fmt.Sprintf("prev=%q: not a SHA-256 hash", s), http.StatusBadRequest)
+			return
+		}
+		copy(sum[:], b)
+	}
+	var res verifyResult
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		sum = chainHash(sum, scanner.Text())
+		res.Lines++
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res.Hash = hex.EncodeToString(sum[:])
+	if want := q.Get("hash"); want != "" {
+		ok := strings.EqualFold(want, res.Hash)
+		res.OK = &ok
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
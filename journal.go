@@ -0,0 +1,88 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// journalUnits returns the systemd units that have entries in the journal.
+func journalUnits(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	b, err := exec.CommandContext(ctx, "journalctl", "--field=_SYSTEMD_UNIT").Output()
+	if err != nil {
+		return nil, err
+	}
+	units := strings.Fields(string(b))
+	slices.Sort(units)
+	return units, nil
+}
+
+// journalHandler lists the units at /journal,
+// and shows the viewer for one unit at /journal?unit=UNIT.
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if unit := q.Get("unit"); unit != "" {
+		q.Del("path")
+		writeViewer(w, "journal: "+unit, "./journal/tail?"+q.Encode())
+		return
+	}
+
+	units, err := journalUnits(r.Context())
+	if err != nil {
+		slog.Error("journal units", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := listPage{Title: "journal"}
+	for _, unit := range units {
+		page.Items = append(page.Items, listItem{Title: unit, URL: "./journal?unit=" + url.QueryEscape(unit)})
+	}
+	renderPage(w, "list.html", page)
+}
+
+// journalTailHandler streams the journal entries of the unit as SSE.
+//
+// lines=N (default 100) sets the number of past entries to start with.
+func journalTailHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts, err := parseSSEOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unit := q.Get("unit")
+	if unit == "" {
+		http.Error(w, "unit is required", http.StatusBadRequest)
+		return
+	}
+	lines := 100
+	if s := q.Get("lines"); s != "" {
+		if lines, err = strconv.Atoi(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	logAttrs(r.Context(), "unit", unit)
+	cmd := exec.CommandContext(r.Context(), "journalctl",
+		"--follow", "--output=short-iso", "--lines="+strconv.Itoa(lines),
+		"--unit="+unit)
+	linesCh := make(chan Line)
+	go func() {
+		if err := tailCommand(r.Context(), linesCh, cmd); err != nil {
+			slog.Error("journal", "unit", unit, "error", err)
+		}
+	}()
+	streamEvents(w, r, linesCh, opts)
+}
@@ -0,0 +1,388 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// serviceAccountDir holds the credentials of the pod webtail runs in.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sClient talks to the Kubernetes API server, to list the pods and stream their logs.
+type k8sClient struct {
+	server string
+	client *http.Client
+	// token, or the tokenFile read before each request (as the in-cluster tokens are rotated).
+	token, tokenFile string
+	// namespace is the default namespace, listed if the namespaces cannot be.
+	namespace string
+}
+
+// newK8sClient returns a client of the API server: of the cluster webtail runs in for "in-cluster",
+// else of the current context of the kubeconfig file.
+func newK8sClient(spec string) (*k8sClient, error) {
+	if spec == "in-cluster" {
+		return inClusterK8sClient()
+	}
+	return kubeconfigK8sClient(spec)
+}
+
+func inClusterK8sClient() (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := k8sTLSConfig(ca, false)
+	if err != nil {
+		return nil, err
+	}
+	kc := &k8sClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		client:    &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}
+	if b, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace")); err == nil {
+		kc.namespace = strings.TrimSpace(string(b))
+	}
+	return kc, nil
+}
+
+// kubeconfig is the subset of the kubeconfig file we use.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string `json:"token"`
+			TokenFile             string `json:"tokenFile"`
+			ClientCertificate     string `json:"client-certificate"`
+			ClientCertificateData []byte `json:"client-certificate-data"`
+			ClientKey             string `json:"client-key"`
+			ClientKeyData         []byte `json:"client-key-data"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// kubeconfigK8sClient returns a client of the current context of the kubeconfig file.
+// Only the token and client certificate authentications are supported, not the exec plugins.
+func kubeconfigK8sClient(fn string) (*k8sClient, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var cfg kubeconfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	// the paths are relative to the kubeconfig file
+	dir := filepath.Dir(fn)
+	readFile := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+	var found bool
+	var ctx struct{ Cluster, User, Namespace string }
+	for _, c := range cfg.Contexts {
+		if found = c.Name == cfg.CurrentContext; found {
+			ctx.Cluster, ctx.User, ctx.Namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%q: no current context %q", fn, cfg.CurrentContext)
+	}
+	kc := &k8sClient{namespace: ctx.Namespace}
+	if kc.namespace == "" {
+		kc.namespace = "default"
+	}
+
+	var tlsConfig *tls.Config
+	for _, c := range cfg.Clusters {
+		if c.Name != ctx.Cluster {
+			continue
+		}
+		kc.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		ca := c.Cluster.CertificateAuthorityData
+		if ca == nil && c.Cluster.CertificateAuthority != "" {
+			if ca, err = readFile(c.Cluster.CertificateAuthority); err != nil {
+				return nil, err
+			}
+		}
+		if tlsConfig, err = k8sTLSConfig(ca, c.Cluster.InsecureSkipTLSVerify); err != nil {
+			return nil, fmt.Errorf("%q: cluster %q: %w", fn, c.Name, err)
+		}
+	}
+	if kc.server == "" {
+		return nil, fmt.Errorf("%q: no server of cluster %q", fn, ctx.Cluster)
+	}
+	for _, u := range cfg.Users {
+		if u.Name != ctx.User {
+			continue
+		}
+		kc.token = u.User.Token
+		if u.User.TokenFile != "" {
+			kc.tokenFile = u.User.TokenFile
+			if !filepath.IsAbs(kc.tokenFile) {
+				kc.tokenFile = filepath.Join(dir, kc.tokenFile)
+			}
+		}
+		cert, key := u.User.ClientCertificateData, u.User.ClientKeyData
+		if cert == nil && u.User.ClientCertificate != "" {
+			if cert, err = readFile(u.User.ClientCertificate); err != nil {
+				return nil, err
+			}
+		}
+		if key == nil && u.User.ClientKey != "" {
+			if key, err = readFile(u.User.ClientKey); err != nil {
+				return nil, err
+			}
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("%q: user %q: %w", fn, u.Name, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	kc.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return kc, nil
+}
+
+// k8sTLSConfig returns the TLS config trusting the PEM encoded ca, or the system roots without it.
+func k8sTLSConfig(ca []byte, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) != 0 {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate found in the certificate authority")
+		}
+	}
+	return cfg, nil
+}
+
+// errK8sForbidden is returned when the API server refuses the request.
+var errK8sForbidden = errors.New("forbidden")
+
+func (kc *k8sClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", kc.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := kc.token
+	if kc.tokenFile != "" {
+		b, err := os.ReadFile(kc.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("GET %s: %w: %s", path, errK8sForbidden, b)
+		}
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, b)
+	}
+	return resp, nil
+}
+
+// Namespaces lists the names of the namespaces,
+// or just the default one if listing them is forbidden.
+func (kc *k8sClient) Namespaces(ctx context.Context) ([]string, error) {
+	resp, err := kc.get(ctx, "/api/v1/namespaces")
+	if err != nil {
+		if errors.Is(err, errK8sForbidden) && kc.namespace != "" {
+			return []string{kc.namespace}, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(list.Items))
+	for i, it := range list.Items {
+		names[i] = it.Metadata.Name
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// k8sPod is the subset of the pod list entries we use.
+type k8sPod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// Pods lists the pods of the namespace.
+func (kc *k8sClient) Pods(ctx context.Context, namespace string) ([]k8sPod, error) {
+	resp, err := kc.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Items []k8sPod `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(list.Items, func(a, b k8sPod) int { return strings.Compare(a.Metadata.Name, b.Metadata.Name) })
+	return list.Items, nil
+}
+
+// Logs sends the log lines of the container of the pod to linesCh,
+// starting with the last tail lines, and following new output.
+func (kc *k8sClient) Logs(ctx context.Context, linesCh chan<- Line, namespace, pod, container string, tail int) error {
+	defer close(linesCh)
+	q := url.Values{"follow": {"true"}, "tailLines": {strconv.Itoa(tail)}}
+	if container != "" {
+		q.Set("container", container)
+	}
+	resp, err := kc.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(pod)+"/log?"+q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return scanLines(ctx, linesCh, resp.Body)
+}
+
+// ServeHTTP lists the namespaces at /pods, the pods and their containers at /pods?namespace=NS,
+// and shows the viewer of a container at /pods?namespace=NS&pod=POD&container=NAME.
+func (kc *k8sClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	namespace := q.Get("namespace")
+	if pod := q.Get("pod"); namespace != "" && pod != "" {
+		writeViewer(w, "pod: "+namespace+"/"+pod+"/"+q.Get("container"), "./tail?"+q.Encode())
+		return
+	}
+	var namespaces []string
+	var pods []k8sPod
+	var err error
+	if namespace == "" {
+		namespaces, err = kc.Namespaces(r.Context())
+	} else {
+		pods, err = kc.Pods(r.Context(), namespace)
+	}
+	if err != nil {
+		slog.Error("list pods", "namespace", namespace, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	title := "namespaces"
+	if namespace != "" {
+		title = "pods of " + namespace
+	}
+	page := listPage{Title: title}
+	for _, ns := range namespaces {
+		page.Items = append(page.Items, listItem{Title: ns, URL: "./pods?namespace=" + url.QueryEscape(ns)})
+	}
+	for _, p := range pods {
+		item := listItem{Title: p.Metadata.Name, Note: p.Status.Phase}
+		for _, c := range p.Spec.Containers {
+			item.Links = append(item.Links, pageLink{Title: c.Name,
+				URL: "./pods?" + url.Values{"namespace": {namespace}, "pod": {p.Metadata.Name}, "container": {c.Name}}.Encode()})
+		}
+		page.Items = append(page.Items, item)
+	}
+	renderPage(w, "list.html", page)
+}
+
+// TailHandler streams the logs of the container of the pod=POD in the namespace=NS as SSE.
+//
+// lines=N (default 100) sets the number of past lines to start with.
+func (kc *k8sClient) TailHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts, err := parseSSEOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	namespace, pod, container := q.Get("namespace"), q.Get("pod"), q.Get("container")
+	if namespace == "" {
+		namespace = kc.namespace
+	}
+	lines := 100
+	if s := q.Get("lines"); s != "" {
+		if lines, err = strconv.Atoi(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	logAttrs(r.Context(), "namespace", namespace, "pod", pod, "container", container)
+	linesCh := make(chan Line)
+	go func() {
+		if err := kc.Logs(r.Context(), linesCh, namespace, pod, container, lines); err != nil {
+			slog.Error("pod logs", "namespace", namespace, "pod", pod, "container", container, "error", err)
+		}
+	}()
+	streamEvents(w, r, linesCh, opts)
+}
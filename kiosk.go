@@ -0,0 +1,144 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+)
+
+const (
+	// defaultKioskSeconds is how long a view of a wallboard is shown by default.
+	defaultKioskSeconds = 30
+	// minKioskSeconds is the shortest time a view can be shown.
+	minKioskSeconds = 5
+	// defaultKioskLines is the number of the last lines of a view shown by default.
+	defaultKioskLines = 200
+)
+
+// kioskView is a tail view of a wallboard.
+type kioskView struct {
+	Title string `json:"title"`
+	// File or Glob is tailed.
+	File string `json:"file,omitempty"`
+	Glob string `json:"glob,omitempty"`
+	// Filter and Highlight are as in the viewer (case insensitive regexps).
+	Filter    string   `json:"filter,omitempty"`
+	Highlight []string `json:"highlight,omitempty"`
+	// Lines is the number of the last lines shown.
+	Lines int `json:"lines,omitempty"`
+	// Seconds the view is shown, the Seconds of the wallboard if 0.
+	Seconds int `json:"seconds,omitempty"`
+}
+
+// kioskBoard is a wallboard rotating through its views, without controls.
+type kioskBoard struct {
+	Name    string      `json:"-"`
+	Seconds int         `json:"seconds,omitempty"`
+	Views   []kioskView `json:"views"`
+}
+
+// kioskBoards are the wallboards of -kiosk, by name, shown at /kiosk/{name}.
+type kioskBoards map[string]*kioskBoard
+
+// loadKioskBoards reads the JSON object of the named wallboards from fn.
+func loadKioskBoards(fn string) (kioskBoards, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var boards kioskBoards
+	if err := json.Unmarshal(b, &boards); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	for name, kb := range boards {
+		kb.Name = name
+		if kb.Seconds == 0 {
+			kb.Seconds = defaultKioskSeconds
+		}
+		if len(kb.Views) == 0 {
+			return nil, fmt.Errorf("%q: wallboard %q has no views", fn, name)
+		}
+		for i := range kb.Views {
+			v := &kb.Views[i]
+			if (v.File == "") == (v.Glob == "") {
+				return nil, fmt.Errorf("%q: wallboard %q view %d: exactly one of file and glob is required", fn, name, i)
+			}
+			if v.Glob != "" {
+				if err := checkGlob(path.Clean(v.Glob)); err != nil {
+					return nil, fmt.Errorf("%q: wallboard %q view %d: %w", fn, name, i, err)
+				}
+			}
+			if v.Seconds == 0 {
+				v.Seconds = kb.Seconds
+			}
+			if v.Seconds < minKioskSeconds {
+				return nil, fmt.Errorf("%q: wallboard %q view %d: seconds must be at least %d", fn, name, i, minKioskSeconds)
+			}
+			if v.Lines <= 0 {
+				v.Lines = defaultKioskLines
+			}
+			v.Lines = min(v.Lines, maxPageLines)
+			if v.Title == "" {
+				v.Title = v.File + v.Glob
+			}
+		}
+	}
+	return boards, nil
+}
+
+// kioskPane is a view of the kiosk.html template.
+type kioskPane struct {
+	kioskView
+	// TailURL is the stream of the view, HighlightJSON the highlight rules.
+	TailURL, HighlightJSON string
+}
+
+// kioskPage is the data of the kiosk.html template: the wallboard,
+// or the list of the wallboards if it is nil.
+type kioskPage struct {
+	// Root is the relative URL of the root of the server.
+	Root  string
+	Board *kioskBoard
+	Panes []kioskPane
+	Names []string
+}
+
+func (kb kioskBoards) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == "" {
+		page := kioskPage{Root: "./", Names: make([]string, 0, len(kb))}
+		for name := range kb {
+			page.Names = append(page.Names, name)
+		}
+		slices.Sort(page.Names)
+		renderPage(w, "kiosk.html", page)
+		return
+	}
+	board := kb[name]
+	if board == nil {
+		http.Error(w, "no such wallboard", http.StatusNotFound)
+		return
+	}
+	logAttrs(r.Context(), "kiosk", name)
+	page := kioskPage{Root: "../", Board: board}
+	for _, v := range board.Views {
+		q := url.Values{"lines": {strconv.Itoa(v.Lines)}}
+		if v.File != "" {
+			q.Set("file", v.File)
+		} else {
+			q.Set("glob", v.Glob)
+		}
+		hl, _ := json.Marshal(v.Highlight)
+		page.Panes = append(page.Panes, kioskPane{kioskView: v, TailURL: "../tail?" + q.Encode(), HighlightJSON: string(hl)})
+	}
+	renderPage(w, "kiosk.html", page)
+}
@@ -5,18 +5,16 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"cmp"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"html"
-	"io"
 	"io/fs"
 	"log/slog"
-	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
@@ -26,6 +24,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/UNO-SOFT/webtail/store"
 	"github.com/tgulacsi/go/httpunix"
 )
 
@@ -37,224 +36,844 @@ func main() {
 }
 
 func Main() error {
+	if len(os.Args) > 1 && os.Args[1] == "install-service" {
+		return installService(os.Args[2:])
+	}
+	// "webtail agent -connect URL [flags] root" serves over the connection to the aggregator
+	agentMode := len(os.Args) > 1 && os.Args[1] == "agent"
+	if agentMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flagAddr := flag.String("listen", ":8080", "listening address")
+	flagTLSCert := flag.String("tls-cert", "", "certificate (PEM) file to serve HTTPS with, HTTP/2 negotiated (cleartext HTTP/2 is served with prior knowledge, for the proxies)")
+	flagTLSKey := flag.String("tls-key", "", "private key (PEM) file of -tls-cert")
+	flagRescan := flag.Duration("rescan", 5*time.Minute, "full rescan interval of the file index")
+	flagAudit := flag.String("audit", "", "record the accesses of the files (user, client, file, duration, bytes) to this file of JSON lines, or to an SQLite database (sqlite:///path/to/audit.db), shown at /audit")
+	flagState := flag.String("state", "", "file to persist state (view counters) in")
+	flagStore := flag.String("store", "", "URL of the store of the state (view counters, agent credentials, saved views) instead of the files, such as bolt:///var/lib/webtail/state.db; instances behind a load balancer can share an SQL store; known schemes: "+strings.Join(store.Schemes(), ", "))
+	flagKiosk := flag.String("kiosk", "", "JSON file of the named wallboards ({name: {seconds, views: [{title, file|glob, filter, highlight, lines, seconds}]}}), rotating through their tail views without controls at /kiosk/{name}")
+	flagTimeIndex := flag.String("time-index", "", "SQLite database of the timestamp checkpoints of the files (sqlite:///path/to/index.db), for seeking to the start of the time ranges of /api/v1/replay and /api/v1/grep?since=")
+	flagParsers := flag.String("parsers", "", "JSON file of the parsers of the files ([{match, parser: logfmt|json|csv|common|combined, comma, header}]), for the column view of the viewer")
+	flagViewerHooks := flag.String("viewer-hooks", "", "JSON file of the webhooks called when the first viewer attaches to a matching source, and when the last one leaves")
+	flagReadOnly := flag.Bool("read-only", false, "refuse every request changing the state of the server (admin actions, maintenance, pairing...), whatever the other flags enable, see readOnlyAllowed")
+	flagCSP := flag.String("csp", defaultCSP, "Content-Security-Policy of the HTML pages (empty disables)")
+	flag.DurationVar(&idleLock, "idle-lock", 0, "lock the pages idle for this long, until their user authenticates again (requires -users or -oidc-issuer); 0 disables")
+	flagTemplates := flag.String("templates", "", "directory of *.html templates replacing the embedded ones of the same name (such as \"brand\", \"head\" and \"toolbar\"), to customize the pages")
+	flagGraphQL := flag.Bool("graphql", false, "serve the files, their metadata and lines to GraphQL queries at /graphql")
+	flagJournal := flag.Bool("journal", false, "serve the systemd journal at /journal")
+	flagK8s := flag.String("k8s", "", `serve Kubernetes pod logs at /pods: "in-cluster", or the path of a kubeconfig file`)
+	flagSSHHosts := flag.String("ssh-hosts", "", "JSON file of the remote hosts to tail over SSH at /hosts")
+	flagDocker := flag.String("docker", "", "Docker/Podman engine API socket (such as /var/run/docker.sock) to serve container logs from")
+	flagAdminToken := flag.String("admin-token", os.Getenv("WEBTAIL_ADMIN_TOKEN"), "bearer token for the /admin endpoints (empty disables them)")
+	flagDev := flag.Bool("dev", false, "development mode: serve the "+demoName+" source and the /dev/chaos endpoints")
+	flagGELF := flag.String("gelf", "", "UDP address to receive GELF messages on (such as :12201)")
+	flagFluent := flag.String("fluent", "", "TCP address to receive Fluent Forward protocol events on (such as :24224)")
+	flag.DurationVar(&defaultPoll.Min, "min-interval", defaultPoll.Min, "poll interval of files with new data")
+	flag.DurationVar(&defaultPoll.Max, "max-interval", defaultPoll.Max, "longest poll interval of idle files")
+	flag.StringVar(&defaultPoll.Backoff, "backoff", defaultPoll.Backoff, "poll backoff of idle files: linear or exp")
+	flagMaxLineSize := flag.String("max-line-size", "1M", "longer lines are truncated, marked with an ellipsis")
+	flagMaxMemory := flag.String("max-memory", "0", "soft memory budget (such as 512M): approaching it, the caches are shed and the buffers are tightened; 0 is unlimited")
+	flagRecordingSize := flag.String("recording-size", "100M", "the recordings of the streams are truncated beyond this size")
+	flag.DurationVar(&recordingKeep, "recording-keep", recordingKeep, "how long a stopped recording can be downloaded")
+	flagReadRate := flag.String("read-rate", "0", "limit of the aggregate disk read bandwidth per second of the root (such as 10M), 0 is unlimited")
+	var corsOrigins []string
+	flag.Func("cors-origin", "origin (or *) allowed to use /tail and the JSON APIs; can be repeated", func(s string) error {
+		corsOrigins = append(corsOrigins, strings.TrimSuffix(s, "/"))
+		return nil
+	})
+	flagName := flag.String("name", "", "name of this instance in the streams (default: the hostname)")
+	flagRootLabel := flag.String("root-label", "", "label of the root in the streams (default: its base name)")
+	flagRootCheck := flag.Duration("root-check", 10*time.Second, "interval of checking whether the root is available (0 disables)")
+	flag.DurationVar(&fsTimeout, "fs-timeout", fsTimeout, "timeout of the stat, readdir and open of the requests, answered with 504 when exceeded (0 disables)")
+	flagStatTimeout := flag.Duration("stat-timeout", 5*time.Second, "the root is degraded if its check takes longer")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", heartbeatInterval, "send a keep-alive comment on streams idle for this long (0 disables)")
+	flagAlerts := flag.String("alerts", "", "JSON file of the alert rules, notifying webhooks, Slack or email of the matching lines")
+	flagSMTP := flag.String("smtp", "", "address of the SMTP server (host:port) sending the email alerts")
+	flagSMTPFrom := flag.String("smtp-from", "webtail", "sender address of the email alerts")
+	flagPipelines := flag.String("pipelines", "", "JSON file of the named line transformer pipelines (\"default\" is applied to every stream)")
+	flag.Func("redact", "redact creditcard, bearer, email or name=regexp matches in every line sent; can be repeated", func(s string) error {
+		rule, err := parseRedactRule(s)
+		if err != nil {
+			return err
+		}
+		if redactions == nil {
+			redactions = &redactor{}
+		}
+		redactions.rules = append(redactions.rules, rule)
+		return nil
+	})
+	flagUsers := flag.String("users", "", "JSON file of the users ([{name, role: viewer|downloader|admin, token|sha256}]), enables authentication")
+	flagOIDCIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL, enables login with it")
+	flagOIDCClientID := flag.String("oidc-client-id", "", "OIDC client ID")
+	flagOIDCClientSecret := flag.String("oidc-client-secret", os.Getenv("WEBTAIL_OIDC_CLIENT_SECRET"), "OIDC client secret")
+	flagOIDCURL := flag.String("oidc-url", "", "external URL of webtail, the OIDC callback is its /auth/callback")
+	flagOIDCClaim := flag.String("oidc-claim", "email", "ID token claim of the user name (matched against the users file)")
+	flagOIDCRole := flag.String("oidc-role", "viewer", "role of the OIDC users not in the users file")
+	flag.Func("auth-outage", "closed (refuse) or open (allow the viewers from the -auth-outage-network networks) while the OIDC issuer or the users file is unavailable", func(s string) error {
+		if s != "closed" && s != "open" {
+			return fmt.Errorf("auth-outage must be closed or open, not %q", s)
+		}
+		authBackend.Open = s == "open"
+		return nil
+	})
+	flag.Func("auth-outage-network", "CIDR network allowed to read during an authentication outage with -auth-outage=open; can be repeated", func(s string) error {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		authBackend.Networks = append(authBackend.Networks, p.Masked())
+		return nil
+	})
+	flagSessionKey := flag.String("session-key", "", "file of the key signing the session cookies (created if missing), so they stay valid across restarts; without it, the key is kept in the -store (shared by the instances), or is random")
+	flagVerbose := flag.Bool("v", false, "verbose (debug) logging")
+	flagConnect := flag.String("connect", "", "agent mode: WebSocket URL of the aggregator to connect to")
+	flagAgentCompress := flag.Bool("agent-compress", true, "agent mode: compress the connection to the aggregator")
+	flag.StringVar(&agents.Token, "agent-token", os.Getenv("WEBTAIL_AGENT_TOKEN"), "shared secret of the agents and the aggregator (empty disables it)")
+	flagAgentCredentials := flag.String("agent-credentials", "", "file of the credentials of the paired agents (imported into the -store, if given), enables pairing agents with join tokens on /admin/agents")
+	flagJoin := flag.String("join", "", "agent mode: one-time join token to pair with the aggregator, when there are no credentials yet")
+	flagCredentials := flag.String("credentials", "webtail-agent.json", "agent mode: file of the credentials got by pairing")
+	var execCommands []string
+	flag.Func("exec", "shell command to run, its output is the @exec/<command> virtual file; can be repeated", func(s string) error {
+		execCommands = append(execCommands, s)
+		return nil
+	})
+	flagStdin := flag.Bool("stdin", false, "read the standard input into the @stdin virtual file")
+	var captureRules []captureRule
+	flag.Func("capture", "glob=regexp: capture the matching lines of the matching files, for the aggregator to fetch even after an outage; can be repeated", func(s string) error {
+		rule, err := parseCaptureRule(s)
+		captureRules = append(captureRules, rule)
+		return err
+	})
+	flagCaptureFile := flag.String("capture-file", "", "file to persist the captured lines in")
+	flagCaptureSize := flag.String("capture-size", "10M", "the oldest captured lines are dropped beyond this size")
+	flag.IntVar(&sharedTails.Keep, "tail-buffer", sharedTails.Keep, "share one reader of each tailed file between its viewers, keeping its last lines for the new ones, see from=buffer of /tail (0: from=buffer reads the whole file)")
+	flag.DurationVar(&removedWait, "removed-wait", 0, "wait this long for a removed file to reappear, following it from its start then (as tail -F); 0 ends its streams at once")
+	flag.DurationVar(&sharedTails.Linger, "tail-linger", sharedTails.Linger, "keep the shared reader of a file this long after its last viewer left")
+	var warmupGlobs []string
+	flag.Func("warmup", "glob of the files whose shared reader is started (and kept), and whose -time-index is built, at startup, after building the file index, see /readyz; can be repeated", func(s string) error {
+		s = path.Clean(s)
+		warmupGlobs = append(warmupGlobs, s)
+		return checkGlob(s)
+	})
+	flag.IntVar(&clientQueueSize, "client-queue", clientQueueSize, "the most lines queued for a slow client")
+	flag.Func("slow-client", "what to do when the queue of a client is full: drop (the oldest lines) or disconnect", func(s string) error {
+		if s != "drop" && s != "disconnect" {
+			return fmt.Errorf("slow-client must be drop or disconnect, not %q", s)
+		}
+		slowClientPolicy = s
+		return nil
+	})
+	flagSocket := flag.String("socket", "", "Unix domain socket to serve the line protocol (TAIL <path>) on; admin-only, created with 0600 permissions")
 	flag.Parse()
-	root, err := filepath.Abs(flag.Arg(0))
+	if err := defaultPoll.check(); err != nil {
+		return err
+	}
+	if agentMode && *flagConnect == "" {
+		return errAgentFlags
+	}
+	if (*flagTLSCert == "") != (*flagTLSKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	lineSize, err := parseByteSize(*flagMaxLineSize)
+	if err != nil {
+		return fmt.Errorf("max-line-size: %w", err)
+	} else if lineSize <= 0 {
+		return fmt.Errorf("max-line-size must be positive, not %d", lineSize)
+	}
+	maxLineSize = int(lineSize)
+	readRate, err := parseByteSize(*flagReadRate)
+	if err != nil {
+		return fmt.Errorf("read-rate: %w", err)
+	}
+	diskLimiter = newRateLimiter(readRate)
+	if recordingSize, err = parseByteSize(*flagRecordingSize); err != nil {
+		return fmt.Errorf("recording-size: %w", err)
+	}
+	if memory.Budget, err = parseByteSize(*flagMaxMemory); err != nil {
+		return fmt.Errorf("max-memory: %w", err)
+	}
+	if authBackend.Open && len(authBackend.Networks) == 0 {
+		return errors.New("auth-outage=open needs at least one -auth-outage-network")
+	}
+	if *flagUsers != "" {
+		if users, err = loadUsers(*flagUsers); errors.Is(err, errUsersUnavailable) {
+			// served (or refused) as an outage until the file is readable
+			authBackend.Set("users", err)
+		} else if err != nil {
+			return err
+		}
+	}
+	if *flagPipelines != "" {
+		if pipelines, err = loadPipelines(*flagPipelines); err != nil {
+			return err
+		}
+	}
+	if *flagParsers != "" {
+		if parserRules, err = loadParserRules(*flagParsers); err != nil {
+			return err
+		}
+	}
+	if *flagAlerts != "" {
+		rules, err := loadAlertRules(*flagAlerts)
+		if err != nil {
+			return err
+		}
+		alerts = &alerter{Rules: rules, SMTP: *flagSMTP, From: *flagSMTPFrom}
+	}
+	if *flagViewerHooks != "" {
+		hooks, err := loadViewerHooks(*flagViewerHooks)
+		if err != nil {
+			return err
+		}
+		viewerHooks = &viewerTracker{Hooks: hooks}
+	}
+	var k8s *k8sClient
+	if *flagK8s != "" {
+		if k8s, err = newK8sClient(*flagK8s); err != nil {
+			return fmt.Errorf("k8s: %w", err)
+		}
+	}
+	var remotes *sshHosts
+	if *flagSSHHosts != "" {
+		if remotes, err = loadSSHHosts(*flagSSHHosts); err != nil {
+			return err
+		}
+		defer remotes.Close()
+	}
+	if *flagVerbose {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+	logToSelf()
+	sandbox, err := newSandbox(flag.Arg(0))
 	if err != nil {
 		return err
 	}
-	FS := os.DirFS(root)
+	defer sandbox.Close()
+	root := sandbox.Dir()
+	FS := fs.FS(timeoutFS{sandbox})
+	sharedTails.FS = FS
+	instance.Host, _ = os.Hostname()
+	instance.Name, instance.Root = *flagName, *flagRootLabel
+	if instance.Name == "" {
+		instance.Name = instance.Host
+	}
+	if instance.Root == "" {
+		instance.Root = filepath.Base(root)
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		p := path.Clean(r.URL.Query().Get("path"))
-		if fi, err := FS.(fs.StatFS).Stat(p); err != nil {
-			slog.Error("stat", "path", p, "root", root, "error", err)
-			p = "/"
-		} else if !fi.Mode().IsDir() {
-			slog.Error("mode", "path", p, "mode", fi.Mode())
-			p = path.Dir(p)
+	// before the login, which keeps its session key in it
+	var st store.Store
+	if *flagStore != "" {
+		if st, err = store.Open(ctx, *flagStore); err != nil {
+			return err
+		}
+		defer st.Close()
+	}
+	sessions.Store = st
+	if users != nil {
+		go users.watch(ctx)
+	}
+	http.Handle("GET /static/", staticHandler())
+	if *flagOIDCIssuer != "" {
+		defaultRole, ok := roleNames[*flagOIDCRole]
+		if !ok {
+			return fmt.Errorf("oidc-role %q: must be viewer, downloader or admin", *flagOIDCRole)
+		}
+		key, err := loadSessionKey(ctx, *flagSessionKey, st)
+		if err != nil {
+			return fmt.Errorf("session key: %w", err)
+		}
+		if oidcLogin, err = newOIDCAuth(ctx, *flagOIDCIssuer, *flagOIDCClientID, *flagOIDCClientSecret, *flagOIDCURL, *flagOIDCClaim, defaultRole, key); err != nil {
+			return err
+		}
+		http.HandleFunc("GET /auth/login", oidcLogin.login)
+		http.HandleFunc("GET /auth/callback", oidcLogin.callback)
+		http.HandleFunc("GET /auth/logout", oidcLogin.logout)
+		go oidcLogin.watch(ctx)
+	}
+	if idleLock > 0 {
+		if users == nil && oidcLogin == nil {
+			return errors.New("-idle-lock requires -users or -oidc-issuer, to authenticate again")
 		}
+		http.Handle("POST /api/v1/unlock", requireRole(roleViewer, http.HandlerFunc(unlockHandler)))
+	}
+	// after the login, as the pages depend on it
+	if err := loadTemplates(*flagTemplates); err != nil {
+		return err
+	}
+	index := newFileIndex(root, FS, *flagRescan)
+	go index.Run(ctx)
+	go memory.Run(ctx)
+	memory.Register(&memoryConsumer{Name: "virtual files", Usage: virtualFiles.Usage, Shed: virtualFiles.Shed})
+	memory.Register(&memoryConsumer{Name: "shared tails", Usage: sharedTails.Usage, Shed: sharedTails.Shed})
+	memory.Register(&memoryConsumer{Name: "client queues", Usage: queuedBytes.Load})
+	// the warmup builds the time index of the files
+	if *flagTimeIndex != "" {
+		if timeIndex, err = openPositionIndex(ctx, *flagTimeIndex); err != nil {
+			return fmt.Errorf("time-index: %w", err)
+		}
+		defer timeIndex.Close()
+	}
+	go warmup.Run(ctx, root, FS, index, warmupGlobs)
+	health := healthHandler{FS: FS, ReadOnly: *flagReadOnly}
+	http.HandleFunc("GET /healthz", health.healthz)
+	http.HandleFunc("GET /readyz", health.readyz)
+	if *flagRootCheck > 0 {
+		rootStatus.Root, rootStatus.Interval, rootStatus.Timeout = root, *flagRootCheck, *flagStatTimeout
+		go rootStatus.Run(ctx)
+	}
+	http.Handle("GET /api/v1/files", requireRole(roleViewer, index))
+	http.Handle("GET /api/v1/grep", requireRole(roleViewer, grepHandler(root, FS)))
+	http.Handle("POST /api/v1/stat", requireRole(roleViewer, statHandler(FS)))
+	sources := sourceTree{Virtual: virtualFiles, Agents: agents, Remotes: remotes}
+	http.Handle("GET /api/v1/sources", requireRole(roleViewer, sources))
+	if alerts != nil {
+		alerts.Store = st
+		alertsDone := make(chan struct{})
+		go func() {
+			defer close(alertsDone)
+			alerts.Run(ctx, root, FS)
+		}()
+		// the states must be saved and the leases released before the store is closed
+		defer func() { cancel(); <-alertsDone }()
+		http.Handle("GET /api/v1/alerts", requireRole(roleViewer, alerts))
+		for _, pattern := range []string{"POST /api/v1/alerts/{name}/silence", "DELETE /api/v1/alerts/{name}/silence", "POST /api/v1/alerts/{name}/ack"} {
+			http.Handle(pattern, requireAdmin(*flagAdminToken, http.HandlerFunc(alerts.control)))
+		}
+		http.Handle("/admin/alerts", requireAdmin(*flagAdminToken, http.HandlerFunc(alerts.admin)))
+	}
+	if *flagAgentCredentials != "" && !agentMode {
+		if pairing, err = loadAgentPairing(ctx, *flagAgentCredentials, st); err != nil {
+			return err
+		}
+		http.HandleFunc("POST /api/v1/agents/pair", pairing.pair)
+		http.Handle("/admin/agents", requireAdmin(*flagAdminToken, pairing))
+	}
+	if (agents.Token != "" || pairing != nil) && !agentMode {
+		http.HandleFunc("GET /api/v1/agents/connect", agents.connect)
+		http.Handle("GET /api/v1/agents", requireRole(roleViewer, agents))
+		http.HandleFunc("/agents/{name}/", agents.proxy)
+		http.HandleFunc("/agents/{name}", agents.proxy)
+	}
+	http.Handle("GET /find", requireRole(roleViewer, http.HandlerFunc(index.find)))
+	http.Handle("GET /split", requireRole(roleViewer, http.HandlerFunc(splitHandler)))
+	http.Handle("GET /replay", requireRole(roleViewer, http.HandlerFunc(replayHandler)))
+	var kiosk kioskBoards
+	if *flagKiosk != "" {
+		if kiosk, err = loadKioskBoards(*flagKiosk); err != nil {
+			return err
+		}
+		http.Handle("GET /kiosk", requireRole(roleViewer, kiosk))
+		http.Handle("GET /kiosk/{name}", requireRole(roleViewer, kiosk))
+	}
+	http.Handle("GET /api/v1/replay", requireRole(roleViewer, replayDataHandler(root, FS)))
 
-		slog.Info("/", "path", p)
-		dis, err := FS.(fs.ReadDirFS).ReadDir(p)
-		if len(dis) == 0 && err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	views, err := newViewCounter(ctx, *flagState, st)
+	if err != nil {
+		return fmt.Errorf("load state from %q: %w", *flagState, err)
+	}
+	viewsSaved := make(chan struct{})
+	go func() {
+		defer close(viewsSaved)
+		if err := views.Run(ctx); err != nil {
+			slog.Error("save view counts", "file", *flagState, "error", err)
+		}
+	}()
+	// the last save must finish before the store is closed
+	defer func() { cancel(); <-viewsSaved }()
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		http.Handle(method+" /api/v1/favorites", requireRole(roleViewer, http.HandlerFunc(favoritesHandler)))
+	}
+	http.Handle("GET /api/v1/popular", requireRole(roleAdmin, views))
+	var saved *savedViews
+	if st != nil {
+		saved = &savedViews{Store: st}
+		http.Handle("GET /api/v1/views", requireRole(roleViewer, saved))
+		for _, method := range []string{"PUT", "DELETE"} {
+			http.Handle(method+" /api/v1/views/{name}", requireRole(roleViewer, saved))
+		}
+		http.Handle("GET /views/{name}", requireRole(roleViewer, http.HandlerFunc(saved.open)))
+	}
+	if *flagGraphQL {
+		http.Handle("POST /graphql", requireRole(roleViewer, graphQLHandler(root, FS, index, saved)))
+	}
+	http.Handle("POST /api/v1/verify", requireRole(roleViewer, http.HandlerFunc(verifyHandler)))
+
+	var demo *demoSource
+	if *flagDev {
+		if demo, err = newDemoSource(); err != nil {
+			return err
 		}
+		go func() {
+			if err := demo.Run(ctx); err != nil {
+				slog.Error("demo", "error", err)
+			}
+		}()
+		http.Handle("POST /dev/chaos/{action}", requireRole(roleAdmin, demo))
+	}
+
+	http.Handle("/", requireRole(roleViewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean(strings.TrimPrefix(r.URL.Query().Get("path"), "/"))
+		rootErr := rootStatus.Err()
+		var dis []fs.DirEntry
+		// do not block on a hung root
+		if rootErr == nil {
+			if fi, err := FS.(fs.StatFS).Stat(p); err != nil {
+				slog.Error("stat", "path", p, "root", root, "error", err)
+				if errors.Is(err, errFSTimeout) {
+					http.Error(w, err.Error(), http.StatusGatewayTimeout)
+					return
+				}
+				p = "."
+			} else if !fi.Mode().IsDir() {
+				slog.Error("mode", "path", p, "mode", fi.Mode())
+				p = path.Dir(p)
+			}
 
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(200)
-		io.WriteString(w, `<!DOCTYPE html>
-<html>
-    <head>
-        <title>WebTail</title>
-    </head>
-<body>
-<p>
-<ul>
-`)
+			var err error
+			if dis, err = FS.(fs.ReadDirFS).ReadDir(p); len(dis) == 0 && err != nil {
+				http.Error(w, err.Error(), fsStatusCode(err, http.StatusInternalServerError))
+				return
+			}
+		}
+		logAttrs(r.Context(), "dir", p)
+
+		page := indexPage{
+			Find:        findForm{Dir: p},
+			Breadcrumbs: breadcrumbs(instance.Root, p),
+			Maintenance: maintenance.Get(),
+			RootError:   rootErr,
+			Links:       []pageLink{{Title: "split view", URL: "./split"}, {Title: "replay", URL: "./replay"}},
+			Sources:     sources.Tree(r.Context()),
+			Favorites:   pathsSection{Title: "Favorites", Paths: readPaths(r, favoriteCookie)},
+			Recent:      pathsSection{Title: "Recent", Paths: readPaths(r, recentCookie)},
+		}
+		if hasRole(r, roleAdmin) {
+			// the view counts are metrics, as GET /api/v1/popular
+			page.Top = views.Top(10)
+		}
+		var err error
+		if page.SavedViews, err = saved.List(r.Context()); err != nil {
+			slog.Error("list saved views", "error", err)
+		} else if len(page.SavedViews) > maxIndexSavedViews {
+			page.MoreSavedViews = len(page.SavedViews) - maxIndexSavedViews
+			page.SavedViews = page.SavedViews[:maxIndexSavedViews]
+		}
+		if wp := warmup.Progress(); !wp.Ready {
+			page.Warmup = &wp
+		}
+		if *flagJournal {
+			page.Links = append(page.Links, pageLink{Title: "systemd journal", URL: "./journal"})
+		}
+		if *flagDocker != "" {
+			page.Links = append(page.Links, pageLink{Title: "containers", URL: "./containers"})
+		}
+		if k8s != nil {
+			page.Links = append(page.Links, pageLink{Title: "Kubernetes pods", URL: "./pods"})
+		}
+		if remotes != nil {
+			page.Links = append(page.Links, pageLink{Title: "remote hosts", URL: "./hosts"})
+		}
+		if kiosk != nil {
+			page.Links = append(page.Links, pageLink{Title: "wallboards", URL: "./kiosk"})
+		}
+		if demo != nil {
+			page.Links = append(page.Links, pageLink{Title: demoName, URL: "./file?path=" + demoName})
+		}
+		if p != "." {
+			page.Entries = append(page.Entries, dirEntry{Kind: "dir", Name: "..", Path: path.Dir(p)})
+		}
 		for _, di := range dis {
-			bn := di.Name()
-			afn := path.Join(p, bn)
-			var prefix string
+			de := dirEntry{Name: di.Name(), Path: path.Join(p, di.Name())}
 			if di.Type().IsDir() {
-				prefix = "dir"
+				de.Kind = "dir"
 			} else if di.Type().IsRegular() {
-				prefix = "file"
+				de.Kind = "file"
 			} else {
 				continue
 			}
-			io.WriteString(w, "<li><a href=\"./"+prefix+"?path="+url.PathEscape(afn)+"\">"+html.EscapeString(bn)+"</a></li>\n")
+			page.Entries = append(page.Entries, de)
 		}
-		io.WriteString(w, `
-	</ul></p>
-</body>
-</html>`)
-	})
+		renderPage(w, "index.html", page)
+	})))
 
-	http.HandleFunc("GET /file", func(w http.ResponseWriter, r *http.Request) {
-		fn := path.Clean(r.URL.Query().Get("path"))
-		if fi, err := FS.(fs.StatFS).Stat(fn); err != nil {
-			slog.Error("stat", "file", fn, "error", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		} else if !fi.Mode().IsRegular() {
-			slog.Error("not regular", "file", fn, "mode", fi.Mode())
-			http.Error(w, fmt.Sprintf("%q is not a regular file (%v)", fn, fi), http.StatusBadRequest)
+	http.Handle("GET /hexdump", requireRole(roleDownloader, hexdumpHandler(root, FS)))
+	http.Handle("GET /raw", requireRole(roleDownloader, rawHandler(root, FS)))
+	http.Handle("GET /head", requireRole(roleViewer, headHandler(root, FS)))
+	http.Handle("GET /view", requireRole(roleViewer, viewHandler(root, FS)))
+	http.Handle("GET /diff", requireRole(roleViewer, diffHandler(root, FS)))
+	http.Handle("GET /stats", requireRole(roleViewer, statsHandler(root, FS)))
+	http.Handle("GET /stat", requireRole(roleViewer, fileStatHandler(root, FS)))
+	http.Handle("GET /file", requireRole(roleViewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pattern := r.URL.Query().Get("glob"); pattern != "" {
+			writeViewer(w, pattern, "./tail?"+r.URL.RawQuery)
 			return
 		}
+		fn := path.Clean(r.URL.Query().Get("path"))
+		if (demo == nil || fn != demoName) && virtualFiles.Lookup(fn) == nil {
+			if err := rootStatus.Err(); err != nil {
+				w.Header().Set("Retry-After", "60")
+				http.Error(w, "root unavailable: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if fi, err := FS.(fs.StatFS).Stat(fn); err != nil {
+				slog.Error("stat", "file", fn, "error", err)
+				http.Error(w, err.Error(), fsStatusCode(err, http.StatusBadRequest))
+				return
+			} else if !fi.Mode().IsRegular() {
+				slog.Error("not regular", "file", fn, "mode", fi.Mode())
+				http.Error(w, fmt.Sprintf("%q is not a regular file (%v)", fn, fi), http.StatusBadRequest)
+				return
+			}
+		}
 
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(200)
-		io.WriteString(w, `<!DOCTYPE html>
-<html>
-    <head>
-        <title>WebTail</title>
+		if fn != demoName && virtualFiles.Lookup(fn) == nil && !r.URL.Query().Has("text") {
+			if fh, _, err := openTail(root, FS, fn); err == nil {
+				binary, _ := isBinary(fh)
+				fh.Close()
+				if binary {
+					http.Redirect(w, r, "./hexdump?"+url.Values{"path": {fn}}.Encode(), http.StatusSeeOther)
+					return
+				}
+			}
+		}
 
-        <script src="https://unpkg.com/htmx.org@2.0.1" integrity="sha384-QWGpdj554B4ETpJJC9z+ZHJcA/i59TyjxEPXiiUgN2WmTyV5OEZWCD6gQhgkdpB/" crossorigin="anonymous"></script>
-        <script src="https://unpkg.com/htmx-ext-sse@2.2.1/sse.js"></script>
-    </head>
-    <body>
-        <h1>`+html.EscapeString(fn)+`</h1>
-        <pre hx-ext="sse" sse-connect="/tail?left=&right=`+
-			url.QueryEscape(`<br>`)+
-			`&file=`+
-			url.QueryEscape(fn)+
-			`" sse-swap="message" hx-swap="beforebegin swap:1s">
-        </pre>
-    </body>
-</html>`)
-	})
+		logAttrs(r.Context(), "file", fn)
+		addRecent(w, r, fn)
+		// pass the viewer options (record, cont...) through to /tail
+		tailQuery := r.URL.Query()
+		tailQuery.Del("path")
+		for _, k := range viewStateKeys {
+			tailQuery.Del(k)
+		}
+		tailQuery.Set("file", fn)
+		if !tailQuery.Has("from") && !tailQuery.Has("lines") {
+			// the viewer starts with the recent lines
+			tailQuery.Set("from", "buffer")
+		}
+		if _, ok := parserRuleOf(fn); ok && !tailQuery.Has("parse") {
+			// the column view
+			tailQuery.Set("parse", "1")
+		}
+		if virtualFiles.Lookup(fn) == nil && fn != demoName {
+			tailQuery.Set("stat", "1")
+			// the offsets of the lines, for their permalinks
+			tailQuery.Add("annotate", "offset")
+		}
+		// the rate of the lines, and whether they are throttled or dropped
+		tailQuery.Set("rate", "1")
+		writeViewer(w, fn, "./tail?"+tailQuery.Encode())
+	})))
 
-	http.HandleFunc("/tail", func(w http.ResponseWriter, r *http.Request) {
-		q := r.URL.Query()
-		left := q.Get("left")
-		right := q.Get("right")
-		fn := path.Clean(q.Get("file"))
-		if fi, err := FS.(fs.StatFS).Stat(fn); err != nil {
-			slog.Error("stat", "file", fn, "root", root, "error", err)
-			http.Error(w, err.Error(), http.StatusNotFound)
+	var docker *dockerClient
+	if *flagDocker != "" {
+		docker = newDockerClient(*flagDocker)
+		http.Handle("GET /containers", requireRole(roleViewer, docker))
+	}
+	if k8s != nil {
+		http.Handle("GET /pods", requireRole(roleViewer, k8s))
+	}
+	if remotes != nil {
+		http.Handle("GET /hosts", requireRole(roleViewer, remotes))
+	}
+
+	subscriptions := &subscriptionRegistry{root: root, FS: FS}
+	http.Handle("POST /api/v1/subscriptions", requireRole(roleViewer, http.HandlerFunc(subscriptions.handleCreate)))
+	http.Handle("GET /api/v1/subscriptions/{id}", requireRole(roleViewer, http.HandlerFunc(subscriptions.handleGet)))
+	http.Handle("DELETE /api/v1/subscriptions/{id}", requireRole(roleViewer, http.HandlerFunc(subscriptions.handleDelete)))
+	http.Handle("GET /api/v1/subscriptions/{id}/stream", requireRole(roleViewer, refuseWhenFrozen(http.HandlerFunc(subscriptions.handleStream))))
+	http.Handle("POST /api/v1/subscriptions/{id}/sources", requireRole(roleViewer, http.HandlerFunc(subscriptions.handleAdd)))
+	http.Handle("DELETE /api/v1/subscriptions/{id}/sources/{source}", requireRole(roleViewer, http.HandlerFunc(subscriptions.handleRemove)))
+	http.Handle("POST /api/v1/recordings", requireRole(roleViewer, http.HandlerFunc(recordings.handleStart)))
+	http.Handle("POST /api/v1/recordings/{id}/stop", requireRole(roleViewer, http.HandlerFunc(recordings.handleStop)))
+	http.Handle("GET /recordings/{id}", requireRole(roleViewer, http.HandlerFunc(recordings.handleDownload)))
+	http.Handle("POST /api/v1/streams/{id}/flush", requireRole(roleViewer, http.HandlerFunc(recordings.handleFlush)))
+	http.Handle("GET /admin/streams", requireAdmin(*flagAdminToken, http.HandlerFunc(recordings.handleStreams)))
+	http.Handle("POST /admin/streams/{id}/flush", requireAdmin(*flagAdminToken, http.HandlerFunc(recordings.handleAdminFlush)))
+	defer recordings.Close()
+	http.Handle("GET /api/v1/maintenance", requireRole(roleViewer, maintenance))
+	http.Handle("GET /api/v1/root", rootStatus)
+	http.Handle("/admin/maintenance", requireAdmin(*flagAdminToken, maintenance))
+	if users != nil || oidcLogin != nil {
+		http.Handle("GET /admin/sessions", requireAdmin(*flagAdminToken, sessions))
+		http.Handle("DELETE /admin/sessions/{key}", requireAdmin(*flagAdminToken, sessions))
+	}
+	http.Handle("GET /admin/redactions", requireAdmin(*flagAdminToken, redactions))
+	http.Handle("GET /admin/memory", requireAdmin(*flagAdminToken, memory))
+	if *flagAudit != "" {
+		if audit, err = openAudit(ctx, *flagAudit); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+		defer audit.Close()
+		http.Handle("GET /audit", requireAdmin(*flagAdminToken, http.HandlerFunc(auditHandler)))
+	}
+
+	http.Handle("/tail", requireRole(roleViewer, refuseWhenFrozen(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if docker != nil && r.URL.Query().Has("container") {
+			docker.TailHandler(w, r)
 			return
-		} else if !fi.Mode().IsRegular() {
-			slog.Error("not regular", "file", fn, "root", root, "mode", fi.Mode())
-			http.Error(w, fmt.Sprintf("%q is not a regular file (%v)", fn, fi.Mode()), http.StatusBadRequest)
+		}
+		if k8s != nil && r.URL.Query().Has("pod") {
+			k8s.TailHandler(w, r)
 			return
 		}
-
-		slog.Info("tail", "URL", r.URL, "method", r.Method, "file", fn)
-		afn, err := filepath.Abs(filepath.Join(root, filepath.FromSlash(fn)))
+		if remotes != nil && r.URL.Query().Has("host") {
+			remotes.TailHandler(w, r)
+			return
+		}
+		opts, err := parseSSEOptions(r.URL.Query())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if !strings.HasPrefix(afn, root) {
-			http.Error(w, fmt.Sprintf("only files under %q can be tailed (%q)", root, afn), http.StatusBadRequest)
+		poll, err := parsePollOptions(r.URL.Query(), defaultPoll)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		fh, err := os.Open(afn)
+		if pattern := r.URL.Query().Get("glob"); pattern != "" {
+			pattern = path.Clean(pattern)
+			if err := checkGlob(pattern); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			merge, err := parseMergeOptions(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logAttrs(r.Context(), "glob", pattern)
+			linesCh := make(chan Line)
+			go func() {
+				if err := tailGlob(r.Context(), linesCh, root, FS, pattern, poll, merge, nil); err != nil {
+					slog.Error("glob tail", "glob", pattern, "error", err)
+				}
+			}()
+			streamEvents(w, r, linesCh, opts)
+			return
+		}
+		fn := path.Clean(r.URL.Query().Get("file"))
+		if vf := virtualFiles.Lookup(fn); vf != nil {
+			logAttrs(r.Context(), "file", fn)
+			views.Inc(fn)
+			linesCh := make(chan Line)
+			go vf.Tail(r.Context(), linesCh)
+			streamEvents(w, r, linesCh, opts)
+			return
+		}
+		var fh *os.File
+		if demo != nil && fn == demoName {
+			fh, err = demo.Open()
+		} else {
+			var code int
+			if fh, code, err = openTail(root, FS, fn); err != nil {
+				http.Error(w, err.Error(), code)
+				return
+			}
+			if binary, _ := isBinary(fh); binary && !r.URL.Query().Has("text") {
+				fh.Close()
+				http.Error(w, fmt.Sprintf("%q is binary, see /hexdump?path=%s (or force with text=1)", fn, url.QueryEscape(fn)), http.StatusUnsupportedMediaType)
+				return
+			}
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer fh.Close()
-		fl, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, fmt.Sprintf("%T, not a http.Flusher", w), http.StatusInternalServerError)
+		logAttrs(r.Context(), "file", fn)
+		views.Inc(fn)
+		// the offset to follow the file from, instead of its end (or the shared buffer)
+		from := int64(-1)
+		if id := cmp.Or(r.Header.Get("Last-Event-ID"), r.URL.Query().Get("lastEventId")); id != "" {
+			off, sum, err := parseEventID(id)
+			if err == nil {
+				from, err = resumeOffset(r.Context(), fh, off, sum)
+			}
+			if err != nil {
+				slog.Info("restart", "file", fn, "id", id, "reason", err)
+				from = -1
+				opts.Initial = append(opts.Initial, metaEvent{Kind: "restart", Data: struct {
+					Reason string `json:"reason"`
+				}{Reason: err.Error()}})
+			}
+		}
+		if opts.Parser, err = parseFile(r.Context(), r.URL.Query(), fn, fh); err != nil {
+			fh.Close()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if opts.Parser != nil {
+			opts.Initial = append(opts.Initial, metaEvent{Kind: "columns", Data: columnsEvent{Columns: opts.Parser.Columns()}})
+		}
+		// where to start, if not resumed: the end of the file by default (see tailStart)
+		start, err := parseTailStart(r.URL.Query())
+		after := int64(-1)
+		if err == nil && from < 0 {
+			switch start.Kind {
+			case "lines":
+				// the last lines, then the live ones
+				var bf backfilled
+				if bf.Lines, bf.Offset, err = backfill(r.Context(), fh, int(min(start.N, maxPageLines))); err == nil {
+					bf.Count, opts.Backfill, from = len(bf.Lines), &bf, bf.Offset
+				}
+			case "start":
+				from = 0
+			case "offset":
+				from, err = lineStartAfter(r.Context(), fh, start.N)
+			case "end":
+				after, err = tailSeam(r.Context(), fh)
+			}
+		}
+		if err != nil {
+			fh.Close()
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Set headers for SSE
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+		if demo == nil || fn != demoName {
+			var unsubscribe func()
+			opts.FileMeta, unsubscribe = fileMeta.Subscribe(fn)
+			defer unsubscribe()
+		}
+		if r.URL.Query().Has("stat") && (demo == nil || fn != demoName) {
+			// the stats panel
+			smp, release := fileStats.Watch(root, FS, fn)
+			defer release()
+			var unsubscribe func()
+			opts.Meta, unsubscribe = smp.Subscribe()
+			defer unsubscribe()
+		}
 
-		ctx := r.Context()
-		linesCh := make(chan string)
-		go tailFile(ctx, linesCh, fh)
+		linesCh := make(chan Line)
+		if from >= 0 {
+			if fi, err := fh.Stat(); err == nil {
+				opts.CatchUp = fi.Size()
+			}
+			go func() {
+				if err := followFile(r.Context(), linesCh, FS, fn, fh, poll, from); err != nil {
+					slog.Warn("tail", "file", fn, "error", err)
+				}
+			}()
+		} else if demo != nil && fn == demoName {
+			go tailFile(r.Context(), linesCh, fh, poll)
+		} else {
+			go sharedTails.TailFile(r.Context(), linesCh, fn, fh, poll, after)
+		}
+		streamEvents(w, r, linesCh, opts)
+	}))))
 
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-		bw := bufio.NewWriter(w)
-		// Create a channel to send data
-		for {
-			select {
-			case <-ctx.Done():
-				return
+	if *flagJournal {
+		http.Handle("GET /journal", requireRole(roleViewer, http.HandlerFunc(journalHandler)))
+		http.Handle("GET /journal/tail", requireRole(roleViewer, refuseWhenFrozen(http.HandlerFunc(journalTailHandler))))
+	}
 
-			case line, ok := <-linesCh:
-				if !ok {
-					bw.Flush()
-					fl.Flush()
-					return
-				}
-				bw.WriteString("data: ")
-				if left == "" && right == "" {
-					bw.WriteString(line)
-				} else {
-					bw.WriteString(left)
-					bw.WriteString(html.EscapeString(line))
-					bw.WriteString(right)
-				}
-				bw.WriteString("\n\n")
+	if *flagGELF != "" {
+		go func() {
+			if err := serveGELF(ctx, *flagGELF); err != nil {
+				slog.Error("serve GELF", "addr", *flagGELF, "error", err)
+			}
+		}()
+	}
 
-			case <-ticker.C:
-				if bw.Buffered() != 0 {
-					bw.Flush()
-					fl.Flush()
-				}
+	if *flagFluent != "" {
+		go func() {
+			if err := serveFluent(ctx, *flagFluent); err != nil {
+				slog.Error("serve fluent", "addr", *flagFluent, "error", err)
 			}
+		}()
+	}
+
+	for _, command := range execCommands {
+		go runExec(ctx, command)
+	}
+	if *flagStdin {
+		go func() {
+			if err := readStdin(ctx, os.Stdin); err != nil {
+				slog.Error("read stdin", "error", err)
+			}
+		}()
+	}
+
+	if len(captureRules) != 0 {
+		size, err := parseByteSize(*flagCaptureSize)
+		if err != nil {
+			return fmt.Errorf("capture-size: %w", err)
 		}
-	})
+		cs, err := openCaptureStore(*flagCaptureFile, size)
+		if err != nil {
+			return err
+		}
+		memory.Register(&memoryConsumer{Name: "capture", Usage: cs.Usage})
+		go runCapture(ctx, cs, root, FS, captureRules)
+		http.Handle("GET /api/v1/capture", requireRole(roleViewer, cs))
+	}
 
-	slog.Info("Listen", "addr", *flagAddr, "root", root)
-	return httpunix.ListenAndServe(ctx, *flagAddr, http.DefaultServeMux)
-}
+	if *flagSocket != "" {
+		go func() {
+			if err := serveSocket(ctx, *flagSocket, root, FS); err != nil {
+				slog.Error("serve socket", "socket", *flagSocket, "error", err)
+			}
+		}()
+	}
 
-func tailFile(ctx context.Context, linesCh chan<- string, fh *os.File) error {
-	defer func() {
-		slog.Info("finish", "tail", fh.Name())
-		fh.Close()
-		close(linesCh)
-	}()
-	var off int64
-	var a [16384]byte
-	var start int
-	dur := time.Second
-	timer := time.NewTimer(dur)
-	for {
-		n, err := fh.ReadAt(a[start:], off)
-		slog.Info("ReadAt", "off", off, "start", start, "n", n, "error", err)
-		if n == 0 {
-			dur += time.Duration(float32(time.Second) * rand.Float32())
-			timer.Reset(dur)
-			select {
-			case <-timer.C:
-			case <-ctx.Done():
-				return nil
+	http.Handle("GET /api/v1/server", requireRole(roleViewer, newServerReport(map[string]bool{
+		"agent": agentMode, "aggregator": (agents.Token != "" || pairing != nil) && !agentMode, "pairing": pairing != nil,
+		"admin": *flagAdminToken != "", "alerts": alerts != nil, "audit": *flagAudit != "",
+		"authentication": users != nil || oidcLogin != nil, "oidc": oidcLogin != nil,
+		"capture": len(captureRules) != 0, "cors": len(corsOrigins) != 0, "dev": *flagDev, "parsers": parserRules != nil,
+		"docker": docker != nil, "kiosk": kiosk != nil, "exec": len(execCommands) != 0, "fluent": *flagFluent != "",
+		"gelf": *flagGELF != "", "graphql": *flagGraphQL, "journal": *flagJournal, "k8s": k8s != nil,
+		"pipelines": pipelines != nil, "read-only": *flagReadOnly, "redact": redactions != nil, "saved-views": saved != nil,
+		"socket": *flagSocket != "", "ssh": remotes != nil, "stdin": *flagStdin, "store": st != nil,
+		"templates": *flagTemplates != "", "time-index": timeIndex != nil, "viewer-hooks": *flagViewerHooks != "",
+	}, serverLimits{
+		MaxLineSize: maxLineSize, MaxMemory: memory.Budget, ReadRate: readRate, RecordingSize: recordingSize,
+		FSTimeout: fsTimeout.String(), Heartbeat: heartbeatInterval.String(),
+		MinInterval: defaultPoll.Min.String(), MaxInterval: defaultPoll.Max.String(),
+	})))
+	var mux http.Handler = http.DefaultServeMux
+	if *flagReadOnly {
+		slog.Warn("read-only mode")
+		mux = refuseWrites(mux)
+	}
+	handler := withAccessLog(withCORS(corsOrigins, withSecurityHeaders(*flagCSP, mux)))
+	if agentMode {
+		token := agents.Token
+		creds, err := loadAgentCredentials(*flagCredentials)
+		if errors.Is(err, fs.ErrNotExist) && *flagJoin != "" {
+			if creds, err = pairAgent(ctx, *flagConnect, *flagJoin, *flagCredentials); err == nil {
+				slog.Warn("paired with the aggregator, ask its admin to approve", "name", creds.Name, "credentials", *flagCredentials)
 			}
-			continue
-		}
-		dur = time.Second
-		off += int64(n)
-		p := a[:start+n]
-		for {
-			if i := bytes.IndexByte(p, '\n'); i < 0 {
-				start = copy(a[0:], p)
-				break
-			} else {
-				select {
-				case <-ctx.Done():
-					return nil
-				case linesCh <- string(p[:i]):
-					p = p[i+1:]
-				}
+		}
+		if err == nil {
+			if creds.Name != instance.Name {
+				return fmt.Errorf("the credentials in %q are of %q, not %q", *flagCredentials, creds.Name, instance.Name)
 			}
+			token = creds.Secret
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
 		}
-		if err != nil && !errors.Is(err, io.EOF) {
+		slog.Info("Agent", "connect", *flagConnect, "root", root)
+		return runAgent(ctx, *flagConnect, token, *flagAgentCompress, handler)
+	}
+	srv := newHTTPServer(handler)
+	if ln, err := systemdListener(); err != nil {
+		return fmt.Errorf("systemd socket activation: %w", err)
+	} else if ln != nil {
+		slog.Info("Listen", "systemd", ln.Addr(), "root", root, "tls", *flagTLSCert != "")
+		return serveListener(ctx, ln, srv, *flagTLSCert, *flagTLSKey)
+	}
+	slog.Info("Listen", "addr", *flagAddr, "root", root, "tls", *flagTLSCert != "")
+	if *flagTLSCert != "" {
+		ln, err := net.Listen("tcp", *flagAddr)
+		if err != nil {
 			return err
 		}
+		return serveListener(ctx, ln, srv, *flagTLSCert, *flagTLSKey)
 	}
+	// the timeouts of httpunix.ListenAndServe
+	srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout = time.Minute, 15*time.Second, time.Hour, 5*time.Minute
+	return httpunix.ListenAndServeSrv(ctx, *flagAddr, srv)
 }
@@ -0,0 +1,166 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Memory pressure levels, by the heap use compared to the budget.
+const (
+	memoryNormal = iota
+	// memoryTight is above 80% of the budget: the caches are shed, the client queues are shortened.
+	memoryTight
+	// memoryCritical is above 95% of the budget: the buffers are trimmed, too.
+	memoryCritical
+)
+
+// memoryConsumer is a part of webtail holding memory: a ring buffer, a cache or the client queues.
+type memoryConsumer struct {
+	Name string
+	// Usage returns the bytes held (approximately).
+	Usage func() int64
+	// Shed releases memory, according to the pressure level; may be nil.
+	Shed func(level int)
+}
+
+// memoryAccountant keeps the memory use of webtail under the soft Budget (if positive),
+// instead of letting the OOM killer decide:
+// as the heap approaches the budget, it asks the registered consumers to shed memory,
+// and the client queues are shortened.
+type memoryAccountant struct {
+	Budget int64
+
+	level atomic.Int32
+
+	mu        sync.Mutex
+	consumers map[*memoryConsumer]struct{}
+}
+
+// memory is the accountant of this server.
+var memory = &memoryAccountant{}
+
+// Register the consumer, returning a function to unregister it.
+func (ma *memoryAccountant) Register(c *memoryConsumer) func() {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if ma.consumers == nil {
+		ma.consumers = make(map[*memoryConsumer]struct{})
+	}
+	ma.consumers[c] = struct{}{}
+	return func() {
+		ma.mu.Lock()
+		delete(ma.consumers, c)
+		ma.mu.Unlock()
+	}
+}
+
+// Level returns the current pressure level.
+func (ma *memoryAccountant) Level() int { return int(ma.level.Load()) }
+
+// QueueLimit returns the length limit of a client queue of size n, under the current pressure.
+func (ma *memoryAccountant) QueueLimit(n int) int {
+	switch ma.Level() {
+	case memoryTight:
+		return max(100, n/4)
+	case memoryCritical:
+		return max(100, n/16)
+	}
+	return n
+}
+
+// heapBytes returns the bytes of the live and not yet collected objects of the heap,
+// which the budget is compared to.
+func heapBytes() int64 {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64())
+}
+
+// Run checks the heap every second, and sheds memory under pressure, until ctx is canceled.
+// It also sets the memory limit of the runtime to the budget, so the GC works harder near it.
+func (ma *memoryAccountant) Run(ctx context.Context) {
+	if ma.Budget <= 0 {
+		return
+	}
+	debug.SetMemoryLimit(ma.Budget)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		heap := heapBytes()
+		level := memoryNormal
+		switch {
+		case heap >= ma.Budget*95/100:
+			level = memoryCritical
+		case heap >= ma.Budget*80/100:
+			level = memoryTight
+		}
+		if old := ma.level.Swap(int32(level)); int(old) != level {
+			slog.Warn("memory pressure", "level", level, "heap", heap, "budget", ma.Budget, "consumers", ma.usage())
+		}
+		if level == memoryNormal {
+			continue
+		}
+		ma.mu.Lock()
+		consumers := make([]*memoryConsumer, 0, len(ma.consumers))
+		for c := range ma.consumers {
+			if c.Shed != nil {
+				consumers = append(consumers, c)
+			}
+		}
+		ma.mu.Unlock()
+		for _, c := range consumers {
+			c.Shed(level)
+		}
+	}
+}
+
+// consumerUsage is the memory held by a consumer.
+type consumerUsage struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// usage returns the memory held by each consumer (of the same name summed), the biggest first.
+func (ma *memoryAccountant) usage() []consumerUsage {
+	ma.mu.Lock()
+	m := make(map[string]int64, len(ma.consumers))
+	for c := range ma.consumers {
+		m[c.Name] += c.Usage()
+	}
+	ma.mu.Unlock()
+	list := make([]consumerUsage, 0, len(m))
+	for k, v := range m {
+		list = append(list, consumerUsage{Name: k, Bytes: v})
+	}
+	slices.SortFunc(list, func(a, b consumerUsage) int { return cmp.Compare(b.Bytes, a.Bytes) })
+	return list
+}
+
+// ServeHTTP returns the budget, the heap, the pressure level and the usage of the consumers as JSON.
+func (ma *memoryAccountant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Budget    int64           `json:"budget"`
+		Heap      int64           `json:"heap"`
+		Level     int             `json:"level"`
+		Consumers []consumerUsage `json:"consumers"`
+	}{Budget: ma.Budget, Heap: heapBytes(), Level: ma.Level(), Consumers: ma.usage()})
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxMergeLines is the most lines held back for reordering;
+// beyond it the earliest line is sent even if it has not waited the whole window.
+const maxMergeLines = 10_000
+
+// mergeOptions are the options of interleaving the lines of several files
+// in the order of their timestamps.
+type mergeOptions struct {
+	// Layout of the timestamps at the start of the lines, as in the time package.
+	Layout string
+	// Window is how long a line is held back, waiting for earlier lines of the other files.
+	Window time.Duration
+	// fields is the number of space separated fields of the timestamp.
+	fields int
+}
+
+// parseMergeOptions parses the merge=ts, ts-layout and merge-window query parameters.
+// It returns nil without merge=ts.
+func parseMergeOptions(q url.Values) (*mergeOptions, error) {
+	switch s := q.Get("merge"); s {
+	case "":
+		return nil, nil
+	case "ts":
+	default:
+		return nil, fmt.Errorf("merge=%q: only ts is known", s)
+	}
+	mo := newTimestampLayout(q.Get("ts-layout"))
+	mo.Window = 2 * time.Second
+	if s := q.Get("merge-window"); s != "" {
+		var err error
+		if mo.Window, err = time.ParseDuration(s); err != nil || mo.Window < 0 {
+			return nil, fmt.Errorf("merge-window=%q: not a duration", s)
+		}
+	}
+	return mo, nil
+}
+
+// newTimestampLayout returns the options parsing the timestamps of the layout
+// (time.RFC3339Nano if empty), as the ts-layout query parameter.
+func newTimestampLayout(layout string) *mergeOptions {
+	mo := mergeOptions{Layout: cmp.Or(layout, time.RFC3339Nano)}
+	mo.fields = len(strings.Fields(mo.Layout))
+	return &mo
+}
+
+// timestamp parses the time at the start of text:
+// as many space separated fields as there are in the layout.
+// Timestamps without a time zone are in the local one.
+func (mo *mergeOptions) timestamp(text string) (time.Time, bool) {
+	fields := strings.SplitN(strings.TrimLeft(text, " "), " ", mo.fields+1)
+	if len(fields) < mo.fields {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(mo.Layout, strings.Join(fields[:mo.fields], " "), time.Local)
+	return t, err == nil
+}
+
+// timedLine is a line with the timestamp it is ordered by.
+type timedLine struct {
+	Line
+	at time.Time
+	// seq is the order of receiving the line.
+	seq uint64
+}
+
+// arrival is when the line of the seq was received.
+type arrival struct {
+	seq  uint64
+	recv time.Time
+}
+
+// lineHeap orders the lines by their timestamp, then their receive order.
+type lineHeap []timedLine
+
+func (h lineHeap) Len() int { return len(h) }
+func (h lineHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h lineHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *lineHeap) Push(x any)   { *h = append(*h, x.(timedLine)) }
+func (h *lineHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeLines sends the lines read from in to out in the order of their timestamps,
+// holding each line back for the window after its arrival, to let the earlier lines of slower files arrive.
+// When a line has waited the window, it is sent with all the lines of earlier timestamps,
+// so a line arriving late with an early timestamp does not hold back the lines which arrived before it.
+// It closes out when in is closed, or ctx is canceled.
+func mergeLines(ctx context.Context, out chan<- Line, in <-chan timedLine, window time.Duration) {
+	defer close(out)
+	var h lineHeap
+	var seq uint64
+	// arrivals are the lines held back in their order of arrival, and sent are the seqs
+	// of the lines sent before the ones arrived earlier.
+	var arrivals []arrival
+	sent := make(map[uint64]struct{})
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	send := func() bool {
+		tl := heap.Pop(&h).(timedLine)
+		sent[tl.seq] = struct{}{}
+		for len(arrivals) != 0 {
+			if _, ok := sent[arrivals[0].seq]; !ok {
+				break
+			}
+			delete(sent, arrivals[0].seq)
+			arrivals = arrivals[1:]
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case out <- tl.Line:
+			return true
+		}
+	}
+	for {
+		now := time.Now()
+		for h.Len() != 0 && (h.Len() > maxMergeLines || now.Sub(arrivals[0].recv) >= window) {
+			if !send() {
+				return
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var wait <-chan time.Time
+		if h.Len() != 0 {
+			timer.Reset(window - now.Sub(arrivals[0].recv))
+			wait = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait:
+		case tl, ok := <-in:
+			if !ok {
+				for h.Len() != 0 {
+					if !send() {
+						return
+					}
+				}
+				return
+			}
+			seq++
+			tl.seq = seq
+			heap.Push(&h, tl)
+			arrivals = append(arrivals, arrival{seq: seq, recv: time.Now()})
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"sync"
+)
+
+// metaEvent is an out-of-band notification, sent to the viewers as an SSE "meta" event.
+type metaEvent struct {
+	Kind string `json:"kind"`
+	Data any    `json:"data,omitempty"`
+}
+
+// metaHub broadcasts server-wide meta events to all connected streams.
+type metaHub struct {
+	mu     sync.Mutex
+	subs   map[chan metaEvent]struct{}
+	sticky map[string]metaEvent
+}
+
+// metaEvents is the hub of all the SSE streams.
+var metaEvents = &metaHub{}
+
+// Subscribe returns a channel receiving the broadcast events,
+// starting with the current sticky ones, and a function to unsubscribe.
+func (h *metaHub) Subscribe() (<-chan metaEvent, func()) {
+	ch := make(chan metaEvent, 8)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan metaEvent]struct{})
+	}
+	h.subs[ch] = struct{}{}
+	for _, ev := range h.sticky {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// Publish the event to all subscribers. Slow subscribers miss it.
+//
+// If sticky is true, the event is also sent to the streams that connect later,
+// until another event of the same kind replaces it.
+func (h *metaHub) Publish(ev metaEvent, sticky bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sticky == nil {
+		h.sticky = make(map[string]metaEvent)
+	}
+	if sticky {
+		h.sticky[ev.Kind] = ev
+	} else {
+		delete(h.sticky, ev.Kind)
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie   = "webtail_session"
+	oidcStateCookie = "webtail_oidc"
+	sessionTTL      = 12 * time.Hour
+
+	// oidcBucket is the bucket of the session key (sessionKeyName) in the store.
+	oidcBucket     = "oidc"
+	sessionKeyName = "session-key"
+)
+
+// oidcAuth logs the users in with an OpenID Connect provider,
+// keeping them in a signed session cookie.
+//
+// The role of a user is from the users file (by name), or the default Role.
+//
+// An issuer unavailable at the start is discovered later; while it is unreachable,
+// authentication is in an outage (see authOutage).
+type oidcAuth struct {
+	issuer string
+	// Claim of the ID token naming the user, such as "email".
+	Claim string
+	Role  role
+
+	key    []byte
+	secure bool
+
+	mu       sync.RWMutex
+	verifier *oidc.IDTokenVerifier
+	config   oauth2.Config
+}
+
+// oidcLogin is the OIDC login, nil if disabled.
+var oidcLogin *oidcAuth
+
+// newOIDCAuth discovers the issuer; baseURL is the external URL of webtail,
+// the callback is at baseURL/auth/callback.
+func newOIDCAuth(ctx context.Context, issuer, clientID, clientSecret, baseURL, claim string, defaultRole role, key []byte) (*oidcAuth, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("OIDC redirect base URL %q: must be an absolute URL", baseURL)
+	}
+	oa := oidcAuth{
+		issuer: issuer,
+		config: oauth2.Config{
+			ClientID: clientID, ClientSecret: clientSecret,
+			RedirectURL: base.JoinPath("auth", "callback").String(),
+			Scopes:      []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		Claim: claim, Role: defaultRole,
+		key:    key,
+		secure: base.Scheme == "https",
+	}
+	authBackend.Set("oidc", oa.discover(ctx))
+	return &oa, nil
+}
+
+// discover fetches the configuration of the issuer.
+func (oa *oidcAuth) discover(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, oa.issuer)
+	if err != nil {
+		return fmt.Errorf("discover OIDC issuer %q: %w", oa.issuer, err)
+	}
+	oa.mu.Lock()
+	oa.verifier = provider.Verifier(&oidc.Config{ClientID: oa.config.ClientID})
+	oa.config.Endpoint = provider.Endpoint()
+	oa.mu.Unlock()
+	return nil
+}
+
+// provider returns the verifier and the OAuth2 config, ok is false before the discovery.
+func (oa *oidcAuth) provider() (*oidc.IDTokenVerifier, oauth2.Config, bool) {
+	oa.mu.RLock()
+	defer oa.mu.RUnlock()
+	return oa.verifier, oa.config, oa.verifier != nil
+}
+
+// watch checks the issuer every authProbeInterval, until the context is done:
+// discovers it if it has not been yet, else checks that it is reachable.
+func (oa *oidcAuth) watch(ctx context.Context) {
+	ticker := time.NewTicker(authProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, _, ok := oa.provider(); !ok {
+			authBackend.Set("oidc", oa.discover(ctx))
+			continue
+		}
+		authBackend.Set("oidc", oa.probe(ctx))
+	}
+}
+
+// probe fetches the discovery document of the issuer.
+func (oa *oidcAuth) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(oa.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OIDC issuer %q: %s", oa.issuer, resp.Status)
+	}
+	return nil
+}
+
+// sessionKeySize is the size of the generated session keys.
+const sessionKeySize = 32
+
+// loadSessionKey returns the key signing the session cookies: from the file fn (generated if missing),
+// else from the store (generated by the first instance), else a random one, valid until the restart.
+func loadSessionKey(ctx context.Context, fn string, st store.Store) ([]byte, error) {
+	key := make([]byte, sessionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	switch {
+	case fn != "":
+		b, err := os.ReadFile(fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("generate session key", "file", fn)
+			return key, os.WriteFile(fn, key, 0o600)
+		} else if err != nil {
+			return nil, err
+		}
+		if len(b) < sessionKeySize {
+			return nil, fmt.Errorf("%q: the key must be at least %d bytes", fn, sessionKeySize)
+		}
+		return b, nil
+	case st != nil:
+		if err := store.PutNew(ctx, st, oidcBucket, sessionKeyName, key); err != nil && !errors.Is(err, store.ErrExists) {
+			return nil, err
+		}
+		return st.Get(ctx, oidcBucket, sessionKeyName)
+	}
+	slog.Warn("random session key: the sessions end with the restart, and are not valid at the other instances; use -session-key or -store")
+	return key, nil
+}
+
+// sign returns the value with its signature appended.
+func (oa *oidcAuth) sign(value string) string {
+	mac := hmac.New(sha256.New, oa.key)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the value of a signed string.
+func (oa *oidcAuth) verify(signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	return value, hmac.Equal([]byte(signed), []byte(oa.sign(value)))
+}
+
+// setCookie sets the cookie for ttl, or deletes it if ttl is negative.
+func (oa *oidcAuth) setCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	maxAge := int(ttl / time.Second)
+	if ttl < 0 {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: name, Value: value, Path: "/",
+		MaxAge: maxAge, HttpOnly: true, Secure: oa.secure, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// parseSession returns the ID, the user name and the expiry of the request's valid session cookie.
+func (oa *oidcAuth) parseSession(r *http.Request) (string, string, time.Time, bool) {
+	if oa == nil {
+		return "", "", time.Time{}, false
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	value, ok := oa.verify(c.Value)
+	if !ok {
+		return "", "", time.Time{}, false
+	}
+	// value is the expiry, the session ID and the user name
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return "", "", time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > sec {
+		return "", "", time.Time{}, false
+	}
+	name, err := url.QueryUnescape(parts[2])
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	exp := time.Unix(sec, 0)
+	if sessions.SessionRevoked(r.Context(), parts[1], name, exp.Add(-sessionTTL)) {
+		return "", "", time.Time{}, false
+	}
+	return parts[1], name, exp, true
+}
+
+// sessionIssued returns when the request's session was logged in.
+func (oa *oidcAuth) sessionIssued(r *http.Request) (time.Time, bool) {
+	_, _, exp, ok := oa.parseSession(r)
+	return exp.Add(-sessionTTL), ok
+}
+
+// session returns the user of the request's unrevoked session cookie, or nil.
+func (oa *oidcAuth) session(r *http.Request) *authUser {
+	_, name, _, ok := oa.parseSession(r)
+	if !ok {
+		return nil
+	}
+	if u := users.lookup(name); u != nil {
+		return u
+	}
+	return &authUser{Name: name, role: oa.Role}
+}
+
+// login redirects to the provider, remembering the state, the nonce and where to return.
+func (oa *oidcAuth) login(w http.ResponseWriter, r *http.Request) {
+	var a [16]byte
+	rand.Read(a[:])
+	state := hex.EncodeToString(a[:8])
+	nonce := hex.EncodeToString(a[8:])
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	_, config, ok := oa.provider()
+	if !ok {
+		http.Error(w, "the OIDC issuer is unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	oa.setCookie(w, oidcStateCookie, oa.sign(state+":"+nonce+":"+url.QueryEscape(next)), 10*time.Minute)
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+}
+
+// callback finishes the login, setting the session cookie.
+func (oa *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "login expired, try again", http.StatusBadRequest)
+		return
+	}
+	value, ok := oa.verify(c.Value)
+	parts := strings.SplitN(value, ":", 3)
+	if !ok || len(parts) != 3 || r.URL.Query().Get("state") != parts[0] {
+		http.Error(w, "state mismatch", http.StatusBadRequest)
+		return
+	}
+	oa.setCookie(w, oidcStateCookie, "", -1)
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "login failed: "+e+" "+r.URL.Query().Get("error_description"), http.StatusForbidden)
+		return
+	}
+	ctx := r.Context()
+	verifier, config, ok := oa.provider()
+	if !ok {
+		http.Error(w, "the OIDC issuer is unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	token, err := config.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		slog.Warn("OIDC exchange", "error", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "no id_token in the token response", http.StatusForbidden)
+		return
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != parts[1] {
+		slog.Warn("OIDC verify", "error", err)
+		http.Error(w, "invalid ID token", http.StatusForbidden)
+		return
+	}
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	name, _ := claims[oa.Claim].(string)
+	if name == "" {
+		http.Error(w, fmt.Sprintf("no %q claim in the ID token", oa.Claim), http.StatusForbidden)
+		return
+	}
+	// anyone could claim an email address unverified by the provider
+	if oa.Claim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified && claims["email_verified"] != "true" {
+			slog.Warn("OIDC login with unverified email", "email", name)
+			http.Error(w, "the email address is not verified", http.StatusForbidden)
+			return
+		}
+	}
+	logAttrs(ctx, "login", name)
+	now := time.Now()
+	si := sessionInfo{ID: newSessionID(), User: name, Client: r.RemoteAddr, Issued: now, Expires: now.Add(sessionTTL)}
+	if err := sessions.Add(ctx, si); err != nil {
+		slog.Error("add session", "user", name, "error", err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	oa.setCookie(w, sessionCookie, oa.sign(strconv.FormatInt(si.Expires.Unix(), 10)+":"+si.ID+":"+url.QueryEscape(name)), sessionTTL)
+	next, _ := url.QueryUnescape(parts[2])
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// logout revokes the session, and removes its cookie.
+func (oa *oidcAuth) logout(w http.ResponseWriter, r *http.Request) {
+	if id, name, exp, ok := oa.parseSession(r); ok {
+		if err := sessions.Revoke(r.Context(), "session:"+id, revocation{Revoked: time.Now(), By: name, Expires: exp}); err != nil {
+			slog.Error("revoke session", "user", name, "error", err)
+		}
+	}
+	oa.setCookie(w, sessionCookie, "", -1)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+)
+
+const (
+	// maxPageLines is the most lines returned by /head and /view.
+	maxPageLines = 10_000
+	// viewPageLines is the default number of lines on a /view page.
+	viewPageLines = 500
+	// headLines is the default number of lines of /head.
+	headLines = 10
+)
+
+// readLines reads at most n lines of fh from the offset off,
+// and returns them with the offset after the last one.
+// The lines are numbered only when reading from the start of the file.
+func readLines(ctx context.Context, fh *os.File, off int64, n int) ([]Line, int64, error) {
+	br := bufio.NewReaderSize(io.NewSectionReader(fh, off, math.MaxInt64-off), min(16384, maxLineSize))
+	lines := make([]Line, 0, min(n, 1024))
+	numbered := off == 0
+	var read int
+	for len(lines) < n {
+		var long []byte
+		var size int
+		b, err := br.ReadSlice('\n')
+		for errors.Is(err, bufio.ErrBufferFull) {
+			// keep one more byte than the limit, so truncateLine marks it
+			long = append(long, b[:min(len(b), max(0, maxLineSize+1-len(long)))]...)
+			size += len(b)
+			b, err = br.ReadSlice('\n')
+		}
+		size += len(b)
+		if long != nil {
+			b = append(long, b[:min(len(b), max(0, maxLineSize+1-len(long)))]...)
+		}
+		if size == 0 || err != nil && !errors.Is(err, io.EOF) {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return lines, off, err
+		}
+		line := Line{Text: truncateLine(bytes.TrimSuffix(b, []byte{'\n'})), Offset: off}
+		if numbered {
+			line.No = int64(len(lines) + 1)
+		}
+		lines = append(lines, line)
+		off += int64(size)
+		read += size
+		if err != nil {
+			break
+		}
+	}
+	return lines, off, diskLimiter.Wait(ctx, read)
+}
+
+// lineStartBefore returns the offset of the start of the n-th line before off.
+func lineStartBefore(ctx context.Context, fh *os.File, off int64, n int) (int64, error) {
+	if n <= 0 {
+		return off, nil
+	}
+	buf := make([]byte, 16384)
+	end := off
+	for end > 0 {
+		start := max(0, end-int64(len(buf)))
+		p := buf[:end-start]
+		if _, err := fh.ReadAt(p, start); err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if err := diskLimiter.Wait(ctx, len(p)); err != nil {
+			return 0, err
+		}
+		if end == off && p[len(p)-1] == '\n' {
+			// the end of the line before off
+			p = p[:len(p)-1]
+		}
+		for i := len(p) - 1; i >= 0; i-- {
+			if p[i] == '\n' {
+				if n--; n == 0 {
+					return start + int64(i) + 1, nil
+				}
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// parsePageParam parses the non-negative integer query parameter, or returns def if it is missing.
+func parsePageParam(q url.Values, key string, def int64) (int64, error) {
+	s := q.Get(key)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s=%q: not a non-negative integer", key, s)
+	}
+	return i, nil
+}
+
+// headHandler returns the first "lines" (default 10) lines of the "path" file as text.
+func headHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		fn := path.Clean(q.Get("path"))
+		n, err := parsePageParam(q, "lines", headLines)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer fh.Close()
+		lines, _, err := readLines(r.Context(), fh, 0, int(min(n, maxPageLines)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAttrs(r.Context(), "file", fn, "lines", len(lines))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, line := range lines {
+			bw.WriteString(redactions.Redact(line.Text))
+			bw.WriteByte('\n')
+		}
+		bw.Flush()
+	}
+}
+
+// viewHandler shows "limit" (default 500) lines of the "path" file from the "offset" byte offset,
+// with links to the other pages, for reading the file without following it.
+// An offset inside a line starts at the next line.
+//
+// With "context", the line at the offset is marked, after that many lines before it,
+// and the limit defaults to the same number of lines after it: the permalinks of the lines.
+// Each line is anchored by its offset, as #o1234.
+func viewHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		fn := path.Clean(q.Get("path"))
+		off, err := parsePageParam(q, "offset", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		around, err := parsePageParam(q, "context", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		around = min(around, maxPageLines/2)
+		defLimit := int64(viewPageLines)
+		if q.Has("context") {
+			defLimit = 2*around + 1
+		}
+		limit, err := parsePageParam(q, "limit", defLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit = max(1, min(limit, maxPageLines))
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer fh.Close()
+		if binary, _ := isBinary(fh); binary && !q.Has("text") {
+			http.Redirect(w, r, "./hexdump?"+url.Values{"path": {fn}, "off": {strconv.FormatInt(off, 10)}}.Encode(), http.StatusSeeOther)
+			return
+		}
+		fi, err := fh.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		off = min(off, fi.Size())
+		if off > 0 {
+			// align to the start of a line
+			var a [1]byte
+			if _, err := fh.ReadAt(a[:], off-1); err == nil && a[0] != '\n' {
+				if rest, next, err := readLines(r.Context(), fh, off, 1); err == nil && len(rest) != 0 {
+					off = next
+				}
+			}
+		}
+		target := int64(-1)
+		if q.Has("context") {
+			target = off
+			if off, err = lineStartBefore(r.Context(), fh, target, int(around)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		lines, next, err := readLines(r.Context(), fh, off, int(limit))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		prev, err := lineStartBefore(r.Context(), fh, off, int(limit))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		last, err := lineStartBefore(r.Context(), fh, fi.Size(), int(limit))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAttrs(r.Context(), "file", fn, "offset", off, "lines", len(lines))
+
+		link := func(text string, off int64) pageLink {
+			return pageLink{Title: text, URL: "./view?" + url.Values{
+				"path": {fn}, "offset": {strconv.FormatInt(off, 10)}, "limit": {strconv.FormatInt(limit, 10)},
+			}.Encode()}
+		}
+		page := viewPage{Path: fn, TailURL: "./file?" + url.Values{"path": {fn}}.Encode(),
+			Offset: off, Next: next, Size: fi.Size(), Target: target, Lines: lines}
+		page.Nav = []pageLink{link("first", 0)}
+		if off > 0 {
+			page.Nav = append(page.Nav, link("previous", prev))
+		}
+		if next < fi.Size() {
+			page.Nav = append(page.Nav, link("next", next))
+		}
+		page.Nav = append(page.Nav, link("last", last))
+		for i, line := range page.Lines {
+			page.Lines[i].Text = redactions.Redact(line.Text)
+		}
+		renderPage(w, "view.html", page)
+	}
+}
+
+// viewPage is the data of the view.html template: the Lines of the page of the file,
+// the line at the Target offset highlighted.
+type viewPage struct {
+	Path, TailURL              string
+	Offset, Next, Size, Target int64
+	Nav                        []pageLink
+	Lines                      []Line
+}
@@ -0,0 +1,507 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// Pairing an agent without copying a shared secret around:
+//
+//  1. an admin issues a one-time join token on /admin/agents,
+//  2. the agent started with -join exchanges it (and its name) for its own secret
+//     on /api/v1/agents/pair, and saves that in its -credentials file,
+//  3. the admin approves the agent on /admin/agents, after which it can connect.
+
+// joinTokenTTL is how long a join token can be used.
+const joinTokenTTL = time.Hour
+
+// agentCredential is the secret of a paired agent.
+type agentCredential struct {
+	Name string `json:"name"`
+	// SHA256 is the hex encoded hash of the secret.
+	SHA256   string    `json:"sha256"`
+	Approved bool      `json:"approved"`
+	Paired   time.Time `json:"paired"`
+}
+
+// agentPairing holds the join tokens and the credentials of the paired agents,
+// persisting the credentials in the Store (if not nil), or in the JSON file at Path (if not empty).
+type agentPairing struct {
+	Path  string
+	Store store.Store
+
+	mu    sync.Mutex
+	creds map[string]*agentCredential
+	// joins are the expiry of the unused join tokens, by their hash, without a Store
+	joins map[[sha256.Size]byte]time.Time
+}
+
+// pairing is the agent pairing of this aggregator, nil if disabled.
+var pairing *agentPairing
+
+const (
+	// agentsBucket is the bucket of the agent credentials in the store.
+	agentsBucket = "agents"
+	// joinsBucket is the bucket of the expiry of the unused join tokens in the store, by their hash,
+	// so a token issued by one instance can be used at any of them.
+	joinsBucket = "agent-joins"
+)
+
+// loadAgentPairing returns the pairing, loading the credentials from st, or from path.
+// With st, the credentials of the file at path are imported if st has none yet.
+func loadAgentPairing(ctx context.Context, path string, st store.Store) (*agentPairing, error) {
+	ap := agentPairing{Path: path, Store: st, creds: make(map[string]*agentCredential), joins: make(map[[sha256.Size]byte]time.Time)}
+	if st != nil {
+		if err := ap.load(ctx); err != nil {
+			return nil, err
+		}
+		if len(ap.creds) != 0 {
+			return &ap, nil
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &ap, nil
+		}
+		return nil, err
+	}
+	var creds []*agentCredential
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", path, err)
+	}
+	for _, c := range creds {
+		ap.creds[c.Name] = c
+		if st != nil {
+			if err := ap.saveLocked(ctx, c.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &ap, nil
+}
+
+// load the credentials from the store, as other instances sharing it may have changed them.
+func (ap *agentPairing) load(ctx context.Context) error {
+	m, err := ap.Store.List(ctx, agentsBucket)
+	if err != nil {
+		return err
+	}
+	creds := make(map[string]*agentCredential, len(m))
+	for k, v := range m {
+		var c agentCredential
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("parse the credential of %q: %w", k, err)
+		}
+		creds[k] = &c
+	}
+	ap.mu.Lock()
+	ap.creds = creds
+	ap.mu.Unlock()
+	return nil
+}
+
+// saveLocked persists the credential of the named agent (or its removal), with ap.mu held.
+func (ap *agentPairing) saveLocked(ctx context.Context, name string) error {
+	if ap.Store != nil {
+		c := ap.creds[name]
+		if c == nil {
+			return ap.Store.Delete(ctx, agentsBucket, name)
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return ap.Store.Put(ctx, agentsBucket, name, b)
+	}
+	if ap.Path == "" {
+		return nil
+	}
+	creds := make([]*agentCredential, 0, len(ap.creds))
+	for _, c := range ap.creds {
+		creds = append(creds, c)
+	}
+	slices.SortFunc(creds, func(a, b *agentCredential) int { return strings.Compare(a.Name, b.Name) })
+	b, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ap.Path, b)
+}
+
+// newSecret returns a random hex encoded secret and its hash.
+func newSecret() (string, [sha256.Size]byte) {
+	var a [32]byte
+	rand.Read(a[:])
+	s := hex.EncodeToString(a[:])
+	return s, sha256.Sum256([]byte(s))
+}
+
+// NewJoinToken returns a new one-time join token and its expiry.
+func (ap *agentPairing) NewJoinToken(ctx context.Context) (string, time.Time, error) {
+	token, hash := newSecret()
+	now := time.Now()
+	expires := now.Add(joinTokenTTL)
+	if ap.Store != nil {
+		m, err := ap.Store.List(ctx, joinsBucket)
+		if err != nil {
+			return "", expires, err
+		}
+		for k, v := range m {
+			if t, err := time.Parse(time.RFC3339, string(v)); err != nil || now.After(t) {
+				ap.Store.Delete(ctx, joinsBucket, k)
+			}
+		}
+		err = ap.Store.Put(ctx, joinsBucket, hex.EncodeToString(hash[:]), []byte(expires.UTC().Format(time.RFC3339)))
+		return token, expires, err
+	}
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	for k, t := range ap.joins {
+		if now.After(t) {
+			delete(ap.joins, k)
+		}
+	}
+	ap.joins[hash] = expires
+	return token, expires, nil
+}
+
+// useJoinToken reports whether the join token is valid, and removes it.
+func (ap *agentPairing) useJoinToken(ctx context.Context, token string) (bool, error) {
+	hash := sha256.Sum256([]byte(token))
+	now := time.Now()
+	if ap.Store == nil {
+		ap.mu.Lock()
+		defer ap.mu.Unlock()
+		expires, ok := ap.joins[hash]
+		delete(ap.joins, hash)
+		return ok && !now.After(expires), nil
+	}
+	var ok bool
+	err := store.Update(ctx, ap.Store, joinsBucket, hex.EncodeToString(hash[:]), func(old []byte) ([]byte, error) {
+		t, err := time.Parse(time.RFC3339, string(old))
+		ok = old != nil && err == nil && !now.After(t)
+		return nil, nil
+	})
+	return ok, err
+}
+
+// errNotApproved is returned for the paired agents not approved yet.
+var errNotApproved = errors.New("the agent is waiting for approval")
+
+// Authorize checks the secret of the named agent.
+// With a store, the credential is read from it, as it may be approved by another instance.
+func (ap *agentPairing) Authorize(ctx context.Context, name, secret string) error {
+	ap.mu.Lock()
+	c := ap.creds[name]
+	ap.mu.Unlock()
+	if ap.Store != nil {
+		c = nil
+		if b, err := ap.Store.Get(ctx, agentsBucket, name); err == nil {
+			c = new(agentCredential)
+			if err := json.Unmarshal(b, c); err != nil {
+				return fmt.Errorf("parse the credential of %q: %w", name, err)
+			}
+			ap.mu.Lock()
+			ap.creds[name] = c
+			ap.mu.Unlock()
+		} else if !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	if c == nil {
+		return fmt.Errorf("agent %q is not paired", name)
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(c.SHA256)) != 1 {
+		return fmt.Errorf("agent %q: bad secret", name)
+	}
+	if !c.Approved {
+		return errNotApproved
+	}
+	return nil
+}
+
+// agentPairRequest is the request of an agent exchanging its join token.
+type agentPairRequest struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+}
+
+// agentPairResponse is the credential given to the agent.
+type agentPairResponse struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// errAgentPaired is returned for pairing a name already paired.
+var errAgentPaired = errors.New("an agent of this name is already paired, the admin has to revoke it first")
+
+// paired reports whether the named agent is paired, here or (with a store) by another instance.
+func (ap *agentPairing) paired(ctx context.Context, name string) (bool, error) {
+	ap.mu.Lock()
+	c := ap.creds[name]
+	ap.mu.Unlock()
+	if c != nil || ap.Store == nil {
+		return c != nil, nil
+	}
+	_, err := ap.Store.Get(ctx, agentsBucket, name)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// addLocked persists the credential of a new agent, with ap.mu held,
+// returning errAgentPaired if the name is already paired.
+func (ap *agentPairing) addLocked(ctx context.Context, c *agentCredential) error {
+	if ap.creds[c.Name] != nil {
+		return errAgentPaired
+	}
+	if ap.Store != nil {
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if err := store.PutNew(ctx, ap.Store, agentsBucket, c.Name, b); errors.Is(err, store.ErrExists) {
+			return errAgentPaired
+		} else if err != nil {
+			return err
+		}
+		ap.creds[c.Name] = c
+		return nil
+	}
+	ap.creds[c.Name] = c
+	if err := ap.saveLocked(ctx, c.Name); err != nil {
+		delete(ap.creds, c.Name)
+		return err
+	}
+	return nil
+}
+
+// pair exchanges a join token for the credential of a new agent, awaiting approval.
+// Names already paired are refused (without using the token): their agent has to be revoked first,
+// so a join token can not be used to take over the name of an approved agent.
+func (ap *agentPairing) pair(w http.ResponseWriter, r *http.Request) {
+	var req agentPairRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || strings.Contains(req.Name, "/") {
+		http.Error(w, "a name (without a slash) is required", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if taken, err := ap.paired(ctx, req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if taken {
+		slog.Warn("agent pairing refused", "name", req.Name, "addr", r.RemoteAddr, "error", errAgentPaired)
+		http.Error(w, errAgentPaired.Error(), http.StatusConflict)
+		return
+	}
+	if ok, err := ap.useJoinToken(ctx, req.Token); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "invalid or expired join token", http.StatusForbidden)
+		return
+	}
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	secret, sum := newSecret()
+	if err := ap.addLocked(ctx, &agentCredential{Name: req.Name, SHA256: hex.EncodeToString(sum[:]), Paired: time.Now()}); errors.Is(err, errAgentPaired) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.Error("save agent credentials", "file", ap.Path, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Warn("agent paired, waiting for approval", "name", req.Name, "addr", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agentPairResponse{Name: req.Name, Secret: secret})
+}
+
+// ServeHTTP is the admin page of the paired agents on GET, and on POST
+// issues a join token (action=join), approves (action=approve) or forgets (action=revoke) the named agent.
+func (ap *agentPairing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var joinToken string
+	var joinExpires time.Time
+	if ap.Store != nil {
+		if err := ap.load(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if r.Method == "POST" {
+		if !checkCSRF(r) {
+			http.Error(w, "invalid or missing CSRF token, reload the page", http.StatusForbidden)
+			return
+		}
+		name, action := r.FormValue("name"), r.FormValue("action")
+		ap.mu.Lock()
+		c := ap.creds[name]
+		var changed bool
+		switch {
+		case action == "join":
+		case c == nil:
+			ap.mu.Unlock()
+			http.Error(w, fmt.Sprintf("agent %q is not paired", name), http.StatusNotFound)
+			return
+		case action == "approve":
+			c.Approved, changed = true, true
+		case action == "revoke":
+			delete(ap.creds, name)
+			changed = true
+		default:
+			ap.mu.Unlock()
+			http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if changed {
+			err = ap.saveLocked(r.Context(), name)
+		}
+		ap.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if action == "join" {
+			if joinToken, joinExpires, err = ap.NewJoinToken(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			slog.Warn("agent join token issued", "expires", joinExpires)
+		} else {
+			slog.Warn("agent "+action, "name", name)
+			if action == "revoke" {
+				agents.Disconnect(name)
+			}
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+	}
+
+	ap.mu.Lock()
+	page := agentsPage{JoinToken: joinToken, JoinExpires: joinExpires, CSRF: csrfToken(w, r),
+		Agents: make([]agentStatus, 0, len(ap.creds))}
+	for _, c := range ap.creds {
+		page.Agents = append(page.Agents, agentStatus{agentCredential: *c, Status: "waiting for approval"})
+	}
+	ap.mu.Unlock()
+	slices.SortFunc(page.Agents, func(a, b agentStatus) int { return strings.Compare(a.Name, b.Name) })
+	connected := make(map[string]bool)
+	for _, ac := range agents.List() {
+		connected[ac.Info.Name] = true
+	}
+	for i, c := range page.Agents {
+		if c.Approved {
+			page.Agents[i].Status = "approved"
+			if connected[c.Name] {
+				page.Agents[i].Status = "connected"
+			}
+		}
+	}
+	renderPage(w, "agents.html", page)
+}
+
+// agentsPage is the data of the agents.html template.
+type agentsPage struct {
+	JoinToken   string
+	JoinExpires time.Time
+	CSRF        string
+	Agents      []agentStatus
+}
+
+// agentStatus is a paired agent, and its status.
+type agentStatus struct {
+	agentCredential
+	Status string
+}
+
+// agentCredentials is the credential of an agent, saved in its -credentials file.
+type agentCredentials = agentPairResponse
+
+// pairAgent exchanges the join token on the aggregator of connectURL for the credentials,
+// and saves them into fn.
+func pairAgent(ctx context.Context, connectURL, joinToken, fn string) (agentCredentials, error) {
+	var creds agentCredentials
+	u, err := url.Parse(connectURL)
+	if err != nil {
+		return creds, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/connect") + "/pair"
+	b, err := json.Marshal(agentPairRequest{Token: joinToken, Name: instance.Name})
+	if err != nil {
+		return creds, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(b))
+	if err != nil {
+		return creds, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return creds, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return creds, fmt.Errorf("pair with %s: %s: %s", u, resp.Status, bytes.TrimSpace(b))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return creds, fmt.Errorf("pair with %s: %w", u, err)
+	}
+	if b, err = json.Marshal(creds); err != nil {
+		return creds, err
+	}
+	if err := writeFileAtomic(fn, b); err != nil {
+		return creds, err
+	}
+	return creds, os.Chmod(fn, 0o600)
+}
+
+// loadAgentCredentials reads the credentials of the agent from fn.
+func loadAgentCredentials(fn string) (agentCredentials, error) {
+	var creds agentCredentials
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return creds, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	return creds, nil
+}
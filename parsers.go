@@ -0,0 +1,333 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parsers turn the lines of a file into fields, shown by the viewer
+// as a table with sortable and hideable columns, filtered by the values of the columns
+// in the browser (see webtail.js).
+//
+// The -parsers JSON file selects the parser of the files by their pattern.
+// A stream of a file is parsed with parse=1 (its configured parser) or parse=name,
+// then its events are JSON objects (as with annotate) with the fields of the line,
+// after a "columns" meta event listing the known columns.
+
+// lineParser parses the lines of a file into their fields.
+type lineParser interface {
+	// Columns are the known columns in order; more may appear in the fields.
+	Columns() []string
+	// Parse returns the fields of the line, or nil if it does not parse.
+	Parse(text string) map[string]string
+}
+
+// parserRule is a rule of the -parsers JSON file.
+type parserRule struct {
+	// Match is a glob (path.Match) of the files, such as "nginx/access*.log";
+	// without a slash, it is matched against the base name too.
+	Match string `json:"match"`
+	// Parser is the name of the parser, see parserKinds.
+	Parser string `json:"parser"`
+	// Comma is the field separator of csv (default ",").
+	Comma string `json:"comma,omitempty"`
+	// Header are the columns of csv, instead of the first line of the file.
+	Header []string `json:"header,omitempty"`
+}
+
+// parserKinds are the parsers by name. Those reading the file (as csv its header)
+// get it opened, with the context of the request.
+var parserKinds = map[string]func(ctx context.Context, rule parserRule, fh *os.File) (lineParser, error){
+	"logfmt": func(context.Context, parserRule, *os.File) (lineParser, error) { return logfmtParser{}, nil },
+	"json":   func(context.Context, parserRule, *os.File) (lineParser, error) { return jsonParser{}, nil },
+	"csv":    newCSVParser,
+	"common": func(context.Context, parserRule, *os.File) (lineParser, error) {
+		return accessLogParser{columns: accessLogColumns[:7]}, nil
+	},
+	"combined": func(context.Context, parserRule, *os.File) (lineParser, error) {
+		return accessLogParser{columns: accessLogColumns}, nil
+	},
+}
+
+// parserKindNames returns the sorted names of the parsers.
+func parserKindNames() []string {
+	names := make([]string, 0, len(parserKinds))
+	for k := range parserKinds {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// parserRules are the rules of the -parsers file, the first matching one applies.
+var parserRules []parserRule
+
+// loadParserRules reads the parser rules from the JSON file, an array of parserRule, such as
+//
+//	[{"match": "nginx/access*.log", "parser": "combined"}, {"match": "*.csv", "parser": "csv", "comma": ";"}]
+func loadParserRules(fn string) ([]parserRule, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var rules []parserRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	for _, r := range rules {
+		if r.Match == "" {
+			return nil, fmt.Errorf("%q: parser rule: match is required", fn)
+		}
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return nil, fmt.Errorf("%q: parser rule %q: %w", fn, r.Match, err)
+		}
+		if _, ok := parserKinds[r.Parser]; !ok {
+			return nil, fmt.Errorf("%q: parser rule %q: unknown parser %q (known: %s)", fn, r.Match, r.Parser, strings.Join(parserKindNames(), ", "))
+		}
+		if utf8.RuneCountInString(r.Comma) > 1 {
+			return nil, fmt.Errorf("%q: parser rule %q: comma %q is not one character", fn, r.Match, r.Comma)
+		}
+	}
+	return rules, nil
+}
+
+// parserRuleOf returns the first rule matching the file fn.
+func parserRuleOf(fn string) (parserRule, bool) {
+	for _, r := range parserRules {
+		if ok, _ := path.Match(r.Match, fn); ok {
+			return r, true
+		}
+		if !strings.Contains(r.Match, "/") {
+			if ok, _ := path.Match(r.Match, path.Base(fn)); ok {
+				return r, true
+			}
+		}
+	}
+	return parserRule{}, false
+}
+
+// parseFile returns the parser of the parse= query parameter for the file fn (opened as fh):
+// nil without it, the configured one with parse=1, or the named one.
+func parseFile(ctx context.Context, q url.Values, fn string, fh *os.File) (lineParser, error) {
+	name := q.Get("parse")
+	if name == "" {
+		return nil, nil
+	}
+	rule, ok := parserRuleOf(fn)
+	if name == "1" {
+		if !ok {
+			return nil, fmt.Errorf("no parser is configured for %q", fn)
+		}
+	} else if !ok || rule.Parser != name {
+		rule = parserRule{Parser: name}
+	}
+	newParser, ok := parserKinds[rule.Parser]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q (known: %s)", rule.Parser, strings.Join(parserKindNames(), ", "))
+	}
+	return newParser(ctx, rule, fh)
+}
+
+// columnsEvent is the data of the "columns" meta event.
+type columnsEvent struct {
+	Columns []string `json:"columns"`
+}
+
+// logfmtParser parses key=value pairs, the values optionally quoted, as
+//
+//	ts=2024-01-02T03:04:05Z level=info msg="user logged in" user=alice
+//
+// A key without a value is empty, but a line without any key=value pair does not parse.
+type logfmtParser struct{}
+
+func (logfmtParser) Columns() []string { return nil }
+
+func (logfmtParser) Parse(text string) map[string]string {
+	var fields map[string]string
+	var pairs int
+	for s := strings.TrimSpace(text); s != ""; s = strings.TrimLeft(s, " \t") {
+		i := strings.IndexAny(s, "= \t")
+		if i < 0 {
+			i = len(s)
+		} else if i == 0 {
+			return nil
+		}
+		key := s[:i]
+		s = s[i:]
+		var value string
+		if s != "" && s[0] == '=' {
+			pairs++
+			s = s[1:]
+			if strings.HasPrefix(s, `"`) {
+				// the closing quote, skipping the escaped ones
+				end := 1
+				for ; end < len(s) && s[end] != '"'; end++ {
+					if s[end] == '\\' {
+						end++
+					}
+				}
+				if end >= len(s) {
+					return nil
+				}
+				value, s = unquoteLogfmt(s[:end+1]), s[end+1:]
+			} else {
+				end := strings.IndexAny(s, " \t")
+				if end < 0 {
+					end = len(s)
+				}
+				value, s = s[:end], s[end:]
+			}
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[key] = value
+	}
+	if pairs == 0 {
+		return nil
+	}
+	return fields
+}
+
+// unquoteLogfmt unquotes the quoted value, as a Go string if possible.
+func unquoteLogfmt(s string) string {
+	var v string
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	return s[1 : len(s)-1]
+}
+
+// jsonParser parses the lines of JSON objects, as the structured logs of slog or zap.
+// The nested objects are flattened, their keys joined with dots;
+// the values other than strings are shown as JSON.
+type jsonParser struct{}
+
+func (jsonParser) Columns() []string { return nil }
+
+func (jsonParser) Parse(text string) map[string]string {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &obj); err != nil {
+		return nil
+	}
+	fields := make(map[string]string, len(obj))
+	flattenJSON(fields, "", obj)
+	return fields
+}
+
+// flattenJSON adds the values of obj to fields, their keys prefixed.
+func flattenJSON(fields map[string]string, prefix string, obj map[string]json.RawMessage) {
+	for k, raw := range obj {
+		var s string
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(raw, &s) == nil {
+			fields[prefix+k] = s
+		} else if json.Unmarshal(raw, &nested) == nil && nested != nil {
+			flattenJSON(fields, prefix+k+".", nested)
+		} else {
+			fields[prefix+k] = string(raw)
+		}
+	}
+}
+
+// csvParser parses the lines as CSV records, the columns named by the header.
+type csvParser struct {
+	comma  rune
+	header []string
+	// headerLine is the first line of the file, the header itself.
+	headerLine string
+}
+
+// newCSVParser returns the csv parser of the rule, its header the first line of fh if not given.
+func newCSVParser(ctx context.Context, rule parserRule, fh *os.File) (lineParser, error) {
+	cp := &csvParser{comma: ',', header: rule.Header}
+	if rule.Comma != "" {
+		cp.comma, _ = utf8.DecodeRuneInString(rule.Comma)
+	}
+	if len(cp.header) != 0 {
+		return cp, nil
+	}
+	lines, _, err := readLines(ctx, fh, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("csv: no header line in %q", fh.Name())
+	}
+	cp.headerLine = lines[0].Text
+	if cp.header = cp.record(cp.headerLine); len(cp.header) == 0 {
+		return nil, fmt.Errorf("csv: bad header line in %q", fh.Name())
+	}
+	return cp, nil
+}
+
+// record returns the fields of the CSV record of the line, or nil.
+func (cp *csvParser) record(text string) []string {
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comma, r.FieldsPerRecord, r.LazyQuotes = cp.comma, -1, true
+	rec, err := r.Read()
+	if err != nil {
+		return nil
+	}
+	return rec
+}
+
+func (cp *csvParser) Columns() []string { return cp.header }
+
+func (cp *csvParser) Parse(text string) map[string]string {
+	if text == cp.headerLine {
+		return nil
+	}
+	rec := cp.record(text)
+	if rec == nil {
+		return nil
+	}
+	fields := make(map[string]string, len(rec))
+	for i, v := range rec {
+		if i < len(cp.header) {
+			fields[cp.header[i]] = v
+		} else {
+			fields[fmt.Sprintf("column%d", i+1)] = v
+		}
+	}
+	return fields
+}
+
+// accessLogColumns are the fields of the Apache/Nginx combined log format,
+// the first seven those of the common one.
+var accessLogColumns = []string{"host", "ident", "user", "time", "request", "status", "bytes", "referer", "agent"}
+
+// accessLogRe matches the lines of the common and combined log formats.
+var accessLogRe = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]*)\] "((?:[^"\\]|\\.)*)" (\S+) (\S+)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+// accessLogParser parses the lines of the Apache/Nginx access logs.
+type accessLogParser struct {
+	columns []string
+}
+
+func (ap accessLogParser) Columns() []string { return ap.columns }
+
+func (ap accessLogParser) Parse(text string) map[string]string {
+	m := accessLogRe.FindStringSubmatch(text)
+	if m == nil {
+		return nil
+	}
+	fields := make(map[string]string, len(ap.columns))
+	for i, k := range ap.columns {
+		fields[k] = m[i+1]
+	}
+	return fields
+}
@@ -0,0 +1,220 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"time"
+)
+
+const (
+	// maxStatsScan is the most bytes scanned from the end of the file by /stats.
+	maxStatsScan = 64 << 20
+	// defaultStatsBuckets is the default number of the intervals of /stats.
+	defaultStatsBuckets = 60
+	// maxStatsBuckets is the most intervals of /stats.
+	maxStatsBuckets = 1440
+)
+
+// patternStats is the JSON of /stats: the number of the lines matching the pattern
+// in each interval, the oldest first.
+type patternStats struct {
+	Path     string    `json:"path"`
+	Pattern  string    `json:"pattern"`
+	Interval string    `json:"interval"`
+	Start    time.Time `json:"start"`
+	Counts   []int64   `json:"counts"`
+	// Total is the sum of the counts.
+	Total int64 `json:"total"`
+
+	interval time.Duration
+}
+
+// advance shifts the intervals to end after now, and reports whether they changed.
+func (ps *patternStats) advance(now time.Time) bool {
+	end := now.Truncate(ps.interval).Add(ps.interval)
+	start := end.Add(-time.Duration(len(ps.Counts)) * ps.interval)
+	shift := int(start.Sub(ps.Start) / ps.interval)
+	if shift <= 0 {
+		return false
+	}
+	shift = min(shift, len(ps.Counts))
+	for _, n := range ps.Counts[:shift] {
+		ps.Total -= n
+	}
+	copy(ps.Counts, ps.Counts[shift:])
+	clear(ps.Counts[len(ps.Counts)-shift:])
+	ps.Start = start
+	return true
+}
+
+// add counts a matching line at t, if it is in the intervals.
+func (ps *patternStats) add(t time.Time) bool {
+	if t.Before(ps.Start) {
+		return false
+	}
+	i := int(t.Sub(ps.Start) / ps.interval)
+	if i >= len(ps.Counts) {
+		return false
+	}
+	ps.Counts[i]++
+	ps.Total++
+	return true
+}
+
+// statsHandler counts the lines of the path file matching the regexp pattern per interval
+// (default 1m), in the last "buckets" (default 60) intervals, and returns them as JSON.
+//
+// The lines are counted at their leading timestamp (in the ts-layout, RFC 3339 by default),
+// the lines without one at the timestamp of the line before them. The last 64MiB of the file
+// are scanned.
+//
+// With follow=1, the file is followed, and the counts are sent as Server Sent Events
+// when they change, the new lines without a timestamp counted at their arrival.
+func statsHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		fn := path.Clean(q.Get("path"))
+		re, err := regexp.Compile(q.Get("pattern"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("pattern=%q: %v", q.Get("pattern"), err), http.StatusBadRequest)
+			return
+		}
+		interval := time.Minute
+		if s := q.Get("interval"); s != "" {
+			if interval, err = time.ParseDuration(s); err != nil || interval < time.Second {
+				http.Error(w, fmt.Sprintf("interval=%q: not a duration of at least 1s", s), http.StatusBadRequest)
+				return
+			}
+		}
+		buckets, err := parsePageParam(q, "buckets", defaultStatsBuckets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ts := newTimestampLayout(q.Get("ts-layout"))
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if binary, _ := isBinary(fh); binary {
+			fh.Close()
+			http.Error(w, fmt.Sprintf("%q is binary", fn), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		ps := patternStats{
+			Path: fn, Pattern: re.String(), Interval: interval.String(), interval: interval,
+			Counts: make([]int64, max(1, min(buckets, maxStatsBuckets))),
+		}
+		ps.advance(time.Now())
+		seam, err := tailSeam(r.Context(), fh)
+		if err == nil {
+			var off int64
+			if off, err = lineStartAfter(r.Context(), fh, max(0, seam-maxStatsScan)); err == nil {
+				err = ps.scan(r.Context(), fh, off, seam, re, ts)
+			}
+		}
+		if err != nil {
+			fh.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAttrs(r.Context(), "file", fn, "pattern", ps.Pattern, "total", ps.Total)
+		if q.Get("follow") != "1" {
+			fh.Close()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ps)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		send := func() bool {
+			b, _ := json.Marshal(ps)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return false
+			}
+			return rc.Flush() == nil
+		}
+		if !send() {
+			fh.Close()
+			return
+		}
+		linesCh := make(chan Line)
+		go func() {
+			if err := followFile(r.Context(), linesCh, FS, fn, fh, defaultPoll, seam); err != nil {
+				slog.Warn("stats", "file", fn, "error", err)
+			}
+		}()
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		var changed bool
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-linesCh:
+				if !ok {
+					send()
+					return
+				}
+				// both are needed: the window moves on even if the line is not matching
+				advanced := ps.advance(time.Now())
+				if re.MatchString(redactions.Redact(line.Text)) {
+					t, ok := ts.timestamp(line.Text)
+					if !ok {
+						t = line.Time
+					}
+					advanced = ps.add(t) || advanced
+				}
+				changed = advanced || changed
+			case <-ticker.C:
+				if (ps.advance(time.Now()) || changed) && !send() {
+					return
+				}
+				changed = false
+			}
+		}
+	}
+}
+
+// scan counts the matching lines of fh between the offsets.
+func (ps *patternStats) scan(ctx context.Context, fh *os.File, off, end int64, re *regexp.Regexp, ts *mergeOptions) error {
+	var last time.Time
+	for off < end {
+		lines, next, err := readLines(ctx, fh, off, 1024)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if line.Offset >= end {
+				return nil
+			}
+			if t, ok := ts.timestamp(line.Text); ok {
+				last = t
+			}
+			// as the lines are shown, not to reveal the redacted parts by counting them
+			if !last.IsZero() && re.MatchString(redactions.Redact(line.Text)) {
+				ps.add(last)
+			}
+		}
+		if len(lines) == 0 || next <= off {
+			return nil
+		}
+		off = next
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/UNO-SOFT/webtail/process"
+)
+
+// defaultPipeline is the name of the pipeline applied to every stream.
+const defaultPipeline = "default"
+
+// pipelines are the named transformer pipelines of the config file,
+// selectable by pipeline=name.
+var pipelines map[string]process.Pipeline
+
+// loadPipelines reads the pipelines from the JSON file,
+// which maps the pipeline names to transformer specs ("name:arg"), such as
+//
+//	{"default": ["replace:/password=\\S+/password=***/"], "errors": ["grep:(?i)error"]}
+func loadPipelines(fn string) (map[string]process.Pipeline, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var specs map[string][]string
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	m := make(map[string]process.Pipeline, len(specs))
+	for name, ss := range specs {
+		if m[name], err = process.ParsePipeline(ss); err != nil {
+			return nil, fmt.Errorf("%q pipeline %q: %w", fn, name, err)
+		}
+	}
+	return m, nil
+}
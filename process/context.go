@@ -0,0 +1,37 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package process
+
+import (
+	"context"
+	"net/url"
+)
+
+// Conn describes the client connection the lines are processed for,
+// so processors can implement per-user redaction or tagging.
+type Conn struct {
+	// User is the authenticated user, empty if anonymous.
+	User string
+	// RemoteIP is the address of the client (or of the last proxy).
+	RemoteIP string
+	// RequestID identifies the request in the access log.
+	RequestID string
+	// Query holds the query parameters of the request.
+	Query url.Values
+}
+
+type connKey struct{}
+
+// WithConn returns a context carrying c.
+func WithConn(ctx context.Context, c *Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// ConnFrom returns the Conn of the context the processors are called with,
+// or nil if there is none.
+func ConnFrom(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package process
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"slices"
+	"sync"
+)
+
+// Formatter renders a line as the data of its SSE event, selected by format=<name>.
+//
+// The result may contain newlines, those are sent as multiple data lines
+// of the same event.
+type Formatter interface {
+	Format(ctx context.Context, line Line) (string, error)
+}
+
+// FormatterFunc is a function implementing Formatter.
+type FormatterFunc func(ctx context.Context, line Line) (string, error)
+
+// Format calls f.
+func (f FormatterFunc) Format(ctx context.Context, line Line) (string, error) { return f(ctx, line) }
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = map[string]Formatter{
+		"text": FormatterFunc(func(_ context.Context, line Line) (string, error) {
+			return line.Text, nil
+		}),
+		"html": FormatterFunc(func(_ context.Context, line Line) (string, error) {
+			return html.EscapeString(line.Text), nil
+		}),
+	}
+)
+
+// RegisterFormatter registers the formatter under name,
+// panicking if the name is empty or already taken.
+func RegisterFormatter(name string, f Formatter) {
+	if name == "" || f == nil {
+		panic("RegisterFormatter: empty name or nil formatter")
+	}
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	if _, ok := formatters[name]; ok {
+		panic(fmt.Sprintf("RegisterFormatter: %q is already registered", name))
+	}
+	formatters[name] = f
+}
+
+// LookupFormatter returns the formatter registered under name.
+func LookupFormatter(name string) (Formatter, bool) {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+	f, ok := formatters[name]
+	return f, ok
+}
+
+// FormatterNames returns the sorted names of the registered formatters.
+func FormatterNames() []string {
+	formattersMu.RLock()
+	names := make([]string, 0, len(formatters))
+	for k := range formatters {
+		names = append(names, k)
+	}
+	formattersMu.RUnlock()
+	slices.Sort(names)
+	return names
+}
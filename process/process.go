@@ -0,0 +1,25 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package process is the library API of webtail's line processing,
+// for embedders adding their own processors (such as formatters)
+// without forking the rendering code.
+//
+// Processors are registered from an init function, in a package
+// (or file) linked into the webtail binary. They are called with the
+// context of the request, carrying its Conn (see ConnFrom).
+package process
+
+import "time"
+
+// Line is a line read from a source.
+type Line struct {
+	Text string
+	// Offset is the byte offset of the line in the file, -1 if unknown.
+	Offset int64
+	// No is the 1-based line number, 0 if unknown.
+	No int64
+	// Time is when the server has read the line.
+	Time time.Time
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package process
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// LineTransformer transforms a line into zero (filtering), one or more lines.
+type LineTransformer interface {
+	Transform(ctx context.Context, line Line) ([]Line, error)
+}
+
+// TransformerFunc is a function implementing LineTransformer.
+type TransformerFunc func(ctx context.Context, line Line) ([]Line, error)
+
+// Transform calls f.
+func (f TransformerFunc) Transform(ctx context.Context, line Line) ([]Line, error) {
+	return f(ctx, line)
+}
+
+// TransformerFactory returns a LineTransformer configured with arg.
+type TransformerFactory func(arg string) (LineTransformer, error)
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]TransformerFactory{
+		"grep":    grepTransformer(false),
+		"grep-v":  grepTransformer(true),
+		"replace": replaceTransformer,
+		"json":    jsonTransformer,
+	}
+)
+
+// RegisterTransformer registers the factory under name,
+// panicking if the name is empty or already taken.
+func RegisterTransformer(name string, f TransformerFactory) {
+	if name == "" || f == nil || strings.Contains(name, ":") {
+		panic("RegisterTransformer: empty name (or with a colon) or nil factory")
+	}
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	if _, ok := transformers[name]; ok {
+		panic(fmt.Sprintf("RegisterTransformer: %q is already registered", name))
+	}
+	transformers[name] = f
+}
+
+// TransformerNames returns the sorted names of the registered transformers.
+func TransformerNames() []string {
+	transformersMu.RLock()
+	names := make([]string, 0, len(transformers))
+	for k := range transformers {
+		names = append(names, k)
+	}
+	transformersMu.RUnlock()
+	slices.Sort(names)
+	return names
+}
+
+// NewTransformer returns the transformer of the "name:arg" spec.
+func NewTransformer(spec string) (LineTransformer, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	transformersMu.RLock()
+	f, ok := transformers[name]
+	transformersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transformer %q (known: %s)", name, strings.Join(TransformerNames(), ", "))
+	}
+	t, err := f(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return t, nil
+}
+
+// Pipeline runs the lines through its transformers, in order.
+type Pipeline []LineTransformer
+
+// ParsePipeline returns the pipeline of the "name:arg" specs.
+func ParsePipeline(specs []string) (Pipeline, error) {
+	p := make(Pipeline, 0, len(specs))
+	for _, spec := range specs {
+		t, err := NewTransformer(spec)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, t)
+	}
+	return p, nil
+}
+
+// Transform the line through all the transformers.
+func (p Pipeline) Transform(ctx context.Context, line Line) ([]Line, error) {
+	lines := []Line{line}
+	for _, t := range p {
+		var next []Line
+		for _, line := range lines {
+			out, err := t.Transform(ctx, line)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		if lines = next; len(lines) == 0 {
+			break
+		}
+	}
+	return lines, nil
+}
+
+// grepTransformer keeps the lines matching the regexp arg (or not matching it, if invert).
+func grepTransformer(invert bool) TransformerFactory {
+	return func(arg string) (LineTransformer, error) {
+		rx, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, err
+		}
+		return TransformerFunc(func(_ context.Context, line Line) ([]Line, error) {
+			if rx.MatchString(line.Text) == invert {
+				return nil, nil
+			}
+			return []Line{line}, nil
+		}), nil
+	}
+}
+
+// replaceTransformer replaces the matches of a regexp, sed-style: the arg is
+// "/regexp/replacement/", with any delimiter instead of "/".
+// The replacement may refer to the submatches as $1, ${name}.
+func replaceTransformer(arg string) (LineTransformer, error) {
+	if len(arg) < 3 {
+		return nil, fmt.Errorf("%q: want /regexp/replacement/", arg)
+	}
+	parts := strings.Split(arg[1:], arg[:1])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("%q: want /regexp/replacement/", arg)
+	}
+	pattern, repl := parts[0], parts[1]
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return TransformerFunc(func(_ context.Context, line Line) ([]Line, error) {
+		line.Text = rx.ReplaceAllString(line.Text, repl)
+		return []Line{line}, nil
+	}), nil
+}
+
+// jsonTransformer reshapes JSON object lines to the comma separated fields of arg,
+// as "field=value" pairs. Other lines are kept as is.
+func jsonTransformer(arg string) (LineTransformer, error) {
+	fields := strings.Split(arg, ",")
+	if arg == "" {
+		return nil, fmt.Errorf("no fields given")
+	}
+	return TransformerFunc(func(_ context.Context, line Line) ([]Line, error) {
+		if !strings.HasPrefix(strings.TrimSpace(line.Text), "{") {
+			return []Line{line}, nil
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line.Text), &m); err != nil {
+			return []Line{line}, nil
+		}
+		var buf bytes.Buffer
+		for _, f := range fields {
+			v, ok := m[f]
+			if !ok {
+				continue
+			}
+			if buf.Len() != 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(f)
+			buf.WriteByte('=')
+			var s string
+			if json.Unmarshal(v, &s) == nil && !strings.ContainsAny(s, " \"=") {
+				buf.WriteString(s)
+			} else {
+				buf.Write(v)
+			}
+		}
+		line.Text = buf.String()
+		return []Line{line}, nil
+	}), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the bytes read per second.
+// A nil *rateLimiter does not limit.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// waited is the end of the last wait
+	waited time.Time
+}
+
+// diskLimiter limits the aggregate disk read bandwidth of the tails of the root.
+var diskLimiter *rateLimiter
+
+// newRateLimiter returns a limiter of bytesPerSec (with one second of burst),
+// or nil if bytesPerSec is not positive.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	r := float64(bytesPerSec)
+	return &rateLimiter{rate: r, burst: r, tokens: r, last: time.Now()}
+}
+
+// Wait takes n tokens, waiting until the bucket is not in debt anymore,
+// or ctx is canceled.
+func (rl *rateLimiter) Wait(ctx context.Context, n int) error {
+	if rl == nil || n <= 0 {
+		return nil
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens = min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+	rl.tokens -= float64(n)
+	var wait time.Duration
+	if rl.tokens < 0 {
+		wait = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+		rl.waited = now.Add(wait)
+	}
+	rl.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Throttled reports whether a read has waited for the limiter since t.
+func (rl *rateLimiter) Throttled(t time.Time) bool {
+	if rl == nil {
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.waited.After(t)
+}
+
+// limitedFile is a file whose reads wait for the diskLimiter.
+type limitedFile struct {
+	*os.File
+	ctx context.Context
+}
+
+func (lf limitedFile) Read(p []byte) (int, error) {
+	n, err := lf.File.Read(p)
+	if werr := diskLimiter.Wait(lf.ctx, n); err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+// parseByteSize parses sizes such as 1024, 512k, 10M or 1GiB.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	t := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mul := int64(1)
+	if t != "" {
+		switch t[len(t)-1] {
+		case 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		}
+		if mul != 1 {
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("size %q: %w", s, err)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// rawHandler serves the "path" file as is, for download.
+func rawHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if redactions != nil {
+			http.Error(w, "raw files cannot be redacted, so downloading is disabled with redaction rules", http.StatusForbidden)
+			return
+		}
+		fn := path.Clean(r.URL.Query().Get("path"))
+		fh, code, err := openTail(root, FS, fn)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer fh.Close()
+		fi, err := fh.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logAttrs(r.Context(), "file", fn, "size", fi.Size())
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(fn)}))
+		http.ServeContent(w, r, fn, fi.ModTime(), limitedFile{File: fh, ctx: r.Context()})
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// readOnlyAllowed are the requests allowed by -read-only besides the GET, HEAD and OPTIONS ones:
+// the queries, the ones changing only the client's own view (its cookies, streams and recordings),
+// and the revocations, which only take access away.
+//
+// Everything else (the admin actions, the maintenance, the pairing of the agents,
+// the chaos of -dev, and the requests proxied to the agents) is refused,
+// whatever the other flags enable.
+var readOnlyAllowed = []string{
+	"POST /graphql",
+	"POST /api/v1/stat",
+	"POST /api/v1/verify",
+	"POST /api/v1/unlock",
+	"/api/v1/favorites",
+	"/api/v1/subscriptions",
+	"/api/v1/subscriptions/",
+	"POST /api/v1/recordings",
+	"POST /api/v1/recordings/{id}/stop",
+	"POST /api/v1/streams/{id}/flush",
+	"DELETE /admin/sessions/{key}",
+}
+
+// refuseWrites refuses the requests not in readOnlyAllowed with 403 Forbidden,
+// other than GET, HEAD and OPTIONS.
+func refuseWrites(h http.Handler) http.Handler {
+	allowed := http.NewServeMux()
+	for _, pattern := range readOnlyAllowed {
+		allowed.Handle(pattern, h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if _, pattern := allowed.Handler(r); pattern == "" {
+				slog.Warn("read-only", "method", r.Method, "path", r.URL.Path)
+				http.Error(w, "read-only mode", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
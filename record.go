@@ -0,0 +1,80 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// recordGrouper groups continuation lines (such as stack traces)
+// with their leading line into one multi-line record.
+//
+// A line starts a new record if it matches Start,
+// or if Start is nil and it does not match Cont.
+//
+// A record is cut at maxRecordLines lines or maxRecordBytes bytes,
+// the rest of its lines starting a new one.
+type recordGrouper struct {
+	Start, Cont *regexp.Regexp
+	pending     []Line
+	size        int
+}
+
+const (
+	// maxRecordLines is the most lines of a record.
+	maxRecordLines = 1000
+	// maxRecordBytes is the most bytes of the lines of a record.
+	maxRecordBytes = 1 << 20
+)
+
+// newRecordGrouper returns a grouper for the given start and continuation patterns,
+// or nil if both are empty.
+func newRecordGrouper(start, cont string) (*recordGrouper, error) {
+	if start == "" && cont == "" {
+		return nil, nil
+	}
+	var g recordGrouper
+	var err error
+	if start != "" {
+		if g.Start, err = regexp.Compile(start); err != nil {
+			return nil, fmt.Errorf("record start %q: %w", start, err)
+		}
+	}
+	if cont != "" {
+		if g.Cont, err = regexp.Compile(cont); err != nil {
+			return nil, fmt.Errorf("record continuation %q: %w", cont, err)
+		}
+	}
+	return &g, nil
+}
+
+func (g *recordGrouper) isStart(line string) bool {
+	if g.Start != nil {
+		return g.Start.MatchString(line)
+	}
+	return !g.Cont.MatchString(line)
+}
+
+// Add the line, returning the previous record if the line starts a new one,
+// or if the record would be too long with it.
+func (g *recordGrouper) Add(line Line) []Line {
+	if len(g.pending) != 0 && (g.isStart(line.Text) ||
+		len(g.pending) >= maxRecordLines || g.size+len(line.Text) > maxRecordBytes) {
+		rec := g.pending
+		g.pending, g.size = []Line{line}, len(line.Text)
+		return rec
+	}
+	g.pending = append(g.pending, line)
+	g.size += len(line.Text)
+	return nil
+}
+
+// Flush returns the pending record, if any.
+func (g *recordGrouper) Flush() []Line {
+	rec := g.pending
+	g.pending, g.size = nil, 0
+	return rec
+}
@@ -0,0 +1,330 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Recordings save the lines of a stream, as the viewer sees them
+// (redacted, transformed, formatted and filtered), into a temporary file on the server,
+// from the start of the recording until its stop (or the end of the stream),
+// to be downloaded afterwards.
+//
+// Each stream is announced with its id in a "stream" meta event,
+// a recording is started on it with POST /api/v1/recordings,
+// stopped with POST /api/v1/recordings/{id}/stop, and downloaded from /recordings/{id}.
+var (
+	// recordingSize is the most bytes recorded, beyond it the recording is truncated.
+	recordingSize int64 = 100 << 20
+	// recordingKeep is how long a stopped recording can be downloaded.
+	recordingKeep = time.Hour
+)
+
+const (
+	// maxRecordings is the most recordings (running, or stopped and kept) of the server,
+	// maxUserRecordings of a user (or of a client address, without authentication).
+	maxRecordings     = 64
+	maxUserRecordings = 4
+)
+
+// errTooManyRecordings is returned when the limit of the recordings is reached.
+var errTooManyRecordings = errors.New("too many recordings, stop or wait for the expiry of the old ones")
+
+// recordableStream is a stream which can be recorded.
+type recordableStream struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Name    string    `json:"name"`
+	Client  string    `json:"client"`
+	Started time.Time `json:"started"`
+
+	rec atomic.Pointer[recording]
+	// flush asks the stream to flush its output (see Flush).
+	flush chan struct{}
+}
+
+// recording is the file of a recorded stream.
+type recording struct {
+	ID      string     `json:"id"`
+	User    string     `json:"-"`
+	Name    string     `json:"name"`
+	Filter  string     `json:"filter,omitempty"`
+	Started time.Time  `json:"started"`
+	Stopped *time.Time `json:"stopped,omitempty"`
+	Lines   int64      `json:"lines"`
+	Bytes   int64      `json:"bytes"`
+	// Truncated is set when the recording reached recordingSize.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// owner is the user, or the client address without authentication, for maxUserRecordings
+	owner  string
+	filter *regexp.Regexp
+	mu     sync.Mutex
+	fh     *os.File
+	bw     *bufio.Writer
+}
+
+// Write the text to the recording, if it matches the filter.
+func (rec *recording) Write(text string) {
+	if rec.filter != nil && !rec.filter.MatchString(text) {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.bw == nil || rec.Truncated {
+		return
+	}
+	if rec.Bytes+int64(len(text))+1 > recordingSize {
+		rec.Truncated = true
+		return
+	}
+	rec.bw.WriteString(text)
+	rec.bw.WriteByte('\n')
+	rec.Lines++
+	rec.Bytes += int64(len(text)) + 1
+}
+
+// stop the recording, closing its file, and reports whether it was running.
+func (rec *recording) stop() bool {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.bw == nil {
+		return false
+	}
+	if err := rec.bw.Flush(); err != nil {
+		slog.Error("flush recording", "file", rec.fh.Name(), "error", err)
+	}
+	rec.fh.Close()
+	rec.bw = nil
+	now := time.Now()
+	rec.Stopped = &now
+	return true
+}
+
+// recordingRegistry holds the recordable streams and the recordings.
+type recordingRegistry struct {
+	mu         sync.Mutex
+	streams    map[string]*recordableStream
+	recordings map[string]*recording
+}
+
+// recordings are the recordings of this server.
+var recordings = &recordingRegistry{}
+
+// newRecordingID returns a random id.
+func newRecordingID() string {
+	var a [16]byte
+	rand.Read(a[:])
+	return hex.EncodeToString(a[:])
+}
+
+// Stream registers a recordable stream of r, returning it and a function to unregister it,
+// which stops its recording.
+func (rr *recordingRegistry) Stream(r *http.Request) (*recordableStream, func()) {
+	name := "stream"
+	if src := streamSource(r); src != "" {
+		name = path.Base(src)
+	}
+	rs := &recordableStream{
+		ID: newRecordingID(), Name: name, Client: r.RemoteAddr, Started: time.Now(),
+		flush: make(chan struct{}, 1),
+	}
+	if u := authenticate(r); u != nil {
+		rs.User = u.Name
+	}
+	rr.mu.Lock()
+	if rr.streams == nil {
+		rr.streams = make(map[string]*recordableStream)
+	}
+	rr.streams[rs.ID] = rs
+	rr.mu.Unlock()
+	return rs, func() {
+		rr.mu.Lock()
+		delete(rr.streams, rs.ID)
+		rr.mu.Unlock()
+		if rec := rs.rec.Swap(nil); rec != nil {
+			rr.stop(rec)
+		}
+	}
+}
+
+// start a recording of the stream, keeping the lines matching filter
+// (a case-insensitive regexp, or a literal if it is not valid).
+func (rr *recordingRegistry) start(rs *recordableStream, filter string) (*recording, error) {
+	rec := &recording{ID: newRecordingID(), User: rs.User, Name: rs.Name, Filter: filter, Started: time.Now()}
+	if filter != "" {
+		var err error
+		if rec.filter, err = regexp.Compile("(?i)" + filter); err != nil {
+			rec.filter = regexp.MustCompile("(?i)" + regexp.QuoteMeta(filter))
+		}
+	}
+	fh, err := os.CreateTemp("", "webtail-recording-*.log")
+	if err != nil {
+		return nil, err
+	}
+	rec.fh, rec.bw = fh, bufio.NewWriter(fh)
+	if rec.owner = rs.User; rec.owner == "" {
+		rec.owner, _, _ = net.SplitHostPort(rs.Client)
+	}
+	rr.mu.Lock()
+	var n int
+	for _, old := range rr.recordings {
+		if old.owner == rec.owner {
+			n++
+		}
+	}
+	if n >= maxUserRecordings || len(rr.recordings) >= maxRecordings {
+		rr.mu.Unlock()
+		fh.Close()
+		os.Remove(fh.Name())
+		return nil, errTooManyRecordings
+	}
+	if rr.recordings == nil {
+		rr.recordings = make(map[string]*recording)
+	}
+	rr.recordings[rec.ID] = rec
+	rr.mu.Unlock()
+	if old := rs.rec.Swap(rec); old != nil {
+		rr.stop(old)
+	}
+	slog.Info("recording started", "id", rec.ID, "stream", rs.Name, "user", rec.User)
+	return rec, nil
+}
+
+// stop the recording, and remove its file after recordingKeep.
+func (rr *recordingRegistry) stop(rec *recording) {
+	if !rec.stop() {
+		return
+	}
+	slog.Info("recording stopped", "id", rec.ID, "lines", rec.Lines, "bytes", rec.Bytes)
+	time.AfterFunc(recordingKeep, func() {
+		rr.mu.Lock()
+		delete(rr.recordings, rec.ID)
+		rr.mu.Unlock()
+		os.Remove(rec.fh.Name())
+	})
+}
+
+// Close stops the recordings and removes their files.
+func (rr *recordingRegistry) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for id, rec := range rr.recordings {
+		rec.stop()
+		os.Remove(rec.fh.Name())
+		delete(rr.recordings, id)
+	}
+	return nil
+}
+
+// sameUser reports whether the request is of the user, if any.
+func sameUser(r *http.Request, user string) bool {
+	if user == "" {
+		return true
+	}
+	u := authenticate(r)
+	return u != nil && u.Name == user
+}
+
+// lookup returns the recording of the id, if it belongs to the user of the request.
+func (rr *recordingRegistry) lookup(r *http.Request, id string) *recording {
+	rr.mu.Lock()
+	rec := rr.recordings[id]
+	rr.mu.Unlock()
+	if rec == nil || !sameUser(r, rec.User) {
+		return nil
+	}
+	return rec
+}
+
+// handleStart starts a recording of the "stream" (its id), with the "filter" of the viewer,
+// and returns the recording as JSON.
+func (rr *recordingRegistry) handleStart(w http.ResponseWriter, r *http.Request) {
+	rr.mu.Lock()
+	rs := rr.streams[r.FormValue("stream")]
+	rr.mu.Unlock()
+	if rs == nil || !sameUser(r, rs.User) {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+	rec, err := rr.start(rs, r.FormValue("filter"))
+	if errors.Is(err, errTooManyRecordings) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeRecording(w, rec)
+}
+
+// handleStop stops the recording, and returns it as JSON.
+func (rr *recordingRegistry) handleStop(w http.ResponseWriter, r *http.Request) {
+	rec := rr.lookup(r, r.PathValue("id"))
+	if rec == nil {
+		http.Error(w, "no such recording", http.StatusNotFound)
+		return
+	}
+	rr.mu.Lock()
+	for _, rs := range rr.streams {
+		rs.rec.CompareAndSwap(rec, nil)
+	}
+	rr.mu.Unlock()
+	rr.stop(rec)
+	writeRecording(w, rec)
+}
+
+// handleDownload returns the file of the stopped recording as an attachment.
+func (rr *recordingRegistry) handleDownload(w http.ResponseWriter, r *http.Request) {
+	rec := rr.lookup(r, r.PathValue("id"))
+	if rec == nil {
+		http.Error(w, "no such recording", http.StatusNotFound)
+		return
+	}
+	rec.mu.Lock()
+	stopped := rec.Stopped != nil
+	rec.mu.Unlock()
+	if !stopped {
+		http.Error(w, "the recording is not stopped yet", http.StatusConflict)
+		return
+	}
+	fh, err := os.Open(rec.fh.Name())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	defer fh.Close()
+	name := strings.TrimSuffix(rec.Name, path.Ext(rec.Name)) + "-" + rec.Started.Format("20060102-150405") + ".log"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, *rec.Stopped, fh)
+}
+
+// writeRecording writes the recording as JSON, with its download URL.
+func writeRecording(w http.ResponseWriter, rec *recording) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*recording
+		URL string `json:"url"`
+	}{recording: rec, URL: "./recordings/" + rec.ID})
+}
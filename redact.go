@@ -0,0 +1,113 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// redactRule replaces the matches of its regexp with "[REDACTED:<name>]".
+type redactRule struct {
+	Name string
+	Re   *regexp.Regexp
+	// Check filters the matches, if set.
+	Check func(string) bool
+
+	count atomic.Int64
+}
+
+// builtinRedactRules are the predefined rules, by name.
+var builtinRedactRules = map[string]func() *redactRule{
+	"creditcard": func() *redactRule {
+		return &redactRule{Name: "creditcard", Re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), Check: luhnValid}
+	},
+	"bearer": func() *redactRule {
+		return &redactRule{Name: "bearer", Re: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`)}
+	},
+	"email": func() *redactRule {
+		return &redactRule{Name: "email", Re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)}
+	},
+}
+
+// redactor applies the redaction rules to every line sent to any client,
+// counting the redactions for auditing.
+// A nil *redactor does not redact.
+type redactor struct {
+	rules []*redactRule
+}
+
+// redactions are the redaction rules of the server.
+var redactions *redactor
+
+// parseRedactRule returns the builtin rule of the name,
+// or the rule of the "name=regexp" spec.
+func parseRedactRule(spec string) (*redactRule, error) {
+	if f, ok := builtinRedactRules[spec]; ok {
+		return f(), nil
+	}
+	name, pattern, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("redact %q: want one of creditcard, bearer, email, or name=regexp", spec)
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("redact %q: %w", spec, err)
+	}
+	return &redactRule{Name: name, Re: rx}, nil
+}
+
+// Redact returns s with the matches of all the rules replaced.
+func (rd *redactor) Redact(s string) string {
+	if rd == nil {
+		return s
+	}
+	for _, rule := range rd.rules {
+		s = rule.Re.ReplaceAllStringFunc(s, func(m string) string {
+			if rule.Check != nil && !rule.Check(m) {
+				return m
+			}
+			rule.count.Add(1)
+			return "[REDACTED:" + rule.Name + "]"
+		})
+	}
+	return s
+}
+
+// ServeHTTP returns the number of redactions per rule as JSON.
+func (rd *redactor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int64)
+	if rd != nil {
+		for _, rule := range rd.rules {
+			counts[rule.Name] += rule.count.Load()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
+
+// luhnValid reports whether the digits of s pass the Luhn check of card numbers.
+func luhnValid(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
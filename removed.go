@@ -0,0 +1,140 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// errFileRemoved is returned by the tail of a file removed while tailed, after its last line.
+var errFileRemoved = errors.New("file removed")
+
+// removedWait is how long a removed file is waited for to reappear (-removed-wait).
+var removedWait time.Duration
+
+// removedFile is the data of the "removed" and "reappeared" meta events.
+type removedFile struct {
+	File string `json:"file"`
+	// Wait is how long the file is waited for to reappear, empty if not.
+	Wait string `json:"wait,omitempty"`
+}
+
+// followFile sends the lines of the file fn (opened as fh) of FS to linesCh from the offset off,
+// as tailFileFrom.
+//
+// When the file is removed, its viewers get a "removed" meta event (see fileMeta),
+// and it is waited for to reappear for removedWait, to follow it from its start
+// after a "reappeared" meta event (as tail -F). The tail ends otherwise.
+func followFile(ctx context.Context, linesCh chan<- Line, FS fs.FS, fn string, fh *os.File, poll pollOptions, off int64) error {
+	defer close(linesCh)
+	for {
+		err := followFrom(ctx, linesCh, fh, poll, off)
+		fh.Close()
+		if !errors.Is(err, errFileRemoved) {
+			slog.Info("finish", "tail", fn)
+			return err
+		}
+		ev := removedFile{File: fn}
+		if removedWait > 0 {
+			ev.Wait = removedWait.String()
+		}
+		slog.Info("removed", "tail", fn, "wait", removedWait)
+		fileMeta.Publish(fn, metaEvent{Kind: "removed", Data: ev})
+		if removedWait <= 0 {
+			return nil
+		}
+		if fh = waitFile(ctx, FS, fn, poll, removedWait); fh == nil {
+			slog.Info("finish", "tail", fn)
+			return nil
+		}
+		slog.Info("reappeared", "tail", fn)
+		fileMeta.Publish(fn, metaEvent{Kind: "reappeared", Data: removedFile{File: fn}})
+		off = 0
+	}
+}
+
+// waitFile opens the regular file fn of FS when it appears, polling it as a tail,
+// for at most wait. It returns nil if it did not appear, or ctx is canceled.
+func waitFile(ctx context.Context, FS fs.FS, fn string, poll pollOptions, wait time.Duration) *os.File {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	dur := poll.Min
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+		if fi, err := fs.Stat(FS, fn); err == nil && fi.Mode().IsRegular() {
+			if f, err := FS.Open(fn); err == nil {
+				if fh, ok := f.(*os.File); ok {
+					return fh
+				}
+				f.Close()
+			}
+		}
+		dur = poll.next(dur)
+		timer.Reset(dur)
+	}
+}
+
+// fileEvent is a meta event of the tail of a file, and its time,
+// to be sent between the lines read before and after it.
+type fileEvent struct {
+	metaEvent
+	Time time.Time
+}
+
+// fileMetaHub delivers the meta events of the tails of the files (such as their removal)
+// to the streams of the files.
+type fileMetaHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan fileEvent]struct{}
+}
+
+// fileMeta is the hub of the meta events of the tailed files.
+var fileMeta = &fileMetaHub{}
+
+// Subscribe returns a channel receiving the events of the file fn, and a function to unsubscribe.
+func (h *fileMetaHub) Subscribe(fn string) (<-chan fileEvent, func()) {
+	ch := make(chan fileEvent, 8)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[string]map[chan fileEvent]struct{})
+	}
+	if h.subs[fn] == nil {
+		h.subs[fn] = make(map[chan fileEvent]struct{})
+	}
+	h.subs[fn][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if delete(h.subs[fn], ch); len(h.subs[fn]) == 0 {
+			delete(h.subs, fn)
+		}
+	}
+}
+
+// Publish the event of the file fn to its subscribers. Slow subscribers miss it.
+func (h *fileMetaHub) Publish(fn string, ev metaEvent) {
+	fe := fileEvent{metaEvent: ev, Time: time.Now()}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[fn] {
+		select {
+		case ch <- fe:
+		default:
+		}
+	}
+}
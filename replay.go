@@ -0,0 +1,203 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The replay shows what several sources were saying in a window of time, for postmortems:
+// /api/v1/replay returns the lines of the files within the window, ordered by their timestamps,
+// and /replay plays them back in panes, paced by the timestamps, with a shared play/pause/seek control.
+
+const (
+	// maxReplayFiles is the most files of a replay.
+	maxReplayFiles = 8
+	// maxReplayLines is the most lines of a replay (and read of each file), beyond it the replay is truncated.
+	maxReplayLines = 100_000
+)
+
+// replayLine is a line of a replay.
+type replayLine struct {
+	// Source is the index of the file of the line.
+	Source int    `json:"s"`
+	Text   string `json:"t"`
+	// At is the timestamp of the line in Unix milliseconds.
+	// Lines without a timestamp (such as stack traces) have the time of the previous line.
+	At int64 `json:"at"`
+}
+
+// replay is the response of /api/v1/replay.
+type replay struct {
+	Sources   []string     `json:"sources"`
+	From      int64        `json:"from"`
+	To        int64        `json:"to"`
+	Lines     []replayLine `json:"lines"`
+	Truncated bool         `json:"truncated,omitempty"`
+}
+
+// replayWindow is the files and the window of a replay request.
+type replayWindow struct {
+	Files    []string
+	From, To time.Time
+	Layout   string
+}
+
+// parseReplayWindow parses the file=..., from, to and ts-layout (default RFC 3339) query parameters.
+func parseReplayWindow(q url.Values) (replayWindow, error) {
+	rw := replayWindow{Layout: time.RFC3339Nano}
+	for _, fn := range q["file"] {
+		if fn != "" {
+			rw.Files = append(rw.Files, path.Clean(fn))
+		}
+	}
+	if len(rw.Files) == 0 {
+		return rw, fmt.Errorf("file is required")
+	}
+	if len(rw.Files) > maxReplayFiles {
+		return rw, fmt.Errorf("at most %d files can be replayed", maxReplayFiles)
+	}
+	var err error
+	if rw.From, err = parseReplayTime(q.Get("from")); err != nil {
+		return rw, fmt.Errorf("from: %w", err)
+	}
+	if rw.To, err = parseReplayTime(q.Get("to")); err != nil {
+		return rw, fmt.Errorf("to: %w", err)
+	}
+	if !rw.From.Before(rw.To) {
+		return rw, fmt.Errorf("from must be before to")
+	}
+	if s := q.Get("ts-layout"); s != "" {
+		rw.Layout = s
+	}
+	return rw, nil
+}
+
+// parseReplayTime parses the time as RFC 3339, or as the value of a datetime-local input,
+// in the local time zone.
+func parseReplayTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, fmt.Errorf("required")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time", s)
+}
+
+// readReplay returns the lines of the files within the window, ordered by their timestamps.
+func readReplay(ctx context.Context, root string, FS fs.FS, rw replayWindow) (replay, error) {
+	mo := &mergeOptions{Layout: rw.Layout, fields: len(strings.Fields(rw.Layout))}
+	rp := replay{Sources: rw.Files, From: rw.From.UnixMilli(), To: rw.To.UnixMilli()}
+	for i, fn := range rw.Files {
+		fh, _, err := openTail(root, FS, fn)
+		if err != nil {
+			return rp, err
+		}
+		var at time.Time
+		off, err := timeIndex.Seek(ctx, fn, fh, mo, rw.From)
+		if err != nil {
+			fh.Close()
+			return rp, err
+		}
+		// the lines of the file, at most maxReplayLines of each, as the merged ones are cut at that
+		var n int
+	Scan:
+		for n < maxReplayLines {
+			var lines []Line
+			lines, off, err = readLines(ctx, fh, off, 1000)
+			if err != nil || len(lines) == 0 {
+				break
+			}
+			for _, line := range lines {
+				if t, ok := mo.timestamp(line.Text); ok {
+					at = t
+				}
+				if at.Before(rw.From) {
+					continue
+				}
+				if at.After(rw.To) {
+					// the lines of a log are written in order
+					break Scan
+				}
+				if n == maxReplayLines {
+					rp.Truncated = true
+					break Scan
+				}
+				rp.Lines = append(rp.Lines, replayLine{Source: i, Text: redactions.Redact(line.Text), At: at.UnixMilli()})
+				n++
+			}
+		}
+		fh.Close()
+		if err != nil {
+			return rp, fmt.Errorf("read %q: %w", fn, err)
+		}
+	}
+	slices.SortStableFunc(rp.Lines, func(a, b replayLine) int {
+		return cmp.Compare(a.At, b.At)
+	})
+	// the first lines of the window, of all the files
+	if len(rp.Lines) > maxReplayLines {
+		rp.Lines, rp.Truncated = rp.Lines[:maxReplayLines], true
+	}
+	return rp, nil
+}
+
+// replayDataHandler returns the lines of the replay as JSON.
+func replayDataHandler(root string, FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rw, err := parseReplayWindow(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logAttrs(r.Context(), "files", rw.Files, "from", rw.From, "to", rw.To)
+		rp, err := readReplay(r.Context(), root, FS, rw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rp)
+	}
+}
+
+// replayHandler shows the form of choosing the files and the window,
+// and the player of the replay when they are given.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rw, err := parseReplayWindow(q)
+	page := replayPage{Files: append(slices.Clone(rw.Files), ""), From: q.Get("from"), To: q.Get("to"), Layout: q.Get("ts-layout")}
+	if err != nil {
+		if len(rw.Files) != 0 {
+			page.Error = err.Error()
+		}
+	} else {
+		page.Src = "./api/v1/replay?" + q.Encode()
+	}
+	renderPage(w, "replay.html", page)
+}
+
+// replayPage is the data of the replay.html template: the form, and the player of Src if it is set.
+type replayPage struct {
+	Files            []string
+	From, To, Layout string
+	Error, Src       string
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// With annotate=offset, the SSE event id is "<offset>:<checksum>" of the last line of the event:
+// its byte offset in the file, and the CRC-32 of its text, in hex.
+//
+// A client reconnecting with the Last-Event-ID header (or the lastEventId parameter)
+// resumes after that line, if it is still at the offset with the same text,
+// so no line is sent twice. If the file was rewritten (or truncated) since,
+// the stream restarts cleanly, announced by a "restart" meta event,
+// instead of streaming from the middle of a line.
+
+// maxLineSums is the most checksums kept for the lines being rendered.
+const maxLineSums = 4096
+
+// lineSum returns the checksum of the text of a line.
+func lineSum(text string) uint32 { return crc32.ChecksumIEEE([]byte(text)) }
+
+// lineSums are the checksums of the raw lines being rendered, oldest first,
+// for the ids of their events.
+type lineSums struct {
+	offs []int64
+	sums []uint32
+}
+
+// push the checksum of the raw line.
+func (ls *lineSums) push(line Line) {
+	if len(ls.offs) >= maxLineSums {
+		ls.offs, ls.sums = ls.offs[1:], ls.sums[1:]
+	}
+	ls.offs, ls.sums = append(ls.offs, line.Offset), append(ls.sums, lineSum(line.Text))
+}
+
+// take returns the checksum of the line at the offset, dropping the older ones.
+func (ls *lineSums) take(off int64) (uint32, bool) {
+	for i, o := range ls.offs {
+		if o == off {
+			sum := ls.sums[i]
+			ls.offs, ls.sums = ls.offs[i+1:], ls.sums[i+1:]
+			return sum, true
+		}
+	}
+	return 0, false
+}
+
+// eventID returns the id of the event of the line at the offset.
+func eventID(off int64, sum uint32) string {
+	return strconv.FormatInt(off, 10) + ":" + fmt.Sprintf("%08x", sum)
+}
+
+// parseEventID parses the id of eventID.
+func parseEventID(id string) (int64, uint32, error) {
+	offS, sumS, ok := strings.Cut(id, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("event id %q: no checksum", id)
+	}
+	off, err := strconv.ParseInt(offS, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, fmt.Errorf("event id %q: bad offset", id)
+	}
+	sum, err := strconv.ParseUint(sumS, 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("event id %q: bad checksum", id)
+	}
+	return off, uint32(sum), nil
+}
+
+// resumeOffset returns the offset after the complete line of fh at off,
+// if it starts there and has the checksum sum.
+// Otherwise it returns the reason the stream cannot be resumed.
+func resumeOffset(ctx context.Context, fh *os.File, off int64, sum uint32) (int64, error) {
+	if off > 0 {
+		var a [1]byte
+		if _, err := fh.ReadAt(a[:], off-1); err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, fmt.Errorf("the file is shorter than %d bytes", off)
+			}
+			return 0, err
+		} else if a[0] != '\n' {
+			return 0, fmt.Errorf("no line starts at %d", off)
+		}
+	}
+	lines, next, err := readLines(ctx, fh, off, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(lines) == 0 || lines[0].Offset != off {
+		return 0, fmt.Errorf("no line at %d", off)
+	}
+	var a [1]byte
+	if _, err := fh.ReadAt(a[:], next-1); err != nil || a[0] != '\n' {
+		return 0, fmt.Errorf("the line at %d is not complete", off)
+	}
+	if lineSum(lines[0].Text) != sum {
+		return 0, fmt.Errorf("the line at %d has changed", off)
+	}
+	return next, nil
+}
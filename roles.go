@@ -0,0 +1,270 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/process"
+)
+
+// role is what a user is allowed to do, each role includes the lower ones.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer can browse and tail.
+	roleViewer
+	// roleDownloader can also fetch the raw files.
+	roleDownloader
+	// roleAdmin can also see the metrics and use the admin endpoints.
+	roleAdmin
+)
+
+var roleNames = map[string]role{"viewer": roleViewer, "downloader": roleDownloader, "admin": roleAdmin}
+
+func (r role) String() string {
+	for k, v := range roleNames {
+		if v == r {
+			return k
+		}
+	}
+	return "none"
+}
+
+// authUser is a user of the users file.
+type authUser struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// Token is the secret, or SHA256 is its hex encoded hash.
+	// Without them, the user can only log in with OIDC.
+	Token  string `json:"token,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	role     role
+	hash     [sha256.Size]byte
+	hasToken bool
+}
+
+// userDB authenticates the users by their tokens,
+// given as Bearer token, or as the password of Basic authentication.
+// A nil *userDB allows everything (but the admin endpoints).
+//
+// The file is re-read when it changes; while it is unreadable, the last users are kept,
+// and authentication is in an outage (see authOutage).
+type userDB struct {
+	path string
+
+	mu      sync.RWMutex
+	users   []*authUser
+	modTime time.Time
+}
+
+// users are the users of the server, nil if authentication is disabled.
+var users *userDB
+
+// errUsersUnavailable is returned by loadUsers when the users file cannot be read.
+var errUsersUnavailable = errors.New("users file unavailable")
+
+// loadUsers reads the JSON array of users from fn.
+//
+// An unreadable file (wrapped in errUsersUnavailable) returns the empty userDB, to be re-read later.
+func loadUsers(fn string) (*userDB, error) {
+	db := userDB{path: fn}
+	return &db, db.reload()
+}
+
+// reload reads the users file if it has been changed since the last read.
+func (db *userDB) reload() error {
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsersUnavailable, err)
+	}
+	db.mu.RLock()
+	same := fi.ModTime().Equal(db.modTime)
+	db.mu.RUnlock()
+	if same {
+		return nil
+	}
+	b, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsersUnavailable, err)
+	}
+	list, err := parseUsers(db.path, b)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.users, db.modTime = list, fi.ModTime()
+	db.mu.Unlock()
+	return nil
+}
+
+// watch re-reads the users file every authProbeInterval, until the context is done.
+func (db *userDB) watch(ctx context.Context) {
+	ticker := time.NewTicker(authProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := db.reload()
+		if err != nil && !errors.Is(err, errUsersUnavailable) {
+			slog.Error("reload users", "file", db.path, "error", err)
+		}
+		authBackend.Set("users", err)
+	}
+}
+
+// list returns the users.
+func (db *userDB) list() []*authUser {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.users
+}
+
+// parseUsers parses the JSON array of users read from fn.
+func parseUsers(fn string, b []byte) ([]*authUser, error) {
+	var list []*authUser
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	for _, u := range list {
+		var ok bool
+		if u.role, ok = roleNames[u.Role]; !ok || u.Name == "" {
+			return nil, fmt.Errorf("%q: user %q: name is required, role must be viewer, downloader or admin", fn, u.Name)
+		}
+		if u.SHA256 != "" {
+			h, err := hex.DecodeString(u.SHA256)
+			if err != nil || len(h) != len(u.hash) {
+				return nil, fmt.Errorf("%q: user %q: sha256 is not a hex encoded SHA-256 hash", fn, u.Name)
+			}
+			copy(u.hash[:], h)
+			u.hasToken = true
+		} else if u.Token != "" {
+			u.hash, u.hasToken = sha256.Sum256([]byte(u.Token)), true
+		}
+	}
+	return list, nil
+}
+
+// authenticate returns the user of the request's credentials, or nil.
+func (db *userDB) authenticate(r *http.Request) *authUser {
+	if db == nil {
+		return nil
+	}
+	name, token, basic := r.BasicAuth()
+	if !basic {
+		var ok bool
+		if token, ok = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !ok {
+			return nil
+		}
+	}
+	for _, u := range db.list() {
+		if u.checkToken(token) && (!basic || name == u.Name) {
+			if sessions.TokenRevoked(r.Context(), u) {
+				return nil
+			}
+			return u
+		}
+	}
+	return nil
+}
+
+// checkToken reports whether token is the token of the user.
+func (u *authUser) checkToken(token string) bool {
+	hash := sha256.Sum256([]byte(token))
+	return u.hasToken && subtle.ConstantTimeCompare(hash[:], u.hash[:]) == 1
+}
+
+// lookup returns the user of the name, or nil.
+func (db *userDB) lookup(name string) *authUser {
+	if db == nil {
+		return nil
+	}
+	for _, u := range db.list() {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// authenticate returns the user of the request's session or credentials, or nil.
+func authenticate(r *http.Request) *authUser {
+	if u := oidcLogin.session(r); u != nil {
+		return u
+	}
+	return users.authenticate(r)
+}
+
+// hasRole reports whether the user of the request has at least the min role,
+// as requireRole would allow it. Without users and OIDC, everybody has every role.
+func hasRole(r *http.Request, min role) bool {
+	if users == nil && oidcLogin == nil {
+		return true
+	}
+	u := authenticate(r)
+	return u != nil && u.role >= min
+}
+
+// requireRole allows the request only for the users having at least the min role.
+// Without users and OIDC, everything is allowed.
+//
+// Browsers are sent to the OIDC login when it is enabled.
+func requireRole(min role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if users == nil && oidcLogin == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := authenticate(r)
+		if u == nil && oidcLogin != nil && !authBackend.Down("oidc") && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/auth/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+			return
+		}
+		if err := authBackend.Err(); u == nil && err != nil {
+			if !authBackend.allow(r, min) {
+				slog.Warn("refused during authentication outage", "path", r.URL.Path, "client", r.RemoteAddr)
+				http.Error(w, "authentication is unavailable, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			slog.Warn("allowed during authentication outage", "path", r.URL.Path, "client", r.RemoteAddr, "error", err)
+			if c := process.ConnFrom(r.Context()); c != nil {
+				c.User = authOutageUser
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if u == nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="webtail"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if c := process.ConnFrom(r.Context()); c != nil {
+			c.User = u.Name
+		}
+		if u.role < min {
+			http.Error(w, fmt.Sprintf("%s role required", min), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
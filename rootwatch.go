@@ -0,0 +1,168 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errProbeTimeout = errors.New("timeout")
+
+// rootWatch probes the root periodically with bounded-timeout stats,
+// to detect a hung (NFS) or unmounted filesystem, and its recovery.
+type rootWatch struct {
+	Root              string
+	Interval, Timeout time.Duration
+
+	// mountPoint is whether the root was on a different device than its parent
+	// when first seen: if they become the same, the root has been unmounted.
+	mountPoint bool
+	probing    atomic.Bool
+
+	mu    sync.RWMutex
+	err   error
+	since time.Time
+}
+
+// RootState is the health of the root, sent as the "root" meta event.
+type RootState struct {
+	Degraded bool      `json:"degraded"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// rootStatus is the health of the served root.
+var rootStatus = &rootWatch{}
+
+// Err returns the reason the root is degraded, or nil.
+func (rw *rootWatch) Err() error {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	return rw.err
+}
+
+// State returns the current health of the root.
+func (rw *rootWatch) State() RootState {
+	rw.mu.RLock()
+	defer rw.mu.RUnlock()
+	st := RootState{Degraded: rw.err != nil, Since: rw.since}
+	if rw.err != nil {
+		st.Error = rw.err.Error()
+	}
+	return st
+}
+
+// Run probes the root every Interval, until ctx is canceled.
+func (rw *rootWatch) Run(ctx context.Context) {
+	rw.mountPoint = !rw.sameDevice()
+	rw.set(rw.probe())
+	ticker := time.NewTicker(rw.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rw.set(rw.probe())
+		}
+	}
+}
+
+// probe stats and lists the root in a separate goroutine, waiting at most Timeout.
+//
+// A hung probe is not restarted until it returns, to not pile up blocked goroutines.
+func (rw *rootWatch) probe() error {
+	if !rw.probing.CompareAndSwap(false, true) {
+		return fmt.Errorf("stat %q: %w (still hanging)", rw.Root, errProbeTimeout)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer rw.probing.Store(false)
+		done <- func() error {
+			fh, err := os.Open(rw.Root)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			if _, err := fh.Stat(); err != nil {
+				return err
+			}
+			if rw.mountPoint && rw.sameDevice() {
+				return fmt.Errorf("%q: unmounted", rw.Root)
+			}
+			if _, err = fh.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			return nil
+		}()
+	}()
+	timer := time.NewTimer(rw.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("stat %q: %w after %s", rw.Root, errProbeTimeout, rw.Timeout)
+	}
+}
+
+// sameDevice reports whether the root and its parent directory are on the same device.
+func (rw *rootWatch) sameDevice() bool {
+	var devs [2]uint64
+	for i, fn := range []string{rw.Root, filepath.Dir(rw.Root)} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return false
+		}
+		var ok bool
+		if devs[i], ok = fileDevice(fi); !ok {
+			return false
+		}
+	}
+	return devs[0] == devs[1]
+}
+
+// set the probe result, publishing the changes as a sticky "root" meta event.
+func (rw *rootWatch) set(err error) {
+	rw.mu.Lock()
+	changed := (rw.err == nil) != (err == nil) || rw.since.IsZero()
+	rw.err = err
+	if changed {
+		rw.since = time.Now()
+	}
+	rw.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err != nil {
+		slog.Error("root degraded", "root", rw.Root, "error", err)
+		metaEvents.Publish(metaEvent{Kind: "root", Data: rw.State()}, true)
+	} else {
+		slog.Info("root available", "root", rw.Root)
+		metaEvents.Publish(metaEvent{Kind: "root", Data: rw.State()}, false)
+	}
+}
+
+// ServeHTTP returns the health of the root as JSON,
+// with 503 Service Unavailable status when degraded.
+func (rw *rootWatch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := rw.State()
+	w.Header().Set("Content-Type", "application/json")
+	if st.Degraded {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
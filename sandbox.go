@@ -0,0 +1,101 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// errOutsideRoot is returned for the names leading out of the root of the Sandbox.
+var errOutsideRoot = errors.New("outside the root")
+
+// Sandbox resolves the names of the requests under its root directory.
+// All the files of the requests are opened through it.
+//
+// The names are slash-separated, relative to the root and cleaned:
+// absolute names, names leaving the root with "..", and symlinks
+// pointing out of the root are refused (see os.Root).
+type Sandbox struct {
+	// dir is the absolute path of the root, with the symlinks resolved.
+	dir  string
+	root *os.Root
+	fsys fs.FS
+}
+
+var (
+	_ fs.StatFS    = (*Sandbox)(nil)
+	_ fs.ReadDirFS = (*Sandbox)(nil)
+)
+
+// newSandbox returns the Sandbox of the directory.
+func newSandbox(dir string) (*Sandbox, error) {
+	dir, err := filepath.Abs(dir)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Sandbox{dir: dir, root: root, fsys: root.FS()}, nil
+}
+
+// Dir returns the absolute path of the root, with the symlinks resolved.
+func (sb *Sandbox) Dir() string { return sb.dir }
+
+// Close the root.
+func (sb *Sandbox) Close() error { return sb.root.Close() }
+
+// Rel returns the cleaned name, or errOutsideRoot if it leaves the root.
+func (sb *Sandbox) Rel(op, name string) (string, error) {
+	rel := path.Clean(name)
+	if !fs.ValidPath(rel) {
+		return "", &fs.PathError{Op: op, Path: name, Err: errOutsideRoot}
+	}
+	return rel, nil
+}
+
+// Open opens the named file for reading.
+func (sb *Sandbox) Open(name string) (fs.File, error) {
+	fh, err := sb.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return fh, nil
+}
+
+// OpenFile opens the named file for reading.
+func (sb *Sandbox) OpenFile(name string) (*os.File, error) {
+	rel, err := sb.Rel("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return sb.root.Open(rel)
+}
+
+// Stat returns the FileInfo of the named file, following the symlinks inside the root.
+func (sb *Sandbox) Stat(name string) (fs.FileInfo, error) {
+	rel, err := sb.Rel("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return sb.root.Stat(rel)
+}
+
+// ReadDir reads the named directory, returning its entries sorted by name.
+func (sb *Sandbox) ReadDir(name string) ([]fs.DirEntry, error) {
+	rel, err := sb.Rel("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(sb.fsys, rel)
+}
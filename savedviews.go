@@ -0,0 +1,271 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// The saved views are the named views of the team (such as "checkout-errors":
+// the glob app-*.log, filtered by ERROR.*checkout, with highlights),
+// kept in the -store, listed on the index page, and shared by their URL, /views/{name}.
+
+const (
+	// savedViewsBucket is the bucket of the saved views in the store.
+	savedViewsBucket = "saved-views"
+	// maxSavedViewFiles is the most files of a saved view.
+	maxSavedViewFiles = 8
+	// maxSavedViews is the most saved views.
+	maxSavedViews = 500
+	// maxIndexSavedViews is the most saved views listed on the index page.
+	maxIndexSavedViews = 50
+)
+
+var (
+	// errTooManySavedViews is returned saving a new view over maxSavedViews.
+	errTooManySavedViews = fmt.Errorf("at most %d views can be saved", maxSavedViews)
+	// errNotAuthor is returned changing the view of someone else.
+	errNotAuthor = errors.New("the view belongs to someone else")
+)
+
+// savedViewNameRe matches the valid names of the saved views, usable in URLs as they are.
+var savedViewNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// savedView is a named view: the files and the view state of the viewer.
+type savedView struct {
+	Name string `json:"name"`
+	// Files are shown side by side (one in the viewer), or Glob is tailed.
+	Files []string `json:"files,omitempty"`
+	Glob  string   `json:"glob,omitempty"`
+	// Filter and Highlight are as in the viewer (case insensitive regexps).
+	Filter    string   `json:"filter,omitempty"`
+	Highlight []string `json:"highlight,omitempty"`
+	// Author is the user who saved the view, if authenticated.
+	Author  string    `json:"author,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// check cleans the paths of the view, and returns the first problem of it.
+func (sv *savedView) check() error {
+	if !savedViewNameRe.MatchString(sv.Name) {
+		return fmt.Errorf("name %q: must be at most 64 letters, digits, dots, dashes or underscores", sv.Name)
+	}
+	if (len(sv.Files) == 0) == (sv.Glob == "") {
+		return errors.New("exactly one of files and glob is required")
+	}
+	if len(sv.Files) > maxSavedViewFiles {
+		return fmt.Errorf("at most %d files can be saved", maxSavedViewFiles)
+	}
+	for i, fn := range sv.Files {
+		if fn == "" {
+			return errors.New("a file is empty")
+		}
+		sv.Files[i] = path.Clean(fn)
+	}
+	if sv.Glob != "" {
+		sv.Glob = path.Clean(sv.Glob)
+		if err := checkGlob(sv.Glob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// URL returns the URL of the view: the viewer of the file or the glob, or the split view of the files.
+func (sv savedView) URL() string {
+	q := url.Values{}
+	switch {
+	case sv.Glob != "":
+		q.Set("glob", sv.Glob)
+	case len(sv.Files) == 1:
+		q.Set("path", sv.Files[0])
+	default:
+		q["file"] = sv.Files
+		for i := range sv.Files {
+			p := "p" + strconv.Itoa(i) + "."
+			if sv.Filter != "" {
+				q.Set(p+"filter", sv.Filter)
+			}
+			q[p+"hl"] = sv.Highlight
+		}
+		return "./split?" + q.Encode()
+	}
+	if sv.Filter != "" {
+		q.Set("filter", sv.Filter)
+	}
+	q["hl"] = sv.Highlight
+	return "./file?" + q.Encode()
+}
+
+// savedViews keeps the saved views in the store; nil without a -store.
+type savedViews struct {
+	Store store.Store
+}
+
+// List returns the saved views, sorted by their names.
+func (svs *savedViews) List(ctx context.Context) ([]savedView, error) {
+	if svs == nil {
+		return nil, nil
+	}
+	m, err := svs.Store.List(ctx, savedViewsBucket)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]savedView, 0, len(m))
+	for k, b := range m {
+		var sv savedView
+		if err := json.Unmarshal(b, &sv); err != nil {
+			return nil, fmt.Errorf("saved view %q: %w", k, err)
+		}
+		views = append(views, sv)
+	}
+	slices.SortFunc(views, func(a, b savedView) int { return cmp.Compare(a.Name, b.Name) })
+	return views, nil
+}
+
+// Get returns the saved view of the name, or store.ErrNotFound.
+func (svs *savedViews) Get(ctx context.Context, name string) (savedView, error) {
+	var sv savedView
+	b, err := svs.Store.Get(ctx, savedViewsBucket, name)
+	if err != nil {
+		return sv, err
+	}
+	err = json.Unmarshal(b, &sv)
+	return sv, err
+}
+
+// mayChange reports whether the user of r may replace or delete the saved view:
+// its author, or an admin.
+func mayChange(r *http.Request, sv savedView) bool {
+	if sameUser(r, sv.Author) {
+		return true
+	}
+	u := authenticate(r)
+	return u != nil && u.role >= roleAdmin
+}
+
+// ServeHTTP lists the saved views (GET /api/v1/views), saves one (PUT /api/v1/views/{name}, as JSON),
+// or deletes it (DELETE /api/v1/views/{name}). Only the author of a view (or an admin)
+// may replace or delete it.
+func (svs *savedViews) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := r.PathValue("name")
+	if name == "" {
+		views, err := svs.List(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+		return
+	}
+	logAttrs(ctx, "view", name)
+	var sv savedView
+	if r.Method != http.MethodDelete {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&sv); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sv.Name = name
+		if err := sv.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sv.Updated = time.Now().UTC()
+	}
+	var author string
+	if u := authenticate(r); u != nil {
+		author = u.Name
+	}
+	var count int
+	if r.Method != http.MethodDelete {
+		// the limit is checked before the update, so instances saving at once may exceed it slightly
+		m, err := svs.Store.List(ctx, savedViewsBucket)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		count = len(m)
+	}
+	// the view is created, replaced or deleted atomically, so two users cannot create the same at once
+	var exists bool
+	err := store.Update(ctx, svs.Store, savedViewsBucket, name, func(b []byte) ([]byte, error) {
+		if exists = b != nil; !exists {
+			if r.Method == http.MethodDelete {
+				return nil, store.ErrNotFound
+			}
+			if count >= maxSavedViews {
+				return nil, errTooManySavedViews
+			}
+			sv.Author = author
+			return json.Marshal(sv)
+		}
+		var old savedView
+		if err := json.Unmarshal(b, &old); err != nil {
+			return nil, err
+		}
+		if !mayChange(r, old) {
+			return nil, fmt.Errorf("%w: %q belongs to %s", errNotAuthor, name, old.Author)
+		}
+		if r.Method == http.MethodDelete {
+			return nil, nil
+		}
+		sv.Author = old.Author
+		return json.Marshal(sv)
+	})
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, fmt.Sprintf("no view %q", name), http.StatusNotFound)
+		return
+	case errors.Is(err, errTooManySavedViews):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case errors.Is(err, errNotAuthor):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(sv)
+}
+
+// open redirects to the saved view of /views/{name}.
+func (svs *savedViews) open(w http.ResponseWriter, r *http.Request) {
+	sv, err := svs.Get(r.Context(), r.PathValue("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("no view %q", r.PathValue("name")), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logAttrs(r.Context(), "view", sv.Name)
+	// relative to /views/
+	http.Redirect(w, r, "."+sv.URL(), http.StatusSeeOther)
+}
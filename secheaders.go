@@ -0,0 +1,99 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultCSP is the default Content-Security-Policy of the HTML pages:
+// only the embedded assets are loaded, and nothing inline is run,
+// as the lines of the logs shown are attacker-controlled.
+const defaultCSP = "default-src 'self'; script-src 'self'; style-src 'self'; img-src 'self' data:; " +
+	"connect-src 'self'; object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+
+// securityWriter sets the security headers of the response when its header is written.
+type securityWriter struct {
+	http.ResponseWriter
+	csp, frameOptions string
+	written           bool
+}
+
+func (sw *securityWriter) setHeaders() {
+	if sw.written {
+		return
+	}
+	sw.written = true
+	hdr := sw.Header()
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	if !strings.HasPrefix(hdr.Get("Content-Type"), "text/html") {
+		return
+	}
+	if sw.csp != "" {
+		hdr.Set("Content-Security-Policy", sw.csp)
+	}
+	if sw.frameOptions != "" {
+		hdr.Set("X-Frame-Options", sw.frameOptions)
+	}
+	hdr.Set("Referrer-Policy", "same-origin")
+}
+
+func (sw *securityWriter) WriteHeader(code int) {
+	sw.setHeaders()
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *securityWriter) Write(p []byte) (int, error) {
+	if !sw.written {
+		// as net/http does
+		if sw.Header().Get("Content-Type") == "" {
+			sw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		sw.setHeaders()
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, for the SSE streams.
+func (sw *securityWriter) Flush() {
+	sw.setHeaders()
+	if fl, ok := sw.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, for the WebSockets.
+func (sw *securityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sw.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController.
+func (sw *securityWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// withSecurityHeaders sets X-Content-Type-Options: nosniff on all the responses,
+// and the Content-Security-Policy (if not empty), X-Frame-Options and Referrer-Policy
+// on the HTML ones.
+//
+// X-Frame-Options follows the frame-ancestors directive of the policy,
+// for the browsers not supporting it.
+func withSecurityHeaders(csp string, h http.Handler) http.Handler {
+	var frameOptions string
+	for _, dir := range strings.Split(csp, ";") {
+		if name, value, _ := strings.Cut(strings.TrimSpace(dir), " "); name == "frame-ancestors" {
+			switch strings.TrimSpace(value) {
+			case "'none'":
+				frameOptions = "DENY"
+			case "'self'":
+				frameOptions = "SAMEORIGIN"
+			}
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&securityWriter{ResponseWriter: w, csp: csp, frameOptions: frameOptions}, r)
+	})
+}
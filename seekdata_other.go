@@ -0,0 +1,12 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// seekData returns off, as holes cannot be detected on this OS.
+func seekData(fh *os.File, off int64) (int64, error) { return off, nil }
@@ -0,0 +1,28 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// seekData returns the start of the first data region at or after off,
+// or -1 if there is only a hole after off.
+func seekData(fh *os.File, off int64) (int64, error) {
+	d, err := fh.Seek(off, unix.SEEK_DATA)
+	if err == nil {
+		return d, nil
+	}
+	if errors.Is(err, unix.ENXIO) {
+		return -1, nil
+	}
+	// the filesystem does not support it
+	return off, nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+)
+
+// selfName is the virtual file of webtail's own log.
+const selfName = virtualPrefix + "self"
+
+// virtualWriter appends the written lines to a virtual file.
+type virtualWriter struct{ vf *virtualFile }
+
+func (vw virtualWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimSuffix(p, []byte{'\n'}), []byte{'\n'}) {
+		vw.vf.Append(string(line))
+	}
+	return len(p), nil
+}
+
+// logToSelf tees the log output into the @self virtual file,
+// so the server can be debugged from its own UI.
+func logToSelf() {
+	log.SetOutput(io.MultiWriter(log.Writer(), virtualWriter{vf: virtualFiles.Get(selfName)}))
+}
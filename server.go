@@ -0,0 +1,90 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// serverReport is the self-report of /api/v1/server, for the fleet tooling
+// to inventory which webtail instances run which capabilities.
+type serverReport struct {
+	Version  string       `json:"version"`
+	Build    buildReport  `json:"build"`
+	Instance instanceInfo `json:"instance"`
+	// Features are the names of the enabled features, sorted.
+	Features []string `json:"features"`
+	// Roots are the labels of the roots served (not their paths).
+	Roots   []string     `json:"roots"`
+	Limits  serverLimits `json:"limits"`
+	Started time.Time    `json:"started"`
+	Uptime  string       `json:"uptime"`
+}
+
+// buildReport is the build information of the binary.
+type buildReport struct {
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// serverLimits are the limits set by the flags, 0 meaning unlimited.
+type serverLimits struct {
+	MaxLineSize   int    `json:"maxLineSize"`
+	MaxMemory     int64  `json:"maxMemory"`
+	ReadRate      int64  `json:"readRate"`
+	RecordingSize int64  `json:"recordingSize"`
+	FSTimeout     string `json:"fsTimeout"`
+	Heartbeat     string `json:"heartbeat"`
+	MinInterval   string `json:"minInterval"`
+	MaxInterval   string `json:"maxInterval"`
+}
+
+// newServerReport returns the report of the features enabled (true) in the map.
+func newServerReport(features map[string]bool, limits serverLimits) *serverReport {
+	sr := serverReport{
+		Version:  "(devel)",
+		Build:    buildReport{GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH},
+		Instance: instance, Roots: []string{instance.Root},
+		Limits: limits,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Version != "" {
+			sr.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				sr.Build.Revision = s.Value
+			case "vcs.time":
+				sr.Build.Time = s.Value
+			case "vcs.modified":
+				sr.Build.Modified = s.Value == "true"
+			}
+		}
+	}
+	for name, enabled := range features {
+		if enabled {
+			sr.Features = append(sr.Features, name)
+		}
+	}
+	slices.Sort(sr.Features)
+	return &sr
+}
+
+func (sr *serverReport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := *sr
+	report.Started = warmup.Progress().Started
+	report.Uptime = time.Since(report.Started).Round(time.Second).String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// systemdListener returns the socket passed by systemd socket activation,
+// or nil if the process was not socket activated.
+func systemdListener() (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, nil
+	}
+	if n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	// the first passed file descriptor is 3 (SD_LISTEN_FDS_START)
+	f := os.NewFile(3, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// newHTTPServer returns the server of handler, speaking HTTP/2 besides HTTP/1.1:
+// over TLS (negotiated with ALPN), and over cleartext with prior knowledge (h2c),
+// for the reverse proxies terminating TLS.
+// The streams of many tail panes share one connection this way,
+// instead of exhausting the 6 HTTP/1.1 connections per host of the browsers.
+func newHTTPServer(handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second, Protocols: &protocols}
+}
+
+// serveListener serves srv on ln until ctx is canceled,
+// with HTTPS if certFile (and keyFile) is not empty.
+func serveListener(ctx context.Context, ln net.Listener, srv *http.Server, certFile, keyFile string) error {
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutCtx)
+	}()
+	var err error
+	if certFile != "" {
+		err = srv.ServeTLS(ln, certFile, keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+var unitTemplates = template.Must(template.New("socket").Parse(`# Generated by webtail install-service
+[Unit]
+Description=WebTail log viewer socket ({{.Name}})
+
+[Socket]
+ListenStream={{.ListenStream}}
+{{- if .Unix}}
+SocketMode=0660
+{{- end}}
+
+[Install]
+WantedBy=sockets.target
+`))
+
+func init() {
+	template.Must(unitTemplates.New("service").Parse(`# Generated by webtail install-service
+[Unit]
+Description=WebTail log viewer ({{.Name}})
+Documentation=https://github.com/UNO-SOFT/webtail
+Requires={{.Name}}.socket
+After=network.target {{.Name}}.socket
+
+[Service]
+Type=simple
+ExecStart={{.Exec}}
+Restart=on-failure
+{{- if .User}}
+User={{.User}}
+{{- else}}
+DynamicUser=yes
+{{- end}}
+SupplementaryGroups=adm systemd-journal
+StateDirectory={{.Name}}
+
+# only read the logs, write nothing but the state directory
+ProtectSystem=strict
+ReadOnlyPaths={{.Root}}
+ProtectHome=yes
+PrivateTmp=yes
+PrivateDevices=yes
+NoNewPrivileges=yes
+CapabilityBoundingSet=
+AmbientCapabilities=
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+ProtectProc=invisible
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+RemoveIPC=yes
+UMask=0077
+SystemCallArchitectures=native
+SystemCallFilter=@system-service
+SystemCallFilter=~@privileged @resources
+
+[Install]
+WantedBy=multi-user.target
+`))
+}
+
+// installService is the install-service subcommand:
+// it emits (or writes into -dir) matching .service and .socket systemd units.
+func installService(args []string) error {
+	fset := flag.NewFlagSet("install-service", flag.ContinueOnError)
+	flagRoot := fset.String("root", "/var/log", "root directory of the logs to serve")
+	flagListen := fset.String("listen", "unix:/run/webtail.sock", "address to listen on (unix:/path or [host]:port)")
+	flagName := fset.String("name", "webtail", "name of the units")
+	flagUser := fset.String("user", "", "user to run as (default: a dynamic user)")
+	flagDir := fset.String("dir", "", "write the units into this directory (such as /etc/systemd/system) instead of printing them")
+	exe, _ := os.Executable()
+	flagBinary := fset.String("binary", exe, "path of the webtail binary")
+	fset.Usage = func() {
+		fmt.Fprintf(fset.Output(), "Usage: %s install-service [flags] [-- webtail flags]\n", filepath.Base(os.Args[0]))
+		fset.PrintDefaults()
+	}
+	if err := fset.Parse(args); err != nil {
+		return err
+	}
+
+	data := struct {
+		Name, Root, User, Exec, ListenStream string
+		Unix                                 bool
+	}{Name: *flagName, Root: *flagRoot, User: *flagUser}
+	if p, ok := strings.CutPrefix(*flagListen, "unix:"); ok {
+		data.ListenStream, data.Unix = p, true
+	} else if host, port, err := net.SplitHostPort(*flagListen); err != nil {
+		return fmt.Errorf("listen %q: %w", *flagListen, err)
+	} else if host == "" {
+		data.ListenStream = port
+	} else {
+		data.ListenStream = *flagListen
+	}
+	// the listening address is only used when not socket activated
+	execArgs := append([]string{*flagBinary, "-listen=" + *flagListen, "-state=/var/lib/" + *flagName + "/state.json"}, fset.Args()...)
+	execArgs = append(execArgs, *flagRoot)
+	for i, a := range execArgs {
+		if strings.ContainsAny(a, " \t\"'\\") {
+			execArgs[i] = strconv.Quote(a)
+		}
+	}
+	data.Exec = strings.Join(execArgs, " ")
+
+	for _, kind := range []string{"socket", "service"} {
+		var buf strings.Builder
+		if err := unitTemplates.ExecuteTemplate(&buf, kind, data); err != nil {
+			return err
+		}
+		if *flagDir == "" {
+			fmt.Printf("### %s.%s\n%s\n", *flagName, kind, buf.String())
+			continue
+		}
+		fn := filepath.Join(*flagDir, *flagName+"."+kind)
+		if err := os.WriteFile(fn, []byte(buf.String()), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "written", fn)
+	}
+	if *flagDir != "" {
+		fmt.Fprintf(os.Stderr, "Now run\n\tsystemctl daemon-reload && systemctl enable --now %s.socket\n", *flagName)
+	}
+	return nil
+}
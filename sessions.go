@@ -0,0 +1,299 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/process"
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// The admin lists the OIDC sessions and the tokens of the users file at GET /admin/sessions,
+// and revokes them with DELETE /admin/sessions/{key}, where the key is
+//
+//   - the ID of a session,
+//   - "user:<name>" for all the sessions of the user logged in until now,
+//   - "token:<ID>" for the token of a user.
+//
+// The revocation list is kept in the -store (in memory without one), and checked by every request,
+// re-read every revocationRefresh for the revocations at the other instances sharing the store.
+
+const (
+	// sessionsBucket is the bucket of the OIDC sessions in the store, by their IDs.
+	sessionsBucket = "sessions"
+	// revokedBucket is the bucket of the revocations in the store, by their keys.
+	revokedBucket = "revoked"
+	// revocationRefresh is the most time the revocation list is cached for.
+	revocationRefresh = 5 * time.Second
+)
+
+// sessionInfo is an OIDC session.
+type sessionInfo struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Client  string    `json:"client,omitempty"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+	Revoked bool      `json:"revoked,omitempty"`
+}
+
+// revocation is an entry of the revocation list.
+type revocation struct {
+	Revoked time.Time `json:"revoked"`
+	By      string    `json:"by,omitempty"`
+	// Expires is when the entry is not needed anymore, as what it revokes has expired;
+	// zero for the tokens.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// tokenInfo is a token of the users file.
+type tokenInfo struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Role    string `json:"role"`
+	Revoked bool   `json:"revoked,omitempty"`
+}
+
+// sessionRegistry keeps the sessions and the revocation list in the Store, or in memory.
+type sessionRegistry struct {
+	Store store.Store
+
+	mu sync.Mutex
+	// sessions are the sessions without a Store
+	sessions map[string]sessionInfo
+	revoked  map[string]revocation
+	loaded   time.Time
+}
+
+// sessions are the sessions of the server.
+var sessions = &sessionRegistry{sessions: make(map[string]sessionInfo), revoked: make(map[string]revocation)}
+
+// newSessionID returns a random session ID.
+func newSessionID() string {
+	var a [12]byte
+	rand.Read(a[:])
+	return hex.EncodeToString(a[:])
+}
+
+// tokenID returns the ID of the token of the user: the start of its hash.
+func (u *authUser) tokenID() string { return hex.EncodeToString(u.hash[:8]) }
+
+// Add records a new session.
+func (sr *sessionRegistry) Add(ctx context.Context, si sessionInfo) error {
+	if sr.Store == nil {
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+		now := time.Now()
+		for k, v := range sr.sessions {
+			if now.After(v.Expires) {
+				delete(sr.sessions, k)
+			}
+		}
+		sr.sessions[si.ID] = si
+		return nil
+	}
+	b, err := json.Marshal(si)
+	if err != nil {
+		return err
+	}
+	return sr.Store.Put(ctx, sessionsBucket, si.ID, b)
+}
+
+// lookup returns the revocation of the key, re-reading the list from the Store if it is stale.
+func (sr *sessionRegistry) lookup(ctx context.Context, key string) (revocation, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.Store != nil && time.Since(sr.loaded) > revocationRefresh {
+		if err := sr.loadLocked(ctx); err != nil {
+			slog.Error("load the revocation list", "error", err)
+		}
+	}
+	rv, ok := sr.revoked[key]
+	return rv, ok
+}
+
+// loadLocked reads the revocation list from the Store, dropping the expired entries, with sr.mu held.
+func (sr *sessionRegistry) loadLocked(ctx context.Context) error {
+	m, err := sr.Store.List(ctx, revokedBucket)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	revoked := make(map[string]revocation, len(m))
+	for k, b := range m {
+		var rv revocation
+		if err := json.Unmarshal(b, &rv); err != nil {
+			return fmt.Errorf("revocation %q: %w", k, err)
+		}
+		if !rv.Expires.IsZero() && now.After(rv.Expires) {
+			sr.Store.Delete(ctx, revokedBucket, k)
+			continue
+		}
+		revoked[k] = rv
+	}
+	sr.revoked, sr.loaded = revoked, now
+	return nil
+}
+
+// SessionRevoked reports whether the session of the user, issued at the time, has been revoked.
+func (sr *sessionRegistry) SessionRevoked(ctx context.Context, id, user string, issued time.Time) bool {
+	if _, ok := sr.lookup(ctx, "session:"+id); ok {
+		return true
+	}
+	rv, ok := sr.lookup(ctx, "user:"+user)
+	return ok && !issued.After(rv.Revoked)
+}
+
+// TokenRevoked reports whether the token of the user has been revoked.
+func (sr *sessionRegistry) TokenRevoked(ctx context.Context, u *authUser) bool {
+	_, ok := sr.lookup(ctx, "token:"+u.tokenID())
+	return ok
+}
+
+// Revoke adds the key to the revocation list.
+func (sr *sessionRegistry) Revoke(ctx context.Context, key string, rv revocation) error {
+	if sr.Store != nil {
+		b, err := json.Marshal(rv)
+		if err != nil {
+			return err
+		}
+		if err := sr.Store.Put(ctx, revokedBucket, key, b); err != nil {
+			return err
+		}
+	}
+	sr.mu.Lock()
+	sr.revoked[key] = rv
+	sr.mu.Unlock()
+	return nil
+}
+
+// List returns the unexpired sessions, the newest first, dropping the expired ones.
+func (sr *sessionRegistry) List(ctx context.Context) ([]sessionInfo, error) {
+	now := time.Now()
+	list := []sessionInfo{}
+	if sr.Store == nil {
+		sr.mu.Lock()
+		for _, si := range sr.sessions {
+			if now.Before(si.Expires) {
+				list = append(list, si)
+			}
+		}
+		sr.mu.Unlock()
+	} else {
+		m, err := sr.Store.List(ctx, sessionsBucket)
+		if err != nil {
+			return nil, err
+		}
+		for k, b := range m {
+			var si sessionInfo
+			if err := json.Unmarshal(b, &si); err != nil {
+				return nil, fmt.Errorf("session %q: %w", k, err)
+			}
+			if now.After(si.Expires) {
+				sr.Store.Delete(ctx, sessionsBucket, k)
+				continue
+			}
+			list = append(list, si)
+		}
+	}
+	for i, si := range list {
+		list[i].Revoked = sr.SessionRevoked(ctx, si.ID, si.User, si.Issued)
+	}
+	slices.SortFunc(list, func(a, b sessionInfo) int {
+		return cmp.Or(b.Issued.Compare(a.Issued), strings.Compare(a.ID, b.ID))
+	})
+	return list, nil
+}
+
+// ServeHTTP lists the sessions, the tokens and the revocation list on GET,
+// and revokes the session, user or token of the {key} on DELETE.
+func (sr *sessionRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method == http.MethodDelete {
+		key := r.PathValue("key")
+		rv := revocation{Revoked: time.Now()}
+		if c := process.ConnFrom(ctx); c != nil {
+			rv.By = c.User
+		}
+		kind, name, _ := strings.Cut(key, ":")
+		switch kind {
+		case "user":
+			// the sessions issued until now expire by then
+			rv.Expires = rv.Revoked.Add(sessionTTL)
+		case "token":
+			if !slices.ContainsFunc(users.tokens(), func(ti tokenInfo) bool { return ti.ID == name }) {
+				http.Error(w, fmt.Sprintf("no token %q", name), http.StatusNotFound)
+				return
+			}
+		default:
+			list, err := sr.List(ctx)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			i := slices.IndexFunc(list, func(si sessionInfo) bool { return si.ID == key })
+			if i < 0 {
+				http.Error(w, fmt.Sprintf("no session %q", key), http.StatusNotFound)
+				return
+			}
+			key, rv.Expires = "session:"+key, list[i].Expires
+		}
+		if err := sr.Revoke(ctx, key, rv); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Warn("revoked", "key", key, "by", rv.By)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	list, err := sr.List(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens := users.tokens()
+	for i, ti := range tokens {
+		_, tokens[i].Revoked = sr.lookup(ctx, "token:"+ti.ID)
+	}
+	sr.mu.Lock()
+	revoked := make(map[string]revocation, len(sr.revoked))
+	for k, v := range sr.revoked {
+		revoked[k] = v
+	}
+	sr.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sessions []sessionInfo         `json:"sessions"`
+		Tokens   []tokenInfo           `json:"tokens"`
+		Revoked  map[string]revocation `json:"revoked"`
+	}{Sessions: list, Tokens: tokens, Revoked: revoked})
+}
+
+// tokens returns the tokens of the users file.
+func (db *userDB) tokens() []tokenInfo {
+	if db == nil {
+		return nil
+	}
+	var tokens []tokenInfo
+	for _, u := range db.list() {
+		if u.hasToken {
+			tokens = append(tokens, tokenInfo{ID: u.tokenID(), User: u.Name, Role: u.Role})
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// sharedLineSize is the assumed average line length when starting a shared tail
+// near the end of a file, to fill its buffer.
+const sharedLineSize = 256
+
+// tailBroker shares one reader of each file between all its viewers (fan-out),
+// keeping its last lines for the viewers joining later.
+//
+// A slow viewer does not hold up the reader nor the other viewers:
+// the lines not fitting into its queue are dropped, and it is told how many.
+type tailBroker struct {
+	// Keep is the number of lines kept, 0 disables sharing.
+	Keep int
+	// Linger is how long a reader is kept after its last viewer left,
+	// so a reconnecting viewer finds the buffer.
+	Linger time.Duration
+	// FS is where the removed files are waited for to reappear (see followFile).
+	FS fs.FS
+
+	mu    sync.Mutex
+	tails map[string]*sharedTail
+}
+
+// sharedTails is the broker of the /tail streams.
+var sharedTails = &tailBroker{Keep: 1000, Linger: 30 * time.Second}
+
+// sharedTail is the reader of a file, and its buffer.
+type sharedTail struct {
+	vf      *virtualFile
+	cancel  context.CancelFunc
+	viewers int
+	stop    *time.Timer
+	// done is closed when the reader finished, as the file is removed.
+	done chan struct{}
+	// filled is closed when the reader has read the last lines of the file at its start.
+	filled chan struct{}
+}
+
+// TailFile sends the lines of the file fn (opened as fh) to linesCh, until ctx is canceled:
+// through the shared reader, unless sharing is disabled or the poll options are not the defaults.
+//
+// If after is not negative, the lines before that offset are skipped
+// (the kept lines of the shared reader), otherwise the whole file is read without one.
+func (tb *tailBroker) TailFile(ctx context.Context, linesCh chan<- Line, fn string, fh *os.File, poll pollOptions, after int64) {
+	if tb.Keep > 0 && poll == defaultPoll {
+		if after < 0 {
+			tb.Tail(ctx, linesCh, fn, fh)
+			return
+		}
+		ch := make(chan Line)
+		go tb.Tail(ctx, ch, fn, fh)
+		skipBefore(ctx, linesCh, ch, after)
+		return
+	}
+	if err := followFile(ctx, linesCh, tb.FS, fn, fh, poll, max(after, 0)); err != nil {
+		slog.Warn("tail", "file", fn, "error", err)
+	}
+}
+
+// Tail sends the kept and the new lines of the file fn to linesCh, until ctx is canceled.
+// It uses fh (opened for fn) to read the file if there is no reader of it yet,
+// and closes it otherwise.
+func (tb *tailBroker) Tail(ctx context.Context, linesCh chan<- Line, fn string, fh *os.File) {
+	defer close(linesCh)
+	st, startRead, leave := tb.join(fn, fh)
+	defer leave()
+	backlog, sub, unsubscribe := st.vf.Subscribe()
+	defer unsubscribe()
+	// the reader starts after the first subscription
+	if startRead != nil {
+		startRead()
+	}
+	sendSubscribed(ctx, linesCh, backlog, sub, st.done)
+}
+
+// Warm keeps the reader of the file fn (opened as fh, closed if there is a reader already) running
+// until ctx is canceled, and returns the channel closed when its buffer has been filled.
+func (tb *tailBroker) Warm(ctx context.Context, fn string, fh *os.File) <-chan struct{} {
+	st, startRead, leave := tb.join(fn, fh)
+	if startRead != nil {
+		startRead()
+	}
+	context.AfterFunc(ctx, leave)
+	return st.filled
+}
+
+// join adds a viewer to the shared tail of fn, creating it with fh if there is none
+// (closing fh otherwise), and returns it with the function starting its reader (only for a new one),
+// and the function leaving it.
+func (tb *tailBroker) join(fn string, fh *os.File) (*sharedTail, func(), func()) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	st := tb.tails[fn]
+	var startRead func()
+	if st == nil {
+		if tb.tails == nil {
+			tb.tails = make(map[string]*sharedTail)
+		}
+		st = &sharedTail{vf: &virtualFile{Name: fn, ring: make([]Line, tb.Keep)}, done: make(chan struct{}), filled: make(chan struct{})}
+		tb.tails[fn] = st
+		var readCtx context.Context
+		readCtx, st.cancel = context.WithCancel(context.Background())
+		startRead = func() { go tb.read(readCtx, st, fn, fh) }
+	} else {
+		fh.Close()
+	}
+	st.viewers++
+	if st.stop != nil {
+		st.stop.Stop()
+		st.stop = nil
+	}
+	return st, startRead, func() {
+		tb.mu.Lock()
+		defer tb.mu.Unlock()
+		if st.viewers--; st.viewers == 0 {
+			st.stop = time.AfterFunc(tb.Linger, func() {
+				tb.mu.Lock()
+				defer tb.mu.Unlock()
+				if st.viewers == 0 {
+					tb.remove(fn, st)
+				}
+			})
+		}
+	}
+}
+
+// read tails fh into the buffer of st, starting near the end of the file
+// to fill the buffer with the last lines.
+func (tb *tailBroker) read(ctx context.Context, st *sharedTail, fn string, fh *os.File) {
+	var off int64
+	if fi, err := fh.Stat(); err == nil {
+		// from the newline before, to skip the partial first line
+		off = max(0, fi.Size()-int64(tb.Keep)*sharedLineSize-1)
+	}
+	// the buffer is filled when the last complete line at the start is read
+	last := int64(-1)
+	if seam, err := tailSeam(ctx, fh); err == nil && seam > off {
+		if last, err = lineStartBefore(ctx, fh, seam, 1); err != nil {
+			last = -1
+		}
+	}
+	var once sync.Once
+	filled := func() { once.Do(func() { close(st.filled) }) }
+	if last < 0 {
+		filled()
+	}
+	defer filled()
+	ch := make(chan Line)
+	go func() {
+		if err := followFile(ctx, ch, tb.FS, fn, fh, defaultPoll, off); err != nil {
+			st.vf.SetError(err)
+		}
+	}()
+	skip := off > 0
+	for line := range ch {
+		if skip {
+			skip = false
+		} else {
+			st.vf.AppendLine(line)
+		}
+		if line.Offset >= last {
+			filled()
+		}
+	}
+	// the file is removed (not the reader stopped): end the streams of the viewers
+	removed := ctx.Err() == nil
+	// a new viewer starts a new reader
+	tb.mu.Lock()
+	tb.remove(fn, st)
+	tb.mu.Unlock()
+	if removed {
+		close(st.done)
+	}
+}
+
+// Usage returns the bytes of the lines kept by the shared tails.
+func (tb *tailBroker) Usage() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	var n int64
+	for _, st := range tb.tails {
+		n += st.vf.Usage()
+	}
+	return n
+}
+
+// Shed removes the shared tails without viewers under memory pressure,
+// and trims the kept lines of the others to a quarter under critical pressure.
+func (tb *tailBroker) Shed(level int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	for fn, st := range tb.tails {
+		if st.viewers == 0 {
+			if st.stop != nil {
+				st.stop.Stop()
+				st.stop = nil
+			}
+			tb.remove(fn, st)
+		} else if level >= memoryCritical {
+			st.vf.Trim(max(1, tb.Keep/4))
+		}
+	}
+}
+
+// remove the shared tail of fn (if it is st), and stop its reader.
+func (tb *tailBroker) remove(fn string, st *sharedTail) {
+	if tb.tails[fn] == st {
+		delete(tb.tails, fn)
+	}
+	st.cancel()
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serveSocket serves a simple line protocol on the Unix domain socket at sockPath,
+// for local tools that do not want to speak SSE:
+//
+//	TAIL <path>\n
+//
+// is answered with the lines of the file (relative to root), newline-delimited,
+// until the client closes the connection. Errors are reported as a single
+// "ERR <message>\n" line.
+//
+// The socket bypasses the roles of -users and OIDC, so it is admin-only:
+// it is created with 0600 permissions, usable only by the user running webtail (and root).
+func serveSocket(ctx context.Context, sockPath, root string, FS fs.FS) error {
+	if err := os.Remove(sockPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	ln, err := listenPrivate(ctx, sockPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sockPath)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		os.Remove(sockPath)
+	}()
+	slog.Info("Listen", "socket", sockPath, "root", root)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go serveSocketConn(ctx, conn, root, FS)
+	}
+}
+
+// listenPrivate listens on the Unix domain socket at sockPath, with 0600 permissions.
+// The socket is created in a private (0700) directory and moved to sockPath
+// after its permissions are set, so nobody else can connect to it meanwhile.
+func listenPrivate(ctx context.Context, sockPath string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(sockPath), ".webtail-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the listener must not remove the socket by its temporary name on Close
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0o600); err == nil {
+		err = os.Rename(tmp, sockPath)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func serveSocketConn(ctx context.Context, conn net.Conn, root string, FS fs.FS) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	br := bufio.NewReader(conn)
+	req, err := br.ReadString('\n')
+	if err != nil {
+		slog.Warn("socket read", "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	bw := bufio.NewWriter(conn)
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(req), " ")
+	if cmd != "TAIL" || arg == "" {
+		bw.WriteString("ERR usage: TAIL <path>\n")
+		bw.Flush()
+		return
+	}
+	if m := maintenance.Get(); m != nil && m.Freeze {
+		bw.WriteString("ERR maintenance: " + m.Message + "\n")
+		bw.Flush()
+		return
+	}
+	fn := path.Clean(strings.TrimPrefix(arg, "/"))
+	fh, _, err := openTail(root, FS, fn)
+	if err != nil {
+		bw.WriteString("ERR " + err.Error() + "\n")
+		bw.Flush()
+		return
+	}
+	slog.Info("socket tail", "file", fn)
+	// a read returns when the client closes the connection
+	go func() {
+		var a [1]byte
+		conn.SetReadDeadline(time.Time{})
+		br.Read(a[:])
+		cancel()
+	}()
+
+	linesCh := make(chan Line)
+	go sharedTails.TailFile(ctx, linesCh, fn, fh, defaultPoll, -1)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-linesCh:
+			if !ok {
+				bw.Flush()
+				return
+			}
+			bw.WriteString(redactions.Redact(line.Text))
+			if err := bw.WriteByte('\n'); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if bw.Buffered() != 0 {
+				if err := bw.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// activeWindow is how recent the last line of an active source is.
+const activeWindow = time.Minute
+
+// agentSourcesTimeout is the most time the sources of an agent are waited for.
+const agentSourcesTimeout = 2 * time.Second
+
+// Status badges of the sources, in increasing importance.
+const (
+	statusSilent   = "silent"
+	statusActive   = "active"
+	statusErroring = "erroring"
+)
+
+var statusRank = map[string]int{statusSilent: 0, statusActive: 1, statusErroring: 2}
+
+// sourceNode is a host, a source (gelf, fluent, exec, agent, ssh...) or a file in the tree of sources,
+// with the status aggregated from its children.
+type sourceNode struct {
+	Name string `json:"name"`
+	// Path is the name of the virtual file, for its leaf.
+	Path string `json:"path,omitempty"`
+	// URL is the viewer of the leaves, relative to the index page.
+	URL      string        `json:"url,omitempty"`
+	Status   string        `json:"status"`
+	Modified *time.Time    `json:"modified,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Children []*sourceNode `json:"children,omitempty"`
+}
+
+func (n *sourceNode) child(name string) *sourceNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &sourceNode{Name: name, Status: statusSilent}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// aggregate sets the status and modification time of n from its children, recursively.
+func (n *sourceNode) aggregate() {
+	slices.SortFunc(n.Children, func(a, b *sourceNode) int { return strings.Compare(a.Name, b.Name) })
+	for _, c := range n.Children {
+		c.aggregate()
+		if statusRank[c.Status] > statusRank[n.Status] {
+			n.Status = c.Status
+		}
+		if c.Modified != nil && (n.Modified == nil || c.Modified.After(*n.Modified)) {
+			n.Modified = c.Modified
+		}
+	}
+}
+
+// sourceTree is the tree of the sources: the virtual files, the agents and the remote hosts,
+// grouped by host, then by source.
+type sourceTree struct {
+	Virtual *virtualRegistry
+	Agents  *agentRegistry
+	// Remotes are the -ssh-hosts, if any.
+	Remotes *sshHosts
+}
+
+// Tree returns the sources grouped by host, then by source, with the statuses aggregated.
+func (st sourceTree) Tree(ctx context.Context) []*sourceNode {
+	var root sourceNode
+	st.Virtual.addTo(&root)
+	st.Agents.addTo(ctx, &root)
+	if st.Remotes != nil {
+		st.Remotes.addTo(&root)
+	}
+	root.aggregate()
+	return root.Children
+}
+
+// ServeHTTP returns the tree of the sources as JSON.
+func (st sourceTree) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tree := st.Tree(r.Context())
+	if tree == nil {
+		tree = []*sourceNode{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
+// addTo adds the virtual files to the tree, under their host, then their source.
+//
+// The name of a virtual file is "@<source>/<rest>"; its host is the one it was created on,
+// or this instance. The host is removed from the rest.
+func (vr *virtualRegistry) addTo(root *sourceNode) {
+	now := time.Now()
+	for _, name := range vr.Names() {
+		vf := vr.Lookup(name)
+		host := vf.Host
+		if host == "" {
+			host = instance.Name
+		}
+		source, rest, _ := strings.Cut(strings.TrimPrefix(name, virtualPrefix), "/")
+		if vf.Host != "" {
+			rest = strings.TrimPrefix(strings.TrimPrefix(rest, strings.ReplaceAll(vf.Host, "/", "_")), "/")
+		}
+		if rest == "" {
+			rest = source
+		}
+		leaf := root.child(host).child(source).child(rest)
+		leaf.Path, leaf.URL = name, "./file?path="+url.QueryEscape(name)
+		modified, err := vf.Status()
+		if !modified.IsZero() {
+			leaf.Modified = &modified
+		}
+		switch {
+		case err != nil:
+			leaf.Status, leaf.Error = statusErroring, err.Error()
+		case now.Sub(modified) < activeWindow:
+			leaf.Status = statusActive
+		}
+	}
+}
+
+// addTo adds the connected agents to the tree, under their names: their root as the "agent" source,
+// and their own sources, with the URLs going through the /agents/{name}/ proxy.
+func (ar *agentRegistry) addTo(ctx context.Context, root *sourceNode) {
+	list := ar.List()
+	trees := make([][]*sourceNode, len(list))
+	errs := make([]error, len(list))
+	ctx, cancel := context.WithTimeout(ctx, agentSourcesTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, ac := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trees[i], errs[i] = ac.sources(ctx)
+		}()
+	}
+	wg.Wait()
+	for i, ac := range list {
+		prefix := "./agents/" + url.PathEscape(ac.Info.Name) + "/"
+		leaf := root.child(ac.Info.Name).child("agent").child(cmp.Or(ac.Info.Host, ac.Info.Name) + ":" + ac.Info.Root)
+		leaf.URL, leaf.Status = prefix, statusActive
+		if errs[i] != nil {
+			slog.Warn("agent sources", "name", ac.Info.Name, "error", errs[i])
+			leaf.Status, leaf.Error = statusErroring, errs[i].Error()
+		}
+		for _, n := range trees[i] {
+			// the hosts of the agent are the agent itself, or the remote hosts of it
+			h := root.child(n.Name)
+			for _, c := range n.Children {
+				c.rebase(prefix)
+				h.Children = append(h.Children, c)
+			}
+		}
+	}
+}
+
+// rebase prefixes the URLs of the leaves of n.
+func (n *sourceNode) rebase(prefix string) {
+	if rest, ok := strings.CutPrefix(n.URL, "./"); ok {
+		n.URL = prefix + rest
+	}
+	for _, c := range n.Children {
+		c.rebase(prefix)
+	}
+}
+
+// sources returns the tree of the sources of the agent.
+func (ac *agentConn) sources(ctx context.Context) ([]*sourceNode, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ac.Info.Name+"/api/v1/sources", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: ac.proxy.Transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	var tree []*sourceNode
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tree)
+	return tree, err
+}
+
+// addTo adds the remote hosts to the tree, with their Root as the "ssh" source:
+// active while connected, erroring if the last connection failed.
+func (sh *sshHosts) addTo(root *sourceNode) {
+	for _, name := range sh.Names() {
+		h := sh.hosts[name]
+		leaf := root.child(name).child("ssh").child(h.Root)
+		leaf.URL = "./hosts?host=" + url.QueryEscape(name)
+		h.mu.Lock()
+		switch {
+		case h.err != nil:
+			leaf.Status, leaf.Error = statusErroring, h.err.Error()
+		case h.client != nil:
+			leaf.Status = statusActive
+		}
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// maxZeroScan is the most explicitly written zero bytes nextData reads through
+// before deciding that the region is preallocated but not written yet.
+const maxZeroScan = 1 << 20
+
+// nextData returns the offset of the first non-NUL byte at or after off,
+// or -1 if there is none (yet).
+//
+// Holes are jumped over with SEEK_DATA where the OS supports it,
+// explicit zeros are read through, up to maxZeroScan bytes:
+// after that, the offset where the scan stopped is returned, to continue from there,
+// instead of scanning the same zeros again and again.
+func nextData(ctx context.Context, fh *os.File, off int64) (int64, error) {
+	var a [65536]byte
+	var scanned int
+	for scanned < maxZeroScan {
+		d, err := seekData(fh, off)
+		if err != nil || d < 0 {
+			return -1, err
+		}
+		n, err := fh.ReadAt(a[:], d)
+		if i := indexNonZero(a[:n]); i >= 0 {
+			return d + int64(i), nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return -1, err
+		}
+		if err := diskLimiter.Wait(ctx, n); err != nil {
+			return -1, err
+		}
+		off, scanned = d+int64(n), scanned+n
+	}
+	return off, nil
+}
+
+// indexNonZero returns the index of the first non-NUL byte of p, or -1.
+func indexNonZero(p []byte) int {
+	for i, b := range p {
+		if b != 0 {
+			return i
+		}
+	}
+	return -1
+}
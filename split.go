@@ -0,0 +1,63 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// splitHandler shows the files (file=a&file=b...) side by side,
+// each pane with its own stream, filters and pause state.
+//
+// The view state of the i-th pane is in the "p<i>." prefixed query parameters (see webtail.js).
+func splitHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	files := slices.DeleteFunc(q["file"], func(s string) bool { return s == "" })
+	logAttrs(r.Context(), "files", files)
+
+	var page splitPage
+	// keep the panes and their state when adding one
+	for _, k := range slices.Sorted(maps.Keys(q)) {
+		for _, v := range q[k] {
+			if k != "file" || v != "" {
+				page.Hidden = append(page.Hidden, formField{Name: k, Value: v})
+			}
+		}
+	}
+	for i, fn := range files {
+		rest := url.Values{"file": slices.Delete(slices.Clone(files), i, i+1)}
+		tail := url.Values{"file": {fn}, "from": {"buffer"}, "annotate": {"offset"}, "rate": {"1"}}
+		if _, ok := parserRuleOf(fn); ok {
+			tail.Set("parse", "1")
+		}
+		if c := q.Get("compress"); c != "" {
+			tail.Set("compress", c)
+		}
+		page.Panes = append(page.Panes, splitPane{Path: fn, CloseURL: "./split?" + rest.Encode(),
+			TailURL: "./tail?" + tail.Encode(), State: "p" + strconv.Itoa(i) + "."})
+	}
+	renderPage(w, "split.html", page)
+}
+
+// formField is a hidden field of a form.
+type formField struct {
+	Name, Value string
+}
+
+// splitPage is the data of the split.html template.
+type splitPage struct {
+	Hidden []formField
+	Panes  []splitPane
+}
+
+// splitPane is a pane of the split view: the file of Path tailed from TailURL,
+// its view state in the query parameters prefixed by State.
+type splitPane struct {
+	Path, CloseURL, TailURL, State string
+}
@@ -0,0 +1,703 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/process"
+	"github.com/coder/websocket"
+)
+
+// sseOptions are the per-request rendering options of an SSE stream.
+type sseOptions struct {
+	// Left and Right wrap each (HTML escaped) line, if any of them is set.
+	Left, Right string
+	// Formatter renders the lines, instead of HTML escaping.
+	Formatter process.Formatter
+	// Pipeline transforms the lines before anything else.
+	Pipeline process.Pipeline
+	// Grouper groups multi-line records into one event.
+	Grouper *recordGrouper
+	// Annotate the events with the offset (as the SSE id),
+	// and the line number and receive time (in JSON data).
+	Offset, LineNo, Time bool
+	// Instance adds the name of this server (in JSON data).
+	Instance bool
+	// Parser adds the fields of the (first) line (in JSON data), see parseFile.
+	Parser lineParser
+	// Hasher publishes a hash chain checkpoint after every N lines.
+	Hasher *lineHasher
+	// Meta are the meta events of this stream only, such as the stats of the file.
+	Meta <-chan metaEvent
+	// FileMeta are the meta events of the tail of the file, such as its removal (see fileMeta).
+	FileMeta <-chan fileEvent
+	// NoBuffer flushes after every batch of lines, instead of every two seconds.
+	NoBuffer bool
+	// Stall is the idle time after which a "stall" meta event is sent.
+	Stall time.Duration
+	// Rate sends "rate" meta events, see streamRate.
+	Rate bool
+	// Backfill are the last lines of the file, sent before the lines of the stream.
+	Backfill *backfilled
+	// CatchUp is the size of the file when it is read from an earlier offset:
+	// the lines before it are waited for by the reader, never dropped (see lineQueue).
+	CatchUp int64
+	// Initial are the meta events sent at the start of the stream.
+	Initial []metaEvent
+	// Compress is "zstd" to send the batches of Server Sent Events compressed, see zstdSink.
+	Compress string
+
+	// sums are the checksums of the lines for the event ids, with Offset.
+	sums *lineSums
+}
+
+// backfilled are the lines sent before the live ones, followed by a "live" meta event.
+type backfilled struct {
+	Lines []Line `json:"-"`
+	// Count is the number of the lines.
+	Count int `json:"lines"`
+	// Offset is where the live lines start.
+	Offset int64 `json:"offset"`
+}
+
+// annotatedEvent is the JSON data of an event when lineno or ts annotation is requested.
+type annotatedEvent struct {
+	Text     string     `json:"text"`
+	Offset   *int64     `json:"offset,omitempty"`
+	LineNo   int64      `json:"lineno,omitempty"`
+	Time     *time.Time `json:"ts,omitempty"`
+	Instance string     `json:"instance,omitempty"`
+	// Fields are the fields of the parsed line, see lineParser.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// parseSSEOptions parses the left, right, record and cont query parameters.
+//
+// record/cont define multi-line records: a line matching "record",
+// or not matching "cont", starts a new record (SSE event).
+//
+// annotate=offset,lineno,ts,instance adds the source byte offset (and checksum, see resume.go)
+// of the last line of the event as the SSE event id,
+// and turns the data into a JSON object with the text, line number,
+// server receive time and server instance name fields.
+//
+// format=name selects a formatter registered in the process package.
+//
+// The lines are run through the default pipeline of the config file,
+// the pipeline=name pipelines, then the transform=name:arg transformers.
+//
+// hash=N publishes the state of the hash chain of the lines
+// as a "hash" meta event after every N lines.
+//
+// nobuffer=1 sends the lines as soon as they are read.
+//
+// stall=duration sends a "stall" meta event when no line arrived for that long,
+// and another when the lines resume, see stallEvent.
+//
+// compress=zstd sends the Server Sent Events in compressed batches, see zstdSink.
+//
+// rate=1 sends the rate of the lines of the stream as "rate" meta events, see streamRate.
+func parseSSEOptions(q url.Values) (sseOptions, error) {
+	opts := sseOptions{Left: q.Get("left"), Right: q.Get("right"), NoBuffer: q.Get("nobuffer") == "1", Rate: q.Get("rate") == "1"}
+	for _, a := range q["annotate"] {
+		for _, k := range strings.Split(a, ",") {
+			switch k {
+			case "offset":
+				opts.Offset = true
+			case "lineno":
+				opts.LineNo = true
+			case "ts":
+				opts.Time = true
+			case "instance":
+				opts.Instance = true
+			case "":
+			default:
+				return opts, fmt.Errorf("unknown annotation %q", k)
+			}
+		}
+	}
+	opts.Pipeline = append(opts.Pipeline, pipelines[defaultPipeline]...)
+	for _, name := range q["pipeline"] {
+		p, ok := pipelines[name]
+		if !ok {
+			return opts, fmt.Errorf("unknown pipeline %q", name)
+		}
+		opts.Pipeline = append(opts.Pipeline, p...)
+	}
+	if specs := q["transform"]; len(specs) != 0 {
+		p, err := process.ParsePipeline(specs)
+		if err != nil {
+			return opts, err
+		}
+		opts.Pipeline = append(opts.Pipeline, p...)
+	}
+	if s := q.Get("format"); s != "" {
+		var ok bool
+		if opts.Formatter, ok = process.LookupFormatter(s); !ok {
+			return opts, fmt.Errorf("unknown format %q (known: %s)", s, strings.Join(process.FormatterNames(), ", "))
+		}
+	}
+	if s := q.Get("hash"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("hash=%q: not a positive number", s)
+		}
+		opts.Hasher = newLineHasher(n)
+	}
+	if s := q.Get("stall"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("stall=%q: not a positive duration", s)
+		}
+		opts.Stall = d
+	}
+	switch s := q.Get("compress"); s {
+	case "", "zstd":
+		opts.Compress = s
+	default:
+		return opts, fmt.Errorf("compress=%q: only zstd is known", s)
+	}
+	var err error
+	opts.Grouper, err = newRecordGrouper(q.Get("record"), q.Get("cont"))
+	return opts, err
+}
+
+// stallEvent is the data of the "stall" meta event.
+type stallEvent struct {
+	// Idle is the stall= threshold of the stream.
+	Idle string `json:"idle"`
+	// Since is the time of the last line (or the start of the stream).
+	Since time.Time `json:"since"`
+	// Resumed is set on the event of the first line after the stall.
+	Resumed bool `json:"resumed,omitempty"`
+}
+
+// streamRate is the data of the "rate" meta event: the rate of the lines sent to the client,
+// and whether the server throttles or drops them, so the view is late or incomplete.
+// It is sent when it changes, at most every two seconds.
+type streamRate struct {
+	LinesPerSec float64 `json:"linesPerSec"`
+	BytesPerSec float64 `json:"bytesPerSec"`
+	// Dropped is the number of the lines dropped since the previous event, as the client is too slow.
+	Dropped int64 `json:"dropped,omitempty"`
+	// Throttled is set if the reads have been limited by -read-rate since the previous event.
+	Throttled bool `json:"throttled,omitempty"`
+	// Shedding is set while the queues of the clients are shortened under memory pressure.
+	Shedding bool `json:"shedding,omitempty"`
+}
+
+// rateMeter measures the rate of the lines of a stream between its "rate" meta events.
+type rateMeter struct {
+	since        time.Time
+	lines, bytes int64
+	dropped      int64
+	last         streamRate
+}
+
+// add counts the lines sent, and the ones dropped before them.
+func (rm *rateMeter) add(lines []Line, dropped int64) {
+	rm.lines += int64(len(lines))
+	for _, line := range lines {
+		rm.bytes += int64(len(line.Text)) + 1
+	}
+	rm.dropped += dropped
+}
+
+// event returns the rate since the previous event, and whether it is to be sent: if it has changed.
+func (rm *rateMeter) event(now time.Time) (streamRate, bool) {
+	secs := now.Sub(rm.since).Seconds()
+	if secs <= 0 {
+		return rm.last, false
+	}
+	round := func(f float64) float64 { return math.Round(f*10) / 10 }
+	sr := streamRate{
+		LinesPerSec: round(float64(rm.lines) / secs), BytesPerSec: round(float64(rm.bytes) / secs),
+		Dropped: rm.dropped, Throttled: diskLimiter.Throttled(rm.since), Shedding: memory.Level() != memoryNormal,
+	}
+	rm.since, rm.lines, rm.bytes, rm.dropped = now, 0, 0, 0
+	changed := sr != rm.last
+	rm.last = sr
+	return sr, changed
+}
+
+// heartbeatInterval is the idle time after which a ": ping" comment is sent,
+// to keep proxies from closing the connection, and to detect vanished clients.
+var heartbeatInterval = 15 * time.Second
+
+// deadlineWriter sets the write deadline of the connection before each write,
+// so writes to a client which vanished without closing the connection fail
+// instead of blocking.
+type deadlineWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (dw deadlineWriter) Write(p []byte) (int, error) {
+	dw.rc.SetWriteDeadline(time.Now().Add(dw.timeout))
+	return dw.w.Write(p)
+}
+
+// annotate returns the event of the (multi-line) record, with the annotations of opts.
+func (opts sseOptions) annotate(lines []Line, format func(Line) string) annotatedEvent {
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = format(line)
+	}
+	first := lines[0]
+	ev := annotatedEvent{Text: strings.Join(texts, "\n")}
+	if opts.Offset && first.Offset >= 0 {
+		ev.Offset = &first.Offset
+	}
+	if opts.LineNo {
+		ev.LineNo = first.No
+	}
+	if opts.Time {
+		ev.Time = &first.Time
+	}
+	if opts.Instance {
+		ev.Instance = instance.Name
+	}
+	if opts.Parser != nil {
+		ev.Fields = opts.Parser.Parse(first.Text)
+	}
+	return ev
+}
+
+// eventSink writes the events of a stream in the encoding of its transport.
+type eventSink interface {
+	// Event writes the (multi-line) record as one event.
+	Event(lines []Line)
+	// Meta writes the meta event.
+	Meta(ev metaEvent)
+	// Ping writes a heartbeat.
+	Ping()
+	// Pending reports whether there is anything written to flush.
+	Pending() bool
+	// Flush sends what is written to the client.
+	Flush() error
+}
+
+// httpSink is the buffered response of a streaming HTTP transport,
+// setting the write deadline of the connection before each write.
+type httpSink struct {
+	bw *bufio.Writer
+	rc *http.ResponseController
+	dw deadlineWriter
+}
+
+func newHTTPSink(w http.ResponseWriter) *httpSink {
+	rc := http.NewResponseController(w)
+	dw := deadlineWriter{w: w, rc: rc, timeout: 2 * heartbeatInterval}
+	if dw.timeout <= 0 {
+		dw.timeout = 30 * time.Second
+	}
+	return &httpSink{bw: bufio.NewWriter(dw), rc: rc, dw: dw}
+}
+
+func (hs *httpSink) Pending() bool { return hs.bw.Buffered() != 0 }
+
+func (hs *httpSink) Flush() error {
+	err := hs.bw.Flush()
+	if err == nil {
+		hs.rc.SetWriteDeadline(time.Now().Add(hs.dw.timeout))
+		err = hs.rc.Flush()
+	}
+	return err
+}
+
+// close clears the deadline, so it is not left on a reused connection.
+func (hs *httpSink) close() { hs.rc.SetWriteDeadline(time.Time{}) }
+
+// sseSink writes Server Sent Events.
+type sseSink struct {
+	*httpSink
+	opts   sseOptions
+	format func(Line) string
+}
+
+func (ss *sseSink) Meta(ev metaEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("marshal", "event", ev, "error", err)
+		return
+	}
+	ss.bw.WriteString("event: meta\ndata: ")
+	ss.bw.Write(b)
+	ss.bw.WriteString("\n\n")
+}
+
+func (ss *sseSink) Ping() { ss.bw.WriteString(": ping\n\n") }
+
+func (ss *sseSink) Event(lines []Line) {
+	bw, opts := ss.bw, ss.opts
+	last := lines[len(lines)-1]
+	if opts.Offset && last.Offset >= 0 {
+		bw.WriteString("id: ")
+		if sum, ok := opts.sums.take(last.Offset); ok {
+			bw.WriteString(eventID(last.Offset, sum))
+		} else {
+			bw.WriteString(strconv.FormatInt(last.Offset, 10))
+		}
+		bw.WriteByte('\n')
+	}
+	if opts.LineNo || opts.Time || opts.Instance || opts.Parser != nil {
+		b, _ := json.Marshal(opts.annotate(lines, ss.format))
+		bw.WriteString("data: ")
+		bw.Write(b)
+		bw.WriteString("\n\n")
+		return
+	}
+	for _, line := range lines {
+		text := line.Text
+		if opts.Formatter != nil {
+			text = ss.format(line)
+		} else if opts.Left != "" || opts.Right != "" {
+			text = html.EscapeString(text)
+		}
+		for i, part := range strings.Split(opts.Left+text+opts.Right, "\n") {
+			if i != 0 {
+				// the formatter may return several lines
+				bw.WriteByte('\n')
+			}
+			bw.WriteString("data: ")
+			bw.WriteString(part)
+		}
+		bw.WriteByte('\n')
+	}
+	bw.WriteByte('\n')
+}
+
+// streamEvents sends the lines read from linesCh to the client,
+// until linesCh is closed or the client goes away:
+// as Server Sent Events by default, or encoded with the codec=name wire codec
+// over a WebSocket (if the request is an upgrade), or as NDJSON (with the json codec).
+func streamEvents(w http.ResponseWriter, r *http.Request, linesCh <-chan Line, opts sseOptions) {
+	ctx := r.Context()
+	format := func(line Line) string {
+		if opts.Formatter == nil {
+			return line.Text
+		}
+		text, err := opts.Formatter.Format(ctx, line)
+		if err != nil {
+			slog.Debug("format", "line", line.Text, "error", err)
+			return line.Text
+		}
+		return text
+	}
+	if opts.Offset {
+		opts.sums = &lineSums{}
+	}
+	sink, ctx, closeSink := newEventSink(w, r, opts, format)
+	if sink == nil {
+		return
+	}
+	defer closeSink()
+
+	metaCh, unsubscribe := metaEvents.Subscribe()
+	defer unsubscribe()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	lastFlush := time.Now()
+	flush := func() bool {
+		if err := sink.Flush(); err != nil {
+			slog.Info("client gone", "error", err)
+			return false
+		}
+		lastFlush = time.Now()
+		return true
+	}
+	sink.Meta(metaEvent{Kind: "instance", Data: instance})
+	stream, unregister := recordings.Stream(r)
+	defer unregister()
+	defer viewerHooks.Attach(r, streamSource(r))()
+	sink.Meta(metaEvent{Kind: "stream", Data: struct {
+		ID string `json:"id"`
+	}{ID: stream.ID}})
+	for _, ev := range opts.Initial {
+		sink.Meta(ev)
+	}
+	var checkpoints []metaEvent
+	writeEvent := func(lines []Line) {
+		if rec := stream.rec.Load(); rec != nil {
+			for _, line := range lines {
+				rec.Write(format(line))
+			}
+		}
+		if opts.Hasher != nil {
+			defer func() {
+				for _, ev := range checkpoints {
+					sink.Meta(ev)
+				}
+				checkpoints = checkpoints[:0]
+			}()
+			for _, line := range lines {
+				if ev, ok := opts.Hasher.Add(line); ok {
+					checkpoints = append(checkpoints, ev)
+				}
+			}
+		}
+		sink.Event(lines)
+	}
+	grouper := opts.Grouper
+	// process redacts, transforms and groups the line, and writes the events
+	process := func(line Line) {
+		if opts.sums != nil {
+			opts.sums.push(line)
+		}
+		line.Text = redactions.Redact(line.Text)
+		lines := []Line{line}
+		if len(opts.Pipeline) != 0 {
+			var err error
+			if lines, err = opts.Pipeline.Transform(ctx, line); err != nil {
+				slog.Warn("transform", "offset", line.Offset, "error", err)
+				return
+			}
+		}
+		for _, line := range lines {
+			if grouper == nil {
+				writeEvent([]Line{line})
+			} else if rec := grouper.Add(line); len(rec) != 0 {
+				writeEvent(rec)
+			}
+		}
+	}
+	if bf := opts.Backfill; bf != nil {
+		for _, line := range bf.Lines {
+			process(line)
+		}
+		if grouper != nil {
+			if rec := grouper.Flush(); len(rec) != 0 {
+				writeEvent(rec)
+			}
+		}
+		sink.Meta(metaEvent{Kind: "live", Data: bf})
+		if !flush() {
+			return
+		}
+	}
+	queue := newLineQueue(clientQueueSize)
+	queue.catchUp = opts.CatchUp
+	go queue.fill(ctx, linesCh)
+	defer queue.discard()
+	var idle bool
+	rate := rateMeter{since: time.Now()}
+	// the last line for the stall detection
+	lastLine, stalled := time.Now(), false
+	// the events of opts.FileMeta are sent between the lines read before and after them
+	var fileEvents []fileEvent
+	receiveFileEvents := func() {
+		for {
+			select {
+			case ev := <-opts.FileMeta:
+				fileEvents = append(fileEvents, ev)
+			default:
+				return
+			}
+		}
+	}
+	// sendFileEvents sends the events published before t
+	sendFileEvents := func(t time.Time) {
+		for len(fileEvents) != 0 && !fileEvents[0].Time.After(t) {
+			sink.Meta(fileEvents[0].metaEvent)
+			fileEvents = fileEvents[1:]
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-queue.ready:
+			lines, dropped, closed := queue.take()
+			if dropped != 0 {
+				sink.Meta(metaEvent{Kind: "dropped", Data: droppedLines{Lines: dropped, Disconnect: slowClientPolicy == "disconnect"}})
+				if slowClientPolicy == "disconnect" {
+					slog.Warn("disconnect slow client", "dropped", dropped)
+					flush()
+					return
+				}
+			}
+			rate.add(lines, dropped)
+			receiveFileEvents()
+			if stalled && len(lines) != 0 {
+				sink.Meta(metaEvent{Kind: "stall", Data: stallEvent{Idle: opts.Stall.String(), Since: lastLine, Resumed: true}})
+				stalled = false
+			}
+			for _, line := range lines {
+				idle = false
+				lastLine = time.Now()
+				sendFileEvents(line.Time)
+				process(line)
+			}
+			if closed {
+				if grouper != nil {
+					if rec := grouper.Flush(); len(rec) != 0 {
+						writeEvent(rec)
+					}
+				}
+				// the events published before the end of the tail
+				receiveFileEvents()
+				sendFileEvents(time.Now())
+				flush()
+				return
+			}
+			if opts.NoBuffer && sink.Pending() && !flush() {
+				return
+			}
+
+		case <-stream.flush:
+			if sink.Pending() && !flush() {
+				return
+			}
+
+		case ev := <-metaCh:
+			sink.Meta(ev)
+			if !flush() {
+				return
+			}
+
+		case ev := <-opts.Meta:
+			sink.Meta(ev)
+			if !flush() {
+				return
+			}
+
+		case ev := <-opts.FileMeta:
+			// after the lines read before it, still on their way
+			fileEvents = append(fileEvents, ev)
+
+		case <-ticker.C:
+			// a record is complete if no new line arrived for a whole tick
+			if idle && grouper != nil {
+				if rec := grouper.Flush(); len(rec) != 0 {
+					writeEvent(rec)
+				}
+			}
+			idle = true
+			sendFileEvents(time.Now())
+			if opts.Stall > 0 && !stalled && time.Since(lastLine) >= opts.Stall {
+				stalled = true
+				sink.Meta(metaEvent{Kind: "stall", Data: stallEvent{Idle: opts.Stall.String(), Since: lastLine}})
+			}
+			if opts.Rate {
+				if sr, ok := rate.event(time.Now()); ok {
+					sink.Meta(metaEvent{Kind: "rate", Data: sr})
+				}
+			}
+			if !sink.Pending() && heartbeatInterval > 0 && time.Since(lastFlush) >= heartbeatInterval {
+				sink.Ping()
+			}
+			if sink.Pending() && !flush() {
+				return
+			}
+		}
+	}
+}
+
+// streamSource returns the source of the stream r:
+// the file (or virtual file), the glob, or the container or unit, prefixed by its kind.
+func streamSource(r *http.Request) string {
+	q := r.URL.Query()
+	switch {
+	case q.Get("host") != "":
+		return "ssh:" + q.Get("host") + "/" + path.Clean("/" + q.Get("file"))[1:]
+	case q.Get("file") != "":
+		return path.Clean(q.Get("file"))
+	case q.Get("glob") != "":
+		return q.Get("glob")
+	case q.Get("container") != "":
+		return "container:" + q.Get("container")
+	case q.Get("pod") != "":
+		return "pod:" + q.Get("namespace") + "/" + q.Get("pod") + "/" + q.Get("container")
+	case q.Get("unit") != "":
+		return "journal:" + q.Get("unit")
+	}
+	return ""
+}
+
+// newEventSink returns the sink of the transport and codec of the request,
+// the context of the stream, and a function closing the sink.
+// On error, it responds with the error, and returns a nil sink.
+func newEventSink(w http.ResponseWriter, r *http.Request, opts sseOptions, format func(Line) string) (eventSink, context.Context, func()) {
+	ctx := r.Context()
+	name := r.URL.Query().Get("codec")
+	if name == "" && strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		name = "json"
+	}
+	var codec wireCodec
+	if name != "" {
+		var ok bool
+		if codec, ok = codecs[name]; !ok {
+			http.Error(w, fmt.Sprintf("unknown codec %q (known: %s)", name, strings.Join(codecNames(), ", ")), http.StatusBadRequest)
+			return nil, ctx, nil
+		}
+	}
+	if opts.Compress != "" && (codec != nil || strings.EqualFold(r.Header.Get("Upgrade"), "websocket")) {
+		http.Error(w, "compress is for the Server Sent Events only", http.StatusBadRequest)
+		return nil, ctx, nil
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		if codec == nil {
+			codec = codecs["json"]
+		}
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: wsOriginPatterns, CompressionMode: websocket.CompressionContextTakeover})
+		if err != nil {
+			slog.Warn("websocket accept", "error", err)
+			return nil, ctx, nil
+		}
+		// the client sends nothing, but the close and the pongs must be read
+		ctx = c.CloseRead(ctx)
+		ws := &wsSink{ctx: ctx, c: c, codec: codec, opts: opts, format: format}
+		return ws, ctx, func() { c.Close(websocket.StatusNormalClosure, "") }
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, fmt.Sprintf("%T, not a http.Flusher", w), http.StatusInternalServerError)
+		return nil, ctx, nil
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	hs := newHTTPSink(w)
+	if codec != nil {
+		if codec.Binary() {
+			http.Error(w, fmt.Sprintf("the %s codec needs a WebSocket", name), http.StatusBadRequest)
+			return nil, ctx, nil
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return &ndjsonSink{httpSink: hs, codec: codec, opts: opts, format: format}, ctx, hs.close
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	if id := requestID(ctx); id != "" {
+		hs.bw.WriteString(": request-id " + id + "\n\n")
+	}
+	if opts.Compress == "zstd" {
+		return newZstdSink(hs, opts, format), ctx, hs.close
+	}
+	return &sseSink{httpSink: hs, opts: opts, format: format}, ctx, hs.close
+}
+
+// viewStateKeys are the query parameters of the viewer page only (see webtail.js),
+// not passed to the stream. "lines" is passed, as the journal and container streams
+// start with that many lines.
+var viewStateKeys = []string{"filter", "hl", "paused", "wrap", "tz", "age", "sort", "hide", "where", "raw", "spark"}
+
+// writeViewer writes the HTML page that shows the SSE stream at tailURL.
+func writeViewer(w http.ResponseWriter, title, tailURL string) {
+	renderPage(w, "viewer.html", viewerPage{Title: title, TailURL: tailURL})
+}
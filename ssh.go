@@ -0,0 +1,350 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The remote hosts are tailed over SSH: the files under the Root of each host
+// are listed at /hosts?host=NAME, and /tail?host=NAME&file=PATH runs tail -F on the host.
+
+// sshDialTimeout is the timeout of connecting to a remote host.
+const sshDialTimeout = 10 * time.Second
+
+// maxRemoteFiles is the most files listed of a remote host.
+const maxRemoteFiles = 10000
+
+// sshHost is a remote host of the -ssh-hosts JSON file.
+type sshHost struct {
+	// Name is the name of the host in the listing and the URLs.
+	Name string `json:"name"`
+	// Addr is the host:port to connect to (the port defaults to 22).
+	Addr string `json:"addr"`
+	User string `json:"user"`
+	// Key is the path of the private key file.
+	Key string `json:"key"`
+	// KnownHosts is the path of the known_hosts file (default ~/.ssh/known_hosts).
+	KnownHosts string `json:"known_hosts,omitempty"`
+	// Root is the directory served of the host (default /var/log).
+	Root string `json:"root,omitempty"`
+
+	config *ssh.ClientConfig
+	mu     sync.Mutex
+	client *ssh.Client
+	// err is the error of the last connection attempt
+	err error
+}
+
+// loadSSHHosts reads the remote hosts from the JSON file, an array of sshHost, such as
+//
+//	[{"name": "web1", "addr": "web1.example.com", "user": "logs", "key": "/etc/webtail/id_ed25519"}]
+func loadSSHHosts(fn string) (*sshHosts, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []*sshHost
+	if err := json.Unmarshal(b, &hosts); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	sh := &sshHosts{hosts: make(map[string]*sshHost, len(hosts))}
+	for _, h := range hosts {
+		if h.Name == "" || h.Addr == "" || h.User == "" || h.Key == "" {
+			return nil, fmt.Errorf("%q: host %q: name, addr, user and key are required", fn, h.Name)
+		}
+		if strings.ContainsAny(h.Name, "/&?#") {
+			return nil, fmt.Errorf("%q: host %q: the name must not contain any of /&?#", fn, h.Name)
+		}
+		if _, ok := sh.hosts[h.Name]; ok {
+			return nil, fmt.Errorf("%q: host %q is duplicated", fn, h.Name)
+		}
+		if err := h.configure(); err != nil {
+			return nil, fmt.Errorf("%q: host %q: %w", fn, h.Name, err)
+		}
+		sh.hosts[h.Name] = h
+	}
+	return sh, nil
+}
+
+// configure reads the key and the known hosts, and fills the defaults.
+func (h *sshHost) configure() error {
+	if _, _, err := net.SplitHostPort(h.Addr); err != nil {
+		h.Addr = net.JoinHostPort(h.Addr, "22")
+	}
+	if h.Root == "" {
+		h.Root = "/var/log"
+	}
+	if h.Root = path.Clean(h.Root); !path.IsAbs(h.Root) {
+		return fmt.Errorf("root %q is not absolute", h.Root)
+	}
+	b, err := os.ReadFile(h.Key)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return fmt.Errorf("parse key %q: %w", h.Key, err)
+	}
+	if h.KnownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		h.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(h.KnownHosts)
+	if err != nil {
+		return err
+	}
+	h.config = &ssh.ClientConfig{
+		User:            h.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         sshDialTimeout,
+	}
+	return nil
+}
+
+// session returns a new session on the connection to the host,
+// connecting (again) if needed.
+func (h *sshHost) session() (*ssh.Session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client != nil {
+		sess, err := h.client.NewSession()
+		if err == nil {
+			return sess, nil
+		}
+		slog.Warn("ssh session", "host", h.Name, "error", err)
+		h.client.Close()
+		h.client = nil
+	}
+	client, err := ssh.Dial("tcp", h.Addr, h.config)
+	if err != nil {
+		h.err = fmt.Errorf("connect to %s: %w", h.Name, err)
+		return nil, h.err
+	}
+	h.err = nil
+	slog.Info("ssh connected", "host", h.Name, "addr", h.Addr)
+	h.client = client
+	return client.NewSession()
+}
+
+// errFileRequired is returned for a missing remote file.
+var errFileRequired = errors.New("file is required")
+
+// remotePath returns the path of fn under the Root of the host, with the symlinks resolved
+// on the host (by readlink -f), or an error if it would escape the Root.
+func (h *sshHost) remotePath(ctx context.Context, fn string) (string, error) {
+	fn = path.Clean("/" + fn)
+	if fn == "/" {
+		return "", errFileRequired
+	}
+	sess, err := h.session()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	// the Root may be a symlink itself
+	b, err := sess.Output("readlink -f -- " + shellQuote(h.Root) + " " + shellQuote(path.Join(h.Root, fn)))
+	if err != nil {
+		return "", fmt.Errorf("resolve %s:%s: %w", h.Name, fn, err)
+	}
+	root, resolved, ok := strings.Cut(strings.TrimSuffix(string(b), "\n"), "\n")
+	if !ok || !path.IsAbs(root) || !strings.HasPrefix(resolved, strings.TrimSuffix(root, "/")+"/") {
+		return "", fmt.Errorf("%s:%s: %w", h.Name, fn, errOutsideRoot)
+	}
+	return resolved, nil
+}
+
+// Files returns the regular files under the Root, relative to it.
+func (h *sshHost) Files(ctx context.Context) ([]string, error) {
+	sess, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	b, err := sess.Output("find " + shellQuote(h.Root) + " -type f -readable")
+	if len(b) == 0 && err != nil {
+		return nil, fmt.Errorf("list %s:%s: %w", h.Name, h.Root, err)
+	}
+	// unreadable directories make find exit with 1, but the rest is listed
+	var files []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if fn, ok := strings.CutPrefix(line, h.Root+"/"); ok && len(files) < maxRemoteFiles {
+			files = append(files, fn)
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// Tail sends the last lines of the remote file, then the appended ones, to linesCh.
+func (h *sshHost) Tail(ctx context.Context, linesCh chan<- Line, fn string, lines int) error {
+	defer close(linesCh)
+	sess, err := h.session()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd := "tail -n " + strconv.Itoa(lines) + " -F -- " + shellQuote(fn)
+	if err := sess.Start(cmd); err != nil {
+		return fmt.Errorf("start %q on %s: %w", cmd, h.Name, err)
+	}
+	// closing the session kills the remote tail
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	err = scanLines(ctx, linesCh, stdout)
+	slog.Info("finish", "host", h.Name, "command", cmd)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	return sess.Wait()
+}
+
+// shellQuote quotes s for the POSIX shell running the remote commands.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sshHosts are the remote hosts by name.
+type sshHosts struct {
+	hosts map[string]*sshHost
+}
+
+// Names returns the sorted names of the hosts.
+func (sh *sshHosts) Names() []string {
+	names := make([]string, 0, len(sh.hosts))
+	for name := range sh.hosts {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Close the connections to the hosts.
+func (sh *sshHosts) Close() error {
+	for _, h := range sh.hosts {
+		h.mu.Lock()
+		if h.client != nil {
+			h.client.Close()
+			h.client = nil
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// ServeHTTP lists the hosts at /hosts, the files of a host at /hosts?host=NAME,
+// and shows the viewer of a remote file at /hosts?host=NAME&file=PATH.
+func (sh *sshHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("host")
+	var h *sshHost
+	if name != "" {
+		if h = sh.hosts[name]; h == nil {
+			http.Error(w, "unknown host "+name, http.StatusNotFound)
+			return
+		}
+	}
+	if fn := q.Get("file"); h != nil && fn != "" {
+		writeViewer(w, name+":"+fn, "./tail?"+q.Encode())
+		return
+	}
+	var files []string
+	if h != nil {
+		var err error
+		if files, err = h.Files(r.Context()); err != nil {
+			slog.Error("list remote files", "host", name, "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	title := "hosts"
+	if h != nil {
+		title = name + ":" + h.Root
+	}
+	page := listPage{Title: title}
+	if h == nil {
+		for _, name := range sh.Names() {
+			page.Items = append(page.Items, listItem{Title: name, URL: "./hosts?host=" + url.QueryEscape(name), Note: sh.hosts[name].User + "@" + sh.hosts[name].Addr})
+		}
+	}
+	for _, fn := range files {
+		page.Items = append(page.Items, listItem{Title: fn, URL: "./hosts?" + url.Values{"host": {name}, "file": {fn}}.Encode()})
+	}
+	renderPage(w, "list.html", page)
+}
+
+// TailHandler streams the remote file=PATH of the host=NAME as SSE.
+//
+// lines=N (default 100) sets the number of past lines to start with.
+func (sh *sshHosts) TailHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts, err := parseSSEOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := q.Get("host")
+	h := sh.hosts[name]
+	if h == nil {
+		http.Error(w, "unknown host "+name, http.StatusNotFound)
+		return
+	}
+	fn, err := h.remotePath(r.Context(), q.Get("file"))
+	if errors.Is(err, errFileRequired) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errOutsideRoot) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	lines := 100
+	if s := q.Get("lines"); s != "" {
+		if lines, err = strconv.Atoi(s); err != nil || lines < 0 {
+			http.Error(w, "lines="+s+" is not a count", http.StatusBadRequest)
+			return
+		}
+	}
+	logAttrs(r.Context(), "host", name, "file", fn)
+	linesCh := make(chan Line)
+	go func() {
+		if err := h.Tail(r.Context(), linesCh, fn, lines); err != nil {
+			slog.Error("remote tail", "host", name, "file", fn, "error", err)
+		}
+	}()
+	streamEvents(w, r, linesCh, opts)
+}
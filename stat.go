@@ -0,0 +1,67 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxStatPaths is the most paths accepted by one /api/v1/stat request.
+const maxStatPaths = 1000
+
+// FileStat is the state of a path returned by /api/v1/stat.
+type FileStat struct {
+	Path    string     `json:"path"`
+	Exists  bool       `json:"exists"`
+	Dir     bool       `json:"dir,omitempty"`
+	Virtual bool       `json:"virtual,omitempty"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"mtime,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// statHandler accepts a JSON array of paths, and returns their FileStat in the same order.
+func statHandler(FS fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rootStatus.Err(); err != nil {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "root unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		var paths []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&paths); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(paths) > maxStatPaths {
+			http.Error(w, fmt.Sprintf("at most %d paths are allowed, got %d", maxStatPaths, len(paths)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		stats := make([]FileStat, len(paths))
+		for i, p := range paths {
+			fn := path.Clean(strings.TrimPrefix(p, "/"))
+			st := FileStat{Path: p}
+			if virtualFiles.Lookup(fn) != nil {
+				st.Exists, st.Virtual = true, true
+			} else if fi, err := FS.(fs.StatFS).Stat(fn); err == nil {
+				mtime := fi.ModTime()
+				st.Exists, st.Dir, st.Size, st.ModTime = true, fi.IsDir(), fi.Size(), &mtime
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				st.Error = err.Error()
+			}
+			stats[i] = st
+		}
+		logAttrs(r.Context(), "paths", len(paths))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt is a Store in a bbolt database file, usable by one process at a time.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens (or creates) the bbolt database file.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o640, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+func openBolt(_ context.Context, u *url.URL) (Store, error) { return OpenBolt(Path(u)) }
+
+// Get implements Store.
+func (b *Bolt) Get(_ context.Context, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket([]byte(bucket)); bkt != nil {
+			if v := bkt.Get([]byte(key)); v != nil {
+				value = append(make([]byte, 0, len(v)), v...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return value, err
+}
+
+// Put implements Store.
+func (b *Bolt) Put(_ context.Context, bucket, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), value)
+	})
+}
+
+// Delete implements Store.
+func (b *Bolt) Delete(_ context.Context, bucket, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket([]byte(bucket)); bkt != nil {
+			return bkt.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// Update implements Updater.
+func (b *Bolt) Update(_ context.Context, bucket, key string, fn func([]byte) ([]byte, error)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		var old []byte
+		if v := bkt.Get([]byte(key)); v != nil {
+			old = append(make([]byte, 0, len(v)), v...)
+		}
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return bkt.Delete([]byte(key))
+		}
+		return bkt.Put([]byte(key), value)
+	})
+}
+
+// List implements Store.
+func (b *Bolt) List(_ context.Context, bucket string) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			m[string(k)] = append(make([]byte, 0, len(v)), v...)
+			return nil
+		})
+	})
+	return m, err
+}
+
+// Close the database.
+func (b *Bolt) Close() error { return b.db.Close() }
+
+// leasesBucket holds the leases of a Bolt store, as "owner\x00expiry" values.
+const leasesBucket = "webtail\x00leases"
+
+// Lease implements Leaser.
+func (b *Bolt) Lease(_ context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	var ok bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(leasesBucket))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if v := bkt.Get([]byte(name)); v != nil {
+			holder, expiry, _ := strings.Cut(string(v), "\x00")
+			if exp, err := strconv.ParseInt(expiry, 10, 64); err == nil && holder != owner && now.UnixNano() < exp {
+				return nil
+			}
+		}
+		ok = true
+		return bkt.Put([]byte(name), []byte(owner+"\x00"+strconv.FormatInt(now.Add(ttl).UnixNano(), 10)))
+	})
+	return ok, err
+}
+
+// Release implements Leaser.
+func (b *Bolt) Release(_ context.Context, name, owner string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(leasesBucket))
+		if bkt == nil {
+			return nil
+		}
+		if v := bkt.Get([]byte(name)); v != nil && strings.HasPrefix(string(v), owner+"\x00") {
+			return bkt.Delete([]byte(name))
+		}
+		return nil
+	})
+}
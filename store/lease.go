@@ -0,0 +1,72 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Leaser is implemented by the stores granting leases, which coordinate the instances
+// sharing the store: a task (such as evaluating an alert rule) is run by the holder of its lease only.
+//
+// The lease expiry is by the clock of the instances, so ttl must be well above their skew.
+type Leaser interface {
+	// Lease acquires or renews the named lease for owner until ttl from now,
+	// and reports whether owner holds it.
+	Lease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+	// Release gives up the lease, if owner holds it.
+	Release(ctx context.Context, name, owner string) error
+}
+
+// RunLeased runs fn while owner holds the named lease, renewing it at a third of ttl,
+// until ctx is canceled. The context of fn is canceled when the lease is lost,
+// and fn is run again when the lease is acquired again.
+func RunLeased(ctx context.Context, l Leaser, name, owner string, ttl time.Duration, fn func(context.Context)) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	var cancel context.CancelFunc
+	var done chan struct{}
+	stop := func() {
+		if cancel != nil {
+			cancel()
+			<-done
+			cancel = nil
+		}
+	}
+	defer func() {
+		stop()
+		relCtx, relCancel := context.WithTimeout(context.WithoutCancel(ctx), ttl/3)
+		l.Release(relCtx, name, owner)
+		relCancel()
+	}()
+	for {
+		ok, err := l.Lease(ctx, name, owner, ttl)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("lease", "name", name, "owner", owner, "error", err)
+		}
+		if !ok && cancel != nil {
+			slog.Info("lease lost", "name", name, "owner", owner)
+			stop()
+		} else if ok && cancel == nil {
+			slog.Info("lease acquired", "name", name, "owner", owner)
+			fnCtx, fnCancel := context.WithCancel(ctx)
+			cancel, done = fnCancel, make(chan struct{})
+			go func() {
+				defer close(done)
+				fn(fnCtx)
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Dialect is what differs between the SQL databases for the SQL store.
+type Dialect struct {
+	// Placeholder returns the placeholder of the i-th (from 1) parameter.
+	Placeholder func(i int) string
+	// BlobType is the column type of the values.
+	BlobType string
+}
+
+var (
+	// SQLite is the dialect of SQLite (3.24 or later).
+	SQLite = Dialect{Placeholder: func(int) string { return "?" }, BlobType: "BLOB"}
+	// Postgres is the dialect of PostgreSQL (9.5 or later).
+	Postgres = Dialect{Placeholder: func(i int) string { return "$" + strconv.Itoa(i) }, BlobType: "BYTEA"}
+)
+
+// SQL is a Store in the webtail_state table of an SQL database,
+// with its leases in the webtail_lease table.
+type SQL struct {
+	db                      *sql.DB
+	qGet, qPut, qDel, qList string
+	qInsert, qSwap, qDelIf  string
+	qLease, qRelease        string
+}
+
+// NewSQL returns a Store in db, creating its table if it does not exist.
+// The store owns db: closing the store closes db.
+func NewSQL(ctx context.Context, db *sql.DB, d Dialect) (*SQL, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS webtail_state (
+  bucket VARCHAR(255) NOT NULL,
+  name VARCHAR(1024) NOT NULL,
+  value `+d.BlobType+` NOT NULL,
+  PRIMARY KEY (bucket, name)
+)`); err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS webtail_lease (
+  name VARCHAR(255) NOT NULL PRIMARY KEY,
+  owner VARCHAR(255) NOT NULL,
+  expires BIGINT NOT NULL
+)`); err != nil {
+		return nil, err
+	}
+	p1, p2, p3, p4 := d.Placeholder(1), d.Placeholder(2), d.Placeholder(3), d.Placeholder(4)
+	return &SQL{
+		db:   db,
+		qGet: "SELECT value FROM webtail_state WHERE bucket = " + p1 + " AND name = " + p2,
+		qPut: "INSERT INTO webtail_state (bucket, name, value) VALUES (" + p1 + ", " + p2 + ", " + p3 + ")" +
+			" ON CONFLICT (bucket, name) DO UPDATE SET value = excluded.value",
+		qDel:  "DELETE FROM webtail_state WHERE bucket = " + p1 + " AND name = " + p2,
+		qList: "SELECT name, value FROM webtail_state WHERE bucket = " + p1,
+		// the compare-and-swap steps of Update
+		qInsert: "INSERT INTO webtail_state (bucket, name, value) VALUES (" + p1 + ", " + p2 + ", " + p3 + ")" +
+			" ON CONFLICT (bucket, name) DO NOTHING",
+		qSwap:  "UPDATE webtail_state SET value = " + p1 + " WHERE bucket = " + p2 + " AND name = " + p3 + " AND value = " + p4,
+		qDelIf: "DELETE FROM webtail_state WHERE bucket = " + p1 + " AND name = " + p2 + " AND value = " + p3,
+		// renewed by its owner, or taken over when expired
+		qLease: "INSERT INTO webtail_lease (name, owner, expires) VALUES (" + p1 + ", " + p2 + ", " + p3 + ")" +
+			" ON CONFLICT (name) DO UPDATE SET owner = excluded.owner, expires = excluded.expires" +
+			" WHERE webtail_lease.owner = excluded.owner OR webtail_lease.expires < " + p4,
+		qRelease: "DELETE FROM webtail_lease WHERE name = " + p1 + " AND owner = " + p2,
+	}, nil
+}
+
+// Get implements Store.
+func (s *SQL) Get(ctx context.Context, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(ctx, s.qGet, bucket, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+// Put implements Store.
+func (s *SQL) Put(ctx context.Context, bucket, key string, value []byte) error {
+	_, err := s.db.ExecContext(ctx, s.qPut, bucket, key, value)
+	return err
+}
+
+// Delete implements Store.
+func (s *SQL) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.db.ExecContext(ctx, s.qDel, bucket, key)
+	return err
+}
+
+// Update implements Updater, with compare-and-swap: fn is called again
+// if the value has been changed by another instance meanwhile.
+func (s *SQL) Update(ctx context.Context, bucket, key string, fn func([]byte) ([]byte, error)) error {
+	for {
+		old, err := s.Get(ctx, bucket, key)
+		if errors.Is(err, ErrNotFound) {
+			old = nil
+		} else if err != nil {
+			return err
+		}
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+		var res sql.Result
+		switch {
+		case old == nil && value == nil:
+			return nil
+		case old == nil:
+			res, err = s.db.ExecContext(ctx, s.qInsert, bucket, key, value)
+		case value == nil:
+			res, err = s.db.ExecContext(ctx, s.qDelIf, bucket, key, old)
+		default:
+			res, err = s.db.ExecContext(ctx, s.qSwap, value, bucket, key, old)
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// List implements Store.
+func (s *SQL) List(ctx context.Context, bucket string) (map[string][]byte, error) {
+	rows, err := s.db.QueryContext(ctx, s.qList, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return m, err
+		}
+		m[key] = value
+	}
+	return m, rows.Err()
+}
+
+// Lease implements Leaser.
+func (s *SQL) Lease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	res, err := s.db.ExecContext(ctx, s.qLease, name, owner, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Release implements Leaser.
+func (s *SQL) Release(ctx context.Context, name, owner string) error {
+	_, err := s.db.ExecContext(ctx, s.qRelease, name, owner)
+	return err
+}
+
+// Close the database.
+func (s *SQL) Close() error { return s.db.Close() }
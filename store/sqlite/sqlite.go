@@ -0,0 +1,32 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sqlite registers the SQLite store ("sqlite:///path/to/file.sqlite"),
+// it needs cgo.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/UNO-SOFT/webtail/store"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() { store.Register("sqlite", Open) }
+
+// Open opens (or creates) the SQLite database of the URL as a store.
+func Open(ctx context.Context, u *url.URL) (store.Store, error) {
+	db, err := sql.Open("sqlite3", "file:"+store.Path(u)+"?_busy_timeout=10000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	st, err := store.NewSQL(ctx, db, store.SQLite)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return st, nil
+}
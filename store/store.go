@@ -0,0 +1,154 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package store persists the state of webtail (such as the view counts and
+// the credentials of the paired agents) as values in named buckets.
+//
+// The bbolt ("bolt:///path/to/file.db") and SQL stores are built in;
+// embedders can register their own with Register, or build one with NewSQL
+// (for example on PostgreSQL, which suits deployments with several instances).
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+var (
+	// ErrNotFound is returned by Get for a missing key.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned by PutNew for an existing key.
+	ErrExists = errors.New("exists")
+)
+
+// Store holds values by their bucket and key.
+// It must be safe for concurrent use.
+type Store interface {
+	// Get returns the value of the key in the bucket, or ErrNotFound.
+	Get(ctx context.Context, bucket, key string) ([]byte, error)
+	// Put sets the value of the key in the bucket.
+	Put(ctx context.Context, bucket, key string, value []byte) error
+	// Delete removes the key from the bucket; deleting a missing key is not an error.
+	Delete(ctx context.Context, bucket, key string) error
+	// List returns all the keys and values of the bucket.
+	List(ctx context.Context, bucket string) (map[string][]byte, error)
+	Close() error
+}
+
+// Updater is implemented by the stores changing a value atomically,
+// so the instances sharing the store do not lose the changes of each other.
+type Updater interface {
+	// Update sets the value of the key in the bucket to what fn returns for its current value
+	// (nil if missing), deleting it if that is nil. fn may be called again if the value
+	// has been changed meanwhile. An error of fn is returned, leaving the value unchanged.
+	Update(ctx context.Context, bucket, key string, fn func(old []byte) ([]byte, error)) error
+}
+
+// Update changes the value of the key with fn, atomically if st is an Updater,
+// else with Get and Put.
+func Update(ctx context.Context, st Store, bucket, key string, fn func(old []byte) ([]byte, error)) error {
+	if u, ok := st.(Updater); ok {
+		return u.Update(ctx, bucket, key, fn)
+	}
+	old, err := st.Get(ctx, bucket, key)
+	if errors.Is(err, ErrNotFound) {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if old == nil {
+			return nil
+		}
+		return st.Delete(ctx, bucket, key)
+	}
+	return st.Put(ctx, bucket, key, value)
+}
+
+// PutNew sets the value of the key only if it is missing, else returns ErrExists.
+func PutNew(ctx context.Context, st Store, bucket, key string, value []byte) error {
+	return Update(ctx, st, bucket, key, func(old []byte) ([]byte, error) {
+		if old != nil {
+			return nil, ErrExists
+		}
+		return value, nil
+	})
+}
+
+// Opener opens the store described by the URL.
+type Opener func(ctx context.Context, u *url.URL) (Store, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]Opener{"bolt": openBolt}
+)
+
+// Register registers the opener of the stores with the URL scheme,
+// panicking if the scheme is empty or already taken.
+func Register(scheme string, open Opener) {
+	if scheme == "" || open == nil {
+		panic("Register: empty scheme or nil opener")
+	}
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	if _, ok := openers[scheme]; ok {
+		panic(fmt.Sprintf("Register: %q is already registered", scheme))
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the sorted URL schemes of the registered stores.
+func Schemes() []string {
+	openersMu.RLock()
+	schemes := make([]string, 0, len(openers))
+	for k := range openers {
+		schemes = append(schemes, k)
+	}
+	openersMu.RUnlock()
+	slices.Sort(schemes)
+	return schemes
+}
+
+// Open opens the store of the URL with the opener registered for its scheme.
+func Open(ctx context.Context, rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	openersMu.RLock()
+	open := openers[u.Scheme]
+	openersMu.RUnlock()
+	if open == nil {
+		return nil, fmt.Errorf("store %q: unknown scheme %q (known: %q)", rawURL, u.Scheme, Schemes())
+	}
+	st, err := open(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("open store %q: %w", rawURL, err)
+	}
+	return st, nil
+}
+
+// Path returns the file path of a URL such as bolt:///var/lib/webtail.db,
+// or bolt:relative.db.
+func Path(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
+
+var (
+	_ Leaser  = (*Bolt)(nil)
+	_ Leaser  = (*SQL)(nil)
+	_ Updater = (*Bolt)(nil)
+	_ Updater = (*SQL)(nil)
+)
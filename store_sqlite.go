@@ -0,0 +1,10 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build cgo
+
+package main
+
+// the sqlite:///path store
+import _ "github.com/UNO-SOFT/webtail/store/sqlite"
@@ -0,0 +1,388 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/process"
+)
+
+// A subscription is the set of sources of a dashboard, tailed into one multiplexed stream.
+// The dashboard POSTs the spec of the subscription to /api/v1/subscriptions,
+// connects to its stream, then adds and removes sources without reconnecting.
+//
+// The lines of the stream are prefixed by "[<source id>/<file name>] ".
+
+const (
+	// maxSubscriptions limits the number of subscriptions of the server.
+	maxSubscriptions = 1000
+	// maxSubscriptionSources limits the number of sources of a subscription.
+	maxSubscriptionSources = 64
+	// subscriptionIdle is how long a subscription without a connected stream is kept.
+	subscriptionIdle = 10 * time.Minute
+)
+
+// subscriptionSource is a source of a subscription: the files matching a glob.
+type subscriptionSource struct {
+	// ID names the source in the stream, assigned if empty.
+	ID   string `json:"id"`
+	Glob string `json:"glob"`
+	// Filter is a regexp the lines must match.
+	Filter string `json:"filter,omitempty"`
+	// Format is the name of the formatter of the lines.
+	Format string `json:"format,omitempty"`
+
+	filter    *regexp.Regexp
+	formatter process.Formatter
+	cancel    context.CancelFunc
+}
+
+// subscriptionSpec is the body of the creation of a subscription.
+type subscriptionSpec struct {
+	Sources []*subscriptionSource `json:"sources"`
+}
+
+var sourceIDRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// parse checks the source, and compiles its filter and format.
+func (src *subscriptionSource) parse() error {
+	if src.ID != "" && !sourceIDRe.MatchString(src.ID) {
+		return fmt.Errorf("source id %q: only letters, digits and _.- are allowed", src.ID)
+	}
+	if src.Glob == "" {
+		return fmt.Errorf("source %q: no glob", src.ID)
+	}
+	src.Glob = path.Clean(src.Glob)
+	if err := checkGlob(src.Glob); err != nil {
+		return err
+	}
+	if src.Filter != "" {
+		var err error
+		if src.filter, err = regexp.Compile(src.Filter); err != nil {
+			return fmt.Errorf("source %q: filter: %w", src.ID, err)
+		}
+	}
+	if src.Format != "" {
+		var ok bool
+		if src.formatter, ok = process.LookupFormatter(src.Format); !ok {
+			return fmt.Errorf("source %q: unknown format %q (known: %s)", src.ID, src.Format, strings.Join(process.FormatterNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// mark returns the line of the file fn if it passes the filter,
+// formatted, and prefixed by the source and the file name.
+func (src *subscriptionSource) mark(ctx context.Context) func(fn string, line Line) (Line, bool) {
+	return func(fn string, line Line) (Line, bool) {
+		// filter the redacted text only, as the client sees it
+		line.Text = redactions.Redact(line.Text)
+		if src.filter != nil && !src.filter.MatchString(line.Text) {
+			return line, false
+		}
+		if src.formatter != nil {
+			if text, err := src.formatter.Format(ctx, line); err != nil {
+				slog.Debug("format", "line", line.Text, "error", err)
+			} else {
+				line.Text = text
+			}
+		}
+		line.Text = "[" + src.ID + "/" + path.Base(fn) + "] " + line.Text
+		return line, true
+	}
+}
+
+// tailSubscription is a set of sources, and its connected stream.
+type tailSubscription struct {
+	ID      string                `json:"id"`
+	Sources []*subscriptionSource `json:"sources"`
+	User    string                `json:"-"`
+
+	mu     sync.Mutex
+	nextID int
+	// ctx, cancel, linesCh and poll are of the connected stream, ctx is nil if none.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	linesCh chan Line
+	poll    pollOptions
+	expire  *time.Timer
+	removed bool
+}
+
+// add the source to the subscription, starting its tail if the stream is connected.
+func (sub *tailSubscription) add(sr *subscriptionRegistry, src *subscriptionSource) error {
+	if len(sub.Sources) >= maxSubscriptionSources {
+		return fmt.Errorf("at most %d sources are allowed", maxSubscriptionSources)
+	}
+	if src.ID == "" {
+		for {
+			sub.nextID++
+			src.ID = "s" + strconv.Itoa(sub.nextID)
+			if sub.source(src.ID) < 0 {
+				break
+			}
+		}
+	} else if sub.source(src.ID) >= 0 {
+		return fmt.Errorf("source %q already exists", src.ID)
+	}
+	sub.Sources = append(sub.Sources, src)
+	if sub.ctx != nil {
+		sr.start(sub, src)
+	}
+	return nil
+}
+
+// source returns the index of the source of the id, or -1.
+func (sub *tailSubscription) source(id string) int {
+	return slices.IndexFunc(sub.Sources, func(src *subscriptionSource) bool { return src.ID == id })
+}
+
+// subscriptionRegistry holds the subscriptions of the server.
+type subscriptionRegistry struct {
+	root string
+	FS   fs.FS
+
+	mu   sync.Mutex
+	subs map[string]*tailSubscription
+}
+
+// start tailing the source into the stream of the subscription. Must be called with sub.mu held.
+func (sr *subscriptionRegistry) start(sub *tailSubscription, src *subscriptionSource) {
+	ctx, cancel := context.WithCancel(sub.ctx)
+	src.cancel = cancel
+	// the stream's fields are reset when it ends, so the goroutines use their copies
+	linesCh, poll := sub.linesCh, sub.poll
+	// tailGlob closes its channel
+	ch := make(chan Line)
+	go func() {
+		if err := tailGlob(ctx, ch, sr.root, sr.FS, src.Glob, poll, nil, src.mark(ctx)); err != nil {
+			slog.Warn("subscription tail", "subscription", sub.ID, "source", src.ID, "glob", src.Glob, "error", err)
+		}
+	}()
+	go func() {
+		for line := range ch {
+			select {
+			case <-ctx.Done():
+				return
+			case linesCh <- line:
+			}
+		}
+	}()
+}
+
+// lookup returns the subscription of the id, if it belongs to the user of the request.
+func (sr *subscriptionRegistry) lookup(r *http.Request) *tailSubscription {
+	sr.mu.Lock()
+	sub := sr.subs[r.PathValue("id")]
+	sr.mu.Unlock()
+	if sub == nil || !sameUser(r, sub.User) {
+		return nil
+	}
+	return sub
+}
+
+// remove the subscription, ending its stream.
+func (sr *subscriptionRegistry) remove(sub *tailSubscription) {
+	sr.mu.Lock()
+	delete(sr.subs, sub.ID)
+	sr.mu.Unlock()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.removed {
+		return
+	}
+	sub.removed = true
+	sub.expire.Stop()
+	if sub.cancel != nil {
+		sub.cancel()
+	}
+	slog.Info("subscription removed", "id", sub.ID)
+}
+
+// handleCreate creates a subscription of the spec in the body,
+// and returns it as JSON, with the URL of its stream.
+func (sr *subscriptionRegistry) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var spec subscriptionSpec
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&spec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub := &tailSubscription{ID: newRecordingID(), Sources: make([]*subscriptionSource, 0, len(spec.Sources))}
+	if u := authenticate(r); u != nil {
+		sub.User = u.Name
+	}
+	for _, src := range spec.Sources {
+		if src == nil {
+			continue
+		}
+		err := src.parse()
+		if err == nil {
+			err = sub.add(sr, src)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sr.mu.Lock()
+	if len(sr.subs) >= maxSubscriptions {
+		sr.mu.Unlock()
+		http.Error(w, "too many subscriptions", http.StatusTooManyRequests)
+		return
+	}
+	if sr.subs == nil {
+		sr.subs = make(map[string]*tailSubscription)
+	}
+	sr.subs[sub.ID] = sub
+	sub.expire = time.AfterFunc(subscriptionIdle, func() { sr.remove(sub) })
+	sr.mu.Unlock()
+	slog.Info("subscription created", "id", sub.ID, "user", sub.User, "sources", len(sub.Sources))
+	writeSubscription(w, sub, http.StatusCreated)
+}
+
+// handleGet returns the subscription as JSON.
+func (sr *subscriptionRegistry) handleGet(w http.ResponseWriter, r *http.Request) {
+	sub := sr.lookup(r)
+	if sub == nil {
+		http.Error(w, "no such subscription", http.StatusNotFound)
+		return
+	}
+	writeSubscription(w, sub, http.StatusOK)
+}
+
+// handleDelete removes the subscription, ending its stream.
+func (sr *subscriptionRegistry) handleDelete(w http.ResponseWriter, r *http.Request) {
+	sub := sr.lookup(r)
+	if sub == nil {
+		http.Error(w, "no such subscription", http.StatusNotFound)
+		return
+	}
+	sr.remove(sub)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdd adds the source in the body to the subscription, and returns the subscription.
+func (sr *subscriptionRegistry) handleAdd(w http.ResponseWriter, r *http.Request) {
+	sub := sr.lookup(r)
+	if sub == nil {
+		http.Error(w, "no such subscription", http.StatusNotFound)
+		return
+	}
+	var src subscriptionSource
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&src); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := src.parse()
+	if err == nil {
+		sub.mu.Lock()
+		err = sub.add(sr, &src)
+		sub.mu.Unlock()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("subscription source added", "id", sub.ID, "source", src.ID, "glob", src.Glob)
+	writeSubscription(w, sub, http.StatusOK)
+}
+
+// handleRemove removes the source from the subscription, and returns the subscription.
+func (sr *subscriptionRegistry) handleRemove(w http.ResponseWriter, r *http.Request) {
+	sub := sr.lookup(r)
+	if sub == nil {
+		http.Error(w, "no such subscription", http.StatusNotFound)
+		return
+	}
+	sub.mu.Lock()
+	i := sub.source(r.PathValue("source"))
+	if i >= 0 {
+		if cancel := sub.Sources[i].cancel; cancel != nil {
+			cancel()
+		}
+		sub.Sources = slices.Delete(sub.Sources, i, i+1)
+	}
+	sub.mu.Unlock()
+	if i < 0 {
+		http.Error(w, "no such source", http.StatusNotFound)
+		return
+	}
+	slog.Info("subscription source removed", "id", sub.ID, "source", r.PathValue("source"))
+	writeSubscription(w, sub, http.StatusOK)
+}
+
+// handleStream streams the lines of the sources of the subscription,
+// with the rendering options and transports of /tail.
+// A subscription has at most one stream at a time.
+func (sr *subscriptionRegistry) handleStream(w http.ResponseWriter, r *http.Request) {
+	sub := sr.lookup(r)
+	if sub == nil {
+		http.Error(w, "no such subscription", http.StatusNotFound)
+		return
+	}
+	opts, err := parseSSEOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	poll, err := parsePollOptions(r.URL.Query(), defaultPoll)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	linesCh := make(chan Line)
+	sub.mu.Lock()
+	if sub.ctx != nil {
+		sub.mu.Unlock()
+		http.Error(w, "the subscription is already streaming", http.StatusConflict)
+		return
+	}
+	sub.expire.Stop()
+	sub.ctx, sub.cancel, sub.linesCh, sub.poll = ctx, cancel, linesCh, poll
+	for _, src := range sub.Sources {
+		sr.start(sub, src)
+	}
+	sub.mu.Unlock()
+	logAttrs(r.Context(), "subscription", sub.ID)
+	defer func() {
+		sub.mu.Lock()
+		sub.ctx, sub.cancel, sub.linesCh = nil, nil, nil
+		for _, src := range sub.Sources {
+			src.cancel = nil
+		}
+		if !sub.removed {
+			sub.expire.Reset(subscriptionIdle)
+		}
+		sub.mu.Unlock()
+	}()
+	streamEvents(w, r, linesCh, opts)
+}
+
+// writeSubscription writes the subscription as JSON, with the URL of its stream.
+func writeSubscription(w http.ResponseWriter, sub *tailSubscription, code int) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		*tailSubscription
+		Stream string `json:"stream"`
+	}{tailSubscription: sub, Stream: "./api/v1/subscriptions/" + sub.ID + "/stream"})
+}
@@ -0,0 +1,390 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+	"unicode/utf8"
+
+	"github.com/UNO-SOFT/webtail/process"
+)
+
+// openTail opens the regular file fn (relative to root) of FS (the Sandbox) for tailing.
+// On error, it also returns the matching HTTP status code.
+func openTail(root string, FS fs.FS, fn string) (*os.File, int, error) {
+	if err := rootStatus.Err(); err != nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("root unavailable: %w", err)
+	}
+	if fi, err := FS.(fs.StatFS).Stat(fn); err != nil {
+		slog.Error("stat", "file", fn, "root", root, "error", err)
+		return nil, fsStatusCode(err, http.StatusNotFound), err
+	} else if !fi.Mode().IsRegular() {
+		slog.Error("not regular", "file", fn, "root", root, "mode", fi.Mode())
+		return nil, http.StatusBadRequest, fmt.Errorf("%q is not a regular file (%v)", fn, fi.Mode())
+	}
+	f, err := FS.Open(fn)
+	if err != nil {
+		return nil, fsStatusCode(err, http.StatusInternalServerError), err
+	}
+	fh, ok := f.(*os.File)
+	if !ok {
+		f.Close()
+		return nil, http.StatusInternalServerError, fmt.Errorf("%q: %T is not a file", fn, f)
+	}
+	return fh, http.StatusOK, nil
+}
+
+// Line is a line read from a source.
+type Line = process.Line
+
+// pollOptions control how often a file is polled for new data.
+type pollOptions struct {
+	// Min is the interval after new data has been read,
+	// Max is the upper limit of the backoff when the file is idle.
+	Min, Max time.Duration
+	// Backoff is "linear" (add Min with jitter) or "exp" (double, with jitter).
+	Backoff string
+}
+
+// defaultPoll is the server-wide default poll options, set by the flags.
+var defaultPoll = pollOptions{Min: time.Second, Max: 30 * time.Second, Backoff: "linear"}
+
+// minPollInterval is the lowest poll interval a client may request.
+const minPollInterval = 50 * time.Millisecond
+
+// parsePollOptions overrides the defaults with the min-interval, max-interval
+// and backoff query parameters.
+func parsePollOptions(q url.Values, defaults pollOptions) (pollOptions, error) {
+	po := defaults
+	var err error
+	if s := q.Get("min-interval"); s != "" {
+		if po.Min, err = time.ParseDuration(s); err != nil {
+			return po, fmt.Errorf("min-interval: %w", err)
+		}
+	}
+	if s := q.Get("max-interval"); s != "" {
+		if po.Max, err = time.ParseDuration(s); err != nil {
+			return po, fmt.Errorf("max-interval: %w", err)
+		}
+	}
+	if s := q.Get("backoff"); s != "" {
+		po.Backoff = s
+	}
+	return po, po.check()
+}
+
+func (po pollOptions) check() error {
+	if po.Min < minPollInterval {
+		return fmt.Errorf("min-interval must be at least %v", minPollInterval)
+	}
+	if po.Max < po.Min {
+		return fmt.Errorf("max-interval (%v) must not be less than min-interval (%v)", po.Max, po.Min)
+	}
+	if po.Backoff != "linear" && po.Backoff != "exp" {
+		return fmt.Errorf("backoff must be linear or exp, not %q", po.Backoff)
+	}
+	return nil
+}
+
+// next returns the wait after dur, when no new data has been found.
+func (po pollOptions) next(dur time.Duration) time.Duration {
+	if po.Backoff == "exp" {
+		dur = 2*dur + time.Duration(float32(dur/4)*rand.Float32())
+	} else {
+		dur += time.Duration(float32(po.Min) * rand.Float32())
+	}
+	return min(dur, po.Max)
+}
+
+// maxLineSize is the length above which lines are truncated, marked with lineEllipsis.
+var maxLineSize = 1 << 20
+
+// lineEllipsis marks the end of truncated lines.
+const lineEllipsis = "…"
+
+// truncateLine returns b as a string, truncated to maxLineSize bytes.
+func truncateLine(b []byte) string {
+	if len(b) <= maxLineSize {
+		return string(b)
+	}
+	return cutLine(b[:maxLineSize])
+}
+
+// cutLine returns the truncated line b, marked with lineEllipsis,
+// without its last partial rune.
+func cutLine(b []byte) string {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				b = b[:i]
+			}
+			break
+		}
+	}
+	return string(b) + lineEllipsis
+}
+
+// backfill reads the last (at most n) complete lines of fh, and returns them
+// with the offset after them, where the file is to be followed from.
+//
+// The seam is the end of the last complete line at the time of the call:
+// the lines written after it are left to the follow, so no line is lost
+// or duplicated between the backfill and the live lines.
+func backfill(ctx context.Context, fh *os.File, n int) ([]Line, int64, error) {
+	// the partial last line is sent when it is complete
+	seam, err := tailSeam(ctx, fh)
+	if err != nil {
+		return nil, 0, err
+	}
+	start, err := lineStartBefore(ctx, fh, seam, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	lines, _, err := readLines(ctx, fh, start, n)
+	// the lines written since the Stat are read by the follow
+	for i, line := range lines {
+		if line.Offset >= seam {
+			lines = lines[:i]
+			break
+		}
+	}
+	return lines, seam, err
+}
+
+// tailFile sends the lines of fh to linesCh, following the file as it grows,
+// until ctx is canceled.
+//
+// The read buffer grows up to maxLineSize for long lines,
+// the rest of longer lines are skipped.
+func tailFile(ctx context.Context, linesCh chan<- Line, fh *os.File, poll pollOptions) error {
+	return tailFileFrom(ctx, linesCh, fh, poll, 0)
+}
+
+// tailFileFrom is tailFile starting at the offset off,
+// the line numbers are unknown (0) when it is not the start of the file.
+//
+// It returns errFileRemoved after the last line of the file, if it is removed.
+func tailFileFrom(ctx context.Context, linesCh chan<- Line, fh *os.File, poll pollOptions, off int64) error {
+	defer func() {
+		slog.Info("finish", "tail", fh.Name())
+		fh.Close()
+		close(linesCh)
+	}()
+	return followFrom(ctx, linesCh, fh, poll, off)
+}
+
+// followFrom is tailFileFrom, leaving fh and linesCh open.
+func followFrom(ctx context.Context, linesCh chan<- Line, fh *os.File, poll pollOptions, off int64) error {
+	var lineNo int64
+	numbered := off == 0
+	buf := make([]byte, min(16384, maxLineSize))
+	var start int
+	// skipping the rest of a truncated line
+	var skipping bool
+	dur := poll.Min
+	timer := time.NewTimer(dur)
+	sleep := func() bool {
+		timer.Reset(dur)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return false
+		}
+		dur = poll.next(dur)
+		return true
+	}
+	send := func(line Line) bool {
+		if !numbered {
+			line.No = 0
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case linesCh <- line:
+			return true
+		}
+	}
+	for {
+		if start == len(buf) {
+			// no newline in the whole buffer
+			if len(buf) < maxLineSize {
+				buf = append(buf, make([]byte, min(len(buf), maxLineSize-len(buf)))...)
+			} else {
+				lineNo++
+				if !send(Line{Text: cutLine(buf), Offset: off - int64(start), No: lineNo, Time: time.Now()}) {
+					return nil
+				}
+				start, skipping = 0, true
+			}
+		}
+		n, err := fh.ReadAt(buf[start:], off)
+		slog.Debug("ReadAt", "off", off, "start", start, "n", n, "error", err)
+		if n == 0 {
+			// wait for new data, unless the file is removed,
+			// or erroring (instead of spinning on the error)
+			if fileRemoved(fh, err) {
+				err = errFileRemoved
+			} else if err == nil || errors.Is(err, io.EOF) {
+				if !sleep() {
+					return nil
+				}
+				continue
+			}
+			if start != 0 && !skipping {
+				// the unterminated last line
+				lineNo++
+				send(Line{Text: truncateLine(buf[:start]), Offset: off - int64(start), No: lineNo, Time: time.Now()})
+			}
+			return err
+		}
+		if err := diskLimiter.Wait(ctx, n); err != nil {
+			return nil
+		}
+		// the offset of the start of p
+		lineOff := off - int64(start)
+		off += int64(n)
+		p := buf[:start+n]
+		// Line-oriented writers never write NUL bytes: those are holes,
+		// or preallocated space not written yet.
+		var hole, unwritten bool
+		if z := bytes.IndexByte(p[start:], 0); z >= 0 {
+			z += start
+			p = p[:z]
+			d, dErr := nextData(ctx, fh, lineOff+int64(z))
+			if dErr != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return dErr
+			}
+			if hole = d >= 0; hole {
+				off = d
+			} else {
+				off, unwritten = lineOff+int64(z), z == start
+			}
+		}
+		if !unwritten {
+			dur = poll.Min
+		}
+		if skipping {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				i = len(p) - 1
+			} else {
+				skipping = false
+			}
+			p = p[i+1:]
+			lineOff += int64(i + 1)
+		}
+		now := time.Now()
+		for {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				start = copy(buf, p)
+				break
+			}
+			lineNo++
+			if !send(Line{Text: truncateLine(p[:i]), Offset: lineOff, No: lineNo, Time: now}) {
+				return nil
+			}
+			p = p[i+1:]
+			lineOff += int64(i + 1)
+		}
+		if hole {
+			skipping = false
+			if start != 0 {
+				// the record before the hole is complete
+				lineNo++
+				if !send(Line{Text: truncateLine(buf[:start]), Offset: lineOff, No: lineNo, Time: now}) {
+					return nil
+				}
+				start = 0
+			}
+		}
+		if unwritten && !sleep() {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+}
+
+// tailCommand runs cmd and sends the lines of its standard output to linesCh,
+// until the command exits or ctx is canceled.
+func tailCommand(ctx context.Context, linesCh chan<- Line, cmd *exec.Cmd) error {
+	defer close(linesCh)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %q: %w", cmd.Args, err)
+	}
+	err = scanLines(ctx, linesCh, stdout)
+	slog.Info("finish", "command", cmd.Args)
+	if err != nil || ctx.Err() != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	// the command closed its output: report how it exited
+	return cmd.Wait()
+}
+
+// scanLines sends the lines read from r to linesCh, until EOF or ctx is canceled.
+// The offsets are counted from the start of r; the lines longer than maxLineSize are truncated.
+func scanLines(ctx context.Context, linesCh chan<- Line, r io.Reader) error {
+	br := bufio.NewReaderSize(r, min(16384, maxLineSize))
+	var off, pos, lineNo int64
+	// long is the start of a line longer than the buffer, at most maxLineSize+1 bytes of it
+	var long []byte
+	for {
+		b, err := br.ReadSlice('\n')
+		pos += int64(len(b))
+		if errors.Is(err, bufio.ErrBufferFull) {
+			long = append(long, b[:min(len(b), max(0, maxLineSize+1-len(long)))]...)
+			continue
+		}
+		if len(b) == 0 && len(long) == 0 {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		b = bytes.TrimSuffix(bytes.TrimSuffix(b, []byte{'\n'}), []byte{'\r'})
+		if len(long) != 0 {
+			b = append(long, b[:min(len(b), max(0, maxLineSize+1-len(long)))]...)
+			long = long[:0]
+		}
+		lineNo++
+		line := Line{Text: truncateLine(b), Offset: off, No: lineNo, Time: time.Now()}
+		off = pos
+		select {
+		case <-ctx.Done():
+			return nil
+		case linesCh <- line:
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
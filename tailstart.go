@@ -0,0 +1,122 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tailStart is where the /tail stream of a file starts, the from= parameter:
+//
+//   - end (the default): the current end of the file, as tail -f
+//   - start: the start of the file
+//   - offset:<n>: the first line starting at or after the byte offset n
+//   - lines:<n>: the last n lines (as lines=<n>), see backfill
+//   - buffer: the last lines kept by the shared reader of the file (see tailBroker),
+//     the whole file without one, as before from= was added
+type tailStart struct {
+	Kind string
+	N    int64
+}
+
+// parseTailStart parses the from= (or the lines=) query parameter.
+func parseTailStart(q url.Values) (tailStart, error) {
+	s := q.Get("from")
+	if s == "" {
+		if q.Has("lines") {
+			n, err := parsePageParam(q, "lines", 0)
+			return tailStart{Kind: "lines", N: n}, err
+		}
+		return tailStart{Kind: "end"}, nil
+	}
+	kind, arg, hasArg := strings.Cut(s, ":")
+	switch kind {
+	case "end", "start", "buffer":
+		if !hasArg {
+			return tailStart{Kind: kind}, nil
+		}
+	case "offset", "lines":
+		if n, err := strconv.ParseInt(arg, 10, 64); err == nil && n >= 0 {
+			return tailStart{Kind: kind, N: n}, nil
+		}
+	}
+	return tailStart{}, fmt.Errorf("from=%q: must be end, start, buffer, offset:<n> or lines:<n>", s)
+}
+
+// tailSeam returns the end of the last complete line of fh:
+// the offset to follow the file from, so its partial last line is sent complete.
+func tailSeam(ctx context.Context, fh *os.File) (int64, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	seam := fi.Size()
+	if seam == 0 {
+		return 0, nil
+	}
+	var a [1]byte
+	if _, err := fh.ReadAt(a[:], seam-1); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if a[0] == '\n' {
+		return seam, nil
+	}
+	return lineStartBefore(ctx, fh, seam, 1)
+}
+
+// lineStartAfter returns the offset of the first line of fh starting at or after off.
+func lineStartAfter(ctx context.Context, fh *os.File, off int64) (int64, error) {
+	if off == 0 {
+		return 0, nil
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if off > fi.Size() {
+		return 0, fmt.Errorf("offset %d is beyond the end of the file (%d)", off, fi.Size())
+	}
+	var a [1]byte
+	if _, err := fh.ReadAt(a[:], off-1); err != nil {
+		return 0, err
+	}
+	if a[0] == '\n' {
+		return off, nil
+	}
+	// skip the rest of the line
+	_, next, err := readLines(ctx, fh, off, 1)
+	return next, err
+}
+
+// skipBefore sends the lines of ch to linesCh, but the ones before the offset off,
+// until the first line at or after it, or the offsets restart (as the file reappeared).
+func skipBefore(ctx context.Context, linesCh chan<- Line, ch <-chan Line, off int64) {
+	defer close(linesCh)
+	prev := int64(-1)
+	for line := range ch {
+		if off >= 0 && line.Offset >= 0 {
+			if line.Offset >= off || line.Offset < prev {
+				off = -1
+			} else {
+				prev = line.Offset
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			for range ch {
+			}
+			return
+		case linesCh <- line:
+		}
+	}
+}
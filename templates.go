@@ -0,0 +1,146 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// templatesFS holds the templates of the HTML pages.
+//
+//go:embed templates
+var templatesFS embed.FS
+
+// pageTemplates are the templates of the HTML pages, see loadTemplates.
+var pageTemplates *template.Template
+
+// templateFuncs are the functions of the templates, of the configuration.
+var templateFuncs = template.FuncMap{
+	// idleLock returns the seconds of -idle-lock
+	"idleLock": func() int64 { return int64(idleLock / time.Second) },
+	// oidcLogin reports whether the users log in with OIDC
+	"oidcLogin": func() bool { return oidcLogin != nil },
+}
+
+// loadTemplates parses the embedded templates, then the *.html files of dir (if not empty),
+// whose definitions replace the embedded ones of the same name
+// (such as "brand", "head" and "toolbar" of layout.html), to customize the branding and the layout.
+func loadTemplates(dir string) error {
+	tmpl, err := template.New("").Funcs(templateFuncs).ParseFS(templatesFS, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		if tmpl, err = tmpl.ParseFS(os.DirFS(dir), "*.html"); err != nil {
+			return fmt.Errorf("templates %q: %w", dir, err)
+		}
+	}
+	// the parts of every page, to fail at the start rather than on every page
+	for _, name := range []string{"brand", "head", "idlelock", "toolbar"} {
+		if err = tmpl.ExecuteTemplate(io.Discard, name, "./"); err != nil {
+			return fmt.Errorf("templates %q: %w", dir, err)
+		}
+	}
+	pageTemplates = tmpl
+	return nil
+}
+
+// renderPage renders the named template with data as the HTML response,
+// or a 500 Internal Server Error if it fails.
+func renderPage(w http.ResponseWriter, name string, data any) {
+	var buf bytes.Buffer
+	if err := pageTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.Error("render", "template", name, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// findForm is the data of the "findform" template: the "find file" form searching under Dir.
+type findForm struct {
+	Dir, Q string
+}
+
+// pathsSection is the data of the "paths" template: the paths as a list of links, if there is any.
+type pathsSection struct {
+	Title string
+	Paths []string
+}
+
+// pageLink is a link of the index page.
+type pageLink struct {
+	Title, URL string
+}
+
+// breadcrumbs returns the links of the directories leading to dir (relative to the root),
+// the first being the root labeled with label, the last dir itself.
+func breadcrumbs(label, dir string) []pageLink {
+	links := []pageLink{{Title: label, URL: "./dir?path=."}}
+	if dir == "." {
+		return links
+	}
+	segs := strings.Split(dir, "/")
+	for i, seg := range segs {
+		links = append(links, pageLink{Title: seg, URL: "./dir?" + url.Values{"path": {strings.Join(segs[:i+1], "/")}}.Encode()})
+	}
+	return links
+}
+
+// dirEntry is an entry of the listing of the index page, Kind is "dir" or "file".
+type dirEntry struct {
+	Kind, Name, Path string
+}
+
+// indexPage is the data of the index.html template.
+type indexPage struct {
+	Find        findForm
+	Breadcrumbs []pageLink
+	Maintenance *Maintenance
+	RootError   error
+	Warmup      *WarmupProgress
+	Links       []pageLink
+	Sources     []*sourceNode
+	Favorites   pathsSection
+	Recent      pathsSection
+	SavedViews  []savedView
+	// MoreSavedViews is the number of the saved views not listed.
+	MoreSavedViews int
+	Top            []FileViews
+	Entries        []dirEntry
+}
+
+// listPage is the data of the list.html template: the Items as a list,
+// under the find form (if Find is not nil) or the Title.
+type listPage struct {
+	Title   string
+	Find    *findForm
+	Summary string
+	Items   []listItem
+}
+
+// listItem is an item of a listPage: its Title linked to its URL (if any),
+// with a Note and Links after it.
+type listItem struct {
+	Title, URL, Note string
+	Links            []pageLink
+}
+
+// viewerPage is the data of the viewer.html template.
+type viewerPage struct {
+	Title, TailURL string
+}
@@ -0,0 +1,264 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// The time index (-time-index) records checkpoints of the files in SQLite:
+// the offset and the timestamp of the first line with a timestamp after every indexStride bytes,
+// so the queries of a time range (/api/v1/replay, /api/v1/grep with since) seek
+// to the last checkpoint before the range, instead of scanning the file from its start.
+// The lines of a log are assumed to be written in order.
+//
+// The checkpoints are added when the file is queried, for the part written since,
+// and dropped when the file is truncated or rotated (its first bytes change).
+
+const (
+	// indexStride is the distance of the checkpoints of the files.
+	indexStride = 1 << 20
+	// indexHeadSize is the most bytes of the start of a file checksummed, to notice its rotation.
+	indexHeadSize = 4096
+	// indexProbeLines is the most lines read after a stride looking for a timestamp.
+	indexProbeLines = 64
+)
+
+// timeIndex is the index of -time-index, nil if disabled.
+var timeIndex *positionIndex
+
+// positionIndex keeps the checkpoints of the files in the webtail_time_index table,
+// and what has been indexed of them in webtail_time_file, per timestamp layout.
+type positionIndex struct {
+	db *sql.DB
+
+	// locks serialize the updates of each file (and layout), by the key of fileKey
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+// fileLock is the lock of the updates of a file, with the number of its holders and waiters.
+type fileLock struct {
+	sync.Mutex
+	n int
+}
+
+// lock locks the updates of the file (in the layout), and returns the function to unlock them.
+func (pi *positionIndex) lock(fn, layout string) func() {
+	key := fn + "\x00" + layout
+	pi.mu.Lock()
+	l := pi.locks[key]
+	if l == nil {
+		l = new(fileLock)
+		pi.locks[key] = l
+	}
+	l.n++
+	pi.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		pi.mu.Lock()
+		if l.n--; l.n == 0 {
+			delete(pi.locks, key)
+		}
+		pi.mu.Unlock()
+	}
+}
+
+// openPositionIndex opens (or creates) the SQLite database of sqlite:///path/to/index.db.
+func openPositionIndex(ctx context.Context, spec string) (*positionIndex, error) {
+	if !strings.HasPrefix(spec, "sqlite:") {
+		return nil, fmt.Errorf("%q: only sqlite:///path is supported", spec)
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+store.Path(u)+"?_busy_timeout=10000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", spec, err)
+	}
+	for _, qry := range []string{
+		`CREATE TABLE IF NOT EXISTS webtail_time_file (
+  file VARCHAR(4096) NOT NULL,
+  layout VARCHAR(255) NOT NULL,
+  head_size BIGINT NOT NULL,
+  head INTEGER NOT NULL,
+  next BIGINT NOT NULL,
+  PRIMARY KEY (file, layout)
+)`,
+		`CREATE TABLE IF NOT EXISTS webtail_time_index (
+  file VARCHAR(4096) NOT NULL,
+  layout VARCHAR(255) NOT NULL,
+  off BIGINT NOT NULL,
+  ts BIGINT NOT NULL,
+  PRIMARY KEY (file, layout, off)
+)`,
+		`CREATE INDEX IF NOT EXISTS webtail_time_index_ts ON webtail_time_index (file, layout, ts)`,
+	} {
+		if _, err := db.ExecContext(ctx, qry); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%q: %w", spec, err)
+		}
+	}
+	return &positionIndex{db: db, locks: make(map[string]*fileLock)}, nil
+}
+
+// Close the database.
+func (pi *positionIndex) Close() error { return pi.db.Close() }
+
+// Seek returns the offset of fh (the file fn) to read its lines with timestamps (in the layout of mo)
+// at or after t from: the last checkpoint before the first one at or after t, or 0.
+// It updates the checkpoints of the file first. Without an index, it is 0.
+func (pi *positionIndex) Seek(ctx context.Context, fn string, fh *os.File, mo *mergeOptions, t time.Time) (int64, error) {
+	if pi == nil || t.IsZero() {
+		return 0, nil
+	}
+	if err := pi.update(ctx, fn, fh, mo); err != nil {
+		return 0, fmt.Errorf("index %q: %w", fn, err)
+	}
+	var off sql.NullInt64
+	err := pi.db.QueryRowContext(ctx, `SELECT MAX(off) FROM webtail_time_index
+  WHERE file = ? AND layout = ? AND off < COALESCE(
+    (SELECT MIN(off) FROM webtail_time_index WHERE file = ? AND layout = ? AND ts >= ?), ?)`,
+		fn, mo.Layout, fn, mo.Layout, t.UnixNano(), int64(1<<62),
+	).Scan(&off)
+	return off.Int64, err
+}
+
+// update adds the checkpoints of the strides of fh written since the last update,
+// after dropping the old ones if the file has been truncated or rotated.
+//
+// The updates of a file are serialized, those of different files run in parallel:
+// the file is read before the short transaction writing its checkpoints.
+func (pi *positionIndex) update(ctx context.Context, fn string, fh *os.File, mo *mergeOptions) error {
+	defer pi.lock(fn, mo.Layout)()
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	var headSize, next int64
+	var head uint32
+	err = pi.db.QueryRowContext(ctx,
+		"SELECT head_size, head, next FROM webtail_time_file WHERE file = ? AND layout = ?", fn, mo.Layout,
+	).Scan(&headSize, &head, &next)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := diskLimiter.Wait(ctx, int(headSize+min(fi.Size(), indexHeadSize))); err != nil {
+		return err
+	}
+	rotated := false
+	if sum, err := headSum(fh, headSize); err != nil {
+		return err
+	} else if fi.Size() < next || sum != head {
+		// truncated or rotated
+		rotated, next = true, 0
+	}
+	seam, err := tailSeam(ctx, fh)
+	if err != nil {
+		return err
+	}
+	type checkpoint struct {
+		off int64
+		ts  time.Time
+	}
+	var checkpoints []checkpoint
+	for ; next+indexStride <= seam; next += indexStride {
+		off, ts, ok, err := probeTimestamp(ctx, fh, mo, next+indexStride, seam)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if off < seam {
+				// no timestamp in this stride
+				continue
+			}
+			// the rest of the stride has not been written yet
+			break
+		}
+		checkpoints = append(checkpoints, checkpoint{off: off, ts: ts})
+	}
+	headSize = min(fi.Size(), indexHeadSize)
+	if head, err = headSum(fh, headSize); err != nil {
+		return err
+	}
+
+	tx, err := pi.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if rotated {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM webtail_time_index WHERE file = ? AND layout = ?", fn, mo.Layout); err != nil {
+			return err
+		}
+	}
+	for _, c := range checkpoints {
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO webtail_time_index (file, layout, off, ts) VALUES (?, ?, ?, ?) ON CONFLICT (file, layout, off) DO UPDATE SET ts = excluded.ts",
+			fn, mo.Layout, c.off, c.ts.UnixNano(),
+		); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO webtail_time_file (file, layout, head_size, head, next) VALUES (?, ?, ?, ?, ?)"+
+			" ON CONFLICT (file, layout) DO UPDATE SET head_size = excluded.head_size, head = excluded.head, next = excluded.next",
+		fn, mo.Layout, headSize, head, next,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// probeTimestamp returns the offset and the timestamp of the first line of fh
+// starting at or after from (but before the next stride and seam) with a timestamp.
+// Without one, it returns where it has stopped looking.
+func probeTimestamp(ctx context.Context, fh *os.File, mo *mergeOptions, from, seam int64) (int64, time.Time, bool, error) {
+	off, err := lineStartAfter(ctx, fh, from)
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	end := min(seam, from+indexStride)
+	for n := 0; off < end && n < indexProbeLines; {
+		lines, next, err := readLines(ctx, fh, off, indexProbeLines-n)
+		if err != nil || len(lines) == 0 {
+			return off, time.Time{}, false, err
+		}
+		for _, line := range lines {
+			if line.Offset >= end {
+				return line.Offset, time.Time{}, false, nil
+			}
+			if t, ok := mo.timestamp(line.Text); ok {
+				return line.Offset, t, true, nil
+			}
+		}
+		n += len(lines)
+		off = next
+	}
+	return off, time.Time{}, false, nil
+}
+
+// headSum returns the checksum of the first n bytes of fh.
+func headSum(fh *os.File, n int64) (uint32, error) {
+	b := make([]byte, n)
+	if _, err := fh.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(b), nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// The viewer hooks tell the owners of the sources when someone is watching them:
+// a webhook is called when the first viewer attaches to a matching source ("first"),
+// and when the last one detaches ("last"), with the identity of that viewer.
+//
+// A viewer reconnecting within the Grace period does not fire the hooks.
+
+// viewerHook is a rule of the -viewer-hooks JSON file.
+type viewerHook struct {
+	// Match is a glob (path.Match) of the sources, such as "prod/*.log" or "@docker/*".
+	Match string `json:"match"`
+	// URL receives the viewerEvent as JSON.
+	URL string `json:"url"`
+	// Grace is how long after the last viewer left the "last" event is fired (default 10s).
+	Grace string `json:"grace,omitempty"`
+
+	grace time.Duration
+}
+
+// viewerEvent is the JSON body sent to the viewer hooks.
+type viewerEvent struct {
+	// Event is "first" or "last".
+	Event    string    `json:"event"`
+	Source   string    `json:"source"`
+	User     string    `json:"user,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"ts"`
+}
+
+// loadViewerHooks reads the viewer hooks from the JSON file, an array of viewerHook, such as
+//
+//	[{"match": "prod/*", "url": "https://example.com/hooks/webtail", "grace": "30s"}]
+func loadViewerHooks(fn string) ([]*viewerHook, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []*viewerHook
+	if err := json.Unmarshal(b, &hooks); err != nil {
+		return nil, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	for _, h := range hooks {
+		if h.Match == "" || h.URL == "" {
+			return nil, fmt.Errorf("%q: viewer hook %q: match and url are required", fn, h.Match)
+		}
+		if _, err := path.Match(h.Match, ""); err != nil {
+			return nil, fmt.Errorf("%q: viewer hook %q: %w", fn, h.Match, err)
+		}
+		h.grace = 10 * time.Second
+		if h.Grace != "" {
+			if h.grace, err = time.ParseDuration(h.Grace); err != nil || h.grace < 0 {
+				return nil, fmt.Errorf("%q: viewer hook %q: grace %q is not a duration", fn, h.Match, h.Grace)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// watchedSource is the count of the viewers of a source.
+type watchedSource struct {
+	viewers int
+	// last is the timer firing the "last" event.
+	last *time.Timer
+}
+
+// viewerTracker counts the viewers of the sources, and calls the matching hooks.
+type viewerTracker struct {
+	Hooks []*viewerHook
+
+	client  *http.Client
+	mu      sync.Mutex
+	sources map[string]*watchedSource
+}
+
+// viewerHooks track the viewers of this server, nil without any hooks.
+var viewerHooks *viewerTracker
+
+// Attach counts the viewer of the stream r of source,
+// and returns a function to call when it detaches.
+func (vt *viewerTracker) Attach(r *http.Request, source string) func() {
+	if vt == nil {
+		return func() {}
+	}
+	var hooks []*viewerHook
+	for _, h := range vt.Hooks {
+		if ok, _ := path.Match(h.Match, source); ok {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return func() {}
+	}
+	ev := viewerEvent{Source: source, Client: r.RemoteAddr, Instance: instance.Name}
+	if u := authenticate(r); u != nil {
+		ev.User = u.Name
+	}
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	ws := vt.sources[source]
+	if ws == nil {
+		if vt.sources == nil {
+			vt.sources = make(map[string]*watchedSource)
+		}
+		ws = &watchedSource{}
+		vt.sources[source] = ws
+	}
+	ws.viewers++
+	if ws.last != nil {
+		// reconnected within the grace period
+		ws.last.Stop()
+		ws.last = nil
+	} else if ws.viewers == 1 {
+		ev.Event, ev.Time = "first", time.Now()
+		vt.fire(hooks, ev)
+	}
+	return func() {
+		vt.mu.Lock()
+		defer vt.mu.Unlock()
+		if ws.viewers--; ws.viewers != 0 {
+			return
+		}
+		var grace time.Duration
+		for _, h := range hooks {
+			grace = max(grace, h.grace)
+		}
+		var last *time.Timer
+		last = time.AfterFunc(grace, func() {
+			vt.mu.Lock()
+			defer vt.mu.Unlock()
+			if ws.last != last || ws.viewers != 0 {
+				// stopped too late
+				return
+			}
+			ws.last = nil
+			delete(vt.sources, source)
+			ev.Event, ev.Time = "last", time.Now()
+			vt.fire(hooks, ev)
+		})
+		ws.last = last
+	}
+}
+
+// fire calls the hooks with the event, in the background.
+func (vt *viewerTracker) fire(hooks []*viewerHook, ev viewerEvent) {
+	if vt.client == nil {
+		vt.client = &http.Client{Timeout: alertTimeout}
+	}
+	for _, h := range hooks {
+		go func(URL string) {
+			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+			defer cancel()
+			if err := postJSON(ctx, vt.client, URL, ev); err != nil {
+				slog.Error("viewer hook", "source", ev.Source, "event", ev.Event, "error", err)
+			} else {
+				slog.Info("viewer hook", "source", ev.Source, "event", ev.Event, "user", ev.User)
+			}
+		}(h.URL)
+	}
+}
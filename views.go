@@ -0,0 +1,224 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/webtail/store"
+)
+
+// viewCounter counts how many times each file has been tailed,
+// persisting the counts in the Store (if not nil), or in a JSON file (if Path is not empty).
+//
+// The instances sharing a store add their views to the stored counts,
+// and pick up the views of each other when saving.
+type viewCounter struct {
+	Path  string
+	Store store.Store
+
+	mu     sync.Mutex
+	counts map[string]uint64
+	// delta are the views of each file since the last save
+	delta map[string]uint64
+}
+
+// viewsBucket is the bucket of the view counts in the store.
+const viewsBucket = "views"
+
+// FileViews is the number of views of a file.
+type FileViews struct {
+	Path  string `json:"path"`
+	Views uint64 `json:"views"`
+}
+
+// newViewCounter returns a viewCounter, loading the persisted counts from st, or from path.
+// With st, the counts of the file at path are imported if st has none yet.
+func newViewCounter(ctx context.Context, path string, st store.Store) (*viewCounter, error) {
+	vc := viewCounter{Path: path, Store: st, counts: make(map[string]uint64), delta: make(map[string]uint64)}
+	if st != nil {
+		if err := vc.load(ctx); err != nil {
+			return nil, err
+		}
+		if len(vc.counts) != 0 {
+			return &vc, nil
+		}
+	}
+	if path == "" {
+		return &vc, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &vc, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &vc.counts); err != nil {
+		return nil, err
+	}
+	if st != nil {
+		for k, n := range vc.counts {
+			vc.delta[k] = n
+		}
+	}
+	return &vc, nil
+}
+
+// load the counts from the store, keeping the views not saved yet.
+func (vc *viewCounter) load(ctx context.Context) error {
+	m, err := vc.Store.List(ctx, viewsBucket)
+	if err != nil {
+		return err
+	}
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	for k, v := range m {
+		n, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("view count of %q: %w", k, err)
+		}
+		vc.counts[k] = n + vc.delta[k]
+	}
+	return nil
+}
+
+// Inc increments the view count of fn.
+func (vc *viewCounter) Inc(fn string) {
+	vc.mu.Lock()
+	vc.counts[fn]++
+	vc.delta[fn]++
+	vc.mu.Unlock()
+}
+
+// Top returns the n most viewed files.
+func (vc *viewCounter) Top(n int) []FileViews {
+	vc.mu.Lock()
+	top := make([]FileViews, 0, len(vc.counts))
+	for k, v := range vc.counts {
+		top = append(top, FileViews{Path: k, Views: v})
+	}
+	vc.mu.Unlock()
+	slices.SortFunc(top, func(a, b FileViews) int {
+		if c := cmp.Compare(b.Views, a.Views); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Path, b.Path)
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Run saves the counts periodically, and finally when ctx is done.
+func (vc *viewCounter) Run(ctx context.Context) error {
+	if vc.Path == "" && vc.Store == nil {
+		return nil
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return vc.save(context.Background())
+		case <-ticker.C:
+			if err := vc.save(ctx); err != nil {
+				slog.Error("save view counts", "file", vc.Path, "error", err)
+			}
+		}
+	}
+}
+
+func (vc *viewCounter) save(ctx context.Context) error {
+	if vc.Store != nil {
+		return vc.saveStore(ctx)
+	}
+	vc.mu.Lock()
+	if len(vc.delta) == 0 {
+		vc.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(vc.counts)
+	clear(vc.delta)
+	vc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(vc.Path, b)
+}
+
+// saveStore adds the new views to the counts in the store atomically, then loads those.
+func (vc *viewCounter) saveStore(ctx context.Context) error {
+	vc.mu.Lock()
+	delta := vc.delta
+	vc.delta = make(map[string]uint64)
+	vc.mu.Unlock()
+	for k, d := range delta {
+		err := store.Update(ctx, vc.Store, viewsBucket, k, func(old []byte) ([]byte, error) {
+			var n uint64
+			if old != nil {
+				var err error
+				if n, err = strconv.ParseUint(string(old), 10, 64); err != nil {
+					return nil, fmt.Errorf("view count of %q: %w", k, err)
+				}
+			}
+			return strconv.AppendUint(nil, n+d, 10), nil
+		})
+		if err != nil {
+			// retry the rest the next time
+			vc.mu.Lock()
+			for k, d := range delta {
+				vc.delta[k] += d
+			}
+			vc.mu.Unlock()
+			return err
+		}
+		delete(delta, k)
+	}
+	return vc.load(ctx)
+}
+
+// writeFileAtomic writes b into a temporary file next to fn, then renames it to fn.
+func writeFileAtomic(fn string, b []byte) error {
+	fh, err := os.CreateTemp(filepath.Dir(fn), filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err = fh.Write(b); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), fn)
+}
+
+// ServeHTTP returns the n (default 10) most viewed files as JSON.
+func (vc *viewCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	if n <= 0 {
+		n = 10
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vc.Top(n))
+}
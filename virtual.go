@@ -0,0 +1,313 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// virtualPrefix starts the name of every virtual file.
+const virtualPrefix = "@"
+
+// maxVirtualFiles is the most virtual files of the network sources (GELF, fluent, agents),
+// as every tag or host of them creates one.
+const maxVirtualFiles = 1000
+
+// errTooManyVirtualFiles is returned by GetOnHost when maxVirtualFiles have been created.
+var errTooManyVirtualFiles = errors.New("too many virtual files")
+
+// virtualFile is an in-memory log fed by an ingestion source (GELF, commands...),
+// keeping the last lines for the viewers connecting later.
+type virtualFile struct {
+	Name string
+	// Host is where the lines come from, empty for this host.
+	Host string
+
+	mu       sync.Mutex
+	ring     []Line
+	next     int
+	full     bool
+	seq      int64
+	bytes    int64
+	subs     map[*subscription]struct{}
+	modified time.Time
+	err      error
+}
+
+// subscription is a viewer of a virtual file, with the lines it has missed being slow.
+type subscription struct {
+	ch      chan Line
+	dropped atomic.Int64
+}
+
+// Append the line, sending it to all the viewers.
+// Slow viewers miss lines, they are told how many.
+func (vf *virtualFile) Append(text string) {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	vf.seq++
+	vf.modified, vf.err = time.Now(), nil
+	vf.appendLocked(Line{Text: text, Offset: -1, No: vf.seq, Time: vf.modified})
+}
+
+// AppendLine appends the line as is, keeping its offset and number.
+func (vf *virtualFile) AppendLine(line Line) {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	vf.seq++
+	vf.modified, vf.err = time.Now(), nil
+	vf.appendLocked(line)
+}
+
+func (vf *virtualFile) appendLocked(line Line) {
+	vf.bytes += int64(len(line.Text) - len(vf.ring[vf.next].Text))
+	vf.ring[vf.next] = line
+	if vf.next = (vf.next + 1) % len(vf.ring); vf.next == 0 {
+		vf.full = true
+	}
+	for sub := range vf.subs {
+		select {
+		case sub.ch <- line:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Usage returns the bytes of the retained lines.
+func (vf *virtualFile) Usage() int64 {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	return vf.bytes
+}
+
+// Trim drops the retained lines but the last n, to free memory.
+// The file retains more lines again as the new ones come.
+func (vf *virtualFile) Trim(n int) {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	if !vf.full && vf.next <= n {
+		return
+	}
+	var keep []Line
+	if vf.full {
+		keep = append(keep, vf.ring[vf.next:]...)
+	}
+	keep = append(keep, vf.ring[:vf.next]...)
+	keep = keep[len(keep)-n:]
+	ring := make([]Line, len(vf.ring))
+	vf.next, vf.full, vf.bytes = copy(ring, keep), false, 0
+	for _, line := range keep {
+		vf.bytes += int64(len(line.Text))
+	}
+	vf.ring = ring
+}
+
+// SetError marks the source of the file as erroring, until the next line.
+func (vf *virtualFile) SetError(err error) {
+	vf.mu.Lock()
+	vf.err = err
+	vf.mu.Unlock()
+}
+
+// Status returns the time of the last line and the error of the source.
+func (vf *virtualFile) Status() (time.Time, error) {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	return vf.modified, vf.err
+}
+
+// Subscribe returns the retained lines and the subscription to the new ones,
+// and a function to unsubscribe.
+//
+// The subscription can hold as many lines as retained, so a viewer subscribing
+// before the lines are read does not miss them.
+func (vf *virtualFile) Subscribe() ([]Line, *subscription, func()) {
+	sub := &subscription{ch: make(chan Line, max(256, len(vf.ring)))}
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+	var backlog []Line
+	if vf.full {
+		backlog = append(backlog, vf.ring[vf.next:]...)
+	}
+	backlog = append(backlog, vf.ring[:vf.next]...)
+	if vf.subs == nil {
+		vf.subs = make(map[*subscription]struct{})
+	}
+	vf.subs[sub] = struct{}{}
+	return backlog, sub, func() {
+		vf.mu.Lock()
+		delete(vf.subs, sub)
+		vf.mu.Unlock()
+	}
+}
+
+// Tail sends the retained and the new lines to linesCh, until ctx is canceled.
+func (vf *virtualFile) Tail(ctx context.Context, linesCh chan<- Line) {
+	defer close(linesCh)
+	backlog, sub, unsubscribe := vf.Subscribe()
+	defer unsubscribe()
+	sendSubscribed(ctx, linesCh, backlog, sub, nil)
+}
+
+// sendSubscribed sends the backlog, then the lines of sub to linesCh, until ctx is canceled,
+// or done is closed and the lines received by sub are sent.
+// The lines missed by a slow viewer are replaced by a notice line.
+func sendSubscribed(ctx context.Context, linesCh chan<- Line, backlog []Line, sub *subscription, done <-chan struct{}) {
+	send := func(line Line) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case linesCh <- line:
+			return true
+		}
+	}
+	for _, line := range backlog {
+		if !send(line) {
+			return
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			for {
+				select {
+				case line := <-sub.ch:
+					if !send(line) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case line := <-sub.ch:
+			if n := sub.dropped.Swap(0); n != 0 {
+				if !send(Line{Text: fmt.Sprintf("-- %d lines dropped, the viewer is too slow --", n), Offset: -1, Time: time.Now()}) {
+					return
+				}
+			}
+			if !send(line) {
+				return
+			}
+		}
+	}
+}
+
+// virtualRegistry holds the virtual files by name.
+type virtualRegistry struct {
+	// Keep is the number of lines retained for new viewers.
+	Keep int
+
+	mu    sync.RWMutex
+	files map[string]*virtualFile
+	// refused is whether a new file has been refused, to log it once
+	refused bool
+}
+
+// virtualFiles is the registry of all the virtual files.
+var virtualFiles = &virtualRegistry{Keep: 1000}
+
+// Get returns the virtual file of the given name, creating it if needed,
+// for the sources of this server (commands, stdin...), which are not limited.
+func (vr *virtualRegistry) Get(name string) *virtualFile {
+	vf, _ := vr.get(name, "", false)
+	return vf
+}
+
+// GetOnHost returns the virtual file of the given name, creating it on the host if needed,
+// or errTooManyVirtualFiles if maxVirtualFiles have been created already.
+func (vr *virtualRegistry) GetOnHost(name, host string) (*virtualFile, error) {
+	return vr.get(name, host, true)
+}
+
+func (vr *virtualRegistry) get(name, host string, limited bool) (*virtualFile, error) {
+	vr.mu.RLock()
+	vf := vr.files[name]
+	vr.mu.RUnlock()
+	if vf != nil {
+		return vf, nil
+	}
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	if vf = vr.files[name]; vf == nil {
+		if limited && len(vr.files) >= maxVirtualFiles {
+			if !vr.refused {
+				slog.Warn("too many virtual files, the lines of the new sources are dropped", "max", maxVirtualFiles, "name", name)
+				vr.refused = true
+			}
+			return nil, errTooManyVirtualFiles
+		}
+		if vr.files == nil {
+			vr.files = make(map[string]*virtualFile)
+		}
+		vf = &virtualFile{Name: name, Host: host, ring: make([]Line, vr.Keep)}
+		vr.files[name] = vf
+	}
+	return vf, nil
+}
+
+// Lookup returns the virtual file of the given name, or nil.
+func (vr *virtualRegistry) Lookup(name string) *virtualFile {
+	vr.mu.RLock()
+	defer vr.mu.RUnlock()
+	return vr.files[name]
+}
+
+// Names returns the sorted names of the virtual files.
+func (vr *virtualRegistry) Names() []string {
+	vr.mu.RLock()
+	names := make([]string, 0, len(vr.files))
+	for k := range vr.files {
+		names = append(names, k)
+	}
+	vr.mu.RUnlock()
+	slices.Sort(names)
+	return names
+}
+
+// Usage returns the bytes of the lines retained by the virtual files.
+func (vr *virtualRegistry) Usage() int64 {
+	vr.mu.RLock()
+	defer vr.mu.RUnlock()
+	var n int64
+	for _, vf := range vr.files {
+		n += vf.Usage()
+	}
+	return n
+}
+
+// Shed trims the retained lines of the virtual files to a quarter, under critical memory pressure.
+func (vr *virtualRegistry) Shed(level int) {
+	if level < memoryCritical {
+		return
+	}
+	vr.mu.RLock()
+	defer vr.mu.RUnlock()
+	for _, vf := range vr.files {
+		vf.Trim(max(1, vr.Keep/4))
+	}
+}
+
+// virtualName returns the name of a virtual file from its path segments,
+// replacing the slashes in them.
+func virtualName(parts ...string) string {
+	for i, p := range parts {
+		if p = strings.ReplaceAll(strings.TrimSpace(p), "/", "_"); p == "" {
+			p = "-"
+		}
+		parts[i] = p
+	}
+	return virtualPrefix + strings.Join(parts, "/")
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WarmupProgress is the progress of the startup warm-up:
+// building the file index, then starting the shared readers of the -warmup files.
+type WarmupProgress struct {
+	Ready bool `json:"ready"`
+	// Indexed is the number of files indexed so far.
+	Indexed int64 `json:"indexed"`
+	// Files is the number of the -warmup files, Warmed is how many of them are read
+	// (and time indexed, with -time-index).
+	Files    int        `json:"files"`
+	Warmed   int        `json:"warmed"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// warmupState tracks the warm-up.
+type warmupState struct {
+	index *fileIndex
+
+	mu       sync.Mutex
+	progress WarmupProgress
+}
+
+// warmup is the warm-up of this server.
+var warmup = &warmupState{progress: WarmupProgress{Started: time.Now()}}
+
+// Progress returns the current progress of the warm-up.
+func (ws *warmupState) Progress() WarmupProgress {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	p := ws.progress
+	if ws.index != nil && !p.Ready {
+		p.Indexed = ws.index.walked.Load()
+	}
+	return p
+}
+
+// indexTimes builds the -time-index checkpoints of the file fn, in the default timestamp layout.
+func indexTimes(ctx context.Context, root string, FS fs.FS, fn string) error {
+	if timeIndex == nil {
+		return nil
+	}
+	fh, _, err := openTail(root, FS, fn)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return timeIndex.update(ctx, fn, fh, newTimestampLayout(""))
+}
+
+// Run waits for the first scan of the index, then keeps the shared readers
+// of the files matching the globs running (so their buffers are filled) until ctx is canceled,
+// building their time index.
+func (ws *warmupState) Run(ctx context.Context, root string, FS fs.FS, index *fileIndex, globs []string) {
+	ws.mu.Lock()
+	ws.index = index
+	ws.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return
+	case <-index.ready:
+	}
+	var files []string
+	for _, glob := range globs {
+		matches, err := fs.Glob(FS, glob)
+		if err != nil {
+			slog.Warn("warmup glob", "glob", glob, "error", err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) != 0 && sharedTails.Keep == 0 {
+		slog.Warn("no files are warmed up, as the tail buffer is disabled (-tail-buffer=0)")
+		files = nil
+	}
+	ws.mu.Lock()
+	ws.progress.Indexed, ws.progress.Files = index.walked.Load(), len(files)
+	ws.mu.Unlock()
+	for _, fn := range files {
+		fh, _, err := openTail(root, FS, fn)
+		if err != nil {
+			slog.Warn("warmup", "file", fn, "error", err)
+		} else {
+			// the reader is kept for good, the file is warmed when its buffer is filled
+			select {
+			case <-ctx.Done():
+				return
+			case <-sharedTails.Warm(ctx, fn, fh):
+			}
+			if err := indexTimes(ctx, root, FS, fn); err != nil {
+				slog.Warn("warmup time index", "file", fn, "error", err)
+			}
+		}
+		ws.mu.Lock()
+		ws.progress.Warmed++
+		ws.mu.Unlock()
+	}
+	now := time.Now()
+	ws.mu.Lock()
+	ws.progress.Ready, ws.progress.Finished = true, &now
+	p := ws.progress
+	ws.mu.Unlock()
+	slog.Info("warmed up", "files", p.Indexed, "warmed", p.Warmed, "dur", now.Sub(p.Started))
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdHarness decodes the frames of the corpus (a JSON array of {name, frame, want},
+// base64 encoded) with zstd.js, and prints the ones decoded differently.
+const zstdHarness = `
+const fs = require("fs");
+globalThis.window = globalThis;
+eval(fs.readFileSync(process.argv[2], "utf8"));
+const corpus = JSON.parse(fs.readFileSync(process.argv[3], "utf8"));
+let failed = 0;
+for (const c of corpus) {
+	const want = Buffer.from(c.want || "", "base64");
+	let got;
+	try {
+		got = Buffer.from(window.zstdDecompress(new Uint8Array(Buffer.from(c.frame || "", "base64"))));
+	} catch (e) {
+		console.log(c.name + ": " + e.message);
+		failed++;
+		continue;
+	}
+	if (!got.equals(want)) {
+		let i = 0;
+		while (i < got.length && i < want.length && got[i] === want[i]) {
+			i++;
+		}
+		console.log(c.name + ": got " + got.length + " bytes, want " + want.length + ", differing at " + i);
+		failed++;
+	}
+}
+process.exit(failed ? 1 : 0);
+`
+
+// zstdCorpus returns the inputs of the frames: the batches of SSE events zstd.js gets,
+// and the edge cases of the format (empty, raw and RLE blocks, multiple blocks).
+func zstdCorpus() map[string][]byte {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rnd.Uint32())
+		}
+		return b
+	}
+	var events bytes.Buffer
+	for i := range 2000 {
+		fmt.Fprintf(&events, "id: %d\ndata: 2024-05-%02dT10:%02d:%02dZ INFO request path=/api/v%d/items/%d status=%d dur=%dms\n\n",
+			i*97, 1+i%28, i%60, (i*7)%60, i%3, rnd.IntN(100000), []int{200, 201, 404, 500}[rnd.IntN(4)], rnd.IntN(5000))
+	}
+	var words strings.Builder
+	for range 20000 {
+		words.WriteString([]string{"error ", "warn ", "info ", "debug ", "ok\n", "é", "日本", "\t"}[rnd.IntN(8)])
+	}
+	return map[string][]byte{
+		"empty":        {},
+		"byte":         {'x'},
+		"short":        []byte("data: hello\n\n"),
+		"rle":          bytes.Repeat([]byte{'a'}, 300000),
+		"random":       random(1000),
+		"random-multi": random(300000),
+		"events":       events.Bytes(),
+		"words":        []byte(words.String()),
+		"mixed":        append(append(random(70000), events.Bytes()[:100000]...), bytes.Repeat([]byte("zz"), 50000)...),
+	}
+}
+
+// TestZstdJS checks that zstd.js decodes the frames of the encoders of the server,
+// and of the other levels and options, as the Go decoder does.
+func TestZstdJS(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	encoders := map[string]*zstd.Encoder{"server": zstdEncoder}
+	for _, level := range []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedBetterCompression, zstd.SpeedBestCompression} {
+		for _, crc := range []bool{false, true} {
+			enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderCRC(crc), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoders[fmt.Sprintf("%s-crc=%t", level, crc)] = enc
+		}
+	}
+	type entry struct {
+		Name  string `json:"name"`
+		Frame []byte `json:"frame"`
+		Want  []byte `json:"want"`
+	}
+	var corpus []entry
+	for encName, enc := range encoders {
+		for name, b := range zstdCorpus() {
+			frame := enc.EncodeAll(b, nil)
+			if got, err := zstdDecoder.DecodeAll(frame, nil); err != nil || !bytes.Equal(got, b) {
+				t.Fatalf("%s/%s: the Go decoder failed: %v", encName, name, err)
+			}
+			corpus = append(corpus, entry{Name: encName + "/" + name, Frame: frame, Want: b})
+		}
+	}
+	dir := t.TempDir()
+	b, err := json.Marshal(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := assetsFS.ReadFile("assets/zstd.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fn, b := range map[string][]byte{"corpus.json": b, "zstd.js": js, "harness.js": []byte(zstdHarness)} {
+		if err := os.WriteFile(filepath.Join(dir, fn), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := exec.Command(node, filepath.Join(dir, "harness.js"), filepath.Join(dir, "zstd.js"), filepath.Join(dir, "corpus.json")).CombinedOutput()
+	if err != nil {
+		t.Errorf("%v:\n%s", err, out)
+	}
+	t.Logf("%d frames decoded", len(corpus))
+}
+
+// zstdDecoder decodes the frames of the corpus in Go, to check the corpus itself.
+var zstdDecoder, _ = zstd.NewReader(nil)